@@ -0,0 +1,81 @@
+package fsconsul
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Defaults for retrying failed blocking queries.
+const (
+	defaultRetryInitial     = time.Second
+	defaultRetryMaxInterval = time.Minute
+)
+
+// RetryConfig holds how a mapping retries failed queries to Consul: waiting exponentially
+// longer between attempts, with jitter, up to MaxInterval.  Without MaxRetries or FailFast,
+// or with RetryForever, it never gives up; otherwise the mapping fails after MaxRetries
+// failures in a row, or once queries have been failing for FailFast.
+type RetryConfig struct {
+	Initial      Duration
+	MaxInterval  Duration
+	MaxRetries   int
+	FailFast     Duration
+	RetryForever bool
+}
+
+// Determine whether a mapping should give up after this many failures in a row.
+func (retry RetryConfig) exhausted(failures int) bool {
+	return !retry.RetryForever && retry.MaxRetries > 0 && failures > retry.MaxRetries
+}
+
+// Determine whether a mapping should give up once queries have been failing this long.
+func (retry RetryConfig) expired(failingFor time.Duration) bool {
+	return !retry.RetryForever && retry.FailFast > 0 && failingFor >= time.Duration(retry.FailFast)
+}
+
+// backoff is the exponentially growing, jittered delay between retries.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	attempt int
+
+	// Returns a number in [0, 1), for jitter
+	random func() float64
+}
+
+func newBackoff(retry RetryConfig) *backoff {
+	b := &backoff{
+		initial: time.Duration(retry.Initial),
+		max:     time.Duration(retry.MaxInterval),
+		random:  rand.Float64,
+	}
+	if b.initial <= 0 {
+		b.initial = defaultRetryInitial
+	}
+	if b.max <= 0 {
+		b.max = defaultRetryMaxInterval
+	}
+	if b.max < b.initial {
+		b.max = b.initial
+	}
+	return b
+}
+
+// The delay before the next retry: between half and all of initial*2^attempts, capped at
+// the maximum, so that many watchers failing at once don't retry in lockstep.
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.initial << uint(b.attempt); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	b.attempt++
+
+	return delay/2 + time.Duration(b.random()*float64(delay/2))
+}
+
+// Start again from the initial delay, after a success.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
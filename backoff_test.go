@@ -0,0 +1,43 @@
+package fsconsul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(RetryConfig{Initial: Duration(time.Second), MaxInterval: Duration(5 * time.Second)})
+
+	// Without jitter, delays double up to the maximum
+	b.random = func() float64 { return 0.999999 }
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b.next().Round(time.Millisecond); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+
+	// Jitter takes off up to half
+	b.reset()
+	b.random = func() float64 { return 0 }
+	if got := b.next(); got != 500*time.Millisecond {
+		t.Errorf("expected 500ms after a reset, got %s", got)
+	}
+
+	if (RetryConfig{}).exhausted(1000) {
+		t.Error("expected retrying forever by default")
+	}
+	if !(RetryConfig{MaxRetries: 3}).exhausted(4) || (RetryConfig{MaxRetries: 3}).exhausted(3) {
+		t.Error("expected giving up after three retries")
+	}
+	if (RetryConfig{MaxRetries: 3, RetryForever: true}).exhausted(4) {
+		t.Error("expected RetryForever to override MaxRetries")
+	}
+
+	failFast := RetryConfig{FailFast: Duration(5 * time.Minute)}
+	if (RetryConfig{}).expired(time.Hour) || failFast.expired(4*time.Minute) || !failFast.expired(5*time.Minute) {
+		t.Error("expected giving up after failing for five minutes")
+	}
+	if (RetryConfig{FailFast: Duration(time.Minute), RetryForever: true}).expired(time.Hour) {
+		t.Error("expected RetryForever to override FailFast")
+	}
+}
@@ -0,0 +1,106 @@
+package fsconsul
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backpressure policies, saying what happens to snapshots arriving while the previous one
+// is still being applied, e.g. while a slow onchange command runs.
+const (
+	backpressureCoalesce = "coalesce" // keep only the latest
+	backpressureQueue    = "queue"    // keep up to the queue size, in order
+	backpressureDrop     = "drop"     // keep the first, discarding the rest
+)
+
+// How many snapshots a queueing mapping holds, unless configured otherwise.
+const defaultQueueSize = 10
+
+// Check a mapping's backpressure policy is one we know, with a queue size only if it
+// queues.
+func (mappingConfig *MappingConfig) checkBackpressure() error {
+	switch mappingConfig.Backpressure {
+	case "", backpressureCoalesce, backpressureDrop:
+		if mappingConfig.QueueSize != 0 {
+			return fmt.Errorf("queuesize is only used by backpressure queue")
+		}
+	case backpressureQueue:
+		if mappingConfig.QueueSize < 0 {
+			return fmt.Errorf("queuesize can't be negative")
+		}
+	default:
+		return fmt.Errorf("unknown backpressure %s, expected %s, %s or %s",
+			mappingConfig.Backpressure, backpressureCoalesce, backpressureQueue, backpressureDrop)
+	}
+	return nil
+}
+
+// Pass snapshots on as the mapping is ready to apply them, holding those arriving while it's
+// busy as its backpressure policy says, so that the watcher is never held up by a slow
+// onchange command.  A full queue has its last snapshot replaced by the latest, so the
+// files still end up as the prefix is.  Dropped snapshots are caught up with by the next.
+func backpressure(run *mappingRun, in <-chan kvSnapshot, out chan<- kvSnapshot, quitCh <-chan struct{}) {
+	mappingConfig := run.config
+	size := 1
+	if mappingConfig.Backpressure == backpressureQueue {
+		size = mappingConfig.QueueSize
+		if size == 0 {
+			size = defaultQueueSize
+		}
+	}
+
+	var held []kvSnapshot
+	for {
+		var outCh chan<- kvSnapshot
+		var next kvSnapshot
+		if len(held) > 0 {
+			outCh, next = out, held[0]
+		}
+
+		select {
+		case snapshot := <-in:
+			switch {
+			case len(held) == 0:
+				held = append(held, snapshot)
+			case mappingConfig.Backpressure == backpressureDrop:
+				run.logger.WithFields(log.Fields{
+					"index": snapshot.index,
+				}).Warn("Still applying the previous snapshot, dropping this one")
+				run.backlogged(0, 1)
+			case len(held) < size:
+				held = append(held, snapshot)
+			default:
+				held[len(held)-1] = snapshot
+				run.backlogged(1, 0)
+			}
+		case outCh <- next:
+			held = held[1:]
+		case <-quitCh:
+			return
+		}
+		run.setQueued(len(held))
+	}
+}
+
+// Count snapshots coalesced into later ones and dropped, for health checks.
+func (run *mappingRun) backlogged(coalesced, dropped int) {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	run.coalesced += coalesced
+	run.dropped += dropped
+}
+
+func (run *mappingRun) setQueued(n int) {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	run.queued = n
+}
+
+// How many snapshots are waiting to be applied, and how many have been coalesced and
+// dropped.
+func (run *mappingRun) backlog() (queued, coalesced, dropped int) {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	return run.queued, run.coalesced, run.dropped
+}
@@ -0,0 +1,52 @@
+package fsconsul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackpressure(t *testing.T) {
+	for _, test := range []struct {
+		policy    string
+		queueSize int
+		applied   []uint64
+		coalesced int
+		dropped   int
+	}{
+		{"", 0, []uint64{5}, 4, 0},
+		{backpressureQueue, 3, []uint64{1, 2, 5}, 2, 0},
+		{backpressureDrop, 0, []uint64{1}, 0, 4},
+	} {
+		run := newMappingRun(&MappingConfig{Name: "app", Backpressure: test.policy, QueueSize: test.queueSize}, nil)
+		in, out := make(chan kvSnapshot), make(chan kvSnapshot)
+		quitCh := make(chan struct{})
+		go backpressure(run, in, out, quitCh)
+
+		// Five snapshots arrive while the mapping is busy
+		for index := uint64(1); index <= 5; index++ {
+			in <- kvSnapshot{index: index}
+		}
+
+		var applied []uint64
+		for len(applied) < len(test.applied) {
+			select {
+			case snapshot := <-out:
+				applied = append(applied, snapshot.index)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%q: expected %v to be applied, got %v", test.policy, test.applied, applied)
+			}
+		}
+		close(quitCh)
+
+		_, coalesced, dropped := run.backlog()
+		for i := range applied {
+			if applied[i] != test.applied[i] {
+				t.Errorf("%q: expected %v to be applied, got %v", test.policy, test.applied, applied)
+				break
+			}
+		}
+		if coalesced != test.coalesced || dropped != test.dropped {
+			t.Errorf("%q: expected %d coalesced and %d dropped, got %d and %d", test.policy, test.coalesced, test.dropped, coalesced, dropped)
+		}
+	}
+}
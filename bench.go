@@ -0,0 +1,300 @@
+package fsconsul
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// benchReport is what fsconsul bench measured, as JSON, so that releases and scaling
+// changes can be compared.
+type benchReport struct {
+	Version string   `json:"version"`
+	Keys    int      `json:"keys"`
+	Size    int      `json:"size"`
+	Rounds  int      `json:"rounds"`
+	Initial Duration `json:"initial"`
+
+	// From writing a key to Consul until its file is written, and until the onchange
+	// command that followed has finished
+	Written  latencies  `json:"written"`
+	OnChange *latencies `json:"onchange,omitempty"`
+}
+
+// latencies summarizes the latencies of a bench's rounds.
+type latencies struct {
+	P50 Duration `json:"p50"`
+	P90 Duration `json:"p90"`
+	P99 Duration `json:"p99"`
+	Max Duration `json:"max"`
+}
+
+func summarizeLatencies(samples []time.Duration) latencies {
+	if len(samples) == 0 {
+		return latencies{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	// The nearest-rank percentile
+	percentile := func(p int) Duration {
+		rank := (p*len(sorted) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		return Duration(sorted[rank-1])
+	}
+	return latencies{percentile(50), percentile(90), percentile(99), Duration(sorted[len(sorted)-1])}
+}
+
+// benchEvent is a file written, or the files an onchange command ran for, and when.
+type benchEvent struct {
+	files []string
+	at    time.Time
+}
+
+// bench measures how long fsconsul takes to apply changes: it writes keys of the given size
+// under a prefix fsconsul bench has to itself, watches them into a directory, then changes
+// one key per round and times how long it takes for its file to be written and the onchange
+// command to finish.
+type bench struct {
+	consul   ConsulConfig
+	client   *consulapi.Client
+	token    string
+	prefix   string
+	path     string
+	keys     int
+	size     int
+	rounds   int
+	onChange []string
+	timeout  time.Duration
+}
+
+func (b *bench) run() (*benchReport, error) {
+	if err := b.putKeys(); err != nil {
+		return nil, err
+	}
+	defer b.client.KV().DeleteTree(b.prefix, &consulapi.WriteOptions{Token: b.token})
+
+	events := b.keys + b.rounds + 1
+	writes := make(chan benchEvent, events)
+	changes := make(chan benchEvent, events)
+	hooks := Hooks{
+		OnWrite: func(_, file string) {
+			writes <- benchEvent{[]string{file}, time.Now()}
+		},
+		OnError: func(_, file string, err error) {
+			logrus.WithFields(logrus.Fields{
+				"file":  file,
+				"error": err,
+			}).Error("Bench mapping failed")
+		},
+		changed: func(_ string, files []string) {
+			changes <- benchEvent{files, time.Now()}
+		},
+	}
+
+	config := WatchConfig{Mappings: []MappingConfig{{
+		Name:     "bench",
+		Prefix:   b.prefix,
+		Path:     b.path,
+		OnChange: b.onChange,
+	}}}
+	config.Consul = b.consul
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	started := time.Now()
+	go func() { stopped <- Run(ctx, config, hooks) }()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	report := &benchReport{Version: version, Keys: b.keys, Size: b.size, Rounds: b.rounds}
+
+	// Every key is written once at startup
+	for i := 0; i < b.keys; i++ {
+		if _, err := b.await(writes, stopped, ""); err != nil {
+			return nil, fmt.Errorf("initial render: %v", err)
+		}
+	}
+	report.Initial = Duration(time.Since(started))
+	if len(b.onChange) > 0 {
+		if _, err := b.await(changes, stopped, ""); err != nil {
+			return nil, fmt.Errorf("initial onchange: %v", err)
+		}
+	}
+
+	var written, changed []time.Duration
+	for round := 0; round < b.rounds; round++ {
+		key := benchKey(round % b.keys)
+
+		start := time.Now()
+		if err := b.put(key); err != nil {
+			return nil, err
+		}
+		at, err := b.await(writes, stopped, key)
+		if err != nil {
+			return nil, fmt.Errorf("round %d: %v", round, err)
+		}
+		written = append(written, at.Sub(start))
+
+		if len(b.onChange) > 0 {
+			at, err := b.await(changes, stopped, key)
+			if err != nil {
+				return nil, fmt.Errorf("round %d onchange: %v", round, err)
+			}
+			changed = append(changed, at.Sub(start))
+		}
+	}
+
+	report.Written = summarizeLatencies(written)
+	if len(b.onChange) > 0 {
+		onChange := summarizeLatencies(changed)
+		report.OnChange = &onChange
+	}
+	return report, nil
+}
+
+// Wait for an event naming the key's file (or any event, without a key), returning when it
+// happened.
+func (b *bench) await(events <-chan benchEvent, stopped <-chan error, key string) (time.Time, error) {
+	timeout := time.After(b.timeout)
+	for {
+		select {
+		case event := <-events:
+			for _, f := range event.files {
+				if key == "" || filepath.Base(f) == key {
+					return event.at, nil
+				}
+			}
+		case err := <-stopped:
+			return time.Time{}, fmt.Errorf("watching stopped: %v", err)
+		case <-timeout:
+			return time.Time{}, fmt.Errorf("timed out after %s", b.timeout)
+		}
+	}
+}
+
+func benchKey(i int) string {
+	return fmt.Sprintf("key-%06d", i)
+}
+
+// Start from a prefix holding just the bench's keys.
+func (b *bench) putKeys() error {
+	if _, err := b.client.KV().DeleteTree(b.prefix, &consulapi.WriteOptions{Token: b.token}); err != nil {
+		return err
+	}
+	for i := 0; i < b.keys; i++ {
+		if err := b.put(benchKey(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a key with a new random value, hex encoded so that it's a valid file to anything.
+func (b *bench) put(key string) error {
+	value := make([]byte, (b.size+1)/2)
+	if _, err := rand.Read(value); err != nil {
+		return err
+	}
+	encoded := []byte(hex.EncodeToString(value))[:b.size]
+
+	_, err := b.client.KV().Put(&consulapi.KVPair{Key: b.prefix + key, Value: encoded}, &consulapi.WriteOptions{Token: b.token})
+	return err
+}
+
+func writeBenchReport(w io.Writer, report *benchReport) error {
+	encoded, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(encoded, '\n'))
+	return err
+}
+
+func benchCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul bench", benchHelpText, &opts)
+	prefix := flags.String("prefix", "fsconsul-bench/", "the prefix to write synthetic keys under, which is deleted first")
+	path := flags.String("path", "", "the directory to write the keys' files to (a temporary directory by default)")
+	keys := flags.Int("keys", 100, "how many keys to write")
+	size := flags.Int("size", 1024, "the size of each value, in bytes")
+	rounds := flags.Int("rounds", 100, "how many changes to time")
+	onChange := flags.String("onchange", "", "a command to run on each change, whose completion is timed too")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for each change")
+	flags.Parse(args)
+	if flags.NArg() != 0 || *keys < 1 || *size < 0 || *rounds < 1 || strings.Trim(*prefix, "/") == "" {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, nil)
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 1
+	}
+
+	b := &bench{
+		consul:  config.Consul,
+		client:  client,
+		token:   config.Consul.Token,
+		prefix:  strings.TrimPrefix(strings.TrimSuffix(*prefix, "/")+"/", "/"),
+		path:    *path,
+		keys:    *keys,
+		size:    *size,
+		rounds:  *rounds,
+		timeout: *timeout,
+	}
+	if *onChange != "" {
+		b.onChange = strings.Split(*onChange, " ")
+	}
+	if b.path == "" {
+		if b.path, err = ioutil.TempDir("", "fsconsul-bench"); err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to create a directory for the files")
+			return 1
+		}
+		defer os.RemoveAll(b.path)
+	}
+
+	report, err := b.run()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Bench failed")
+		return 1
+	}
+	if err := writeBenchReport(os.Stdout, report); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to write report")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,31 @@
+package fsconsul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarizeLatencies(t *testing.T) {
+	var samples []time.Duration
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+
+	got := summarizeLatencies(samples)
+	want := latencies{
+		P50: Duration(50 * time.Millisecond),
+		P90: Duration(90 * time.Millisecond),
+		P99: Duration(99 * time.Millisecond),
+		Max: Duration(100 * time.Millisecond),
+	}
+	if got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if samples[0] != 100*time.Millisecond {
+		t.Error("expected the samples to be left in order")
+	}
+
+	if got := summarizeLatencies([]time.Duration{time.Second}); got.P50 != Duration(time.Second) || got.P99 != Duration(time.Second) {
+		t.Errorf("expected a single sample to be every percentile, got %+v", got)
+	}
+}
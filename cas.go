@@ -0,0 +1,67 @@
+package fsconsul
+
+import (
+	"fmt"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// casConflict is a check-and-set write refused because the key isn't at the modify index
+// it was last known at.
+type casConflict struct {
+	Key string
+	// The modify index the write expected (0 for a key that shouldn't exist yet), and the
+	// one the key is at (0 if it's gone)
+	Expected uint64
+	Current  uint64
+}
+
+func (c *casConflict) Error() string {
+	switch {
+	case c.Expected == 0:
+		return fmt.Sprintf("%s already exists, at modify index %d", c.Key, c.Current)
+	case c.Current == 0:
+		return fmt.Sprintf("%s was deleted since modify index %d", c.Key, c.Expected)
+	default:
+		return fmt.Sprintf("%s changed since modify index %d, and is now at %d", c.Key, c.Expected, c.Current)
+	}
+}
+
+// Write a pair only if the key is still at the pair's modify index (or doesn't exist, for
+// 0), returning a casConflict if it isn't.
+func casPut(kv *consulapi.KV, pair *consulapi.KVPair, opts *consulapi.WriteOptions) error {
+	ok, _, err := kv.CAS(pair, opts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return conflictOn(kv, pair, opts)
+	}
+	return nil
+}
+
+// Delete a key only if it's still at the pair's modify index, returning a casConflict if
+// it isn't.
+func casDelete(kv *consulapi.KV, pair *consulapi.KVPair, opts *consulapi.WriteOptions) error {
+	ok, _, err := kv.DeleteCAS(pair, opts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return conflictOn(kv, pair, opts)
+	}
+	return nil
+}
+
+// Describe why a check-and-set on a pair failed, by reading where the key is now.
+func conflictOn(kv *consulapi.KV, pair *consulapi.KVPair, opts *consulapi.WriteOptions) error {
+	conflict := &casConflict{Key: pair.Key, Expected: pair.ModifyIndex}
+	current, _, err := kv.Get(pair.Key, &consulapi.QueryOptions{Token: opts.Token})
+	if err != nil {
+		return fmt.Errorf("%s changed since modify index %d", pair.Key, pair.ModifyIndex)
+	}
+	if current != nil {
+		conflict.Current = current.ModifyIndex
+	}
+	return conflict
+}
@@ -0,0 +1,78 @@
+package fsconsul
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader provides the client certificate for Consul mTLS, re-reading the certificate
+// and key whenever they change on disk so that rotated certificates are picked up without
+// a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// Load the certificate and key, failing if they can't be used.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.certificate(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// Get the certificate, reloading it if either file has changed since it was last read.  If
+// a changed pair can't be loaded (e.g. mid-rotation), the previous certificate is used.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certTime, keyTime := modTime(r.certFile), modTime(r.keyFile)
+	if r.cert != nil && certTime.Equal(r.certTime) && keyTime.Equal(r.keyTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert == nil {
+			return nil, err
+		}
+
+		log.WithFields(log.Fields{
+			"certFile": r.certFile,
+			"error":    err,
+		}).Warn("Failed to reload client certificate, using the previous one")
+		return r.cert, nil
+	}
+
+	if r.cert != nil {
+		log.WithFields(log.Fields{
+			"certFile": r.certFile,
+		}).Info("Reloaded client certificate")
+	}
+
+	r.cert, r.certTime, r.keyTime = &cert, certTime, keyTime
+	return r.cert, nil
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
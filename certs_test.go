@@ -0,0 +1,97 @@
+package fsconsul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a self-signed certificate and key with the given serial number.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "fsconsul"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	certFile := filepath.Join(tempDir, "cert.pem")
+	keyFile := filepath.Join(tempDir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	serial := func() int64 {
+		cert, err := reloader.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return parsed.SerialNumber.Int64()
+	}
+
+	if s := serial(); s != 1 {
+		t.Fatalf("expected serial 1, got %d", s)
+	}
+
+	// Rotate the certificate, making sure the modification times differ
+	writeTestCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	if s := serial(); s != 2 {
+		t.Fatalf("expected rotated serial 2, got %d", s)
+	}
+
+	// A half-written rotation keeps the previous certificate
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+
+	if s := serial(); s != 2 {
+		t.Fatalf("expected previous serial 2, got %d", s)
+	}
+}
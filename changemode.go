@@ -0,0 +1,75 @@
+package fsconsul
+
+import (
+	"fmt"
+)
+
+// Change modes, saying what a snapshot changing files does, as in Nomad's template block.
+const (
+	changeModeNoop    = "noop"    // nothing, the files are only rendered
+	changeModeRestart = "restart" // restart the process run with exec
+	changeModeSignal  = "signal"  // send the process run with exec the change signal
+	changeModeScript  = "script"  // run the onchange command
+)
+
+// Act on a snapshot that changed files as the mapping's change mode says.  Without a change
+// mode, the process run with exec is reloaded as exec configures, and the onchange command
+// is run.
+func onChanged(config *WatchConfig, run *mappingRun, index uint64, changes fileChanges, failed []keyFailure) (int, error) {
+	mappingConfig := run.config
+	defer config.hooks.ranOnChange(mappingConfig.Name, changes.files())
+
+	switch mappingConfig.ChangeMode {
+	case changeModeNoop:
+		return 0, nil
+	case changeModeRestart:
+		run.child.changedWith(nil)
+		return 0, nil
+	case changeModeSignal:
+		sig, err := parseSignal(mappingConfig.ChangeSignal, "")
+		if err != nil {
+			return 1, err
+		}
+		run.child.changedWith(sig)
+		return 0, nil
+	case changeModeScript:
+		return runOnChange(config, run, index, changes, failed)
+	}
+
+	run.child.changed()
+	return runOnChange(config, run, index, changes, failed)
+}
+
+// Check a mapping's change mode has what it acts on: a process run with exec to restart or
+// signal, or an onchange command to run.
+func validateChangeMode(config *WatchConfig, mappingConfig *MappingConfig) error {
+	hasOnChange := mappingConfig.OnChangeRaw != "" || mappingConfig.OnChange != nil
+
+	switch mappingConfig.ChangeMode {
+	case "":
+		return nil
+	case changeModeNoop:
+	case changeModeRestart, changeModeSignal:
+		if config.Exec.Command == "" {
+			return fmt.Errorf("changemode %s needs a process run with exec", mappingConfig.ChangeMode)
+		}
+	case changeModeScript:
+		if !hasOnChange {
+			return fmt.Errorf("changemode script needs an onchange command")
+		}
+	default:
+		return fmt.Errorf("unknown changemode %s", mappingConfig.ChangeMode)
+	}
+
+	if mappingConfig.ChangeMode == changeModeSignal {
+		if _, err := parseSignal(mappingConfig.ChangeSignal, ""); err != nil {
+			return fmt.Errorf("changemode signal needs a changesignal: %v", err)
+		}
+	} else if mappingConfig.ChangeSignal != "" {
+		return fmt.Errorf("changesignal is only used by changemode signal")
+	}
+	if hasOnChange && mappingConfig.ChangeMode != changeModeScript {
+		return fmt.Errorf("changemode %s doesn't run the onchange command", mappingConfig.ChangeMode)
+	}
+	return nil
+}
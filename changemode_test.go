@@ -0,0 +1,62 @@
+package fsconsul
+
+import (
+	"testing"
+)
+
+func TestChangeMode(t *testing.T) {
+	config := &WatchConfig{Exec: ExecConfig{Command: "app"}}
+
+	for _, tc := range []struct {
+		mappingConfig MappingConfig
+		valid         bool
+	}{
+		{MappingConfig{}, true},
+		{MappingConfig{ChangeMode: "noop"}, true},
+		{MappingConfig{ChangeMode: "restart"}, true},
+		{MappingConfig{ChangeMode: "signal", ChangeSignal: "SIGTERM"}, true},
+		{MappingConfig{ChangeMode: "signal"}, false},
+		{MappingConfig{ChangeMode: "script", OnChangeRaw: "reload.sh"}, true},
+		{MappingConfig{ChangeMode: "script"}, false},
+		{MappingConfig{ChangeMode: "noop", OnChangeRaw: "reload.sh"}, false},
+		{MappingConfig{ChangeMode: "restart", ChangeSignal: "TERM"}, false},
+		{MappingConfig{ChangeMode: "reload"}, false},
+	} {
+		if err := validateChangeMode(config, &tc.mappingConfig); (err == nil) != tc.valid {
+			t.Errorf("changemode %q: expected valid %v, got %v", tc.mappingConfig.ChangeMode, tc.valid, err)
+		}
+	}
+
+	// Restarting and signalling need a process to act on
+	if err := validateChangeMode(&WatchConfig{}, &MappingConfig{ChangeMode: "restart"}); err == nil {
+		t.Error("expected restart without exec to be refused")
+	}
+
+	child, err := newSupervisor(config.Exec)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	act := func(mappingConfig MappingConfig) {
+		run := newMappingRun(&mappingConfig, nil)
+		run.child = child
+		if _, err := onChanged(config, run, 1, fileChanges{}, nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	act(MappingConfig{ChangeMode: "noop"})
+	if sigs, restart := child.pending(); len(sigs) != 0 || restart {
+		t.Fatal("expected noop to leave the child alone")
+	}
+
+	act(MappingConfig{ChangeMode: "signal", ChangeSignal: "TERM"})
+	act(MappingConfig{ChangeMode: "signal", ChangeSignal: "TERM"})
+	if sigs, restart := child.pending(); len(sigs) != 1 || restart {
+		t.Fatalf("expected one pending signal, got %v", sigs)
+	}
+
+	act(MappingConfig{ChangeMode: "restart"})
+	if _, restart := child.pending(); !restart {
+		t.Fatal("expected a pending restart")
+	}
+}
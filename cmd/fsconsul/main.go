@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/adam-zacharski/fsconsul"
+)
+
+func main() {
+	os.Exit(fsconsul.Main(os.Args[1:]))
+}
@@ -0,0 +1,757 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// command is a subcommand of the fsconsul CLI.
+type command struct {
+	Name     string
+	Synopsis string
+	Run      func(args []string) int
+}
+
+// The table of subcommands, populated in init() since the completion command refers to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"watch", "Watch prefixes and write them to paths (the default)", watchCommand},
+		{"once", "Write prefixes to paths once and exit", onceCommand},
+		{"fetch", "Print the rendered value of a single key", fetchCommand},
+		{"put", "Write a value to a single key", putCommand},
+		{"snapshot", "Print keys under a prefix in consul kv export format", snapshotCommand},
+		{"import", "Write keys from a consul kv export file", importCommand},
+		{"push", "Write the files in a path to keys under a prefix", pushCommand},
+		{"diff", "Show how paths differ from their prefixes", diffCommand},
+		{"verify", "Check that paths match their prefixes, content and permissions, without changing them", verifyCommand},
+		{"validate", "Check a configuration file for errors", validateCommand},
+		{"config", "Print the effective configuration, with where each setting came from", configCommand},
+		{"doctor", "Diagnose the environment for a configuration", doctorMain},
+		{"report", "Print a compliance report of the files a configuration renders", reportCommand},
+		{"owns", "List the files a configuration renders, or check whether it renders a file", ownsCommand},
+		{"gc", "Delete the files of mappings that were removed or moved", gcCommand},
+		{"bench", "Measure how long changes take to reach files and onchange commands", benchCommand},
+		{"launchd", "Print a launchd job running fsconsul watch", launchdCommand},
+		{"service", "Install, start, stop or remove fsconsul watch as a Windows service", serviceCommand},
+		{"version", "Print the fsconsul version", versionCommand},
+		{"completion", "Print a bash, zsh or fish completion script", completionCommand},
+	}
+}
+
+// List the commands with their synopses, for the help text.
+func commandList() string {
+	var list strings.Builder
+	for _, cmd := range commands {
+		fmt.Fprintf(&list, "  %-10s  %s\n", cmd.Name, cmd.Synopsis)
+	}
+	return list.String()
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func watchCommand(args []string) int {
+	return runWatch("fsconsul watch", watchHelpText, args, false)
+}
+
+func onceCommand(args []string) int {
+	return runWatch("fsconsul once", onceHelpText, args, true)
+}
+
+func fetchCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul fetch", fetchHelpText, &opts)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.loadConfig(log)
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 1
+	}
+
+	pair, _, err := client.KV().Get(flags.Arg(0), &consulapi.QueryOptions{Token: config.Consul.Token})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to read key")
+		return 1
+	}
+	if pair == nil {
+		log.WithFields(logrus.Fields{
+			"key": flags.Arg(0),
+		}).Error("Key does not exist")
+		return 1
+	}
+
+	rendered, err := renderValue(&MappingConfig{Keystore: opts.keystore}, pair.Key, pair.Value, nil)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to render value")
+		return 1
+	}
+
+	os.Stdout.Write(rendered)
+	return 0
+}
+
+func putCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul put", putHelpText, &opts)
+	cas := flags.Bool("cas", false, "only write the key if it's still at -modify-index")
+	modifyIndex := flags.Uint64("modify-index", 0, "the modify index the key was last known at, for -cas (0 if it shouldn't exist yet)")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.loadConfig(log)
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	var value []byte
+	var err error
+	if flags.NArg() == 2 && flags.Arg(1) != "-" {
+		value = []byte(flags.Arg(1))
+	} else {
+		value, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to read value from stdin")
+			return 1
+		}
+	}
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 1
+	}
+
+	pair := &consulapi.KVPair{Key: flags.Arg(0), Value: value, ModifyIndex: *modifyIndex}
+	if *cas {
+		err = casPut(client.KV(), pair, &consulapi.WriteOptions{Token: config.Consul.Token})
+	} else {
+		_, err = client.KV().Put(pair, &consulapi.WriteOptions{Token: config.Consul.Token})
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to write key")
+		return 1
+	}
+
+	return 0
+}
+
+// Compare each mapping's prefix with its path.  Like diff(1), exits 0 if there are no
+// differences, 1 if there are and 2 on trouble.
+func diffCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul diff", diffHelpText, &opts)
+	flags.Parse(args)
+	if opts.configFile == "" && flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, flags.Args())
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 2
+	}
+
+	var summary *runSummary
+	if config.JSONSummary {
+		summary = newRunSummary()
+	}
+
+	code = 0
+	for i := range config.Mappings {
+		mappingConfig := &config.Mappings[i]
+
+		// Registry values, files passed over a socket, or keys only set as environment
+		// variables, aren't on disk to compare with
+		if mappingConfig.Registry != "" || mappingConfig.Socket != "" || mappingConfig.envOnly() {
+			continue
+		}
+
+		pairs, err := listMapping(client, config, mappingConfig)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"mapping": mappingConfig.Name,
+				"error":   err,
+			}).Error("Failed to list prefix")
+			return 2
+		}
+
+		added, updated, deleted, err := diffMapping(config, mappingConfig, pairs)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"mapping": mappingConfig.Name,
+				"error":   err,
+			}).Error("Failed to diff mapping")
+			return 2
+		}
+
+		if len(added)+len(updated)+len(deleted) > 0 {
+			code = 1
+		}
+
+		if summary != nil {
+			perMapping := summary.addMapping(mappingConfig.Name)
+			perMapping.Added = append(perMapping.Added, added...)
+			perMapping.Updated = append(perMapping.Updated, updated...)
+			perMapping.Deleted = append(perMapping.Deleted, deleted...)
+			perMapping.finish()
+			continue
+		}
+
+		for _, file := range added {
+			fmt.Println("+ " + file)
+		}
+		for _, file := range updated {
+			fmt.Println("~ " + file)
+		}
+		for _, file := range deleted {
+			fmt.Println("- " + file)
+		}
+	}
+
+	if summary != nil {
+		summary.writeAs(os.Stdout, config.SummaryFormat)
+	}
+
+	// Configuration management tools report differences as changes rather than failures
+	if code == 1 && (config.SummaryFormat == "ansible" || config.SummaryFormat == "salt") {
+		return 0
+	}
+
+	return code
+}
+
+// List the files that writing the pairs would add and update, and those a pruning mapping
+// would delete.
+func diffMapping(config *WatchConfig, mappingConfig *MappingConfig, pairs consulapi.KVPairs) (added, updated, deleted []string, err error) {
+	files, err := renderMapping(mappingConfig, pairs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for keyfile, rendered := range files {
+		existing, err := ioutil.ReadFile(keyfile)
+		if os.IsNotExist(err) {
+			added = append(added, keyfile)
+		} else if err != nil {
+			return nil, nil, nil, err
+		} else if !bytes.Equal(existing, rendered) {
+			updated = append(updated, keyfile)
+		}
+	}
+
+	// Compared as the first snapshot of a run, so no key was removed since the last one
+	if mappingConfig.Prune {
+		env, _ := snapshotEnv(mappingConfig, pairs)
+		emptyKeys := applyEmptyValues(mappingConfig, nil, env)
+		if deleted, err = prunedFiles(config, mappingConfig, env, nil, emptyKeys); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(updated)
+	sort.Strings(deleted)
+	return added, updated, deleted, nil
+}
+
+// Render the pairs into the files a mapping would write, without writing anything.
+func renderMapping(mappingConfig *MappingConfig, pairs consulapi.KVPairs) (map[string][]byte, error) {
+	env, _ := snapshotEnv(mappingConfig, pairs)
+	if unsafe := dropUnsafeKeys(mappingConfig, env); len(unsafe) > 0 && mappingConfig.StrictKeys {
+		return nil, unsafe[0]
+	}
+
+	if mappingConfig.Format != "" {
+		keyfile := explodedPath(mappingConfig)
+		rendered, err := renderExploded(mappingConfig, env)
+		if err == nil {
+			rendered, err = patchFile(mappingConfig, keyfile, rendered)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{keyfile: markManaged(mappingConfig, keyfile, rendered)}, nil
+	}
+
+	files := make(map[string][]byte, len(env))
+	for k, v := range env {
+		// Folders have no file of their own
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		keyfile := keyfilePath(mappingConfig, k)
+
+		rendered, err := renderValue(mappingConfig, k, []byte(v), env)
+		if err != nil {
+			return nil, err
+		}
+		rendered, err = patchFile(mappingConfig, keyfile, rendered)
+		if err != nil {
+			return nil, err
+		}
+		files[keyfile] = markManaged(mappingConfig, keyfile, rendered)
+	}
+	return files, nil
+}
+
+func validateCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul validate", validateHelpText, &opts)
+	flags.Parse(args)
+	if opts.configFile == "" {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.loadConfig(log)
+	if config == nil {
+		return code
+	}
+
+	applyDefaults(config)
+
+	errs := validateConfig(config)
+
+	if config.JSONSummary {
+		summary := newRunSummary()
+		for _, err := range errs {
+			summary.addError(err)
+		}
+		summary.writeAs(os.Stdout, config.SummaryFormat)
+	} else {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return 1
+	}
+
+	if config.JSONSummary {
+		return 0
+	}
+
+	fmt.Printf("%s is valid\n", opts.configFile)
+	return 0
+}
+
+// Check a configuration for mistakes that would only surface once fsconsul is running.
+func validateConfig(config *WatchConfig) []error {
+	var errs []error
+
+	// Embedded, mappings can be registered once watching, and fragments in the conf.d
+	// directory are loaded once starting
+	if len(config.Mappings) == 0 && len(config.Profiles) == 0 && config.done == nil && config.ConfDir == "" {
+		errs = append(errs, fmt.Errorf("no mappings are configured"))
+	}
+	errs = append(errs, validateProfiles(config)...)
+	if config.Consul.TokenFile != "" && config.Consul.Token == "" {
+		errs = append(errs, fmt.Errorf("consul token file %s couldn't be read or is empty", config.Consul.TokenFile))
+	}
+
+	paths := make(map[string]int)
+	names := make(map[string]int)
+	for i, mappingConfig := range config.Mappings {
+		if other, ok := names[mappingConfig.Name]; ok {
+			errs = append(errs, fmt.Errorf("mappings %d and %d are both named %s", other, i, mappingConfig.Name))
+		} else {
+			names[mappingConfig.Name] = i
+		}
+
+		if mappingConfig.PointerKey != "" {
+			if mappingConfig.Prefix != "" {
+				errs = append(errs, fmt.Errorf("mapping %d has both a prefix and a pointerkey naming its prefix", i))
+			}
+			if mappingConfig.Backend != "" && mappingConfig.Backend != "consul" || mappingConfig.Drift.Datacenter != "" {
+				errs = append(errs, fmt.Errorf("mapping %d has a pointerkey, which only works reading from the local consul datacenter", i))
+			}
+		} else if mappingConfig.Prefix == "" {
+			errs = append(errs, fmt.Errorf("mapping %d has no prefix", i))
+		}
+		if fallback := mappingConfig.FallbackPrefix; fallback != "" {
+			if mappingConfig.PointerKey != "" || mappingConfig.Backend != "" && mappingConfig.Backend != "consul" {
+				errs = append(errs, fmt.Errorf("mapping %d has a fallbackprefix, which only works with a consul prefix", i))
+			} else if strings.HasPrefix(fallback, mappingConfig.Prefix) || strings.HasPrefix(mappingConfig.Prefix, fallback) {
+				errs = append(errs, fmt.Errorf("mapping %d has a fallbackprefix overlapping its prefix", i))
+			}
+		}
+		if mappingConfig.Registry != "" {
+			if _, _, err := splitRegistryKey(mappingConfig.Registry); err != nil {
+				errs = append(errs, fmt.Errorf("mapping %d: %v", i, err))
+			}
+			if runtime.GOOS != "windows" {
+				errs = append(errs, fmt.Errorf("mapping %d writes to the registry, which is only available on Windows", i))
+			}
+			if mappingConfig.Format != "" || mappingConfig.Patch {
+				errs = append(errs, fmt.Errorf("mapping %d writes to the registry, so can't explode or patch files", i))
+			}
+		} else if mappingConfig.Socket != "" {
+			if runtime.GOOS != "linux" {
+				errs = append(errs, fmt.Errorf("mapping %d passes files over a socket, which is only available on Linux", i))
+			}
+			if mappingConfig.Path != "" || mappingConfig.Format != "" || mappingConfig.Patch {
+				errs = append(errs, fmt.Errorf("mapping %d passes files over a socket, so can't have a path, explode or patch files", i))
+			}
+		} else if mappingConfig.Path == "" {
+			if !mappingConfig.ExecEnv {
+				errs = append(errs, fmt.Errorf("mapping %d has no path", i))
+			} else if mappingConfig.Format != "" || mappingConfig.Patch || mappingConfig.Prune || mappingConfig.PhaseOrder != "" {
+				errs = append(errs, fmt.Errorf("mapping %d only sets environment variables, so can't explode, patch or prune files or have a phaseorder", i))
+			}
+		} else if other, ok := paths[mappingConfig.Path]; ok {
+			errs = append(errs, fmt.Errorf("mappings %d and %d write to the same path %s", other, i, mappingConfig.Path))
+		} else {
+			paths[mappingConfig.Path] = i
+		}
+
+		if err := mappingConfig.checkPermissions(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %v", i, err))
+		}
+		if err := mappingConfig.checkTrailingNewline(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %v", i, err))
+		}
+
+		if mappingConfig.Transit.Key != "" && mappingConfig.Transit.Vault != nil && mappingConfig.Transit.Vault.Addr == "" && os.Getenv("VAULT_ADDR") == "" {
+			errs = append(errs, fmt.Errorf("mapping %d decrypts with vault transit but no vault addr is configured", i))
+		}
+
+		switch mappingConfig.Backend {
+		case "", "consul":
+		case "vault":
+			if config.Vault.Addr == "" && os.Getenv("VAULT_ADDR") == "" {
+				errs = append(errs, fmt.Errorf("mapping %d reads from vault but no vault addr is configured", i))
+			}
+			if mappingConfig.KeysOnly {
+				errs = append(errs, fmt.Errorf("mapping %d reads from vault, which has no keys-only queries", i))
+			}
+		case "etcd":
+			if len(config.Etcd.Endpoints) == 0 && os.Getenv("ETCDCTL_ENDPOINTS") == "" {
+				errs = append(errs, fmt.Errorf("mapping %d reads from etcd but no etcd endpoints are configured", i))
+			}
+			if mappingConfig.KeysOnly || mappingConfig.Drift.Datacenter != "" {
+				errs = append(errs, fmt.Errorf("mapping %d reads from etcd, which has no keys-only queries or datacenters", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("mapping %d has unknown backend %s", i, mappingConfig.Backend))
+		}
+
+		if err := mappingConfig.checkPhaseOrder(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %v", i, err))
+		} else if mappingConfig.PhaseOrder != "" && (mappingConfig.Registry != "" || mappingConfig.Socket != "" || mappingConfig.Format != "") {
+			errs = append(errs, fmt.Errorf("mapping %d has a phaseorder, which needs it to write a file per key", i))
+		}
+		if mappingConfig.ExecEnv && config.Exec.Command == "" {
+			errs = append(errs, fmt.Errorf("mapping %d has execenv, which needs a process run with exec", i))
+		} else if mappingConfig.ExecEnv && (mappingConfig.Registry != "" || mappingConfig.Socket != "") {
+			errs = append(errs, fmt.Errorf("mapping %d has execenv, which can't be combined with registry or socket", i))
+		}
+		if err := mappingConfig.checkBackpressure(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %v", i, err))
+		}
+		if len(mappingConfig.Keystores) > 0 && mappingConfig.Keystore == "" {
+			errs = append(errs, fmt.Errorf("mapping %d has keystores but no keystore to try first", i))
+		}
+		if mappingConfig.IndexFile && mappingConfig.Path == "" && !mappingConfig.ExecEnv {
+			errs = append(errs, fmt.Errorf("mapping %d has an indexfile, which needs a path or execenv", i))
+		}
+		if mappingConfig.DeltaWrites && mappingConfig.AtomicWrites {
+			errs = append(errs, fmt.Errorf("mapping %d has both deltawrites and atomicwrites, which write files in different ways", i))
+		}
+		if mappingConfig.Prune && (mappingConfig.Registry != "" || mappingConfig.Socket != "" || mappingConfig.Format != "" || !mappingConfig.managesDeletes()) {
+			errs = append(errs, fmt.Errorf("mapping %d prunes files, which needs it to write a file per key and manage deletes", i))
+		}
+		if mappingConfig.Explode != "" && mappingConfig.Explode != mappingConfig.Format {
+			errs = append(errs, fmt.Errorf("mapping %d has both format %s and explode %s, which is the older name for format", i, mappingConfig.Format, mappingConfig.Explode))
+		}
+		if mappingConfig.Format != "" && mappingConfig.ExplodeFile == "" {
+			errs = append(errs, fmt.Errorf("mapping %d has a format but no explodefile", i))
+		}
+		if (mappingConfig.Format == "xml" || mappingConfig.Format == "template") && mappingConfig.Skeleton == "" {
+			errs = append(errs, fmt.Errorf("mapping %d has format %s but no skeleton", i, mappingConfig.Format))
+		}
+		switch mappingConfig.KeyCase {
+		case "", keyCaseLower, keyCaseUpper, keyCaseSnake:
+		default:
+			errs = append(errs, fmt.Errorf("mapping %d has unknown keycase %s, expected lower, upper or snake", i, mappingConfig.KeyCase))
+		}
+		switch mappingConfig.EmptyValues {
+		case "", emptyWrite, emptySkip, emptyDelete, emptyFail:
+		default:
+			errs = append(errs, fmt.Errorf("mapping %d has unknown emptyvalues policy %s", i, mappingConfig.EmptyValues))
+		}
+		if err := validateChangeMode(config, &mappingConfig); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %v", i, err))
+		}
+		if mappingConfig.Wait <= 0 && (mappingConfig.MaxWait > 0 || mappingConfig.Splay > 0) {
+			errs = append(errs, fmt.Errorf("mapping %d has a maxwait or splay but no wait", i))
+		} else if mappingConfig.MaxWait > 0 && mappingConfig.MaxWait < mappingConfig.Wait {
+			errs = append(errs, fmt.Errorf("mapping %d has a maxwait shorter than its wait", i))
+		}
+	}
+
+	if err := checkDependencies(config.Mappings); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, checkDangerousPaths(config)...)
+
+	for i, notifierConfig := range config.Notifiers {
+		if err := notifierConfig.check(); err != nil {
+			errs = append(errs, fmt.Errorf("notifier %d: %v", i, err))
+		}
+	}
+
+	return errs
+}
+
+func versionCommand(args []string) int {
+	fmt.Printf("fsconsul %s\n", version)
+	return 0
+}
+
+const watchHelpText = `
+Usage: %s watch [options] prefix path onchange
+
+  Write files to the specified location on the local system by reading K/Vs
+  from Consul's K/V store with the given prefix and executing a program on
+  any change.
+
+Options:
+`
+
+const onceHelpText = `
+Usage: %s once [options] prefix path onchange
+
+  Write files to the specified location on the local system by reading K/Vs
+  from Consul's K/V store with the given prefix, execute the program and exit.
+
+Options:
+`
+
+const fetchHelpText = `
+Usage: %s fetch [options] key
+
+  Print the value of a key as it would be written to disk, decrypting it if
+  a keystore is given.
+
+Options:
+`
+
+const putHelpText = `
+Usage: %s put [options] key [value]
+
+  Write a value to a key.  The value is read from stdin if it is omitted or
+  given as "-".  With -cas, the key is only written if it's still at
+  -modify-index, so that a change made by someone else since it was read
+  isn't overwritten.
+
+Options:
+`
+
+const snapshotHelpText = `
+Usage: %s snapshot [options] [prefix]
+
+  Print every key under a prefix (or the whole K/V store) as JSON in the
+  format written by "consul kv export", with base64 values and flags.
+
+Options:
+`
+
+const importHelpText = `
+Usage: %s import [options] [file]
+
+  Write the keys in a file in the format written by "consul kv export" or
+  "fsconsul snapshot", keeping their flags.  The file is read from stdin if
+  it is omitted or given as "-".  With -cas, each key is only written if it's
+  still at the modify index the snapshot recorded (or doesn't exist, for keys
+  without one); keys changed since are left alone and reported.
+
+Options:
+`
+
+const reportHelpText = `
+Usage: %s report [options] prefix path onchange
+
+  Print a JSON report mapping every file the configuration renders to the
+  Consul key it comes from, with the identity of the ACL token keys are
+  read with, how values are decrypted, and each file's mode and owner.
+
+Options:
+`
+
+const pushHelpText = `
+Usage: %s push [options] path prefix
+
+  Write every file under the path to the key of the same name under the
+  prefix, the reverse of watch.  Keys whose files are unchanged aren't
+  written.  With -delete, keys under the prefix without a file are deleted;
+  with -cas, keys changed by someone else since they were listed are left
+  alone and reported.
+
+Options:
+`
+
+const benchHelpText = `
+Usage: %s bench [options]
+
+  Measure how quickly fsconsul applies changes against a real Consul: write
+  synthetic keys under a prefix, watch them into a directory, then change one
+  key per round and time how long it takes from writing the key until its
+  file is written, and until the onchange command has finished.  Prints a
+  JSON report of the 50th, 90th and 99th percentiles and the maximum, with
+  the time taken to render every key at startup.
+
+  The prefix is deleted before and after the run, so give it one of its own.
+
+Options:
+`
+
+const launchdHelpText = `
+Usage: %s launchd [-label label] [-log file] -- [watch options] [prefix path...]
+
+  Print a launchd property list running fsconsul watch with the options and
+  arguments after --.  launchd starts it at load and restarts it if it
+  fails; fsconsul exits cleanly on SIGTERM, so unloading the job stops it
+  for good.  Install it in /Library/LaunchDaemons and load it with
+  launchctl.
+
+Options:
+`
+
+const serviceHelpText = `
+Usage: %s service install [-name name] [-display-name name] -- [watch options] [prefix path...]
+       %[1]s service start|stop|uninstall [-name name]
+
+  Manage fsconsul watch as a Windows service.  install creates a service,
+  started automatically at boot, running fsconsul watch with the options and
+  arguments after --, and registers it as a source of the event log, which it
+  logs to.  stop waits for the service to finish its writes and onchange
+  commands, as on Ctrl-C.  The service control manager starts the service
+  with fsconsul service run, which isn't meant to be run by hand.
+
+Options:
+`
+
+const ownsHelpText = `
+Usage: %s owns -configFile file [path...]
+
+  List the files the configuration renders from what is currently in
+  Consul, with the mapping rendering each.  Given paths, print those the
+  configuration renders and exit 1 if any of them isn't, so configuration
+  management tools can leave fsconsul's files alone.
+
+Options:
+`
+
+const gcHelpText = `
+Usage: %s gc -configFile file [-yes] [-force]
+
+  List the files recorded in the state file that no configured mapping
+  renders any more, because their mapping was removed from the
+  configuration or its path changed, and delete them once confirmed.
+  Files changed since fsconsul wrote them are kept unless -force is given.
+  Run it with the config file and state file fsconsul watch runs with.
+
+Options:
+`
+
+const diffHelpText = `
+Usage: %s diff [options] prefix path
+
+  List the files that would be created (+), modified (~) or, for mappings
+  that prune, deleted (-) by writing the prefix to the path.  Exits 0 if
+  there are no differences, 1 if there are and 2 on error.
+
+Options:
+`
+
+const verifyHelpText = `
+Usage: %s verify [options] (-configFile file | prefix path...)
+
+  Check that every file the mappings render exists with the content in
+  Consul and the mapping's mode and ownership, and that no files are left
+  that fsconsul would have deleted.  Prints each mismatch and exits 0 if
+  there are none, 1 if there are and 2 on error.  Nothing is written, so
+  verify can run as an account that can only read the paths.
+
+Options:
+`
+
+const configHelpText = `
+Usage: %s config print [options] [prefix path onchange]
+
+  Print the configuration the options and arguments (or config file) would
+  run with, one setting per line with where it came from: the config file,
+  a command-line switch, the environment or a default.  Secrets are
+  redacted.  fsconsul watch logs the same when it starts.
+
+Options:
+`
+
+const validateHelpText = `
+Usage: %s validate -configFile file
+
+  Check a configuration file for errors.
+
+Options:
+`
@@ -0,0 +1,50 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	config := &WatchConfig{
+		Mappings: []MappingConfig{
+			{Prefix: "app1", Path: "/etc/app1"},
+			{Prefix: "app2", Path: "/etc/app1/"},
+			{Path: "/etc/app3"},
+		},
+	}
+	applyDefaults(config)
+
+	if errs := validateConfig(config); len(errs) != 2 {
+		t.Fatalf("Expected a duplicate path and a missing prefix error but got %v", errs)
+	}
+
+	if errs := validateConfig(&WatchConfig{}); len(errs) != 1 {
+		t.Fatalf("Expected an error for a config without mappings but got %v", errs)
+	}
+}
+
+func TestStartupValidation(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	content := `{"mappings": [{"prefix": "app/", "path": "` + filepath.ToSlash(filepath.Join(dir, "app")) + `", "changemode": "atomc"}]}`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A typo is refused rather than replaced by the default
+	if code := onceCommand([]string{"-configFile", configFile}); code == 0 {
+		t.Fatal("expected an unknown changemode to stop fsconsul from starting")
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	list := commandList()
+	for _, cmd := range commands {
+		if !strings.Contains(list, "  "+cmd.Name+" ") {
+			t.Errorf("expected the help text to list %s", cmd.Name)
+		}
+	}
+}
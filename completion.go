@@ -0,0 +1,98 @@
+package fsconsul
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func completionCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: fsconsul completion bash|zsh|fish")
+		return 1
+	}
+
+	var script string
+	switch args[0] {
+	case "bash":
+		script = bashCompletion()
+	case "zsh":
+		script = zshCompletion()
+	case "fish":
+		script = fishCompletion()
+	default:
+		fmt.Fprintf(os.Stderr, "Unsupported shell %q, expected bash, zsh or fish\n", args[0])
+		return 1
+	}
+
+	fmt.Print(script)
+	return 0
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, cmd := range commands {
+		names[i] = cmd.Name
+	}
+	return names
+}
+
+// The shared options, for completion purposes.
+func optionFlags() []*flag.Flag {
+	var flags []*flag.Flag
+	newFlagSet("", "", &options{}).VisitAll(func(f *flag.Flag) {
+		flags = append(flags, f)
+	})
+	return flags
+}
+
+func flagNames() []string {
+	var names []string
+	for _, f := range optionFlags() {
+		names = append(names, "-"+f.Name)
+	}
+	return names
+}
+
+func bashCompletion() string {
+	return fmt.Sprintf(`_fsconsul() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    if [ $COMP_CWORD -eq 1 ] && [[ "$cur" != -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    elif [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    else
+        COMPREPLY=($(compgen -f -- "$cur"))
+    fi
+}
+complete -F _fsconsul fsconsul
+`, strings.Join(commandNames(), " "), strings.Join(flagNames(), " "))
+}
+
+func zshCompletion() string {
+	return fmt.Sprintf(`#compdef fsconsul
+_fsconsul() {
+    if (( CURRENT == 2 )) && [[ $words[CURRENT] != -* ]]; then
+        compadd %s
+    elif [[ $words[CURRENT] == -* ]]; then
+        compadd -- %s
+    else
+        _files
+    fi
+}
+compdef _fsconsul fsconsul
+`, strings.Join(commandNames(), " "), strings.Join(flagNames(), " "))
+}
+
+func fishCompletion() string {
+	b := &bytes.Buffer{}
+	for _, cmd := range commands {
+		fmt.Fprintf(b, "complete -c fsconsul -f -n '__fish_use_subcommand' -a %s -d '%s'\n", cmd.Name, cmd.Synopsis)
+	}
+	for _, f := range optionFlags() {
+		fmt.Fprintf(b, "complete -c fsconsul -o %s -d '%s'\n", f.Name, strings.Replace(f.Usage, "'", "\\'", -1))
+	}
+	return b.String()
+}
@@ -0,0 +1,309 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Without file ownership (on Windows), every fragment is treated as the current user's and
+// permissions aren't checked.
+const noFileOwnership = runtime.GOOS == "windows"
+
+// Set in the environment of worker processes, which read their configuration from stdin.
+const workerEnv = "FSCONSUL_WORKER"
+
+// TenantConfig holds what the conf.d fragments of a user other than fsconsul's own may do:
+// the prefix their mappings must read under, and the Consul token their worker reads with.
+// Workers are never given fsconsul's own tokens and secrets.
+type TenantConfig struct {
+	// User name or uid
+	User string
+
+	Prefix string
+
+	Token     string
+	TokenFile string
+}
+
+// tenantFragment is a mapping fragment from the conf.d directory owned by another user,
+// whose mappings are rendered by a worker process running as that user.
+type tenantFragment struct {
+	Path     string
+	UID, GID int
+	Mappings []MappingConfig
+	Tenant   TenantConfig
+}
+
+// Variables dropped from the environment of workers, which could otherwise read fsconsul's
+// credentials from it.
+var workerSecretEnv = []string{"CONSUL_HTTP_TOKEN", "CONSUL_HTTP_AUTH", "VAULT_", "ETCDCTL_", "AWS_"}
+
+// Load the mapping fragments in config.ConfDir.  Fragments owned by the user fsconsul runs
+// as are added to config.Mappings; the rest are returned, to be run by workers.
+func loadConfDir(config *WatchConfig) ([]tenantFragment, error) {
+	if config.ConfDir == "" {
+		return nil, nil
+	}
+
+	// Users able to write to the directory could replace each other's fragments, unless it's
+	// sticky like /tmp
+	info, err := os.Stat(config.ConfDir)
+	if err != nil {
+		return nil, err
+	}
+	if !noFileOwnership && info.Mode().Perm()&0022 != 0 && info.Mode()&os.ModeSticky == 0 {
+		return nil, fmt.Errorf("%s is writable by other users but not sticky", config.ConfDir)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(config.ConfDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var tenants []tenantFragment
+	for _, path := range paths {
+		fragment, err := loadFragment(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if fragment.UID == os.Getuid() {
+			config.Mappings = append(config.Mappings, fragment.Mappings...)
+			continue
+		}
+
+		tenant, ok := tenantFor(config, fragment.UID)
+		if !ok {
+			return nil, fmt.Errorf("%s is owned by uid %d, which isn't a tenant", path, fragment.UID)
+		}
+		if err := checkTenantMappings(tenant, fragment.Mappings); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		fragment.Tenant = tenant
+		tenants = append(tenants, fragment)
+	}
+
+	return tenants, nil
+}
+
+// Find the tenant configured for a user, by name or uid.
+func tenantFor(config *WatchConfig, uid int) (TenantConfig, bool) {
+	id := strconv.Itoa(uid)
+	name := ""
+	if u, err := user.LookupId(id); err == nil {
+		name = u.Username
+	}
+	for _, tenant := range config.Tenants {
+		if tenant.User == id || (name != "" && tenant.User == name) {
+			return tenant, true
+		}
+	}
+	return TenantConfig{}, false
+}
+
+// Check a tenant's mappings only read from Consul, under the tenant's prefix, so that one
+// tenant can't render another's keys.
+func checkTenantMappings(tenant TenantConfig, mappings []MappingConfig) error {
+	root := strings.TrimLeft(tenant.Prefix, "/")
+	if root == "" {
+		return fmt.Errorf("tenant %s has no prefix", tenant.User)
+	}
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	under := func(prefix string) bool {
+		prefix = strings.TrimLeft(prefix, "/")
+		return strings.HasPrefix(prefix, root) || prefix == strings.TrimSuffix(root, "/")
+	}
+
+	for i, mappingConfig := range mappings {
+		if mappingConfig.Backend != "" && mappingConfig.Backend != "consul" {
+			return fmt.Errorf("mapping %d reads from %s, but tenants can only read from consul", i, mappingConfig.Backend)
+		}
+		for _, prefix := range []string{mappingConfig.Prefix, mappingConfig.FallbackPrefix, mappingConfig.PointerKey} {
+			if prefix != "" && !under(prefix) {
+				return fmt.Errorf("mapping %d reads %s, outside the tenant's prefix %s", i, prefix, root)
+			}
+		}
+	}
+	return nil
+}
+
+func loadFragment(path string) (tenantFragment, error) {
+	// A symlink would have the fragment read as its owner rather than the target's
+	info, err := os.Lstat(path)
+	if err != nil {
+		return tenantFragment{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return tenantFragment{}, fmt.Errorf("%s isn't a regular file", path)
+	}
+
+	// Anyone able to change a fragment could render as its owner
+	if !noFileOwnership && info.Mode().Perm()&0022 != 0 {
+		return tenantFragment{}, fmt.Errorf("%s is writable by users other than its owner", path)
+	}
+
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return tenantFragment{}, fmt.Errorf("cannot determine the owner of %s", path)
+	}
+
+	// The file read must be the one checked, not one swapped in since
+	f, err := os.Open(path)
+	if err != nil {
+		return tenantFragment{}, err
+	}
+	defer f.Close()
+	if opened, err := f.Stat(); err != nil || !os.SameFile(info, opened) {
+		return tenantFragment{}, fmt.Errorf("%s changed while it was read", path)
+	}
+	body, err := ioutil.ReadAll(f)
+	if err != nil {
+		return tenantFragment{}, err
+	}
+
+	var fragment struct {
+		Mappings []MappingConfig
+	}
+	if err := json.Unmarshal(body, &fragment); err != nil {
+		return tenantFragment{}, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	return tenantFragment{Path: path, UID: uid, GID: gid, Mappings: fragment.Mappings}, nil
+}
+
+// The configuration of a tenant's worker: how to reach Consul, with the tenant's token, and
+// how to run, but none of fsconsul's own tokens or secrets, which the tenant could read from
+// the worker running as them.
+func workerConfigFor(config *WatchConfig, tenant tenantFragment) (WatchConfig, error) {
+	token := tenant.Tenant.Token
+	if token == "" && tenant.Tenant.TokenFile != "" {
+		data, err := ioutil.ReadFile(tenant.Tenant.TokenFile)
+		if err != nil {
+			return WatchConfig{}, fmt.Errorf("failed to read token of tenant %s: %v", tenant.Tenant.User, err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	return WatchConfig{
+		RunOnce: config.RunOnce,
+		Consul: ConsulConfig{
+			Addr:            config.Consul.Addr,
+			DC:              config.Consul.DC,
+			Token:           token,
+			CAFile:          config.Consul.CAFile,
+			CertFile:        config.Consul.CertFile,
+			KeyFile:         config.Consul.KeyFile,
+			UseTLS:          config.Consul.UseTLS,
+			Proxy:           config.Consul.Proxy,
+			PinnedKeys:      config.Consul.PinnedKeys,
+			CheckRevocation: config.Consul.CheckRevocation,
+		},
+		Log:                 config.Log,
+		Degraded:            config.Degraded,
+		SourceFile:          config.SourceFile,
+		DangerousPaths:      config.DangerousPaths,
+		DryRun:              config.DryRun,
+		OnceOnChange:        config.OnceOnChange,
+		OnceOnChangeTimeout: config.OnceOnChangeTimeout,
+		ShutdownTimeout:     config.ShutdownTimeout,
+		Mappings:            tenant.Mappings,
+	}, nil
+}
+
+// fsconsul's environment, less the variables holding credentials.
+func workerEnviron() []string {
+	var environ []string
+	for _, v := range os.Environ() {
+		name := strings.ToUpper(strings.SplitN(v, "=", 2)[0])
+		secret := strings.Contains(name, "TOKEN") || strings.Contains(name, "SECRET") || strings.Contains(name, "PASSWORD")
+		for _, prefix := range workerSecretEnv {
+			secret = secret || strings.HasPrefix(name, prefix)
+		}
+		if !secret {
+			environ = append(environ, v)
+		}
+	}
+	return environ
+}
+
+// Start a worker process running the tenant's mappings as the tenant.
+func startWorker(config *WatchConfig, tenant tenantFragment) (*exec.Cmd, error) {
+	workerConfig, err := workerConfigFor(config, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(workerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	attr, err := workerSysProcAttr(tenant.UID, tenant.GID)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(executable)
+	cmd.Env = append(workerEnviron(), workerEnv+"="+tenant.Path)
+	cmd.SysProcAttr = attr
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start worker for %s: %v", tenant.Path, err)
+	}
+
+	stdin.Write(body)
+	stdin.Close()
+
+	log.WithFields(log.Fields{
+		"fragment": tenant.Path,
+		"uid":      tenant.UID,
+		"pid":      cmd.Process.Pid,
+	}).Info("Started worker")
+
+	return cmd, nil
+}
+
+// Run as a worker: render the mappings of the configuration given on stdin.
+func workerMain() int {
+	var config WatchConfig
+	if err := json.NewDecoder(os.Stdin).Decode(&config); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to read worker config")
+		return 1
+	}
+
+	if err := configureLogging(log.StandardLogger(), config.Log); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to configure logging")
+		return 1
+	}
+
+	return watchAndExec(&config)
+}
@@ -0,0 +1,11 @@
+package fsconsul
+
+import "syscall"
+
+// Run workers as the given user, terminating them if fsconsul exits.
+func workerSysProcAttr(uid, gid int) (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		Pdeathsig:  syscall.SIGTERM,
+	}, nil
+}
@@ -0,0 +1,92 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fragment := filepath.Join(tempDir, "app1.json")
+	if err := ioutil.WriteFile(fragment, []byte(`{"mappings": [{"prefix": "app1", "path": "/tmp/app1"}]}`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(tempDir, "ignored.txt"), []byte("not a fragment"), 0644)
+
+	config := &WatchConfig{
+		ConfDir:  tempDir,
+		Mappings: []MappingConfig{{Prefix: "main", Path: "/tmp/main"}},
+	}
+
+	// Fragments owned by the current user are rendered by this process
+	tenants, err := loadConfDir(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tenants) != 0 {
+		t.Errorf("expected no tenants, got %v", tenants)
+	}
+	if len(config.Mappings) != 2 || config.Mappings[1].Prefix != "app1" {
+		t.Errorf("expected the fragment's mapping to be added, got %v", config.Mappings)
+	}
+
+	// Fragments others can write to are refused
+	os.Chmod(fragment, 0666)
+	if _, err := loadConfDir(&WatchConfig{ConfDir: tempDir}); err == nil {
+		t.Errorf("expected a world-writable fragment to be refused")
+	}
+	os.Chmod(fragment, 0644)
+
+	// So are symlinks, which would be read as their owner rather than the target's
+	link := filepath.Join(tempDir, "link.json")
+	if err := os.Symlink(fragment, link); err == nil {
+		if _, err := loadFragment(link); err == nil {
+			t.Errorf("expected a symlinked fragment to be refused")
+		}
+	}
+}
+
+func TestTenantWorkers(t *testing.T) {
+	tenant := TenantConfig{User: "billing", Prefix: "billing", Token: "billing-token"}
+	if err := checkTenantMappings(tenant, []MappingConfig{{Prefix: "billing/config/"}}); err != nil {
+		t.Errorf("expected a mapping under the tenant's prefix to be allowed, got %v", err)
+	}
+	for _, mappingConfig := range []MappingConfig{
+		{Prefix: "payroll/config/"},
+		{Prefix: "billing-admin/"},
+		{Prefix: "billing/config/", FallbackPrefix: "payroll/"},
+		{Prefix: "billing/config/", Backend: "vault"},
+	} {
+		if err := checkTenantMappings(tenant, []MappingConfig{mappingConfig}); err == nil {
+			t.Errorf("expected %+v to be refused", mappingConfig)
+		}
+	}
+
+	config := &WatchConfig{
+		Consul:    ConsulConfig{Addr: "consul:8500", Token: "root-token"},
+		Vault:     VaultConfig{Token: "vault-token"},
+		Notifiers: []NotifierConfig{{URL: "https://hooks.example.com/secret"}},
+	}
+	worker, err := workerConfigFor(config, tenantFragment{Tenant: tenant})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if worker.Consul.Addr != "consul:8500" || worker.Consul.Token != "billing-token" || worker.Vault.Token != "" || len(worker.Notifiers) != 0 {
+		t.Errorf("expected the worker to get the tenant's token and none of fsconsul's secrets, got %+v", worker)
+	}
+
+	os.Setenv("CONSUL_HTTP_TOKEN", "root-token")
+	defer os.Unsetenv("CONSUL_HTTP_TOKEN")
+	for _, v := range workerEnviron() {
+		if v == "CONSUL_HTTP_TOKEN=root-token" {
+			t.Errorf("expected the token to be left out of the worker's environment")
+		}
+	}
+}
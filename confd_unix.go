@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package fsconsul
+
+import "syscall"
+
+// Run workers as the given user.
+func workerSysProcAttr(uid, gid int) (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}, nil
+}
@@ -0,0 +1,10 @@
+package fsconsul
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func workerSysProcAttr(uid, gid int) (*syscall.SysProcAttr, error) {
+	return nil, fmt.Errorf("running mappings as other users is not supported on Windows")
+}
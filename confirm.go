@@ -0,0 +1,95 @@
+package fsconsul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a confirmation hook has to decide, unless configured otherwise.
+const defaultConfirmTimeout = 30 * time.Second
+
+// ConfirmDeletesConfig holds the configuration of a hook that must approve snapshots
+// deleting more than Threshold files before the files are deleted.
+type ConfirmDeletesConfig struct {
+	Threshold int
+
+	// Command run with the files to delete on stdin, one per line.  A non-zero exit vetoes
+	// the deletions.
+	Command string
+
+	// URL POSTed a JSON object with the mapping and files to delete.  A response other than
+	// 2xx vetoes the deletions.
+	URL string
+
+	Timeout Duration
+}
+
+// Determine whether deleting the files needs confirming.
+func (confirm ConfirmDeletesConfig) needed(files []string) bool {
+	return confirm.Threshold > 0 && len(files) > confirm.Threshold && (confirm.Command != "" || confirm.URL != "")
+}
+
+// Ask the confirmation hooks whether the files may be deleted, returning why not if either
+// vetoes it (or fails).
+func confirmDeletes(mappingConfig *MappingConfig, files []string) error {
+	confirm := mappingConfig.ConfirmDeletes
+
+	timeout := time.Duration(confirm.Timeout)
+	if timeout <= 0 {
+		timeout = defaultConfirmTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if confirm.Command != "" {
+		args := strings.Split(confirm.Command, " ")
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(),
+			"FSCONSUL_MAPPING="+mappingConfig.Name,
+			"FSCONSUL_DELETIONS="+strconv.Itoa(len(files)))
+		cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("confirmation command refused: %v", err)
+		}
+	}
+
+	if confirm.URL != "" {
+		body, err := json.Marshal(map[string]interface{}{
+			"mapping": mappingConfig.Name,
+			"files":   files,
+		})
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", confirm.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("confirmation webhook failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			reason, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("confirmation webhook refused with %s: %s", resp.Status, bytes.TrimSpace(reason))
+		}
+	}
+
+	return nil
+}
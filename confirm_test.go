@@ -0,0 +1,57 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestConfirmDeletes(t *testing.T) {
+	files := []string{"/etc/app/a", "/etc/app/b", "/etc/app/c"}
+
+	confirm := ConfirmDeletesConfig{Threshold: 3, URL: "http://example.com"}
+	if confirm.needed(files) {
+		t.Fatalf("expected deleting as many files as the threshold not to need confirming")
+	}
+	confirm.Threshold = 2
+	if !confirm.needed(files) {
+		t.Fatalf("expected deleting more files than the threshold to need confirming")
+	}
+
+	var got []string
+	allow := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Mapping string
+			Files   []string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		got = body.Files
+		if !allow {
+			http.Error(w, "too many deletions", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	mappingConfig := &MappingConfig{Name: "app", ConfirmDeletes: ConfirmDeletesConfig{Threshold: 2, URL: server.URL}}
+	if err := confirmDeletes(mappingConfig, files); err != nil {
+		t.Fatalf("expected the webhook to confirm, got %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected the webhook to be sent the files, got %v", got)
+	}
+
+	allow = false
+	if err := confirmDeletes(mappingConfig, files); err == nil {
+		t.Fatalf("expected the webhook to veto")
+	}
+
+	if runtime.GOOS != "windows" {
+		mappingConfig.ConfirmDeletes = ConfirmDeletesConfig{Threshold: 2, Command: "false"}
+		if err := confirmDeletes(mappingConfig, files); err == nil {
+			t.Fatalf("expected a failing command to veto")
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package fsconsul
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for a rate limited or unavailable agent that doesn't say.
+const defaultRetryAfter = 5 * time.Second
+
+// The longest Retry-After honoured, so that a misbehaving agent can't stall fsconsul forever.
+const maxRetryAfter = 5 * time.Minute
+
+// consulStatusError is a rate limited (429) or unavailable (503) response from Consul.
+type consulStatusError struct {
+	Code       int
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *consulStatusError) Error() string {
+	return fmt.Sprintf("consul returned %d %s: %s", e.Code, http.StatusText(e.Code), e.Body)
+}
+
+// statusTransport turns rate limited and unavailable responses into consulStatusErrors, so
+// that callers can tell them apart and respect their Retry-After.
+type statusTransport struct {
+	base http.RoundTripper
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return resp, err
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	return nil, &consulStatusError{
+		Code:       resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
+// Parse a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	retryAfter := defaultRetryAfter
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		retryAfter = date.Sub(now)
+	}
+
+	if retryAfter < 0 {
+		return 0
+	} else if retryAfter > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return retryAfter
+}
+
+// Classify an error from talking to Consul, returning how long to wait before retrying if
+// Consul said.
+func classifyError(err error) (kind string, retryAfter time.Duration) {
+	var statusErr *consulStatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.Code == http.StatusTooManyRequests {
+			return "rate-limited", statusErr.RetryAfter
+		}
+		return "unavailable", statusErr.RetryAfter
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout", 0
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return "connection", 0
+	}
+
+	if strings.Contains(err.Error(), "403") || strings.Contains(err.Error(), "Permission denied") {
+		return "forbidden", 0
+	}
+
+	return "other", 0
+}
+
+// Describe an error kind for the log.
+func consulErrorMessage(kind string) string {
+	switch kind {
+	case "rate-limited":
+		return "Rate limited by consul agent."
+	case "unavailable":
+		return "Consul agent unavailable."
+	case "timeout":
+		return "Timed out communicating with consul agent."
+	case "forbidden":
+		return "Consul agent denied access, check the token."
+	default:
+		return "Error communicating with consul agent."
+	}
+}
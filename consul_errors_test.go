@@ -0,0 +1,66 @@
+package fsconsul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultRetryAfter},
+		{"garbage", defaultRetryAfter},
+		{"0", 0},
+		{"30", 30 * time.Second},
+		{"86400", maxRetryAfter},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	} {
+		if actual := parseRetryAfter(test.value, now); actual != test.expected {
+			t.Errorf("Retry-After %q: expected %v, got %v", test.value, test.expected, actual)
+		}
+	}
+}
+
+func TestClassifyStatusErrors(t *testing.T) {
+	code := http.StatusTooManyRequests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &statusTransport{base: http.DefaultTransport}}
+
+	for _, test := range []struct {
+		code int
+		kind string
+	}{
+		{http.StatusTooManyRequests, "rate-limited"},
+		{http.StatusServiceUnavailable, "unavailable"},
+	} {
+		code = test.code
+		_, err := client.Get(server.URL)
+		if err == nil {
+			t.Fatalf("expected an error for %d", test.code)
+		}
+
+		kind, retryAfter := classifyError(err)
+		if kind != test.kind || retryAfter != 7*time.Second {
+			t.Errorf("%d: expected %s after 7s, got %s after %v", test.code, test.kind, kind, retryAfter)
+		}
+	}
+
+	// Anything else is passed through untouched
+	code = http.StatusNotFound
+	resp, err := client.Get(server.URL)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 response, got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,58 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Fill in the Consul settings that aren't configured from the standard Consul environment
+// variables, as the consul CLI and other tools do.  A token isn't taken from the
+// environment when logging in with an auth method.  Returns the settings filled in, by
+// their path in the config file.
+func applyConsulEnv(consul *ConsulConfig) []string {
+	var set []string
+	fill := func(path, name string, setting *string) {
+		if value := os.Getenv(name); *setting == "" && value != "" {
+			*setting = value
+			set = append(set, path)
+		}
+	}
+
+	fill("consul.addr", "CONSUL_HTTP_ADDR", &consul.Addr)
+	if consul.Login.AuthMethod == "" && consul.Token == "" {
+		fill("consul.tokenfile", "CONSUL_HTTP_TOKEN_FILE", &consul.TokenFile)
+		if consul.TokenFile == "" {
+			fill("consul.token", "CONSUL_HTTP_TOKEN", &consul.Token)
+		}
+	}
+	fill("consul.cafile", "CONSUL_CACERT", &consul.CAFile)
+	fill("consul.certfile", "CONSUL_CLIENT_CERT", &consul.CertFile)
+	fill("consul.keyfile", "CONSUL_CLIENT_KEY", &consul.KeyFile)
+
+	if useTLS, err := strconv.ParseBool(os.Getenv("CONSUL_HTTP_SSL")); err == nil && useTLS && !consul.UseTLS {
+		consul.UseTLS = true
+		set = append(set, "consul.usetls")
+	}
+
+	// CONSUL_HTTP_ADDR may have a scheme, which says whether to use TLS
+	if strings.HasPrefix(consul.Addr, "https://") {
+		consul.Addr = strings.TrimPrefix(consul.Addr, "https://")
+		consul.UseTLS = true
+	} else {
+		consul.Addr = strings.TrimPrefix(consul.Addr, "http://")
+	}
+	return set
+}
+
+// Read the token from the token file, unless the token is given.  A file that can't be
+// read leaves the token empty, which validation reports.
+func readConsulTokenFile(consul *ConsulConfig) {
+	if consul.Token != "" || consul.TokenFile == "" {
+		return
+	}
+	if data, err := ioutil.ReadFile(consul.TokenFile); err == nil {
+		consul.Token = strings.TrimSpace(string(data))
+	}
+}
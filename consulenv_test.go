@@ -0,0 +1,47 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConsulEnv(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_ADDR", "https://consul.internal:8501")
+	t.Setenv("CONSUL_HTTP_TOKEN", "env-token")
+	t.Setenv("CONSUL_CACERT", "/etc/consul/ca.pem")
+	t.Setenv("CONSUL_HTTP_SSL", "")
+
+	// Settings in the config file win
+	consul := ConsulConfig{CAFile: "/etc/fsconsul/ca.pem"}
+	set := applyConsulEnv(&consul)
+	if consul.Addr != "consul.internal:8501" || !consul.UseTLS {
+		t.Errorf("address %q, usetls %v", consul.Addr, consul.UseTLS)
+	}
+	if consul.Token != "env-token" || consul.CAFile != "/etc/fsconsul/ca.pem" {
+		t.Errorf("token %q, cafile %q", consul.Token, consul.CAFile)
+	}
+	if want := []string{"consul.addr", "consul.token"}; !reflect.DeepEqual(set, want) {
+		t.Errorf("set %v, want %v", set, want)
+	}
+
+	// No token from the environment when logging in
+	consul = ConsulConfig{Login: LoginConfig{AuthMethod: "kubernetes"}}
+	applyConsulEnv(&consul)
+	if consul.Token != "" {
+		t.Errorf("token %q taken from the environment with an auth method", consul.Token)
+	}
+
+	// A token file beats the token
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONSUL_HTTP_TOKEN_FILE", tokenFile)
+	config := WatchConfig{}
+	applyDefaults(&config)
+	if config.Consul.Token != "file-token" {
+		t.Errorf("token %q, want the token file's", config.Consul.Token)
+	}
+}
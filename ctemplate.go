@@ -0,0 +1,89 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// ctKeyPair is a key listed by ls or tree, as consul-template has it: Key is relative to
+// the listed prefix, and Path to the mapping's prefix.
+type ctKeyPair struct {
+	Key   string
+	Path  string
+	Value string
+}
+
+// Render a snapshot by running the mapping's skeleton template with consul-template's key,
+// keyOrDefault, ls and tree functions reading the rendered values, so simple
+// consul-template setups can be moved over as they are.  Keys may be given relative to the
+// prefix or in full.
+func explodeTemplate(mappingConfig *MappingConfig, keys []string, values map[string]string) ([]byte, error) {
+	if mappingConfig.Skeleton == "" {
+		return nil, fmt.Errorf("template explode needs a skeleton template")
+	}
+
+	skeleton, err := ioutil.ReadFile(mappingConfig.Skeleton)
+	if err != nil {
+		return nil, err
+	}
+
+	funcs := sprigFuncs()
+	funcs["key"] = func(key string) (string, error) {
+		value, ok := values[relativeKey(mappingConfig, key)]
+		if !ok {
+			return "", fmt.Errorf("key %s not found under %s", key, mappingConfig.Prefix)
+		}
+		return value, nil
+	}
+	funcs["keyOrDefault"] = func(key, fallback string) string {
+		if value, ok := values[relativeKey(mappingConfig, key)]; ok {
+			return value
+		}
+		return fallback
+	}
+	funcs["ls"] = func(prefix string) []ctKeyPair {
+		return listPairs(mappingConfig, keys, values, prefix, false)
+	}
+	funcs["tree"] = func(prefix string) []ctKeyPair {
+		return listPairs(mappingConfig, keys, values, prefix, true)
+	}
+
+	tmpl, err := template.New(filepath.Base(mappingConfig.Skeleton)).Funcs(funcs).Parse(string(skeleton))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse skeleton: %v", err)
+	}
+
+	b := &bytes.Buffer{}
+	if err := tmpl.Execute(b, values); err != nil {
+		return nil, fmt.Errorf("could not execute skeleton: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// List the keys below a prefix, sorted: only those directly below it, or with recursive,
+// every key in the tree below it.
+func listPairs(mappingConfig *MappingConfig, keys []string, values map[string]string, prefix string, recursive bool) []ctKeyPair {
+	prefix = relativeKey(mappingConfig, prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var pairs []ctKeyPair
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(k, prefix)
+		if !recursive && strings.Contains(rel, "/") {
+			continue
+		}
+		pairs = append(pairs, ctKeyPair{Key: rel, Path: k, Value: values[k]})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Path < pairs[j].Path })
+	return pairs
+}
@@ -0,0 +1,59 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplodeTemplate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	skeleton := filepath.Join(tempDir, "app.conf.ctmpl")
+	ioutil.WriteFile(skeleton, []byte(`name = {{key "app/config/name"}}
+port = {{keyOrDefault "port" "8080"}}
+{{- range ls "servers"}}
+server {{.Key}} = {{.Value}}
+{{- end}}
+{{- range tree "limits/"}}
+{{.Path}} = {{.Value}}
+{{- end}}
+`), 0644)
+
+	env := map[string]string{
+		"name":               "app",
+		"servers/b":          "b.internal",
+		"servers/a":          "a.internal",
+		"servers/old/c":      "c.internal",
+		"limits/cpu":         "2",
+		"limits/memory/hard": "1G",
+	}
+
+	mappingConfig := &MappingConfig{Prefix: "app/config/", Format: "template", Skeleton: skeleton}
+	rendered, err := renderExploded(mappingConfig, env)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := `name = app
+port = 8080
+server a = a.internal
+server b = b.internal
+limits/cpu = 2
+limits/memory/hard = 1G
+`
+	if string(rendered) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rendered)
+	}
+
+	// Missing keys without a default fail the render
+	ioutil.WriteFile(skeleton, []byte(`{{key "missing"}}`), 0644)
+	if _, err := renderExploded(mappingConfig, env); err == nil {
+		t.Error("expected a missing key to fail")
+	}
+}
@@ -0,0 +1,52 @@
+package fsconsul
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Pass snapshots on once the prefix has been quiet for the mapping's wait, plus a random
+// delay of up to its splay, so that a burst of changes (e.g. a consul kv import) is written,
+// and onchange run, once rather than for every snapshot in it.  The first snapshot is passed
+// on straight away, and a prefix that never settles is still applied every maxwait.
+func debounce(mappingConfig *MappingConfig, in <-chan kvSnapshot, out chan<- kvSnapshot, quitCh <-chan struct{}) {
+	wait := time.Duration(mappingConfig.Wait)
+	maxWait := time.Duration(mappingConfig.MaxWait)
+	if maxWait <= 0 {
+		maxWait = 4 * wait
+	}
+
+	first := true
+	var latest kvSnapshot
+	var quietCh, deadlineCh <-chan time.Time
+	for {
+		select {
+		case snapshot := <-in:
+			latest = snapshot
+			if !first {
+				// Every change restarts the quiet period, but not the deadline
+				quiet := wait
+				if mappingConfig.Splay > 0 {
+					quiet += time.Duration(rand.Int63n(int64(mappingConfig.Splay)))
+				}
+				quietCh = time.After(quiet)
+				if deadlineCh == nil {
+					deadlineCh = time.After(maxWait)
+				}
+				continue
+			}
+			first = false
+		case <-quietCh:
+		case <-deadlineCh:
+		case <-quitCh:
+			return
+		}
+
+		quietCh, deadlineCh = nil, nil
+		select {
+		case out <- latest:
+		case <-quitCh:
+			return
+		}
+	}
+}
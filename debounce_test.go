@@ -0,0 +1,55 @@
+package fsconsul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	in := make(chan kvSnapshot)
+	out := make(chan kvSnapshot)
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+
+	mappingConfig := &MappingConfig{Wait: Duration(50 * time.Millisecond), MaxWait: Duration(150 * time.Millisecond)}
+	go debounce(mappingConfig, in, out, quitCh)
+
+	// The first snapshot isn't held back
+	in <- kvSnapshot{index: 1}
+	select {
+	case snapshot := <-out:
+		if snapshot.index != 1 {
+			t.Fatalf("expected the first snapshot, got %d", snapshot.index)
+		}
+	case <-time.After(25 * time.Millisecond):
+		t.Fatal("expected the first snapshot straight away")
+	}
+
+	// A burst is passed on once, as its last snapshot
+	for i := uint64(2); i <= 4; i++ {
+		in <- kvSnapshot{index: i}
+	}
+	select {
+	case snapshot := <-out:
+		if snapshot.index != 4 {
+			t.Fatalf("expected the last snapshot of the burst, got %d", snapshot.index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the burst to be passed on once quiet")
+	}
+
+	// A prefix that never settles is still passed on by the deadline
+	start := time.Now()
+	for i := uint64(5); ; i++ {
+		select {
+		case in <- kvSnapshot{index: i}:
+			time.Sleep(20 * time.Millisecond)
+			continue
+		case <-out:
+		}
+		break
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the snapshot by maxwait, took %s", elapsed)
+	}
+}
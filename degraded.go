@@ -0,0 +1,188 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DegradedConfig holds the configuration for degraded mode, entered once Consul or Vault has
+// been unreachable for a while.
+type DegradedConfig struct {
+	// How long Consul or Vault must be unreachable before fsconsul is degraded (0 disables
+	// degraded mode)
+	After Duration
+
+	// Command run on becoming degraded and on recovering, with FSCONSUL_STATE set to degraded
+	// or recovered
+	Command string
+}
+
+// connectivity tracks whether fsconsul can reach one Consul agent, Vault or etcd, shared by
+// the mappings reading from it.  Once failing for longer than the configured threshold,
+// it's degraded: existing files keep being served, errors are only logged at debug level,
+// health checks report it and the degraded command is run, once.  Methods are safe to call
+// on a nil connectivity.
+type connectivity struct {
+	config    DegradedConfig
+	notifiers *notifiers
+	logger    *log.Entry
+
+	// How many of the connectivities notifying the same notifiers are degraded, so that the
+	// degraded event is only resolved once they've all recovered
+	degradedCount *int32
+
+	mu           sync.Mutex
+	failingSince time.Time
+	degraded     bool
+}
+
+// Track connectivity, degrading only with a threshold configured.
+func newConnectivity(config DegradedConfig) *connectivity {
+	return &connectivity{config: config, logger: log.NewEntry(log.StandardLogger()), degradedCount: new(int32)}
+}
+
+// connectivities hands out a connectivity per endpoint, so that a mapping whose agent is
+// reachable doesn't clear the failures of one whose agent is down.
+type connectivities struct {
+	config    DegradedConfig
+	notifiers *notifiers
+	logger    *log.Entry
+
+	mu            sync.Mutex
+	byEndpoint    map[string]*connectivity
+	degradedCount int32
+}
+
+func newConnectivities(config DegradedConfig) *connectivities {
+	return &connectivities{config: config, logger: log.NewEntry(log.StandardLogger()), byEndpoint: map[string]*connectivity{}}
+}
+
+// The connectivity of the endpoint a mapping reads its keys from.
+func (c *connectivities) forMapping(config *WatchConfig, mappingConfig *MappingConfig) *connectivity {
+	endpoint := connectivityEndpoint(config, mappingConfig)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.byEndpoint[endpoint]
+	if !ok {
+		conn = &connectivity{
+			config:        c.config,
+			notifiers:     c.notifiers,
+			logger:        c.logger.WithField("endpoint", endpoint),
+			degradedCount: &c.degradedCount,
+		}
+		c.byEndpoint[endpoint] = conn
+	}
+	return conn
+}
+
+// The endpoint a mapping reads its keys from: Vault's address, etcd's endpoints or the
+// mapping's Consul agent and datacenter.
+func connectivityEndpoint(config *WatchConfig, mappingConfig *MappingConfig) string {
+	switch mappingConfig.Backend {
+	case "vault":
+		return "vault " + config.Vault.Addr
+	case "etcd":
+		return "etcd " + strings.Join(config.Etcd.Endpoints, ",")
+	}
+	consul := config.consulFor(mappingConfig)
+	return "consul " + consul.Addr + " " + consul.DC
+}
+
+// Record a failure to reach Consul or Vault, returning whether it should be logged quietly.
+func (c *connectivity) failed() (quiet bool) {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.failingSince.IsZero() {
+		c.failingSince = now
+	}
+
+	if c.degraded {
+		return true
+	}
+
+	if c.config.After > 0 && now.Sub(c.failingSince) >= time.Duration(c.config.After) {
+		c.degraded = true
+		c.logger.WithFields(log.Fields{
+			"since": c.failingSince,
+		}).Error("Consul or Vault has been unreachable too long, degraded: serving existing files until it's back")
+		c.notify("degraded")
+		atomic.AddInt32(c.degradedCount, 1)
+		c.notifiers.trigger(EventDegraded, "", fmt.Sprintf("Consul or Vault has been unreachable since %s", c.failingSince.Format(time.RFC3339)))
+	}
+
+	return false
+}
+
+// Record a successful request to Consul or Vault, recovering if degraded.
+func (c *connectivity) succeeded() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.degraded {
+		c.logger.WithFields(log.Fields{
+			"since": c.failingSince,
+		}).Info("Consul or Vault is reachable again, recovered")
+		c.notify("recovered")
+		if atomic.AddInt32(c.degradedCount, -1) == 0 {
+			c.notifiers.resolve(EventDegraded, "")
+		}
+	}
+
+	c.failingSince = time.Time{}
+	c.degraded = false
+}
+
+// Whether fsconsul is degraded, and since when requests have been failing (zero if they
+// aren't).
+func (c *connectivity) state() (degraded bool, failingSince time.Time) {
+	if c == nil {
+		return false, time.Time{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.degraded, c.failingSince
+}
+
+// Run the degraded command in the background, so that a slow alert doesn't hold up the
+// watchers.
+func (c *connectivity) notify(state string) {
+	if c.config.Command == "" {
+		return
+	}
+
+	args := strings.Split(c.config.Command, " ")
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"FSCONSUL_STATE="+state,
+		"FSCONSUL_FAILING_SINCE="+c.failingSince.Format(time.RFC3339))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	go func() {
+		if err := cmd.Run(); err != nil {
+			c.logger.WithFields(log.Fields{
+				"error": err,
+				"state": state,
+			}).Error("Failed to run degraded command")
+		}
+	}()
+}
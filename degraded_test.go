@@ -0,0 +1,71 @@
+package fsconsul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectivityDegrades(t *testing.T) {
+	conn := newConnectivity(DegradedConfig{After: Duration(50 * time.Millisecond)})
+
+	if conn.failed() {
+		t.Fatalf("expected the first failure to be logged")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if conn.failed() {
+		t.Fatalf("expected the failure degrading fsconsul to be logged")
+	}
+	if !conn.failed() {
+		t.Fatalf("expected failures once degraded to be quiet")
+	}
+
+	conn.succeeded()
+	if conn.failed() {
+		t.Fatalf("expected failures after recovering to be logged")
+	}
+
+	// Degraded mode is disabled without a threshold
+	disabled := newConnectivity(DegradedConfig{})
+	if disabled.failed() {
+		t.Fatalf("expected failures to be logged with degraded mode disabled")
+	}
+	disabled.succeeded()
+}
+
+func TestConnectivityPerAgent(t *testing.T) {
+	config := &WatchConfig{
+		Consul: ConsulConfig{Addr: "consul-a:8500"},
+		Mappings: []MappingConfig{
+			{Name: "a", Prefix: "a/"},
+			{Name: "b", Prefix: "b/", Consul: &ConsulConfig{Addr: "consul-b:8500"}},
+			{Name: "a2", Prefix: "a2/"},
+		},
+	}
+	conns := newConnectivities(DegradedConfig{After: Duration(50 * time.Millisecond)})
+	a := conns.forMapping(config, &config.Mappings[0])
+	b := conns.forMapping(config, &config.Mappings[1])
+	if a == b {
+		t.Fatalf("expected mappings using different agents to be tracked separately")
+	}
+	if conns.forMapping(config, &config.Mappings[2]) != a {
+		t.Fatalf("expected mappings using the same agent to share its connectivity")
+	}
+
+	// Reaching agent b doesn't clear agent a's failures
+	a.failed()
+	time.Sleep(60 * time.Millisecond)
+	b.succeeded()
+	a.failed()
+	if degraded, failingSince := a.state(); !degraded || failingSince.IsZero() {
+		t.Fatalf("expected agent a to be degraded, got %v since %v", degraded, failingSince)
+	}
+	if degraded, failingSince := b.state(); degraded || !failingSince.IsZero() {
+		t.Fatalf("expected agent b to be reachable, got %v since %v", degraded, failingSince)
+	}
+
+	a.succeeded()
+	if degraded, _ := a.state(); degraded {
+		t.Fatalf("expected agent a to recover")
+	}
+}
@@ -0,0 +1,162 @@
+package fsconsul
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Files smaller than this are always rewritten whole, as a delta saves little.
+var deltaWriteMinSize = 1 << 20
+
+// Content-defined chunks average 16KiB, between 4KiB and 64KiB.
+const (
+	chunkMinSize = 4 << 10
+	chunkMaxSize = 64 << 10
+	chunkMask    = 1<<14 - 1
+)
+
+// A random value for each byte, for the rolling gear hash that places chunk boundaries.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64, so that boundaries are the same from run to run
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunk is a piece of a file, identified by the hash of its content.
+type chunk struct {
+	offset int64
+	length int
+	sum    [sha256.Size]byte
+}
+
+// Split content into chunks whose boundaries depend on the content around them, so that a
+// change only moves the boundaries near it.
+func chunkContent(content []byte) []chunk {
+	var chunks []chunk
+	start := 0
+	var hash uint64
+	for i, b := range content {
+		hash = hash<<1 + gearTable[b]
+		size := i + 1 - start
+		if size < chunkMinSize {
+			continue
+		}
+		if hash&chunkMask == 0 || size >= chunkMaxSize {
+			chunks = append(chunks, chunk{int64(start), size, sha256.Sum256(content[start : i+1])})
+			start, hash = i+1, 0
+		}
+	}
+	if start < len(content) {
+		chunks = append(chunks, chunk{int64(start), len(content) - start, sha256.Sum256(content[start:])})
+	}
+	return chunks
+}
+
+// chunkIndex is the chunks of a file as fsconsul last wrote it, valid while the file keeps
+// the size and mtime it had then.
+type chunkIndex struct {
+	size    int64
+	modTime time.Time
+	chunks  []chunk
+}
+
+// The chunks of the files written with delta writes, by file, so that a file needn't be
+// read to find what's changed.
+var (
+	chunkIndexesLock sync.Mutex
+	chunkIndexes     = make(map[string]chunkIndex)
+)
+
+// The chunks of a file, from the index if the file hasn't changed since it was written, or
+// else by reading it.
+func fileChunks(keyfile string, info os.FileInfo) ([]chunk, error) {
+	chunkIndexesLock.Lock()
+	index, ok := chunkIndexes[keyfile]
+	chunkIndexesLock.Unlock()
+	if ok && index.size == info.Size() && index.modTime.Equal(info.ModTime()) {
+		return index.chunks, nil
+	}
+
+	existing, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	return chunkContent(existing), nil
+}
+
+// Write content over a keyfile, writing only the chunks that differ from those already at
+// the same offsets, to spare the disk rewriting large files that change a little at a time.
+// Unlike a whole write, readers may see a mix of old and new chunks.  Returns the number of
+// bytes written.
+func writeDelta(keyfile string, content []byte, attrs fileAttrs) (int64, error) {
+	info, err := os.Stat(keyfile)
+	if err != nil || !info.Mode().IsRegular() {
+		return int64(len(content)), writeAndSync(keyfile, content, attrs)
+	}
+	existing, err := fileChunks(keyfile, info)
+	if err != nil {
+		return 0, err
+	}
+	at := make(map[int64]chunk, len(existing))
+	for _, c := range existing {
+		at[c.offset] = c
+	}
+
+	f, err := os.OpenFile(keyfile, os.O_WRONLY, attrs.mode)
+	if err != nil {
+		return 0, err
+	}
+
+	chunks := chunkContent(content)
+	var written int64
+	err = attrs.apply(f)
+	for _, c := range chunks {
+		if err != nil {
+			break
+		}
+		if old, ok := at[c.offset]; ok && old.length == c.length && old.sum == c.sum {
+			continue
+		}
+		_, err = f.WriteAt(content[c.offset:c.offset+int64(c.length)], c.offset)
+		written += int64(c.length)
+	}
+	if err == nil {
+		err = f.Truncate(int64(len(content)))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	// Whatever went wrong, the file can't be trusted to match an index any more
+	chunkIndexesLock.Lock()
+	defer chunkIndexesLock.Unlock()
+	delete(chunkIndexes, keyfile)
+	if err != nil {
+		return written, err
+	}
+	if info, err := os.Stat(keyfile); err == nil {
+		chunkIndexes[keyfile] = chunkIndex{info.Size(), info.ModTime(), chunks}
+	}
+
+	log.WithFields(log.Fields{
+		"file":    keyfile,
+		"size":    len(content),
+		"written": written,
+	}).Debug("Wrote changed chunks")
+	return written, nil
+}
@@ -0,0 +1,45 @@
+package fsconsul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDelta(t *testing.T) {
+	content := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	var total int
+	for _, c := range chunkContent(content) {
+		if int64(total) != c.offset || c.length > chunkMaxSize {
+			t.Fatalf("chunk at %d of %d bytes doesn't follow the previous one", c.offset, c.length)
+		}
+		total += c.length
+	}
+	if total != len(content) {
+		t.Fatalf("chunks cover %d of %d bytes", total, len(content))
+	}
+
+	keyfile := filepath.Join(t.TempDir(), "large.bin")
+	attrs := fileAttrs{mode: 0640, uid: -1, gid: -1}
+	if written, err := writeDelta(keyfile, content, attrs); err != nil || written != int64(len(content)) {
+		t.Fatalf("expected a new file to be written whole, wrote %d: %v", written, err)
+	}
+
+	// Change a few bytes in the middle and drop the end
+	changed := append([]byte(nil), content[:len(content)-1000]...)
+	copy(changed[1<<20:], "changed")
+	written, err := writeDelta(keyfile, changed, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written == 0 || written > 2*chunkMaxSize {
+		t.Errorf("expected only the changed chunks to be written, wrote %d bytes", written)
+	}
+	if onDisk, _ := ioutil.ReadFile(keyfile); !bytes.Equal(onDisk, changed) {
+		t.Error("file doesn't hold the new content")
+	}
+}
@@ -0,0 +1,145 @@
+package fsconsul
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mappingRun holds the runtime state of a single mapping's watcher.
+type mappingRun struct {
+	config  *MappingConfig
+	summary *mappingSummary
+	conn    *connectivity
+	state   *stateFile
+	child   *supervisor
+	notify  *notifiers
+
+	// Logs what the mapping does, at its profile's level and naming its profile
+	logger *log.Entry
+
+	// The mappings this one waits for before its first render
+	deps []*mappingRun
+
+	rendered     chan struct{} // closed once the mapping has rendered a snapshot
+	renderedOnce sync.Once
+	done         chan struct{} // closed when the mapping's watcher exits
+	stop         chan struct{} // closed to stop the mapping's watcher
+
+	// When the mapping's files were last in sync with Consul, and why a strict mapping's
+	// last snapshot failed to apply or the required keys a refused one was missing, until
+	// one applies cleanly
+	syncLock  sync.Mutex
+	lastSync  time.Time
+	lastError error
+	missing   []string
+
+	// How many empty values the mapping's snapshots have had
+	emptyValues int
+
+	// Snapshots waiting to be applied, and how many were coalesced into later ones or
+	// dropped, as the mapping's backpressure policy says
+	queued, coalesced, dropped int
+}
+
+func newMappingRun(mappingConfig *MappingConfig, summary *mappingSummary) *mappingRun {
+	return &mappingRun{
+		config:   mappingConfig,
+		summary:  summary,
+		logger:   log.WithField("mapping", mappingConfig.Name),
+		rendered: make(chan struct{}),
+		done:     make(chan struct{}),
+		stop:     make(chan struct{}),
+		lastSync: time.Now(),
+	}
+}
+
+func (run *mappingRun) markRendered() {
+	run.renderedOnce.Do(func() { close(run.rendered) })
+}
+
+// Block until every dependency has rendered at least once.  Fails if a dependency's
+// watcher exits without ever rendering.
+func (run *mappingRun) waitForDeps() error {
+	for _, dep := range run.deps {
+		select {
+		case <-dep.rendered:
+		case <-run.stop:
+			return errStopped
+		case <-dep.done:
+			select {
+			case <-dep.rendered:
+			default:
+				return fmt.Errorf("dependency %s exited without rendering", dep.config.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Wire up each mapping's dependencies by name, which checkDependencies has verified.
+func linkDependencies(runs []*mappingRun) {
+	byName := make(map[string]*mappingRun, len(runs))
+	for _, run := range runs {
+		byName[run.config.Name] = run
+	}
+
+	for _, run := range runs {
+		run.deps = nil
+		for _, name := range run.config.DependsOn {
+			run.deps = append(run.deps, byName[name])
+		}
+	}
+}
+
+// Check that mapping dependencies refer to known mappings and contain no cycles.
+func checkDependencies(mappings []MappingConfig) error {
+	dependsOn := make(map[string][]string, len(mappings))
+	for _, mappingConfig := range mappings {
+		dependsOn[mappingConfig.Name] = mappingConfig.DependsOn
+	}
+
+	for name, deps := range dependsOn {
+		for _, dep := range deps {
+			if _, ok := dependsOn[dep]; !ok {
+				return fmt.Errorf("mapping %s depends on unknown mapping %s", name, dep)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(mappings))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("mapping dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, dep := range dependsOn[name] {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for _, mappingConfig := range mappings {
+		if err := visit(mappingConfig.Name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
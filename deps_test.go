@@ -0,0 +1,68 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	mappings := []MappingConfig{
+		{Name: "certs"},
+		{Name: "app", DependsOn: []string{"certs"}},
+		{Name: "proxy", DependsOn: []string{"app", "certs"}},
+	}
+	if err := checkDependencies(mappings); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	mappings[0].DependsOn = []string{"proxy"}
+	if err := checkDependencies(mappings); err == nil {
+		t.Fatal("Expected a dependency cycle to be detected")
+	}
+
+	mappings[0].DependsOn = []string{"missing"}
+	if err := checkDependencies(mappings); err == nil {
+		t.Fatal("Expected an unknown dependency to be detected")
+	}
+}
+
+func TestDependencyFailedRender(t *testing.T) {
+	tempDir := t.TempDir()
+	certs := filepath.Join(tempDir, "certs")
+	if err := os.MkdirAll(certs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A file where a key needs a directory fails that key's write
+	if err := ioutil.WriteFile(filepath.Join(certs, "blocked"), []byte("not a directory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := filepath.Join(tempDir, "kv.json")
+	err := ioutil.WriteFile(fixture, []byte(`[
+		{"key": "certs/blocked/server.pem", "value": "cGVt"},
+		{"key": "app/app.conf", "value": "YXBw"}
+	]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := filepath.Join(tempDir, "app")
+	config := &WatchConfig{
+		RunOnce:    true,
+		SourceFile: fixture,
+		Mappings: []MappingConfig{
+			{Name: "certs", Prefix: "certs/", Path: certs},
+			{Name: "app", Prefix: "app/", Path: app, DependsOn: []string{"certs"}},
+		},
+	}
+	if code := watchAndExec(config); code == 0 {
+		t.Fatal("expected app to fail when its dependency never rendered")
+	}
+
+	// The dependent waits for a render without errors, which never comes
+	if _, err := os.Stat(filepath.Join(app, "app.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expected app not to render after its dependency failed, got %v", err)
+	}
+}
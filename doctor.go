@@ -0,0 +1,276 @@
+package fsconsul
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Paths with less free space than this fail the disk space check.
+const minFreeSpace = 64 * 1024 * 1024
+
+// Returned where free space can't be checked, in which case the check is left out.
+var errNoDiskFree = errors.New("free space can't be checked on this platform")
+
+// doctorCheck is the outcome of a single diagnostic check.
+type doctorCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+func doctorMain(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul doctor", doctorHelpText, &opts)
+	flags.Parse(args)
+	if opts.configFile == "" && flags.NArg() < 2 {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, flags.Args())
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	checks := runDoctor(config)
+	return printDoctorReport(os.Stdout, checks)
+}
+
+// Run every diagnostic check for the configuration.
+func runDoctor(config *WatchConfig) []doctorCheck {
+	var checks []doctorCheck
+
+	for _, certFile := range []string{config.Consul.CAFile, config.Consul.CertFile} {
+		if certFile != "" {
+			checks = append(checks, checkCertificate(certFile))
+		}
+	}
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		checks = append(checks, doctorCheck{"consul client", false, err.Error()})
+	} else {
+		checks = append(checks, checkConsul(client))
+	}
+
+	for i := range config.Mappings {
+		mappingConfig := &config.Mappings[i]
+
+		if mappingConfig.Consul != nil {
+			mappingClient, err := config.consulClientFor(client, mappingConfig)
+			if err != nil {
+				checks = append(checks, doctorCheck{"consul client for " + mappingConfig.Name, false, err.Error()})
+			} else {
+				checks = append(checks, checkPrefix(mappingClient, config.consulFor(mappingConfig).Token, mappingConfig))
+			}
+		} else if client != nil {
+			checks = append(checks, checkPrefix(client, config.Consul.Token, mappingConfig))
+		}
+		for _, keystore := range mappingConfig.keystores() {
+			checks = append(checks, checkKeystore(keystore))
+		}
+		checks = append(checks, checkPath(mappingConfig)...)
+		if len(mappingConfig.OnChange) > 0 {
+			checks = append(checks, checkOnChange(mappingConfig))
+		}
+	}
+
+	return checks
+}
+
+// Print a PASS/FAIL line per check and return the exit code for the report.
+func printDoctorReport(out io.Writer, checks []doctorCheck) int {
+	code := 0
+	for _, check := range checks {
+		status := "PASS"
+		if !check.Passed {
+			status = "FAIL"
+			code = 1
+		}
+		fmt.Fprintf(out, "%s  %-40s %s\n", status, check.Name, check.Detail)
+	}
+
+	return code
+}
+
+func checkConsul(client *consulapi.Client) doctorCheck {
+	leader, err := client.Status().Leader()
+	if err != nil {
+		return doctorCheck{"consul connectivity", false, err.Error()}
+	}
+	if leader == "" {
+		return doctorCheck{"consul connectivity", false, "cluster has no leader"}
+	}
+
+	return doctorCheck{"consul connectivity", true, "leader is " + leader}
+}
+
+func checkPrefix(client *consulapi.Client, token string, mappingConfig *MappingConfig) doctorCheck {
+	name := fmt.Sprintf("read access to %s", mappingConfig.Prefix)
+
+	keys, _, err := client.KV().Keys(mappingConfig.Prefix, "", &consulapi.QueryOptions{Token: token})
+	if err != nil {
+		return doctorCheck{name, false, err.Error()}
+	}
+
+	// ACLs filter out keys the token can't read rather than failing the request.
+	if len(keys) == 0 {
+		return doctorCheck{name, false, "no readable keys under prefix"}
+	}
+
+	return doctorCheck{name, true, fmt.Sprintf("%d keys", len(keys))}
+}
+
+func checkCertificate(certFile string) doctorCheck {
+	name := fmt.Sprintf("certificate %s", certFile)
+
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return doctorCheck{name, false, err.Error()}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return doctorCheck{name, false, "no PEM data found"}
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return doctorCheck{name, false, err.Error()}
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return doctorCheck{name, false, fmt.Sprintf("not valid before %s", cert.NotBefore)}
+	}
+	if now.After(cert.NotAfter) {
+		return doctorCheck{name, false, fmt.Sprintf("expired %s", cert.NotAfter)}
+	}
+
+	return doctorCheck{name, true, fmt.Sprintf("expires %s", cert.NotAfter)}
+}
+
+func checkKeystore(keystore string) doctorCheck {
+	name := fmt.Sprintf("keystore %s", keystore)
+
+	if isKeychain(keystore) {
+		// Keys are only fetched once a value needs them
+		if runtime.GOOS != "darwin" {
+			return doctorCheck{name, false, "keychain keystores are only available on macOS"}
+		}
+		if _, err := exec.LookPath("security"); err != nil {
+			return doctorCheck{name, false, err.Error()}
+		}
+		return doctorCheck{name, true, "keys are read from the keychain when needed"}
+	}
+
+	keys, err := ioutil.ReadDir(keystore)
+	if err != nil {
+		return doctorCheck{name, false, err.Error()}
+	}
+
+	for _, key := range keys {
+		if key.IsDir() {
+			continue
+		}
+
+		f, err := os.Open(keystore + string(os.PathSeparator) + key.Name())
+		if err != nil {
+			return doctorCheck{name, false, err.Error()}
+		}
+		f.Close()
+	}
+
+	return doctorCheck{name, true, fmt.Sprintf("%d entries readable", len(keys))}
+}
+
+func checkPath(mappingConfig *MappingConfig) []doctorCheck {
+	name := fmt.Sprintf("write access to %s", mappingConfig.Path)
+
+	// The path is created when it's first written, so its nearest existing parent is checked
+	// instead.  Nothing is created.
+	dir, err := existingParent(mappingConfig.Path)
+	if err == nil {
+		err = canWrite(dir)
+	}
+	if err != nil {
+		return []doctorCheck{{name, false, err.Error()}}
+	}
+
+	var detail string
+	if dir != filepath.Clean(mappingConfig.Path) {
+		detail = fmt.Sprintf("doesn't exist yet, %s is writable", dir)
+	}
+	checks := []doctorCheck{{name, true, detail}}
+
+	name = fmt.Sprintf("disk space at %s", mappingConfig.Path)
+	free, err := diskFree(dir)
+	if err == errNoDiskFree {
+		return checks
+	} else if err != nil {
+		return append(checks, doctorCheck{name, false, err.Error()})
+	}
+
+	detail = fmt.Sprintf("%d MiB free", free/(1024*1024))
+	return append(checks, doctorCheck{name, free >= minFreeSpace, detail})
+}
+
+// Find the path, or its nearest parent that exists, which has to be a directory.
+func existingParent(path string) (string, error) {
+	dir := filepath.Clean(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s isn't a directory", dir)
+			}
+			return dir, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", err
+		}
+		dir = parent
+	}
+}
+
+func checkOnChange(mappingConfig *MappingConfig) doctorCheck {
+	name := fmt.Sprintf("onchange %s", mappingConfig.OnChange[0])
+
+	resolved, err := exec.LookPath(mappingConfig.OnChange[0])
+	if err != nil {
+		return doctorCheck{name, false, err.Error()}
+	}
+
+	return doctorCheck{name, true, resolved}
+}
+
+const doctorHelpText = `
+Usage: %s doctor [options] prefix path onchange
+
+  Check that the environment is fit for the given configuration: Consul
+  connectivity, read access to each prefix, validity of TLS certificates,
+  readability of keystores, writability of and free space at each path,
+  and resolution of each onchange command.  Prints a PASS/FAIL report and
+  exits non-zero if any check fails.
+
+Options:
+`
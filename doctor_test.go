@@ -0,0 +1,21 @@
+package fsconsul
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPath(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "app", "config")
+
+	checks := checkPath(&MappingConfig{Path: missing})
+	if len(checks) != 2 || !checks[0].Passed {
+		t.Fatalf("expected a path under a writable directory to pass, got %+v", checks)
+	}
+
+	// Checking the path doesn't create it
+	if _, err := os.Stat(filepath.Dir(missing)); !os.IsNotExist(err) {
+		t.Fatalf("expected doctor to leave the path uncreated, got %v", err)
+	}
+}
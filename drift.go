@@ -0,0 +1,268 @@
+package fsconsul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults for comparing a mapping's prefix with another datacenter.
+const (
+	defaultDriftInterval  = 30 * time.Second
+	defaultDriftTolerance = time.Minute
+)
+
+// DriftConfig holds the configuration for comparing a mapping's prefix with the same prefix
+// in another datacenter, alerting when they've differed for longer than replication should
+// take.
+type DriftConfig struct {
+	// Datacenter to compare with (empty disables the comparison)
+	Datacenter string
+
+	// How often to compare (30s by default), and how long the prefixes may differ before
+	// alerting (1m by default)
+	Interval  Duration
+	Tolerance Duration
+
+	// Command run on drifting and on converging again, with FSCONSUL_MAPPING,
+	// FSCONSUL_DATACENTER and FSCONSUL_DRIFT (drifted or converged) set
+	Command string
+
+	// URL POSTed a JSON object describing the drift on drifting and on converging again
+	URL string
+
+	// File the number of differing keys is written to after every comparison, in the
+	// Prometheus text format, for node_exporter's textfile collector
+	MetricsFile string
+}
+
+// kvDrift is how a prefix differs between the local datacenter and another.
+type kvDrift struct {
+	Missing   []string `json:"missing"`   // in the local datacenter only
+	Extra     []string `json:"extra"`     // in the other datacenter only
+	Differing []string `json:"differing"` // in both, with different values
+}
+
+func (d *kvDrift) keys() int {
+	return len(d.Missing) + len(d.Extra) + len(d.Differing)
+}
+
+// Compare the keys of a prefix in the local datacenter with those in another.
+func compareKV(local, remote consulapi.KVPairs) *kvDrift {
+	remoteValues := make(map[string][]byte, len(remote))
+	for _, pair := range remote {
+		remoteValues[pair.Key] = pair.Value
+	}
+
+	d := &kvDrift{}
+	for _, pair := range local {
+		value, ok := remoteValues[pair.Key]
+		if !ok {
+			d.Missing = append(d.Missing, pair.Key)
+		} else if !bytes.Equal(value, pair.Value) {
+			d.Differing = append(d.Differing, pair.Key)
+		}
+		delete(remoteValues, pair.Key)
+	}
+	for k := range remoteValues {
+		d.Extra = append(d.Extra, k)
+	}
+
+	sort.Strings(d.Missing)
+	sort.Strings(d.Extra)
+	sort.Strings(d.Differing)
+	return d
+}
+
+// driftTracker decides when differences have lasted long enough to alert on.
+type driftTracker struct {
+	tolerance time.Duration
+
+	differingSince time.Time
+	drifted        bool
+}
+
+// Record a comparison, returning drifted or converged when that changes, or nothing.
+func (t *driftTracker) observe(now time.Time, d *kvDrift) string {
+	if d.keys() == 0 {
+		t.differingSince = time.Time{}
+		if t.drifted {
+			t.drifted = false
+			return "converged"
+		}
+		return ""
+	}
+
+	if t.differingSince.IsZero() {
+		t.differingSince = now
+	}
+	if !t.drifted && now.Sub(t.differingSince) >= t.tolerance {
+		t.drifted = true
+		return "drifted"
+	}
+	return ""
+}
+
+// Compare the mapping's prefix with another datacenter until the mapping exits.
+func watchDrift(run *mappingRun, client *consulapi.Client, token string) {
+	drift := run.config.Drift
+
+	interval := time.Duration(drift.Interval)
+	if interval <= 0 {
+		interval = defaultDriftInterval
+	}
+	tracker := &driftTracker{tolerance: time.Duration(drift.Tolerance)}
+	if tracker.tolerance <= 0 {
+		tracker.tolerance = defaultDriftTolerance
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logger := run.logger.WithFields(log.Fields{
+		"datacenter": drift.Datacenter,
+	})
+
+	for {
+		select {
+		case <-run.done:
+			return
+		case <-ticker.C:
+		}
+
+		local, _, err := client.KV().List(run.config.Prefix, &consulapi.QueryOptions{Token: token})
+		if err == nil {
+			var remote consulapi.KVPairs
+			remote, _, err = client.KV().List(run.config.Prefix, &consulapi.QueryOptions{Token: token, Datacenter: drift.Datacenter})
+			if err == nil {
+				d := compareKV(local, remote)
+				writeDriftMetrics(run.config, d, logger)
+
+				switch tracker.observe(time.Now(), d) {
+				case "drifted":
+					logger.WithFields(log.Fields{
+						"since":     tracker.differingSince,
+						"missing":   len(d.Missing),
+						"extra":     len(d.Extra),
+						"differing": len(d.Differing),
+					}).Error("Prefix differs from the other datacenter for longer than the tolerance")
+					alertDrift(run.config, "drifted", d, logger)
+				case "converged":
+					logger.Info("Prefix matches the other datacenter again")
+					alertDrift(run.config, "converged", d, logger)
+				}
+				continue
+			}
+		}
+
+		logger.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to compare prefix with the other datacenter")
+	}
+}
+
+func writeDriftMetrics(mappingConfig *MappingConfig, d *kvDrift, logger *log.Entry) {
+	if mappingConfig.Drift.MetricsFile == "" {
+		return
+	}
+
+	labels := fmt.Sprintf("mapping=%s,datacenter=%s",
+		strconv.Quote(mappingConfig.Name), strconv.Quote(mappingConfig.Drift.Datacenter))
+	metrics := "# HELP fsconsul_drift_keys Keys differing between the local and other datacenter.\n" +
+		"# TYPE fsconsul_drift_keys gauge\n" +
+		fmt.Sprintf("fsconsul_drift_keys{%s,kind=\"missing\"} %d\n", labels, len(d.Missing)) +
+		fmt.Sprintf("fsconsul_drift_keys{%s,kind=\"extra\"} %d\n", labels, len(d.Extra)) +
+		fmt.Sprintf("fsconsul_drift_keys{%s,kind=\"differing\"} %d\n", labels, len(d.Differing))
+
+	// Written atomically, so the collector never reads a partial file
+	tmp := mappingConfig.Drift.MetricsFile + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(metrics), 0644)
+	if err == nil {
+		err = os.Rename(tmp, mappingConfig.Drift.MetricsFile)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to write drift metrics")
+	}
+}
+
+// Run the drift command and call the drift webhook, in the background so that a slow alert
+// doesn't hold up the comparisons.
+func alertDrift(mappingConfig *MappingConfig, state string, d *kvDrift, logger *log.Entry) {
+	drift := mappingConfig.Drift
+
+	if drift.Command != "" {
+		args := strings.Split(drift.Command, " ")
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = append(os.Environ(),
+			"FSCONSUL_MAPPING="+mappingConfig.Name,
+			"FSCONSUL_DATACENTER="+drift.Datacenter,
+			"FSCONSUL_DRIFT="+state)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		go func() {
+			if err := cmd.Run(); err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"state": state,
+				}).Error("Failed to run drift command")
+			}
+		}()
+	}
+
+	if drift.URL != "" {
+		body, err := json.Marshal(map[string]interface{}{
+			"mapping":    mappingConfig.Name,
+			"prefix":     mappingConfig.Prefix,
+			"datacenter": drift.Datacenter,
+			"state":      state,
+			"drift":      d,
+		})
+		if err != nil {
+			return
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), defaultConfirmTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, "POST", drift.URL, bytes.NewReader(body))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/json")
+				var resp *http.Response
+				if resp, err = http.DefaultClient.Do(req); err == nil {
+					resp.Body.Close()
+					if resp.StatusCode < 200 || resp.StatusCode > 299 {
+						err = fmt.Errorf("webhook responded with %s", resp.Status)
+					}
+				}
+			}
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"state": state,
+				}).Error("Failed to call drift webhook")
+			}
+		}()
+	}
+}
+
+// Determine whether a watching mapping reads its keys from Consul, rather than from Vault,
+// a source file or a replay, and keeps doing so.
+func watchesConsul(config *WatchConfig, mappingConfig *MappingConfig) bool {
+	return !config.RunOnce && config.Replay == "" && config.SourceFile == "" && mappingConfig.Backend != "vault"
+}
@@ -0,0 +1,48 @@
+package fsconsul
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestDrift(t *testing.T) {
+	local := consulapi.KVPairs{
+		{Key: "app/a", Value: []byte("1")},
+		{Key: "app/b", Value: []byte("2")},
+		{Key: "app/c", Value: []byte("3")},
+	}
+	remote := consulapi.KVPairs{
+		{Key: "app/a", Value: []byte("1")},
+		{Key: "app/b", Value: []byte("old")},
+		{Key: "app/d", Value: []byte("4")},
+	}
+
+	d := compareKV(local, remote)
+	expected := &kvDrift{Missing: []string{"app/c"}, Extra: []string{"app/d"}, Differing: []string{"app/b"}}
+	if !reflect.DeepEqual(d, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, d)
+	}
+
+	// Differences only alert once they've lasted the tolerance, and converging alerts again
+	tracker := &driftTracker{tolerance: time.Minute}
+	start := time.Now()
+	for _, step := range []struct {
+		after time.Duration
+		drift *kvDrift
+		want  string
+	}{
+		{0, d, ""},
+		{30 * time.Second, d, ""},
+		{time.Minute, d, "drifted"},
+		{2 * time.Minute, d, ""},
+		{3 * time.Minute, compareKV(local, local), "converged"},
+		{4 * time.Minute, d, ""},
+	} {
+		if got := tracker.observe(start.Add(step.after), step.drift); got != step.want {
+			t.Errorf("after %s: expected %q, got %q", step.after, step.want, got)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Files with more lines than this between them aren't diffed line by line.
+const maxDiffLines = 2000
+
+// Watch the mappings as usual, but log the files each snapshot would create, update and
+// delete, printing their diffs to stdout, rather than touching the disk or running onchange
+// and exec.  Paths aren't locked, so a dry run can watch alongside the instance it's trying
+// a configuration for.
+func dryRun(config *WatchConfig) int {
+	stopCh, stopStopping := stopSignal(config, nil)
+	defer stopStopping()
+	// Keys fetched from the Keychain to decrypt values aren't left on disk
+	defer removeKeychains()
+
+	quitCh := make(chan struct{})
+	returnCodes := make(chan int)
+	for i := range config.Mappings {
+		go func(mappingConfig *MappingConfig) {
+			returnCodes <- dryRunMapping(config, mappingConfig, os.Stdout, quitCh)
+		}(&config.Mappings[i])
+	}
+
+	failures := false
+	for pending := len(config.Mappings); pending > 0; {
+		select {
+		case code := <-returnCodes:
+			pending--
+			if code != 0 {
+				failures = true
+			}
+		case <-stopCh:
+			close(quitCh)
+			stopCh = nil
+		}
+	}
+
+	if failures {
+		return 1
+	}
+	return 0
+}
+
+// Render each of a mapping's snapshots and report what applying it would change, until
+// quitCh is closed, or after the first snapshot when running once.
+func dryRunMapping(config *WatchConfig, mappingConfig *MappingConfig, diffs io.Writer, quitCh <-chan struct{}) int {
+	logger := config.mappingLogger().WithFields(log.Fields{
+		"mapping": mappingConfig.Name,
+		"dryRun":  true,
+	})
+
+	// Only files are dry run
+	if mappingConfig.Registry != "" || mappingConfig.Socket != "" || mappingConfig.envOnly() {
+		logger.Warn("Registry, socket and environment mappings aren't dry run")
+		return 0
+	}
+
+	errCh := make(chan error, 1)
+	pairCh := make(chan kvSnapshot)
+	sourceQuit := make(chan struct{})
+	defer close(sourceQuit)
+
+	if err := startSource(config, mappingConfig, nil, logger, pairCh, errCh, sourceQuit); err != nil {
+		logger.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to watch mapping")
+		return 1
+	}
+
+	// What the last snapshot rendered; files it rendered that the next doesn't would be
+	// deleted
+	var previous map[string][]byte
+	var previousEnv map[string]string
+	for {
+		var snapshot kvSnapshot
+		select {
+		case snapshot = <-pairCh:
+		case err := <-errCh:
+			logger.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to watch mapping")
+			return 1
+		case <-quitCh:
+			return 0
+		}
+
+		files, err := renderMapping(mappingConfig, snapshot.pairs)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"error": err,
+				"index": snapshot.index,
+			}).Error("Failed to render snapshot")
+			if config.RunOnce {
+				return 1
+			}
+			continue
+		}
+
+		env, _ := snapshotEnv(mappingConfig, snapshot.pairs)
+		emptyKeys := applyEmptyValues(mappingConfig, previousEnv, env)
+
+		var deleted []string
+		if mappingConfig.managesDeletes() {
+			for keyfile := range previous {
+				if _, ok := files[keyfile]; !ok {
+					deleted = append(deleted, keyfile)
+				}
+			}
+			if mappingConfig.Prune {
+				var removed []string
+				for k := range previousEnv {
+					if _, ok := env[k]; !ok {
+						removed = append(removed, k)
+					}
+				}
+				pruned, err := prunedFiles(config, mappingConfig, env, removed, emptyKeys)
+				if err != nil {
+					logger.WithFields(log.Fields{
+						"error": err,
+					}).Warn("Failed to list files to prune")
+				}
+				deleted = append(deleted, pruned...)
+			}
+		}
+		reportDryRun(logger, mappingConfig, files, deleted, snapshot.index, diffs)
+		previous, previousEnv = files, env
+
+		if config.RunOnce {
+			return 0
+		}
+	}
+}
+
+// Log what writing the rendered files and deleting the others would change, and print the
+// diffs.  Diffs of mappings that decrypt values are withheld, to keep secrets out of them.
+func reportDryRun(logger *log.Entry, mappingConfig *MappingConfig, files map[string][]byte, deleted []string, index uint64, diffs io.Writer) {
+	keyfiles := make([]string, 0, len(files))
+	for keyfile := range files {
+		keyfiles = append(keyfiles, keyfile)
+	}
+	sort.Strings(keyfiles)
+	sort.Strings(deleted)
+	secret := mappingConfig.Keystore != "" || mappingConfig.Transit.Key != ""
+
+	changed := 0
+	for _, keyfile := range keyfiles {
+		rendered := files[keyfile]
+		existing, err := ioutil.ReadFile(keyfile)
+		switch {
+		case os.IsNotExist(err):
+			logger.WithFields(log.Fields{
+				"file":  keyfile,
+				"bytes": len(rendered),
+			}).Info("Would create file")
+		case err != nil:
+			logger.WithFields(log.Fields{
+				"file":  keyfile,
+				"error": err,
+			}).Warn("Failed to read file, it would be rewritten")
+		case !bytes.Equal(existing, rendered):
+			logger.WithFields(log.Fields{
+				"file":  keyfile,
+				"bytes": len(rendered),
+			}).Info("Would update file")
+		case !upToDate(mappingConfig, keyfile, rendered):
+			logger.WithFields(log.Fields{
+				"file": keyfile,
+			}).Info("Would set file's mode or owner")
+			changed++
+			continue
+		default:
+			continue
+		}
+		changed++
+
+		if secret {
+			fmt.Fprintf(diffs, "--- %s\n+++ %s\n(diff withheld, the mapping decrypts values)\n", keyfile, keyfile)
+		} else {
+			io.WriteString(diffs, unifiedDiff(keyfile, existing, rendered))
+		}
+	}
+
+	for _, keyfile := range deleted {
+		logger.WithFields(log.Fields{
+			"file": keyfile,
+		}).Info("Would delete file")
+		changed++
+		if existing, err := ioutil.ReadFile(keyfile); err == nil && !secret {
+			io.WriteString(diffs, unifiedDiff(keyfile, existing, nil))
+		}
+	}
+
+	logger.WithFields(log.Fields{
+		"index":   index,
+		"changes": changed,
+	}).Info("Dry run of snapshot complete, nothing was changed")
+}
+
+// Diff two versions of a file in unified format, with three lines of context.
+func unifiedDiff(name string, old, new []byte) string {
+	a, b := diffLines(old), diffLines(new)
+	header := fmt.Sprintf("--- %s\n+++ %s\n", name, name)
+	if len(a)+len(b) > maxDiffLines {
+		return header + fmt.Sprintf("(%d lines replaced by %d, too long to diff)\n", len(a), len(b))
+	}
+
+	// The longest common subsequence of lines, from each pair of suffixes
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// The edit script, as lines prefixed with ' ', - or +, with their line numbers
+	type edit struct {
+		op   byte
+		line string
+		i, j int
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	// Group changes less than seven lines apart into hunks
+	const context = 3
+	var out strings.Builder
+	out.WriteString(header)
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+		first := start - context
+		if first < 0 {
+			first = 0
+		}
+		last := start
+		for k := start; k < len(edits) && k <= last+2*context; k++ {
+			if edits[k].op != ' ' {
+				last = k
+			}
+		}
+		end := last + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		oldLines, newLines := 0, 0
+		for _, e := range edits[first:end] {
+			if e.op != '+' {
+				oldLines++
+			}
+			if e.op != '-' {
+				newLines++
+			}
+		}
+		oldStart, newStart := edits[first].i+1, edits[first].j+1
+		if oldLines == 0 {
+			oldStart--
+		}
+		if newLines == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldLines, newStart, newLines)
+		for _, e := range edits[first:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+		start = end
+	}
+	return out.String()
+}
+
+func diffLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
@@ -0,0 +1,105 @@
+package fsconsul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	old := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	new := []byte("a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n")
+	want := `--- f
++++ f
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if diff := unifiedDiff("f", old, new); diff != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, diff)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir() + string(os.PathSeparator)
+	if err := ioutil.WriteFile(filepath.Join(dir, "db.conf"), []byte("pool=10\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mappingConfig := &MappingConfig{Prefix: "app/", Path: dir}
+	files, err := renderMapping(mappingConfig, consulapi.KVPairs{
+		{Key: "app/db.conf", Value: []byte("pool=20\n")},
+		{Key: "app/new.conf", Value: []byte("new\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var diffs bytes.Buffer
+	reportDryRun(log.WithField("test", true), mappingConfig, files, nil, 1, &diffs)
+	if !strings.Contains(diffs.String(), "-pool=10\n+pool=20\n") || !strings.Contains(diffs.String(), "+new\n") {
+		t.Errorf("unexpected diffs:\n%s", diffs.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.conf")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written")
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "db.conf")); string(content) != "pool=10\n" {
+		t.Error("expected the file to be left alone")
+	}
+}
+
+func TestDryRunSkipsPathlessMappings(t *testing.T) {
+	config := &WatchConfig{RunOnce: true}
+	applyDefaults(config)
+
+	// Nothing is watched, so these would block if they weren't skipped
+	for _, mappingConfig := range []*MappingConfig{
+		{Prefix: "app/", Registry: `HKLM\Software\App`},
+		{Prefix: "app/", Socket: "/run/app.sock"},
+		{Prefix: "app/", ExecEnv: true},
+	} {
+		var diffs bytes.Buffer
+		if code := dryRunMapping(config, mappingConfig, &diffs, nil); code != 0 || diffs.Len() != 0 {
+			t.Errorf("expected %+v to be skipped, got %d and %q", mappingConfig, code, diffs.String())
+		}
+	}
+}
+
+func TestDryRunLeavesConsulPathAlone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "5")
+		w.Write([]byte(`[{"Key": "app/a.conf", "Value": "YQ==", "ModifyIndex": 5}]`))
+	}))
+	defer server.Close()
+
+	config := &WatchConfig{RunOnce: true, Consul: ConsulConfig{Addr: strings.TrimPrefix(server.URL, "http://")}}
+	applyDefaults(config)
+	root := filepath.Join(t.TempDir(), "app") + string(os.PathSeparator)
+
+	var diffs bytes.Buffer
+	if code := dryRunMapping(config, &MappingConfig{Prefix: "app/", Path: root}, &diffs, nil); code != 0 {
+		t.Fatalf("expected the dry run to succeed, got %d", code)
+	}
+	if !strings.Contains(diffs.String(), "+a") {
+		t.Errorf("unexpected diffs:\n%s", diffs.String())
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("expected the mapping's path not to be created, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshal(t *testing.T) {
+	for _, test := range []struct {
+		json     string
+		expected time.Duration
+	}{
+		{`"1m30s"`, 90 * time.Second},
+		{`"250ms"`, 250 * time.Millisecond},
+		{`15`, 15 * time.Second},
+		{`0.5`, 500 * time.Millisecond},
+	} {
+		var d Duration
+		if err := json.Unmarshal([]byte(test.json), &d); err != nil {
+			t.Fatalf("Failed to parse %s due to %v", test.json, err)
+		}
+		if time.Duration(d) != test.expected {
+			t.Fatalf("Expected %s to parse as %v but got %v", test.json, test.expected, time.Duration(d))
+		}
+	}
+
+	var d Duration
+	if err := json.Unmarshal([]byte(`"soon"`), &d); err == nil {
+		t.Fatal("Expected an error for an invalid duration")
+	}
+}
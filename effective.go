@@ -0,0 +1,230 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Where a configuration value came from.
+const (
+	fromFile    = "file"
+	fromFlag    = "flag"
+	fromEnv     = "env"
+	fromDefault = "default"
+)
+
+// Settings whose values are secret, by the last part of their path.
+var secretSettings = map[string]bool{
+	"token":      true,
+	"secretid":   true,
+	"apikey":     true,
+	"routingkey": true,
+	"password":   true,
+}
+
+// Settings holding URLs that may carry credentials anywhere in them, e.g. webhooks with a
+// token in their path, by the last part of their path.  Only their scheme and host are shown.
+var urlSettings = map[string]bool{
+	"url": true,
+}
+
+// effectiveConfig is the configuration fsconsul runs with, defaults applied and secrets
+// redacted, flattened into dotted paths (e.g. mappings.0.prefix) with where each came from.
+type effectiveConfig struct {
+	Values  map[string]interface{}
+	Sources map[string]string
+}
+
+// Flatten a configuration into dotted paths, leaving out settings that aren't set.
+func flattenConfig(config *WatchConfig) map[string]interface{} {
+	flat := make(map[string]interface{})
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return flat
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return flat
+	}
+
+	var walk func(path string, value interface{})
+	walk = func(path string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				walk(joinPath(path, strings.ToLower(k)), child)
+			}
+		case []interface{}:
+			for i, child := range v {
+				walk(joinPath(path, strconv.Itoa(i)), child)
+			}
+		case nil:
+		case string:
+			if v != "" && v != "0s" {
+				flat[path] = v
+			}
+		case bool:
+			if v {
+				flat[path] = v
+			}
+		case float64:
+			if v != 0 {
+				flat[path] = v
+			}
+		}
+	}
+	walk("", decoded)
+	return flat
+}
+
+func joinPath(path, k string) string {
+	if path == "" {
+		return k
+	}
+	return path + "." + k
+}
+
+// Resolve the effective configuration, applying its defaults.  Settings that were set before
+// the command-line switches were applied came from the config file (or the switches, without
+// one); those that were set since, from the switches.
+func (opts *options) effective(config *WatchConfig) effectiveConfig {
+	base := fromFlag
+	if opts.configFile != "" {
+		base = fromFile
+	}
+
+	given := flattenConfig(config)
+	fromEnvironment := applyConsulEnv(&config.Consul)
+	applyDefaults(config)
+	values := flattenConfig(config)
+
+	sources := make(map[string]string, len(values))
+	for path := range values {
+		loaded, wasLoaded := opts.loaded[path]
+		switch {
+		case !wasLoaded && given[path] == nil:
+			sources[path] = fromDefault
+		case wasLoaded && reflect.DeepEqual(loaded, given[path]):
+			// Set by the file, if perhaps normalized by the defaults
+			sources[path] = base
+		default:
+			sources[path] = fromFlag
+		}
+	}
+
+	for _, path := range fromEnvironment {
+		sources[path] = fromEnv
+	}
+	if _, ok := given["consul.token"]; !ok && sources["consul.tokenfile"] != "" {
+		sources["consul.token"] = sources["consul.tokenfile"]
+	}
+
+	// Vault's address and token fall back to the environment when they're used
+	for path, name := range map[string]string{"vault.addr": "VAULT_ADDR", "vault.token": "VAULT_TOKEN"} {
+		if _, ok := values[path]; !ok && os.Getenv(name) != "" {
+			values[path] = os.Getenv(name)
+			sources[path] = fromEnv
+		}
+	}
+
+	for path, value := range values {
+		values[path] = redactSetting(path, value)
+	}
+	return effectiveConfig{Values: values, Sources: sources}
+}
+
+// Redact secret settings, all but the scheme and host of webhook URLs, and the passwords of
+// other URLs.
+func redactSetting(path string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	setting := path[strings.LastIndex(path, ".")+1:]
+	if secretSettings[setting] {
+		return "redacted"
+	}
+	if urlSettings[setting] {
+		return redactURL(s)
+	}
+	if strings.Contains(s, "://") {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), "redacted")
+				return u.String()
+			}
+		}
+	}
+	return s
+}
+
+// Redact a URL's user info, path and query, or all of it if it can't be parsed.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return "redacted"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.Path != "" && u.Path != "/" {
+		u.Path, u.RawPath = "/redacted", ""
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// The configuration's paths, sorted.
+func (effective effectiveConfig) paths() []string {
+	paths := make([]string, 0, len(effective.Values))
+	for path := range effective.Values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Log the effective configuration as a single entry, each setting a field.
+func logEffectiveConfig(log *logrus.Logger, effective effectiveConfig) {
+	fields := make(logrus.Fields, len(effective.Values)+1)
+	for path, value := range effective.Values {
+		fields[path] = value
+	}
+	fields["sources"] = effective.Sources
+	log.WithFields(fields).Info("Effective configuration")
+}
+
+func configCommand(args []string) int {
+	var opts options
+	flags := newFlagSet("fsconsul config", configHelpText, &opts)
+	if len(args) == 0 || args[0] != "print" {
+		flags.Usage()
+		return 1
+	}
+	flags.Parse(args[1:])
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, flags.Args())
+	if config == nil {
+		return code
+	}
+
+	effective := opts.effective(config)
+	for _, path := range effective.paths() {
+		value, _ := json.Marshal(effective.Values[path])
+		fmt.Printf("%s = %s (%s)\n", path, value, effective.Sources[path])
+	}
+	return 0
+}
@@ -0,0 +1,53 @@
+package fsconsul
+
+import (
+	"sort"
+	"strings"
+)
+
+// Policies for keys with empty values.
+const (
+	emptyWrite  = "write"  // write an empty file (the default)
+	emptySkip   = "skip"   // leave the key's file as it was, or don't create it
+	emptyDelete = "delete" // treat the key as removed
+	emptyFail   = "fail"   // refuse to apply the snapshot
+)
+
+// Find the keys with empty values, other than folders, and apply the mapping's policy for
+// them to the new env: skipped keys keep their previous value, if they had one, and deleted
+// keys are removed.  Returns the empty keys, in order.
+func applyEmptyValues(mappingConfig *MappingConfig, env, newEnv map[string]string) []string {
+	var empty []string
+	for k, v := range newEnv {
+		if v != "" || strings.HasSuffix(k, "/") {
+			continue
+		}
+		empty = append(empty, k)
+
+		switch mappingConfig.EmptyValues {
+		case emptySkip:
+			if previous, ok := env[k]; ok {
+				newEnv[k] = previous
+			} else {
+				delete(newEnv, k)
+			}
+		case emptyDelete:
+			delete(newEnv, k)
+		}
+	}
+	sort.Strings(empty)
+	return empty
+}
+
+// Count empty values seen in the mapping's snapshots, for health checks.
+func (run *mappingRun) sawEmptyValues(n int) {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	run.emptyValues += n
+}
+
+func (run *mappingRun) emptyValueCount() int {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	return run.emptyValues
+}
@@ -0,0 +1,34 @@
+package fsconsul
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyEmptyValues(t *testing.T) {
+	env := map[string]string{"a": "old", "c": "kept"}
+	snapshot := map[string]string{"a": "", "b": "", "c": "kept", "d/": ""}
+
+	for _, test := range []struct {
+		policy string
+		want   map[string]string
+	}{
+		{"", map[string]string{"a": "", "b": "", "c": "kept", "d/": ""}},
+		{emptySkip, map[string]string{"a": "old", "c": "kept", "d/": ""}},
+		{emptyDelete, map[string]string{"c": "kept", "d/": ""}},
+		{emptyFail, map[string]string{"a": "", "b": "", "c": "kept", "d/": ""}},
+	} {
+		newEnv := map[string]string{}
+		for k, v := range snapshot {
+			newEnv[k] = v
+		}
+
+		empty := applyEmptyValues(&MappingConfig{EmptyValues: test.policy}, env, newEnv)
+		if !reflect.DeepEqual(empty, []string{"a", "b"}) {
+			t.Errorf("%q: expected a and b to be empty, got %v", test.policy, empty)
+		}
+		if !reflect.DeepEqual(newEnv, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.policy, test.want, newEnv)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package fsconsul
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// EtcdConfig holds the configuration for reading mappings from etcd, through the JSON
+// gateway of its v3 API.
+type EtcdConfig struct {
+	// Client URLs, e.g. https://etcd-0:2379, tried in turn (defaults to ETCDCTL_ENDPOINTS)
+	Endpoints []string
+
+	// The user to authenticate as, if etcd has auth enabled
+	Username string
+	Password string
+
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// etcdClient reads key ranges from etcd and watches them, authenticating again when its
+// token expires.
+type etcdClient struct {
+	config EtcdConfig
+	// Requests time out, but watches run until they're stopped
+	http   *http.Client
+	stream *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+func etcdFor(etcdConfig EtcdConfig) (*etcdClient, error) {
+	if len(etcdConfig.Endpoints) == 0 && os.Getenv("ETCDCTL_ENDPOINTS") != "" {
+		etcdConfig.Endpoints = strings.Split(os.Getenv("ETCDCTL_ENDPOINTS"), ",")
+	}
+	if len(etcdConfig.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd mappings need etcd endpoints (or ETCDCTL_ENDPOINTS)")
+	}
+	endpoints := make([]string, len(etcdConfig.Endpoints))
+	for i, endpoint := range etcdConfig.Endpoints {
+		endpoints[i] = strings.TrimSuffix(strings.TrimSpace(endpoint), "/")
+	}
+	etcdConfig.Endpoints = endpoints
+
+	tlsConfig := &tls.Config{}
+	if etcdConfig.CAFile != "" {
+		certPool := x509.NewCertPool()
+		if data, err := ioutil.ReadFile(etcdConfig.CAFile); err != nil {
+			return nil, err
+		} else if !certPool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("Invalid certificate file: %s", etcdConfig.CAFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	if etcdConfig.CertFile != "" && etcdConfig.KeyFile != "" {
+		reloader, err := newCertReloader(etcdConfig.CertFile, etcdConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	return &etcdClient{
+		config: etcdConfig,
+		http:   &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		stream: &http.Client{Transport: transport},
+	}, nil
+}
+
+// etcdInt is an int64 as etcd's JSON gateway encodes it, as a string.  Numbers are
+// accepted too.
+type etcdInt int64
+
+func (i *etcdInt) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*i = etcdInt(n)
+	return err
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision"`
+}
+
+// Keys and values are base64 encoded, as JSON encodes []byte.
+type etcdKV struct {
+	Key         []byte  `json:"key"`
+	Value       []byte  `json:"value"`
+	ModRevision etcdInt `json:"mod_revision"`
+}
+
+type etcdEvent struct {
+	// PUT is the default, so it's left out
+	Type string `json:"type"`
+	Kv   etcdKV `json:"kv"`
+}
+
+type etcdError struct {
+	Message string `json:"message"`
+}
+
+// The end of the range of keys starting with prefix: the prefix with its last byte that
+// can be incremented incremented.  An empty prefix ranges over every key.
+func etcdRangeEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+func etcdRange(prefix string) map[string][]byte {
+	key := []byte(prefix)
+	if len(key) == 0 {
+		key = []byte{0}
+	}
+	return map[string][]byte{"key": key, "range_end": etcdRangeEnd([]byte(prefix))}
+}
+
+func (kv etcdKV) pair() *consulapi.KVPair {
+	return &consulapi.KVPair{Key: string(kv.Key), Value: kv.Value, ModifyIndex: uint64(kv.ModRevision)}
+}
+
+// Post a request to the first endpoint that answers, authenticating first if etcd needs
+// it.  A refused token is replaced once.
+func (c *etcdClient) post(ctx context.Context, client *http.Client, path string, body interface{}) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.currentToken(attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.postAnywhere(ctx, client, path, token, encoded)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && c.config.Username != "" && attempt == 0 {
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			defer resp.Body.Close()
+			var failure etcdError
+			json.NewDecoder(resp.Body).Decode(&failure)
+			return nil, fmt.Errorf("etcd returned %s: %s", resp.Status, failure.Message)
+		}
+		return resp, nil
+	}
+}
+
+func (c *etcdClient) postAnywhere(ctx context.Context, client *http.Client, path, token string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for _, endpoint := range c.config.Endpoints {
+		req, err := http.NewRequest("POST", endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+
+		resp, err := client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// The token to authenticate requests with, if etcd has auth enabled, getting a new one
+// if there's none yet or it was refused.
+func (c *etcdClient) currentToken(refused bool) (string, error) {
+	if c.config.Username == "" {
+		return "", nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && !refused {
+		return c.token, nil
+	}
+
+	encoded, err := json.Marshal(map[string]string{"name": c.config.Username, "password": c.config.Password})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.postAnywhere(context.Background(), c.http, "/v3/auth/authenticate", "", encoded)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var authenticated struct {
+		Token   string `json:"token"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&authenticated)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || authenticated.Token == "" {
+		return "", fmt.Errorf("failed to authenticate with etcd as %s: %s %s", c.config.Username, resp.Status, authenticated.Message)
+	}
+	c.token = authenticated.Token
+	return c.token, nil
+}
+
+// List the keys starting with prefix, and the revision they were listed at.
+func (c *etcdClient) list(prefix string) (consulapi.KVPairs, uint64, error) {
+	resp, err := c.post(context.Background(), c.http, "/v3/kv/range", etcdRange(prefix))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var listed struct {
+		Header etcdHeader `json:"header"`
+		Kvs    []etcdKV   `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		return nil, 0, fmt.Errorf("etcd returned an unreadable range: %v", err)
+	}
+
+	pairs := make(consulapi.KVPairs, 0, len(listed.Kvs))
+	for _, kv := range listed.Kvs {
+		pairs = append(pairs, kv.pair())
+	}
+	return pairs, uint64(listed.Header.Revision), nil
+}
+
+// Watch the keys starting with prefix for changes after revision, calling changed with
+// each batch of events until the watch fails or quitCh is closed.  etcd cancels watches
+// of revisions it has compacted away, which is returned as an error like any other.
+func (c *etcdClient) watch(prefix string, revision uint64, changed func(uint64, []etcdEvent), quitCh <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-quitCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	request := etcdRange(prefix)
+	create := map[string]interface{}{"key": request["key"], "range_end": request["range_end"], "start_revision": revision + 1}
+	resp, err := c.post(ctx, c.stream, "/v3/watch", map[string]interface{}{"create_request": create})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result *struct {
+				Header          etcdHeader  `json:"header"`
+				Canceled        bool        `json:"canceled"`
+				CancelReason    string      `json:"cancel_reason"`
+				CompactRevision etcdInt     `json:"compact_revision"`
+				Events          []etcdEvent `json:"events"`
+			} `json:"result"`
+			Error *etcdError `json:"error"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			return fmt.Errorf("etcd watch ended: %v", err)
+		}
+		if message.Error != nil {
+			return fmt.Errorf("etcd watch failed: %s", message.Error.Message)
+		}
+		if message.Result == nil {
+			continue
+		}
+		if message.Result.Canceled || message.Result.CompactRevision > 0 {
+			return fmt.Errorf("etcd canceled the watch: %s", message.Result.CancelReason)
+		}
+		if len(message.Result.Events) > 0 {
+			changed(uint64(message.Result.Header.Revision), message.Result.Events)
+		}
+	}
+}
+
+// Feed the render pipeline from the keys starting with a prefix in etcd, as they change.
+// Each connection lists the keys, then watches them from that revision, so nothing is
+// missed while reconnecting.
+func watchEtcd(
+	client *etcdClient,
+	prefix string,
+	retry RetryConfig,
+	conn *connectivity,
+	logger *log.Entry,
+	pairCh chan<- kvSnapshot,
+	errCh chan<- error,
+	quitCh <-chan struct{}) {
+
+	send := func(current map[string]*consulapi.KVPair, revision uint64) bool {
+		pairs := make(consulapi.KVPairs, 0, len(current))
+		for _, pair := range current {
+			pairs = append(pairs, pair)
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+		select {
+		case pairCh <- kvSnapshot{pairs, revision}:
+			return true
+		case <-quitCh:
+			return false
+		}
+	}
+
+	delays := newBackoff(retry)
+	failures := 0
+	var failingSince time.Time
+	for first := true; ; first = false {
+		pairs, revision, err := client.list(prefix)
+		if err == nil {
+			failures = 0
+			delays.reset()
+			conn.succeeded()
+
+			current := make(map[string]*consulapi.KVPair, len(pairs))
+			for _, pair := range pairs {
+				current[pair.Key] = pair
+			}
+			if !send(current, revision) {
+				return
+			}
+
+			err = client.watch(prefix, revision, func(revision uint64, events []etcdEvent) {
+				for _, event := range events {
+					if event.Type == "DELETE" {
+						delete(current, string(event.Kv.Key))
+					} else {
+						current[string(event.Kv.Key)] = event.Kv.pair()
+					}
+				}
+				send(current, revision)
+			}, quitCh)
+		}
+
+		select {
+		case <-quitCh:
+			return
+		default:
+		}
+
+		// Fail fast if the initial listing fails, as with Consul
+		if first && pairs == nil {
+			errCh <- err
+			return
+		}
+
+		failures++
+		if failures == 1 {
+			failingSince = time.Now()
+		}
+		if failingFor := time.Since(failingSince); retry.exhausted(failures) || retry.expired(failingFor) {
+			logger.WithFields(log.Fields{
+				"error":      err,
+				"failures":   failures,
+				"failingFor": failingFor,
+			}).Error("Giving up on etcd")
+			errCh <- fmt.Errorf("giving up after %d failed requests over %s: %v", failures, failingFor.Round(time.Second), err)
+			return
+		}
+
+		delay := delays.next()
+		entry := logger.WithFields(log.Fields{
+			"error":    err,
+			"prefix":   prefix,
+			"retryIn":  delay,
+			"failures": failures,
+		})
+		if conn.failed() {
+			entry.Debug("Lost etcd watch, listing the prefix again")
+		} else {
+			entry.Warn("Lost etcd watch, listing the prefix again")
+		}
+
+		select {
+		case <-quitCh:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
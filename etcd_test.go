@@ -0,0 +1,87 @@
+package fsconsul
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Serve /app/db and /app/cache behind auth, and a watch that changes /app/db and deletes
+// /app/cache.
+func newEtcdServer(t *testing.T) *httptest.Server {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/auth/authenticate" {
+			fmt.Fprint(w, `{"token": "etcd-token"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "etcd-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "etcdserver: invalid auth token"}`)
+			return
+		}
+
+		var request map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&request)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var key []byte
+			json.Unmarshal(request["key"], &key)
+			if string(key) != "/app/" {
+				t.Errorf("expected a range of /app/, got %q", key)
+			}
+			fmt.Fprintf(w, `{"header": {"revision": "10"}, "kvs": [
+				{"key": "%s", "value": "%s", "mod_revision": "4"},
+				{"key": "%s", "value": "%s", "mod_revision": "7"}]}`,
+				b64("/app/cache"), b64("cache"), b64("/app/db"), b64("db"))
+		case "/v3/watch":
+			fmt.Fprint(w, `{"result": {"header": {"revision": "10"}, "created": true}}`+"\n")
+			fmt.Fprintf(w, `{"result": {"header": {"revision": "12"}, "events": [
+				{"kv": {"key": "%s", "value": "%s", "mod_revision": "11"}},
+				{"type": "DELETE", "kv": {"key": "%s", "mod_revision": "12"}}]}}`+"\n",
+				b64("/app/db"), b64("new db"), b64("/app/cache"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestWatchEtcd(t *testing.T) {
+	server := newEtcdServer(t)
+	defer server.Close()
+
+	client, err := etcdFor(EtcdConfig{Endpoints: []string{server.URL}, Username: "fsconsul", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairCh := make(chan kvSnapshot)
+	errCh := make(chan error, 1)
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+	go watchEtcd(client, "/app/", RetryConfig{}, nil, log.NewEntry(log.StandardLogger()), pairCh, errCh, quitCh)
+
+	mappingConfig := &MappingConfig{Prefix: "/app/", Backend: "etcd"}
+	for i, want := range []map[string]string{{"db": "db", "cache": "cache"}, {"db": "new db"}} {
+		select {
+		case snapshot := <-pairCh:
+			env, _ := snapshotEnv(mappingConfig, snapshot.pairs)
+			if fmt.Sprint(env) != fmt.Sprint(want) {
+				t.Errorf("snapshot %d: expected %v, got %v", i, want, env)
+			}
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for snapshot %d", i)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package fsconsul
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"github.com/ghodss/yaml"
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+// Suffixes of keys whose values are evaluated, when a mapping asks for evaluation.
+const (
+	jsonnetSuffix = ".jsonnet"
+	cueSuffix     = ".cue"
+)
+
+// Determine the key a file is written under once any evaluation suffix is stripped, so
+// that "app.yaml.jsonnet" is written to "app.yaml".
+func evaluatedKey(mappingConfig *MappingConfig, key string) string {
+	if !mappingConfig.Evaluate {
+		return key
+	}
+
+	for _, suffix := range []string{jsonnetSuffix, cueSuffix} {
+		if strings.HasSuffix(key, suffix) && len(key) > len(suffix) {
+			return strings.TrimSuffix(key, suffix)
+		}
+	}
+
+	return key
+}
+
+// Evaluate Jsonnet or CUE values, selected by the key's suffix, into JSON, or into YAML if
+// the key is named for a YAML file once the suffix is stripped.  Other values are
+// returned as they are.
+func evaluateValue(mappingConfig *MappingConfig, key string, value []byte) ([]byte, error) {
+	output := evaluatedKey(mappingConfig, key)
+	if output == key {
+		return value, nil
+	}
+
+	var json []byte
+	var err error
+	switch {
+	case strings.HasSuffix(key, jsonnetSuffix):
+		json, err = evaluateJsonnet(key, value)
+	case strings.HasSuffix(key, cueSuffix):
+		json, err = evaluateCUE(key, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch path.Ext(output) {
+	case ".yaml", ".yml":
+		return yaml.JSONToYAML(json)
+	default:
+		return json, nil
+	}
+}
+
+func evaluateJsonnet(key string, value []byte) ([]byte, error) {
+	// Imports could read any file fsconsul can, so values may only import nothing
+	vm := jsonnet.MakeVM()
+	vm.Importer(&jsonnet.MemoryImporter{Data: map[string]jsonnet.Contents{}})
+
+	json, err := vm.EvaluateSnippet(key, string(value))
+	if err != nil {
+		return nil, fmt.Errorf("could not evaluate jsonnet: %v", err)
+	}
+
+	return []byte(json), nil
+}
+
+func evaluateCUE(key string, value []byte) ([]byte, error) {
+	v := cuecontext.New().CompileString(string(value), cue.Filename(key))
+	if err := v.Err(); err != nil {
+		return nil, fmt.Errorf("could not compile cue: %v", err)
+	}
+
+	if err := v.Validate(cue.Concrete(true)); err != nil {
+		return nil, fmt.Errorf("could not evaluate cue: %v", err)
+	}
+
+	json, err := v.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("could not evaluate cue: %v", err)
+	}
+
+	return append(json, '\n'), nil
+}
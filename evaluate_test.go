@@ -0,0 +1,31 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateJsonnet(t *testing.T) {
+	mappingConfig := &MappingConfig{Evaluate: true}
+
+	evaluated, err := evaluateValue(mappingConfig, "app.json.jsonnet", []byte(`{ port: 8000 + 80 }`))
+	if err != nil || !strings.Contains(string(evaluated), `"port": 8080`) {
+		t.Fatalf("expected the value to be evaluated, got %q (%v)", evaluated, err)
+	}
+
+	// Values can't read local files
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(secret, []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{
+		`{ data: importstr "` + filepath.ToSlash(secret) + `" }`,
+		`import "` + filepath.ToSlash(secret) + `"`,
+	} {
+		if evaluated, err := evaluateValue(mappingConfig, "app.json.jsonnet", []byte(value)); err == nil {
+			t.Errorf("expected %s to fail, got %q", value, evaluated)
+		}
+	}
+}
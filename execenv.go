@@ -0,0 +1,45 @@
+package fsconsul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Render a snapshot's keys as the variables a mapping with execenv sets in the environment
+// of the process run with exec, named as an env explode file names them.  Keys that fail to
+// render, or whose values can't be put in an environment, are left out and returned as
+// failures.
+func execEnvVars(mappingConfig *MappingConfig, env map[string]string) (map[string]string, []keyFailure) {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	vars := make(map[string]string, len(keys))
+	var failed []keyFailure
+	for _, k := range keys {
+		rendered, err := renderValue(mappingConfig, k, []byte(env[k]), env)
+		if err == nil && strings.IndexByte(string(rendered), 0) >= 0 {
+			err = fmt.Errorf("value holds a NUL byte, which environment variables can't")
+		}
+		if err != nil {
+			failed = append(failed, keyFailure{k, err.Error()})
+			continue
+		}
+
+		name := envName(mappingConfig, k)
+		if name == "" {
+			continue
+		}
+		vars[name] = string(rendered)
+	}
+	return vars, failed
+}
+
+// Whether a mapping's keys are only put in the environment of the process run with exec,
+// rather than written to files too.
+func (mappingConfig *MappingConfig) envOnly() bool {
+	return mappingConfig.ExecEnv && mappingConfig.Path == ""
+}
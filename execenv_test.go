@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecEnv(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fixture := filepath.Join(tempDir, "kv.json")
+	if err := ioutil.WriteFile(fixture, []byte(`[{"key": "app/db/host", "value": "b25l"}]`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The child records the variable it started with, and exits once it's been restarted
+	// with the new value
+	log := filepath.Join(tempDir, "child.log")
+	script := filepath.Join(tempDir, "child.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "started $DB_HOST" >> `+log+`
+if [ "$DB_HOST" = two ]; then exit 4; fi
+while true; do sleep 0.1; done
+`), 0755)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config := &WatchConfig{
+		SourceFile: fixture,
+		Exec:       ExecConfig{Command: script, KillTimeout: Duration(5 * time.Second)},
+		Mappings:   []MappingConfig{{Prefix: "app/", ExecEnv: true}},
+	}
+	codes := make(chan int, 1)
+	go func() { codes <- watchAndExec(config) }()
+
+	waitFor := func(want string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if content, _ := ioutil.ReadFile(log); strings.Contains(string(content), want) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("child never %s", want)
+	}
+	waitFor("started one")
+
+	if err := ioutil.WriteFile(fixture, []byte(`[{"key": "app/db/host", "value": "dHdv"}]`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fixture, later, later)
+	waitFor("started two")
+
+	select {
+	case code := <-codes:
+		if code != 4 {
+			t.Fatalf("expected fsconsul to exit with the child's code, got %d", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("fsconsul didn't exit with the child")
+	}
+}
@@ -0,0 +1,369 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Render every key of a snapshot into the single file of an exploding mapping, in the
+// mapping's Format.  Nested keys become nested objects (json, yaml), sections (ini),
+// tables (toml), dotted names (properties) or underscored names (env); xml and template are
+// rendered from a skeleton template.
+func renderExploded(mappingConfig *MappingConfig, env map[string]string) ([]byte, error) {
+	values := make(map[string]string, len(env))
+	var keys []string
+	for k, v := range env {
+		// Folders have no value of their own
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+
+		rendered, err := renderValue(mappingConfig, k, []byte(v), env)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s: %v", k, err)
+		}
+		values[k] = string(rendered)
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rendered, err := explodeValues(mappingConfig, keys, values)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeNewline(mappingConfig.trailingNewline(mappingConfig.ExplodeFile), rendered), nil
+}
+
+func explodeValues(mappingConfig *MappingConfig, keys []string, values map[string]string) ([]byte, error) {
+	switch mappingConfig.Format {
+	case "json":
+		return explodeJSON(keys, values)
+	case "yaml":
+		return explodeYAML(keys, values)
+	case "env":
+		return explodeEnv(mappingConfig, keys, values), nil
+	case "ini":
+		return explodeINI(keys, values), nil
+	case "toml":
+		return explodeTOML(keys, values)
+	case "properties":
+		return explodeProperties(keys, values), nil
+	case "xml":
+		return explodeXML(mappingConfig, keys, values)
+	case "template":
+		return explodeTemplate(mappingConfig, keys, values)
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected json, yaml, ini, toml, properties, env, xml or template", mappingConfig.Format)
+	}
+}
+
+// The file an exploding mapping renders to.
+func explodedPath(mappingConfig *MappingConfig) string {
+	return mappingConfig.Path + filepath.FromSlash(mappingConfig.ExplodeFile)
+}
+
+// Nest values by the segments of their keys.
+func explodeTree(keys []string, values map[string]string) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	for _, k := range keys {
+		parts := strings.Split(k, "/")
+
+		node := root
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				if _, exists := node[part]; exists {
+					return nil, fmt.Errorf("%s is both a value and has keys below it", part)
+				}
+				child = make(map[string]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+
+		leaf := parts[len(parts)-1]
+		if _, exists := node[leaf]; exists {
+			return nil, fmt.Errorf("%s is both a value and has keys below it", k)
+		}
+		node[leaf] = values[k]
+	}
+	return root, nil
+}
+
+func explodeJSON(keys []string, values map[string]string) ([]byte, error) {
+	root, err := explodeTree(keys, values)
+	if err != nil {
+		return nil, err
+	}
+
+	exploded, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(exploded, '\n'), nil
+}
+
+func explodeYAML(keys []string, values map[string]string) ([]byte, error) {
+	exploded, err := explodeJSON(keys, values)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(exploded)
+}
+
+// Write keys as environment variables, e.g. db/pool-size as DB_POOL_SIZE, quoting values
+// that a shell or systemd's EnvironmentFile wouldn't read back as they are.
+func explodeEnv(mappingConfig *MappingConfig, keys []string, values map[string]string) []byte {
+	b := &bytes.Buffer{}
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s=%s\n", envName(mappingConfig, k), envValue(values[k]))
+	}
+	return b.Bytes()
+}
+
+// The environment variable a key is written as, e.g. db/pool-size as DB_POOL_SIZE.
+func envName(mappingConfig *MappingConfig, k string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, casedKey(mappingConfig.KeyCase, k))
+	// Variables are upper-cased unless the mapping asks for lower case
+	if mappingConfig.KeyCase != keyCaseLower {
+		name = strings.ToUpper(name)
+	}
+	return name
+}
+
+func envValue(s string) string {
+	if !strings.ContainsAny(s, " \t\n\r\"'\\$`#;&|<>()") {
+		return s
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// Split a key into its parent (the section it belongs in) and its name.
+func splitSection(k string) (parent, name string) {
+	i := strings.LastIndex(k, "/")
+	if i < 0 {
+		return "", k
+	}
+	return k[:i], k[i+1:]
+}
+
+// Group keys by parent, keeping parents in the order they're first seen and keys without a
+// parent first.
+func sections(keys []string) ([]string, map[string][]string) {
+	var order []string
+	grouped := make(map[string][]string)
+	for _, k := range keys {
+		parent, _ := splitSection(k)
+		if _, ok := grouped[parent]; !ok && parent != "" {
+			order = append(order, parent)
+		}
+		grouped[parent] = append(grouped[parent], k)
+	}
+	return order, grouped
+}
+
+func explodeINI(keys []string, values map[string]string) []byte {
+	b := &bytes.Buffer{}
+	order, grouped := sections(keys)
+
+	for _, k := range grouped[""] {
+		fmt.Fprintf(b, "%s = %s\n", k, iniValue(values[k]))
+	}
+	for _, parent := range order {
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(b, "[%s]\n", strings.Replace(parent, "/", ".", -1))
+		for _, k := range grouped[parent] {
+			_, name := splitSection(k)
+			fmt.Fprintf(b, "%s = %s\n", name, iniValue(values[k]))
+		}
+	}
+
+	return b.Bytes()
+}
+
+// INI has no escaping, so multi-line values are joined onto one line.
+func iniValue(value string) string {
+	return strings.Replace(strings.TrimRight(value, "\n"), "\n", " ", -1)
+}
+
+func explodeTOML(keys []string, values map[string]string) ([]byte, error) {
+	b := &bytes.Buffer{}
+	order, grouped := sections(keys)
+
+	// A key can't be both a value and a table
+	for _, parent := range order {
+		parts := strings.Split(parent, "/")
+		for i := range parts {
+			ancestor := strings.Join(parts[:i+1], "/")
+			if _, ok := values[ancestor]; ok {
+				return nil, fmt.Errorf("%s is both a value and has keys below it", ancestor)
+			}
+		}
+	}
+
+	for _, k := range grouped[""] {
+		fmt.Fprintf(b, "%s = %s\n", tomlKey(k), tomlString(values[k]))
+	}
+	for _, parent := range order {
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+
+		parts := strings.Split(parent, "/")
+		for i, part := range parts {
+			parts[i] = tomlKey(part)
+		}
+		fmt.Fprintf(b, "[%s]\n", strings.Join(parts, "."))
+
+		for _, k := range grouped[parent] {
+			_, name := splitSection(k)
+			fmt.Fprintf(b, "%s = %s\n", tomlKey(name), tomlString(values[k]))
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// Quote a TOML key unless it's a bare key.
+func tomlKey(key string) string {
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return tomlString(key)
+		}
+	}
+	if key == "" {
+		return `""`
+	}
+	return key
+}
+
+// Quote a TOML basic string.  Go's escapes aren't all valid TOML, so control characters
+// are written with TOML's own, and everything else is left as it is.  Invalid UTF-8 is
+// replaced, since TOML documents must be valid UTF-8.
+func tomlString(s string) string {
+	b := &strings.Builder{}
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func explodeProperties(keys []string, values map[string]string) []byte {
+	b := &bytes.Buffer{}
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s=%s\n",
+			propertiesEscape(strings.Replace(k, "/", ".", -1), true),
+			propertiesEscape(values[k], false))
+	}
+	return b.Bytes()
+}
+
+// Escape a Java properties key or value.  Files are ISO-8859-1, so anything else is written
+// as a unicode escape.
+func propertiesEscape(s string, key bool) string {
+	b := &strings.Builder{}
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '=' || r == ':' || r == '#' || r == '!':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == ' ' && (key || i == 0):
+			b.WriteString(`\ `)
+		case r < 0x20 || r > 0x7e:
+			if r > 0xffff {
+				// Characters outside the BMP are written as a surrogate pair
+				r -= 0x10000
+				fmt.Fprintf(b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+			} else {
+				fmt.Fprintf(b, `\u%04x`, r)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Render the snapshot into an exploding mapping's file and write it, unless it's already up
+// to date.  Returns whether the file was written.
+func writeExploded(mappingConfig *MappingConfig, env map[string]string, summary *mappingSummary) (bool, error) {
+	if mappingConfig.ExplodeFile == "" {
+		return false, fmt.Errorf("mapping explodes but has no explodefile")
+	}
+	keyfile := explodedPath(mappingConfig)
+
+	rendered, err := renderExploded(mappingConfig, env)
+	if err != nil {
+		return false, err
+	}
+
+	rendered, err = patchFile(mappingConfig, keyfile, rendered)
+	if err != nil {
+		return false, err
+	}
+	rendered = markManaged(mappingConfig, keyfile, rendered)
+
+	if upToDate(mappingConfig, keyfile, rendered) {
+		return false, nil
+	}
+
+	if err := makeDirs(mappingConfig, filepath.Dir(keyfile)); err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(keyfile)
+	existed := err == nil
+
+	if err := writeKeyFile(mappingConfig, keyfile, rendered); err != nil {
+		return false, err
+	}
+	summary.wrote(keyfile, existed, len(rendered))
+
+	return true, nil
+}
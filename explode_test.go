@@ -0,0 +1,126 @@
+package fsconsul
+
+import "testing"
+
+func TestExplode(t *testing.T) {
+	env := map[string]string{
+		"name":             "app",
+		"db/host":          "db.internal",
+		"db/pool/size":     "10",
+		"log/level":        "info",
+		"greeting":         "héllo = world",
+		"folder/":          "",
+		"db/pool/idle.max": "2",
+	}
+
+	for _, test := range []struct {
+		format   string
+		expected string
+	}{
+		{"json", `{
+  "db": {
+    "host": "db.internal",
+    "pool": {
+      "idle.max": "2",
+      "size": "10"
+    }
+  },
+  "greeting": "héllo = world",
+  "log": {
+    "level": "info"
+  },
+  "name": "app"
+}
+`},
+		{"ini", `greeting = héllo = world
+name = app
+
+[db]
+host = db.internal
+
+[db.pool]
+idle.max = 2
+size = 10
+
+[log]
+level = info
+`},
+		{"toml", `greeting = "héllo = world"
+name = "app"
+
+[db]
+host = "db.internal"
+
+[db.pool]
+"idle.max" = "2"
+size = "10"
+
+[log]
+level = "info"
+`},
+		{"properties", `db.host=db.internal
+db.pool.idle.max=2
+db.pool.size=10
+greeting=h\u00e9llo \= world
+log.level=info
+name=app
+`},
+		{"env", `DB_HOST=db.internal
+DB_POOL_IDLE_MAX=2
+DB_POOL_SIZE=10
+GREETING="héllo = world"
+LOG_LEVEL=info
+NAME=app
+`},
+	} {
+		exploded, err := renderExploded(&MappingConfig{Format: test.format}, env)
+		if err != nil {
+			t.Fatalf("%s: err: %v", test.format, err)
+		}
+		if string(exploded) != test.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.format, test.expected, exploded)
+		}
+	}
+
+	// A key can't be both a value and have keys below it
+	conflicting := map[string]string{"db": "x", "db/host": "y"}
+	for _, format := range []string{"json", "toml"} {
+		if _, err := renderExploded(&MappingConfig{Format: format}, conflicting); err == nil {
+			t.Errorf("%s: expected an error for conflicting keys", format)
+		}
+	}
+}
+
+func TestExplodeFormat(t *testing.T) {
+	config := &WatchConfig{
+		Mappings: []MappingConfig{
+			{Prefix: "app1", Path: "/etc/app1", Explode: "json", ExplodeFile: "app.json"},
+			{Prefix: "app2", Path: "/etc/app2", Format: "yaml", Explode: "json", ExplodeFile: "app.yaml"},
+		},
+	}
+	applyDefaults(config)
+
+	// explode is still read as the format
+	if config.Mappings[0].Format != "json" {
+		t.Fatalf("expected explode to set the format, got %q", config.Mappings[0].Format)
+	}
+	if errs := validateConfig(config); len(errs) != 1 {
+		t.Fatalf("Expected an error for a mapping with two formats but got %v", errs)
+	}
+}
+
+func TestTOMLString(t *testing.T) {
+	for value, expected := range map[string]string{
+		"plain":              `"plain"`,
+		"héllo":              `"héllo"`,
+		"a\"b\\c":            `"a\"b\\c"`,
+		"tab\tline\nend\r":   `"tab\tline\nend\r"`,
+		"\b\f":               `"\b\f"`,
+		"nul\x00bell\a\x7f":  `"nul\u0000bell\u0007\u007F"`,
+		"invalid \xff utf-8": "\"invalid � utf-8\"",
+	} {
+		if quoted := tomlString(value); quoted != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, quoted)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package fsconsul
+
+import (
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Split a listing of a mapping's prefix and its fallback prefix into a snapshot of the
+// prefix's keys, filled in with the fallback's keys the prefix doesn't have.  Returns the
+// keys taken from the fallback too, keyed relative to the prefix.
+func snapshotFallback(mappingConfig *MappingConfig, pairs consulapi.KVPairs) (map[string]string, map[string]uint64, map[string]bool) {
+	var primary, fallback consulapi.KVPairs
+	for _, pair := range pairs {
+		if strings.HasPrefix(pair.Key, mappingConfig.FallbackPrefix) {
+			fallback = append(fallback, pair)
+		} else {
+			primary = append(primary, pair)
+		}
+	}
+
+	// Each prefix is snapshotted as it would be alone, environment overlays and all
+	alone := *mappingConfig
+	alone.FallbackPrefix = ""
+	env, modifyIndexes := snapshotEnv(&alone, primary)
+	fallbackEnv, fallbackIndexes := snapshotEnv(&alone, aliasPairs(mappingConfig, mappingConfig.FallbackPrefix, fallback))
+
+	fromFallback := make(map[string]bool)
+	for k, v := range fallbackEnv {
+		if _, ok := env[k]; ok {
+			continue
+		}
+		env[k] = v
+		modifyIndexes[k] = fallbackIndexes[k]
+		fromFallback[k] = true
+	}
+	return env, modifyIndexes, fromFallback
+}
+
+// The keys of a listing that are taken from the mapping's fallback prefix, if it has one.
+func fallbackKeys(mappingConfig *MappingConfig, pairs consulapi.KVPairs) map[string]bool {
+	if mappingConfig.FallbackPrefix == "" {
+		return nil
+	}
+	_, _, fromFallback := snapshotFallback(mappingConfig, pairs)
+	return fromFallback
+}
+
+// Watch a mapping's prefix and its fallback prefix, sending both listings together once
+// each has been listed.  Snapshots are indexed by the later of the two prefixes' indexes.
+func watchFallback(
+	client *consulapi.Client,
+	mappingConfig *MappingConfig,
+	token string,
+	conn *connectivity,
+	logger *log.Entry,
+	pairCh chan<- kvSnapshot,
+	errCh chan<- error,
+	quitCh <-chan struct{}) {
+
+	primaryCh := make(chan kvSnapshot)
+	fallbackCh := make(chan kvSnapshot)
+	// Either watch may fail, and neither may block doing so
+	watchErrCh := make(chan error, 2)
+	go watch(client, mappingConfig.Prefix, token, mappingConfig.Retry, mappingConfig.KeysOnly, conn, logger, primaryCh, watchErrCh, quitCh)
+	go watch(client, mappingConfig.FallbackPrefix, token, mappingConfig.Retry, mappingConfig.KeysOnly, conn, logger, fallbackCh, watchErrCh, quitCh)
+
+	var primary, fallback *kvSnapshot
+	for {
+		select {
+		case <-quitCh:
+			return
+		case err := <-watchErrCh:
+			errCh <- err
+			return
+		case snapshot := <-primaryCh:
+			primary = &snapshot
+		case snapshot := <-fallbackCh:
+			fallback = &snapshot
+		}
+		if primary == nil || fallback == nil {
+			continue
+		}
+
+		merged := make(consulapi.KVPairs, 0, len(primary.pairs)+len(fallback.pairs))
+		merged = append(append(merged, primary.pairs...), fallback.pairs...)
+		index := primary.index
+		if fallback.index > index {
+			index = fallback.index
+		}
+		logger.WithFields(log.Fields{
+			"index":    index,
+			"fallback": mappingConfig.FallbackPrefix,
+		}).Debug("Merged prefix with its fallback")
+
+		select {
+		case pairCh <- kvSnapshot{merged, index}:
+		case <-quitCh:
+			return
+		}
+	}
+}
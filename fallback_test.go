@@ -0,0 +1,29 @@
+package fsconsul
+
+import (
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestSnapshotFallback(t *testing.T) {
+	mappingConfig := &MappingConfig{Prefix: "teams/app/", FallbackPrefix: "app/", Path: "/etc/app/"}
+	pairs := consulapi.KVPairs{
+		{Key: "teams/app/db.conf", Value: []byte("new db"), ModifyIndex: 9},
+		{Key: "app/db.conf", Value: []byte("old db"), ModifyIndex: 3},
+		{Key: "app/cache.conf", Value: []byte("old cache"), ModifyIndex: 4},
+	}
+
+	env, modifyIndexes := snapshotEnv(mappingConfig, pairs)
+	if len(env) != 2 || env["db.conf"] != "new db" || env["cache.conf"] != "old cache" {
+		t.Errorf("expected the prefix's keys filled in from the fallback, got %v", env)
+	}
+	if modifyIndexes["db.conf"] != 9 || modifyIndexes["cache.conf"] != 4 {
+		t.Errorf("expected the modify indexes of the keys rendered, got %v", modifyIndexes)
+	}
+
+	fromFallback := fallbackKeys(mappingConfig, pairs)
+	if len(fromFallback) != 1 || !fromFallback["cache.conf"] {
+		t.Errorf("expected only cache.conf to come from the fallback, got %v", fromFallback)
+	}
+}
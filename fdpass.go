@@ -0,0 +1,98 @@
+package fsconsul
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fdServer hands a socket mapping's rendered files to the processes connecting to its Unix
+// socket, each as a sealed memfd passed with SCM_RIGHTS, so that they never touch the disk.
+type fdServer struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// Apply a snapshot to the files served, keeping the previous content of keys that fail to
+// render.  Files are named by their keys, relative to the prefix.
+func (s *fdServer) update(mappingConfig *MappingConfig, logger *log.Entry, newEnv map[string]string, summary *mappingSummary) (fileChanges, []keyFailure) {
+	var changes fileChanges
+	var failed []keyFailure
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make(map[string][]byte, len(newEnv))
+	for k, v := range newEnv {
+		// Folders have no value of their own
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+
+		previous, existed := s.files[k]
+		rendered, err := renderValue(mappingConfig, k, []byte(v), newEnv)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"key":   k,
+				"error": err,
+			}).Error("Failed to render value")
+			summary.addError(k, err)
+			failed = append(failed, keyFailure{k, err.Error()})
+			if existed {
+				files[k] = previous
+			}
+			continue
+		}
+
+		files[k] = rendered
+		if !existed {
+			changes.Created = append(changes.Created, k)
+		} else if string(previous) != string(rendered) {
+			changes.Updated = append(changes.Updated, k)
+		} else {
+			continue
+		}
+		summary.wrote(k, existed, len(rendered))
+	}
+
+	for k, content := range s.files {
+		if _, ok := files[k]; ok {
+			continue
+		}
+		if !mappingConfig.managesDeletes() {
+			files[k] = content
+			continue
+		}
+		summary.deleted(k)
+		changes.Deleted = append(changes.Deleted, k)
+	}
+
+	s.files = files
+	return changes, failed
+}
+
+// The names of the files served, in order, with their content.  Updates replace the files
+// rather than changing them, so they can be read without the lock.
+func (s *fdServer) snapshot() ([]string, map[string][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, s.files
+}
+
+// Stop serving, removing the socket.  Safe to call on a nil fdServer.
+func (s *fdServer) close() {
+	if s != nil {
+		s.listener.Close()
+	}
+}
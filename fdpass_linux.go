@@ -0,0 +1,130 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package fsconsul
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mfdCloexec      = 0x1
+	mfdAllowSealing = 0x2
+
+	fAddSeals   = 1033
+	fSealSeal   = 0x1
+	fSealShrink = 0x2
+	fSealGrow   = 0x4
+	fSealWrite  = 0x8
+)
+
+// Listen on the mapping's socket, with the mapping's file mode and owner.  A socket left
+// behind by a previous run is replaced.
+func listenFDs(mappingConfig *MappingConfig) (*fdServer, error) {
+	path := mappingConfig.Socket
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	attrs, err := resolveAttrs(mappingConfig.FileMode, defaultFileMode, mappingConfig.Owner, mappingConfig.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sequenced packets keep each file's name together with its descriptor
+	listener, err := net.Listen("unixpacket", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, attrs.mode)
+	if err == nil && (attrs.uid >= 0 || attrs.gid >= 0) {
+		err = os.Chown(path, attrs.uid, attrs.gid)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &fdServer{listener: listener}
+	go s.serve(mappingConfig.Name)
+	return s, nil
+}
+
+func (s *fdServer) serve(mapping string) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.send(conn.(*net.UnixConn)); err != nil {
+				log.WithFields(log.Fields{
+					"mapping": mapping,
+					"error":   err,
+				}).Warn("Failed to pass files over socket")
+			}
+		}()
+	}
+}
+
+// Send every file to a process that connected, one message each: the file's name, with a
+// memfd holding its content.  The connection is closed after the last file.
+func (s *fdServer) send(conn *net.UnixConn) error {
+	names, files := s.snapshot()
+	for _, name := range names {
+		fd, err := sealedMemfd(files[name])
+		if err != nil {
+			return err
+		}
+		_, _, err = conn.WriteMsgUnix([]byte(name), syscall.UnixRights(fd), nil)
+		syscall.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create a memfd holding the content, sealed so that it can't be changed by anyone holding
+// it.  Each receiver gets its own, so that they don't share a file offset.
+func sealedMemfd(content []byte) (int, error) {
+	name, err := syscall.BytePtrFromString("fsconsul")
+	if err != nil {
+		return -1, err
+	}
+	r, _, errno := syscall.Syscall(sysMemfdCreate, uintptr(unsafe.Pointer(name)), mfdCloexec|mfdAllowSealing, 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("memfd_create: %v", errno)
+	}
+	fd := int(r)
+
+	for written := 0; written < len(content); {
+		n, err := syscall.Write(fd, content[written:])
+		if err != nil {
+			syscall.Close(fd)
+			return -1, err
+		}
+		written += n
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), fAddSeals, fSealSeal|fSealShrink|fSealGrow|fSealWrite); errno != 0 {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("sealing memfd: %v", errno)
+	}
+	if _, err := syscall.Seek(fd, 0, 0); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,83 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package fsconsul
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestPassFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{Name: "secrets", Socket: filepath.Join(tempDir, "secrets.sock")}
+	served, err := listenFDs(mappingConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer served.close()
+
+	changes, failed := served.update(mappingConfig, log.NewEntry(log.StandardLogger()), map[string]string{"db/password": "hunter2", "db/": ""}, nil)
+	if len(changes.Created) != 1 || len(failed) != 0 {
+		t.Fatalf("expected one file created, got %v %v", changes, failed)
+	}
+	if changes, _ = served.update(mappingConfig, log.NewEntry(log.StandardLogger()), map[string]string{"db/password": "hunter2", "api/key": "abc"}, nil); len(changes.Created) != 1 || len(changes.Updated) != 0 {
+		t.Fatalf("expected only the new file to change, got %v", changes)
+	}
+
+	conn, err := net.Dial("unixpacket", mappingConfig.Socket)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	received := make(map[string]string)
+	for {
+		name := make([]byte, 256)
+		oob := make([]byte, syscall.CmsgSpace(4))
+		n, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(name, oob)
+		if err == io.EOF || n == 0 {
+			break
+		} else if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("expected a descriptor with %s, got %v", name[:n], err)
+		}
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		f := os.NewFile(uintptr(fds[0]), string(name[:n]))
+		content, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The content is sealed
+		if _, err := f.Write([]byte("x")); err == nil {
+			t.Fatal("expected the memfd to be read-only")
+		}
+		f.Close()
+		received[string(name[:n])] = string(content)
+	}
+
+	if len(received) != 2 || received["db/password"] != "hunter2" || received["api/key"] != "abc" {
+		t.Fatalf("unexpected files %v", received)
+	}
+}
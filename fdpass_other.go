@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package fsconsul
+
+import "fmt"
+
+func listenFDs(mappingConfig *MappingConfig) (*fdServer, error) {
+	return nil, fmt.Errorf("passing files over a socket is only available on Linux")
+}
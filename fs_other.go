@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package fsconsul
+
+// statfs differs too much between the other Unixes to be worth supporting them all.
+func diskFree(path string) (uint64, error) {
+	return 0, errNoDiskFree
+}
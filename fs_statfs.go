@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fsconsul
+
+import "syscall"
+
+// Report the number of bytes available to unprivileged users at path.
+func diskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
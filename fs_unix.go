@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package fsconsul
+
+import (
+	"os"
+	"syscall"
+)
+
+// Report whether both paths reside on the same filesystem (device).
+func sameFilesystem(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+
+	return aInfo.Sys().(*syscall.Stat_t).Dev == bInfo.Sys().(*syscall.Stat_t).Dev, nil
+}
+
+// Report whether the current user may create files in the directory, without creating any.
+func canWrite(dir string) error {
+	return syscall.Access(dir, 0x2) // W_OK
+}
+
+// Get the user and group owning a file.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
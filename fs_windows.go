@@ -0,0 +1,67 @@
+//go:build windows
+// +build windows
+
+package fsconsul
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+
+// Report whether both paths reside on the same filesystem (volume).
+func sameFilesystem(a, b string) (bool, error) {
+	if _, err := os.Stat(a); err != nil {
+		return false, err
+	}
+
+	aAbs, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+
+	bAbs, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.EqualFold(filepath.VolumeName(aAbs), filepath.VolumeName(bAbs)), nil
+}
+
+// Report the number of bytes available to the current user at path.
+func diskFree(path string) (uint64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	ret, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+
+	return free, nil
+}
+
+// Report whether the current user may create files in the directory, without creating any.
+// Only the read-only attribute is checked, not the directory's ACL.
+func canWrite(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		return &os.PathError{Op: "write", Path: dir, Err: syscall.ERROR_ACCESS_DENIED}
+	}
+	return nil
+}
+
+// Files have no uid on Windows, so they're treated as owned by the current user.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return os.Getuid(), os.Getgid(), true
+}
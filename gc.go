@@ -0,0 +1,184 @@
+package fsconsul
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// orphan is a file recorded in a state file that no configured mapping renders any more.
+type orphan struct {
+	mapping  string
+	file     string
+	hash     string
+	modified bool // changed since fsconsul wrote it
+}
+
+// Find the orphans recorded in a state file: the files of mappings that are no longer
+// configured, and those mappings' snapshots left behind.  Files that are gone are skipped,
+// as are files a configured mapping renders or that are under a configured mapping's path,
+// which may have been taken over.
+func findOrphans(config *WatchConfig, state *stateFile) []orphan {
+	configured := make(map[string]bool, len(config.Mappings))
+	live := make(map[string]bool)
+	for i := range config.Mappings {
+		configured[config.Mappings[i].Name] = true
+		for _, key := range state.get(config.Mappings[i].Name).Keys {
+			live[key.File] = true
+		}
+	}
+
+	underMapping := func(file string) bool {
+		for i := range config.Mappings {
+			path := config.Mappings[i].Path
+			if path != "" && strings.HasPrefix(file, path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var orphans []orphan
+	for name, recorded := range state.Mappings {
+		files := recorded.Orphans
+		if !configured[name] {
+			files = recorded.files()
+		}
+		for file, hash := range files {
+			if live[file] || underMapping(file) {
+				continue
+			}
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			modified := hash != "" && contentHash(content) != hash
+			orphans = append(orphans, orphan{mapping: name, file: file, hash: hash, modified: modified})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].file < orphans[j].file })
+	return orphans
+}
+
+// Find the files mappings no longer render from the state file, and delete them once the
+// operator confirms.  Files changed since fsconsul wrote them are only deleted with -force.
+func gcCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul gc", gcHelpText, &opts)
+	yes := flags.Bool("yes", false, "delete the files without asking for confirmation")
+	force := flags.Bool("force", false, "also delete files that were changed since fsconsul wrote them")
+	flags.Parse(args)
+	if opts.configFile == "" {
+		flags.Usage()
+		return 2
+	}
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, nil)
+	if config == nil {
+		return code
+	}
+
+	// Profiles record their mappings in state files of their own
+	names := []string{""}
+	for _, profile := range config.Profiles {
+		names = append(names, profile.Name)
+	}
+
+	type found struct {
+		state   *stateFile
+		config  *WatchConfig
+		orphans []orphan
+	}
+	var all []found
+	var deletable int
+	for _, name := range names {
+		derived, err := profileConfig(config, name)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Invalid profile")
+			return 2
+		}
+		applyDefaults(derived)
+		if derived.StateFile == "" {
+			log.Error("fsconsul gc needs the state file the mappings were run with, -state-file or statefile")
+			return 2
+		}
+
+		state, err := loadState(derived.StateFile)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+				"file":  derived.StateFile,
+			}).Error("Failed to load state file")
+			return 2
+		}
+
+		orphans := findOrphans(derived, state)
+		for _, o := range orphans {
+			if o.modified && !*force {
+				fmt.Printf("%s\t%s\tchanged since it was written, kept (use -force)\n", o.file, o.mapping)
+				continue
+			}
+			fmt.Printf("%s\t%s\n", o.file, o.mapping)
+			deletable++
+		}
+		all = append(all, found{state, derived, orphans})
+	}
+
+	if deletable == 0 {
+		fmt.Println("No orphaned files to delete")
+		return 0
+	}
+
+	if !*yes {
+		fmt.Printf("Delete %d files? [y/N] ", deletable)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Println("Nothing deleted")
+			return 1
+		}
+	}
+
+	code = 0
+	for _, f := range all {
+		configured := make(map[string]bool, len(f.config.Mappings))
+		for i := range f.config.Mappings {
+			configured[f.config.Mappings[i].Name] = true
+		}
+
+		removed := make(map[string][]string)
+		for _, o := range f.orphans {
+			if o.modified && !*force {
+				continue
+			}
+			if err := os.Remove(o.file); err != nil && !os.IsNotExist(err) {
+				log.WithFields(logrus.Fields{
+					"error": err,
+					"file":  o.file,
+				}).Error("Failed to delete file")
+				code = 2
+				continue
+			}
+			removed[o.mapping] = append(removed[o.mapping], o.file)
+		}
+
+		for mapping, files := range removed {
+			if err := f.state.forget(mapping, files, configured[mapping]); err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err,
+					"file":  f.config.StateFile,
+				}).Error("Failed to update state file")
+				code = 2
+			}
+		}
+	}
+	return code
+}
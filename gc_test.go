@@ -0,0 +1,64 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindOrphans(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	oldPath := filepath.Join(tempDir, "old") + string(filepath.Separator)
+	newPath := filepath.Join(tempDir, "new") + string(filepath.Separator)
+	gonePath := filepath.Join(tempDir, "gone") + string(filepath.Separator)
+	for _, dir := range []string{oldPath, newPath, gonePath} {
+		os.MkdirAll(dir, 0755)
+	}
+	write := func(file, content string) keyState {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return keyState{ModifyIndex: 1, File: file, Hash: contentHash([]byte(content))}
+	}
+
+	state, err := loadState(filepath.Join(tempDir, "state.json"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// app moves from old/ to new/, leaving its old file behind
+	state.applied("app", "", 1, map[string]keyState{"a.conf": write(oldPath+"a.conf", "a")})
+	state.applied("app", "", 2, map[string]keyState{"a.conf": write(newPath+"a.conf", "a")})
+
+	// gone is removed from the configuration, after one of its files was edited
+	state.applied("gone", "", 1, map[string]keyState{"b.conf": write(gonePath+"b.conf", "b"), "c.conf": write(gonePath+"c.conf", "c")})
+	ioutil.WriteFile(gonePath+"c.conf", []byte("edited"), 0644)
+
+	config := &WatchConfig{Mappings: []MappingConfig{{Name: "app", Path: newPath}}}
+	orphans := findOrphans(config, state)
+	if len(orphans) != 3 {
+		t.Fatalf("expected 3 orphans, got %v", orphans)
+	}
+	if orphans[0].file != gonePath+"b.conf" || orphans[0].modified || orphans[1].file != gonePath+"c.conf" || !orphans[1].modified || orphans[2].file != oldPath+"a.conf" {
+		t.Errorf("unexpected orphans %v", orphans)
+	}
+
+	// Once deleted, they're forgotten, with the mapping that's gone
+	for _, o := range orphans {
+		os.Remove(o.file)
+	}
+	state.forget("app", []string{oldPath + "a.conf"}, true)
+	state.forget("gone", []string{gonePath + "b.conf", gonePath + "c.conf"}, false)
+	if _, ok := state.Mappings["gone"]; ok {
+		t.Errorf("expected the removed mapping to be forgotten")
+	}
+	if recorded := state.get("app"); len(recorded.Orphans) != 0 || recorded.Keys["a.conf"].File != newPath+"a.conf" {
+		t.Errorf("expected app to keep only its current file, got %+v", recorded)
+	}
+}
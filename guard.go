@@ -0,0 +1,85 @@
+package fsconsul
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Paths fsconsul won't manage deletions in, or above, unless told it's intended: deleting
+// every file not in Consul from one of these would break the host.
+var defaultDangerousPaths = []string{
+	"/",
+	"/bin",
+	"/boot",
+	"/dev",
+	"/etc",
+	"/etc/group",
+	"/etc/passwd",
+	"/etc/shadow",
+	"/etc/sudoers",
+	"/etc/ssh",
+	"/home",
+	"/lib",
+	"/lib64",
+	"/proc",
+	"/root",
+	"/sbin",
+	"/sys",
+	"/usr",
+	"/usr/bin",
+	"/usr/lib",
+	"/usr/local/bin",
+	"/usr/sbin",
+	"/var",
+	"/var/lib",
+	`C:\`,
+	`C:\Program Files`,
+	`C:\Users`,
+	`C:\Windows`,
+	`C:\Windows\System32`,
+}
+
+// Check that no mapping manages deletions in a dangerous path (the defaults and any
+// configured) or in a directory containing one.
+func checkDangerousPaths(config *WatchConfig) []error {
+	if config.IKnowWhatImDoing {
+		return nil
+	}
+
+	dangerous := append(append([]string{}, defaultDangerousPaths...), config.DangerousPaths...)
+
+	var errs []error
+	for _, mappingConfig := range config.Mappings {
+		if mappingConfig.Path == "" || !mappingConfig.managesDeletes() || mappingConfig.Format != "" {
+			continue
+		}
+
+		for _, path := range dangerous {
+			if within(path, mappingConfig.Path) {
+				errs = append(errs, fmt.Errorf(
+					"mapping %s would delete files in %s, which is protected; pass -i-know-what-im-doing if that's intended",
+					mappingConfig.Name, path))
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// Determine whether path is dir or beneath it.
+func within(path, dir string) bool {
+	path, dir = filepath.Clean(path), filepath.Clean(dir)
+	if runtime.GOOS == "windows" {
+		path, dir = strings.ToLower(path), strings.ToLower(dir)
+	}
+
+	if path == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, dir)
+}
@@ -0,0 +1,32 @@
+package fsconsul
+
+import "testing"
+
+func TestCheckDangerousPaths(t *testing.T) {
+	noDeletes := false
+	config := &WatchConfig{
+		Mappings: []MappingConfig{
+			{Prefix: "app1", Path: "/etc/"},
+			{Prefix: "app2", Path: "/etc/app2"},
+			{Prefix: "app3", Path: "/"},
+			{Prefix: "app4", Path: "/etc", ManageDeletes: &noDeletes},
+			{Prefix: "app5", Path: "/srv/app5"},
+		},
+		DangerousPaths: []string{"/srv"},
+	}
+	applyDefaults(config)
+
+	if errs := checkDangerousPaths(config); len(errs) != 2 {
+		t.Fatalf("Expected errors for /etc and / but got %v", errs)
+	}
+
+	config.DangerousPaths = []string{"/srv/app5/data"}
+	if errs := checkDangerousPaths(config); len(errs) != 3 {
+		t.Fatalf("Expected an error for a mapping containing a configured path but got %v", errs)
+	}
+
+	config.IKnowWhatImDoing = true
+	if errs := checkDangerousPaths(config); len(errs) != 0 {
+		t.Fatalf("Expected no errors once acknowledged but got %v", errs)
+	}
+}
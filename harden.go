@@ -0,0 +1,99 @@
+package fsconsul
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// HardenConfig holds the configuration for restricting what the process can do once started
+type HardenConfig struct {
+	Enabled bool
+
+	// Further paths to allow, e.g. for onchange commands that touch files outside the mappings
+	ReadPaths  []string
+	WritePaths []string
+}
+
+// System directories needed to resolve names, verify certificates and run onchange commands.
+var systemReadPaths = []string{"/etc", "/usr", "/bin", "/sbin", "/lib", "/lib64", "/opt"}
+
+// Work out which paths the process needs to read and write once started: the mappings'
+// target and staging directories, the temp directory, keystores, TLS material and the
+// commands it runs.
+func hardenedPaths(config *WatchConfig) (readPaths, writePaths []string) {
+	readPaths = append(readPaths, systemReadPaths...)
+	readPaths = append(readPaths, config.Harden.ReadPaths...)
+	for _, path := range []string{config.Consul.CAFile, config.Consul.CertFile, config.Consul.KeyFile, config.Vault.CAFile, config.Vault.AppRole.SecretIDFile, config.SourceFile, config.Replay} {
+		if path != "" {
+			readPaths = append(readPaths, path)
+		}
+	}
+
+	writePaths = append(writePaths, os.TempDir(), os.DevNull)
+	writePaths = append(writePaths, config.Harden.WritePaths...)
+	if config.StateFile != "" {
+		writePaths = append(writePaths, filepath.Dir(config.StateFile))
+	}
+	if config.Record != "" {
+		writePaths = append(writePaths, config.Record)
+	}
+	if config.Log.Journald {
+		// Large journal entries are passed through a file in /dev/shm
+		writePaths = append(writePaths, "/dev/shm")
+	}
+
+	for _, mappingConfig := range config.Mappings {
+		if mappingConfig.Consul != nil {
+			for _, path := range []string{mappingConfig.Consul.CAFile, mappingConfig.Consul.CertFile, mappingConfig.Consul.KeyFile} {
+				if path != "" {
+					readPaths = append(readPaths, path)
+				}
+			}
+		}
+		writePaths = append(writePaths, mappingConfig.Path)
+		if mappingConfig.StagingDir != "" {
+			writePaths = append(writePaths, mappingConfig.StagingDir)
+		}
+		if mappingConfig.Socket != "" {
+			writePaths = append(writePaths, filepath.Dir(mappingConfig.Socket))
+		}
+		if mappingConfig.Drift.MetricsFile != "" {
+			writePaths = append(writePaths, filepath.Dir(mappingConfig.Drift.MetricsFile))
+		}
+		if mappingConfig.Staleness.Marker != "" {
+			writePaths = append(writePaths, filepath.Dir(mappingConfig.Staleness.Marker))
+		}
+		// Keys from the Keychain are fetched into the temp directory
+		for _, keystore := range mappingConfig.keystores() {
+			if !isKeychain(keystore) {
+				readPaths = append(readPaths, keystore)
+			}
+		}
+		if mappingConfig.Skeleton != "" {
+			readPaths = append(readPaths, mappingConfig.Skeleton)
+		}
+		if len(mappingConfig.OnChange) > 0 {
+			readPaths = appendCommandDir(readPaths, mappingConfig.OnChange[0])
+		}
+		for _, command := range []string{mappingConfig.Staleness.Command, mappingConfig.ConfirmDeletes.Command} {
+			if command != "" {
+				readPaths = appendCommandDir(readPaths, strings.Split(command, " ")[0])
+			}
+		}
+	}
+	if config.Exec.Command != "" {
+		readPaths = appendCommandDir(readPaths, strings.Split(config.Exec.Command, " ")[0])
+	}
+
+	return readPaths, writePaths
+}
+
+// Allow reading and running a command's binary, wherever it's found on the PATH.
+func appendCommandDir(readPaths []string, name string) []string {
+	if command, err := exec.LookPath(name); err == nil {
+		readPaths = append(readPaths, filepath.Dir(command))
+	}
+	return readPaths
+}
@@ -0,0 +1,197 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	landlockAccessExecute    = 1 << 0
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessReadFile   = 1 << 2
+	landlockAccessReadDir    = 1 << 3
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+	landlockAccessRefer      = 1 << 13
+
+	landlockFileAccess = landlockAccessExecute | landlockAccessWriteFile | landlockAccessReadFile
+	landlockReadAccess = landlockAccessExecute | landlockAccessReadFile | landlockAccessReadDir
+	landlockAllAccess  = 1<<13 - 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+
+	// Offsets into struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// Syscalls fsconsul never needs, which would let a compromised process escape or tamper
+// with the host.  Denied with EPERM rather than killing the process.
+var deniedSyscalls = append([]uint32{
+	syscall.SYS_PTRACE,
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_CHROOT,
+	syscall.SYS_REBOOT,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_UNSHARE,
+	syscall.SYS_PERF_EVENT_OPEN,
+	syscall.SYS_ACCT,
+	syscall.SYS_SETTIMEOFDAY,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_KEYCTL,
+	syscall.SYS_REQUEST_KEY,
+}, archDeniedSyscalls...)
+
+// Restrict the process (and the onchange commands it runs) to the filesystem access it
+// needs and deny syscalls it never makes.
+func harden(config *WatchConfig) error {
+	// Restrictions must apply to every thread, which the runtime can only arrange without cgo
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno == syscall.ENOTSUP {
+		return fmt.Errorf("hardening needs a build with CGO_ENABLED=0")
+	} else if errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %v", errno)
+	}
+
+	if err := landlock(hardenedPaths(config)); err != nil {
+		return err
+	}
+
+	return seccomp()
+}
+
+func landlock(readPaths, writePaths []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		log.WithFields(log.Fields{
+			"error": errno,
+		}).Warn("Landlock isn't available, filesystem access won't be restricted")
+		return nil
+	}
+
+	// Renaming between directories (from a staging directory) needs ABI 2
+	handled := uint64(landlockAllAccess &^ landlockAccessRefer)
+	if abi >= 2 {
+		handled |= landlockAccessRefer
+	}
+
+	attr := landlockRulesetAttr{handledAccessFS: handled}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, path := range readPaths {
+		if err := landlockAllow(int(fd), path, landlockReadAccess); err != nil {
+			return err
+		}
+	}
+	for _, path := range writePaths {
+		if err := landlockAllow(int(fd), path, handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to apply landlock ruleset: %v", errno)
+	}
+
+	return nil
+}
+
+// Allow the given access beneath path, skipping paths that don't exist.
+func landlockAllow(rulesetFd int, path string, access uint64) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Rules for files may only grant access that applies to files
+	if !info.IsDir() {
+		access &= landlockFileAccess
+	}
+
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer syscall.Close(fd)
+
+	attr := landlockPathBeneathAttr{allowedAccess: access, parentFd: int32(fd)}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to allow access to %s: %v", path, errno)
+	}
+
+	return nil
+}
+
+func seccomp() error {
+	filter := []syscall.SockFilter{
+		// Kill the process if it makes syscalls for another architecture, whose numbers differ
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataArch},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: auditArch},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetKillProcess},
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataNr},
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter,
+			syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 1, K: nr},
+			syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)})
+	}
+	filter = append(filter, syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow})
+
+	program := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.Syscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return fmt.Errorf("failed to apply seccomp filter: %v", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package fsconsul
+
+const (
+	auditArch  = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp = 317
+
+	// For passing files to socket mappings' consumers
+	sysMemfdCreate = 319
+)
+
+// Denied syscalls missing from the syscall package on amd64.
+var archDeniedSyscalls = []uint32{
+	308, // setns
+	310, // process_vm_readv
+	311, // process_vm_writev
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+}
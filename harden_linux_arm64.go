@@ -0,0 +1,20 @@
+package fsconsul
+
+import "syscall"
+
+const (
+	auditArch  = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSeccomp = syscall.SYS_SECCOMP
+
+	// For passing files to socket mappings' consumers
+	sysMemfdCreate = 279
+)
+
+var archDeniedSyscalls = []uint32{
+	syscall.SYS_SETNS,
+	syscall.SYS_PROCESS_VM_READV,
+	syscall.SYS_PROCESS_VM_WRITEV,
+	syscall.SYS_FINIT_MODULE,
+	294, // kexec_file_load
+	syscall.SYS_BPF,
+}
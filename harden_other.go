@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package fsconsul
+
+import "fmt"
+
+func harden(config *WatchConfig) error {
+	return fmt.Errorf("hardening is only supported on Linux (amd64 and arm64)")
+}
@@ -0,0 +1,48 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestHardenedPathsCoverMappingCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are shell scripts here")
+	}
+
+	tempDir := t.TempDir()
+	command := func(name string) string {
+		dir := filepath.Join(tempDir, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	config := &WatchConfig{
+		Exec: ExecConfig{Command: command("supervised") + " --config /etc/app.conf"},
+		Mappings: []MappingConfig{{
+			Path:           filepath.Join(tempDir, "app"),
+			OnChange:       []string{command("onchange")},
+			Staleness:      StalenessConfig{Marker: filepath.Join(tempDir, "markers", "stale"), Command: command("stale") + " app"},
+			ConfirmDeletes: ConfirmDeletesConfig{Threshold: 10, Command: command("confirm")},
+		}},
+	}
+	readPaths, writePaths := hardenedPaths(config)
+
+	for _, name := range []string{"supervised", "onchange", "stale", "confirm"} {
+		if !containsString(readPaths, filepath.Join(tempDir, name)) {
+			t.Errorf("expected the %s command's directory to be readable, got %v", name, readPaths)
+		}
+	}
+	if !containsString(writePaths, filepath.Join(tempDir, "markers")) {
+		t.Errorf("expected the stale marker's directory to be writable, got %v", writePaths)
+	}
+}
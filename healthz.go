@@ -0,0 +1,198 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a mapping may go without syncing with Consul before it's unhealthy, unless
+// configured otherwise.  Blocking queries return at least every five minutes, even when
+// nothing changes.
+const defaultHealthMaxAge = 10 * time.Minute
+
+// HealthConfig holds the configuration of the HTTP health check endpoint, for liveness and
+// readiness probes.
+type HealthConfig struct {
+	// Address to serve /healthz on, e.g. 127.0.0.1:8080 (empty disables it)
+	Addr string
+
+	// How long since a mapping last synced with Consul before it's unhealthy (10m by default)
+	MaxAge Duration
+}
+
+// healthServer reports whether every running mapping, of every profile, has synced with
+// Consul recently.
+type healthServer struct {
+	maxAge   time.Duration
+	listener net.Listener
+
+	mu       sync.Mutex
+	profiles map[string][]*mappingRun
+}
+
+// mappingHealth is the health of a single mapping, as reported by /healthz.
+type mappingHealth struct {
+	Profile  string    `json:"profile,omitempty"`
+	Mapping  string    `json:"mapping"`
+	Healthy  bool      `json:"healthy"`
+	Rendered bool      `json:"rendered"`
+	LastSync time.Time `json:"lastSync"`
+	Error    string    `json:"error,omitempty"`
+
+	// How long it has been since the mapping last synced (or started, if it hasn't), for
+	// alerting on stale configuration without parsing lastSync
+	SecondsSinceSync int64 `json:"secondsSinceSync"`
+
+	// Whether Consul or Vault has been unreachable long enough for the mapping to be
+	// serving the files it has as they were, and since when requests have been failing
+	Degraded     bool       `json:"degraded"`
+	FailingSince *time.Time `json:"failingSince,omitempty"`
+
+	// Required keys missing from the last snapshot, which the mapping refused to apply
+	MissingKeys []string `json:"missingKeys,omitempty"`
+
+	// Empty values the mapping's snapshots have had, whatever the policy for them
+	EmptyValues int `json:"emptyValues"`
+
+	// Snapshots waiting to be applied, e.g. behind a slow onchange command, and those
+	// coalesced into later ones or dropped
+	Queued    int `json:"queued"`
+	Coalesced int `json:"coalesced"`
+	Dropped   int `json:"dropped"`
+}
+
+// Start serving /healthz, or nothing without an address.
+func startHealthServer(config HealthConfig) (*healthServer, error) {
+	if config.Addr == "" {
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &healthServer{
+		maxAge:   time.Duration(config.MaxAge),
+		listener: listener,
+		profiles: make(map[string][]*mappingRun),
+	}
+	if h.maxAge <= 0 {
+		h.maxAge = defaultHealthMaxAge
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	go http.Serve(listener, mux)
+	return h, nil
+}
+
+// Stop serving.  Safe to call on a nil healthServer.
+func (h *healthServer) close() {
+	if h != nil {
+		h.listener.Close()
+	}
+}
+
+// Set the running mappings of a profile, whenever they change.  Safe to call on a nil
+// healthServer.
+func (h *healthServer) setRuns(profile string, runs []*mappingRun) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.profiles[profile] = append([]*mappingRun(nil), runs...)
+}
+
+// Check every running mapping: it must still be watching, have rendered at least once,
+// have applied its last snapshot and have synced within the maximum age.
+func (h *healthServer) check(now time.Time) []mappingHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var checks []mappingHealth
+	for profile, runs := range h.profiles {
+		for _, run := range runs {
+			check := mappingHealth{
+				Profile:  profile,
+				Mapping:  run.config.Name,
+				LastSync: run.lastSynced(),
+
+				MissingKeys: run.missingKeys(),
+				EmptyValues: run.emptyValueCount(),
+			}
+			check.SecondsSinceSync = int64(now.Sub(check.LastSync) / time.Second)
+			check.Queued, check.Coalesced, check.Dropped = run.backlog()
+			degraded, failingSince := run.conn.state()
+			check.Degraded = degraded
+			if !failingSince.IsZero() {
+				check.FailingSince = &failingSince
+			}
+			select {
+			case <-run.rendered:
+				check.Rendered = true
+			default:
+			}
+
+			select {
+			case <-run.done:
+				check.Error = "mapping has stopped"
+			default:
+				if err := run.failure(); err != nil {
+					check.Error = err.Error()
+				} else if !check.Rendered {
+					check.Error = "mapping hasn't rendered yet"
+				} else if now.Sub(check.LastSync) > h.maxAge {
+					check.Error = "mapping hasn't synced with consul recently"
+				}
+			}
+			check.Healthy = check.Error == ""
+			checks = append(checks, check)
+		}
+	}
+
+	sort.Slice(checks, func(i, j int) bool {
+		if checks[i].Profile != checks[j].Profile {
+			return checks[i].Profile < checks[j].Profile
+		}
+		return checks[i].Mapping < checks[j].Mapping
+	})
+	return checks
+}
+
+func (h *healthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	checks := h.check(time.Now())
+
+	healthy := len(checks) > 0
+	degraded := false
+	for _, check := range checks {
+		healthy = healthy && check.Healthy
+		degraded = degraded || check.Degraded
+	}
+
+	// Degraded mappings are still serving files, so only fail the check once they've gone
+	// too long without syncing
+	status := "ok"
+	if !healthy {
+		status = "unhealthy"
+	} else if degraded {
+		status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Healthy  bool            `json:"healthy"`
+		Status   string          `json:"status"`
+		Degraded bool            `json:"degraded"`
+		Mappings []mappingHealth `json:"mappings"`
+	}{healthy, status, degraded, checks})
+}
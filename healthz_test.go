@@ -0,0 +1,111 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthServer(t *testing.T) {
+	health, err := startHealthServer(HealthConfig{Addr: "127.0.0.1:0", MaxAge: Duration(time.Minute)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer health.close()
+
+	get := func() (int, []mappingHealth) {
+		resp, err := http.Get("http://" + health.listener.Addr().String() + "/healthz")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			Healthy  bool
+			Mappings []mappingHealth
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return resp.StatusCode, body.Mappings
+	}
+
+	// Nothing running isn't healthy
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without mappings, got %d", code)
+	}
+
+	a := newMappingRun(&MappingConfig{Name: "a"}, nil)
+	b := newMappingRun(&MappingConfig{Name: "b"}, nil)
+	health.setRuns("", []*mappingRun{a})
+	health.setRuns("search", []*mappingRun{b})
+
+	if code, mappings := get(); code != http.StatusServiceUnavailable || len(mappings) != 2 || mappings[1].Profile != "search" {
+		t.Fatalf("expected mappings that haven't rendered to be unhealthy, got %d %v", code, mappings)
+	}
+
+	a.markRendered()
+	b.markRendered()
+	if code, _ := get(); code != http.StatusOK {
+		t.Fatalf("expected rendered mappings to be healthy, got %d", code)
+	}
+
+	b.failed(errors.New("could not execute template"))
+	if code, mappings := get(); code != http.StatusServiceUnavailable || !mappings[0].Healthy || mappings[1].Healthy {
+		t.Fatalf("expected only the failing mapping to be unhealthy, got %d %v", code, mappings)
+	}
+	b.synced()
+
+	// A mapping that hasn't synced for too long is unhealthy
+	checks := health.check(time.Now().Add(2 * time.Minute))
+	if checks[0].Healthy || checks[0].Error == "" {
+		t.Fatalf("expected a stale mapping to be unhealthy, got %v", checks[0])
+	}
+	if checks[0].SecondsSinceSync < 120 {
+		t.Fatalf("expected at least 120 seconds since the last sync, got %d", checks[0].SecondsSinceSync)
+	}
+}
+
+func TestHealthDegraded(t *testing.T) {
+	conn := newConnectivity(DegradedConfig{After: Duration(time.Millisecond)})
+	run := newMappingRun(&MappingConfig{Name: "app"}, nil)
+	run.conn = conn
+	run.markRendered()
+
+	health := &healthServer{maxAge: time.Minute, profiles: map[string][]*mappingRun{"": {run}}}
+	if checks := health.check(time.Now()); checks[0].Degraded || checks[0].FailingSince != nil {
+		t.Fatalf("expected a reachable backend not to be reported, got %v", checks[0])
+	}
+
+	conn.failed()
+	time.Sleep(5 * time.Millisecond)
+	conn.failed()
+	checks := health.check(time.Now())
+	if !checks[0].Degraded || checks[0].FailingSince == nil || !checks[0].Healthy {
+		t.Fatalf("expected a degraded mapping still serving its files, got %v", checks[0])
+	}
+
+	conn.succeeded()
+	if checks := health.check(time.Now()); checks[0].Degraded || checks[0].FailingSince != nil {
+		t.Fatalf("expected the mapping to recover, got %v", checks[0])
+	}
+}
+
+func TestHealthMissingKeys(t *testing.T) {
+	run := newMappingRun(&MappingConfig{Name: "app"}, nil)
+	run.markRendered()
+	health := &healthServer{maxAge: time.Minute, profiles: map[string][]*mappingRun{"": {run}}}
+
+	run.refused([]string{"db.conf"}, errors.New("snapshot is missing required keys"))
+	checks := health.check(time.Now())
+	if checks[0].Healthy || len(checks[0].MissingKeys) != 1 || checks[0].MissingKeys[0] != "db.conf" {
+		t.Fatalf("expected a mapping refusing its snapshot to list the missing keys, got %v", checks[0])
+	}
+
+	run.synced()
+	if checks := health.check(time.Now()); !checks[0].Healthy || checks[0].MissingKeys != nil {
+		t.Fatalf("expected the mapping to recover once a complete snapshot applies, got %v", checks[0])
+	}
+}
@@ -0,0 +1,35 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+)
+
+// The file a mapping with indexfile records the last snapshot it applied in, in its path.
+// Like fsconsul's other files there, it's never pruned or verified.
+const indexFileName = ".fsconsul-index"
+
+// The variable a mapping with execenv and indexfile gives the process run with exec the
+// index in.
+const indexEnvVar = "FSCONSUL_INDEX"
+
+// indexRecord is the content of an index file.
+type indexRecord struct {
+	Index   uint64    `json:"index"`
+	Applied time.Time `json:"applied"`
+}
+
+// Record that a mapping has applied the snapshot at index, so that the services reading
+// its files can tell which version they're reading.  The file is replaced atomically, so
+// it's never seen half written.
+func writeIndexFile(mappingConfig *MappingConfig, index uint64, applied time.Time) error {
+	content, err := json.Marshal(indexRecord{index, applied.UTC()})
+	if err != nil {
+		return err
+	}
+
+	atomic := *mappingConfig
+	atomic.AtomicWrites, atomic.DeltaWrites = true, false
+	return writeKeyFile(&atomic, filepath.Join(mappingConfig.Path, indexFileName), append(content, '\n'))
+}
@@ -0,0 +1,54 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestIndexFile(t *testing.T) {
+	replay := t.TempDir()
+	snapshot := kvSnapshot{consulapi.KVPairs{{Key: "app/a.conf", Value: []byte("a"), ModifyIndex: 7}}, 7}
+	if err := recordSnapshot(replay, "app", snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	config := &WatchConfig{
+		RunOnce:  true,
+		Replay:   replay,
+		Mappings: []MappingConfig{{Name: "app", Prefix: "app/", Path: dir, IndexFile: true}},
+	}
+	started := time.Now()
+	if code := watchAndExec(config); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, indexFileName))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var record indexRecord
+	if err := json.Unmarshal(content, &record); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if record.Index != 7 || record.Applied.Before(started.Add(-time.Second)) {
+		t.Fatalf("unexpected index file %s", content)
+	}
+
+	// The index changing alone doesn't restart the process run with exec
+	child := &supervisor{changes: make(chan struct{}, 1)}
+	if !child.setEnv("app", map[string]string{"A": "1", indexEnvVar: "7"}) {
+		t.Fatal("expected the first variables to restart the child")
+	}
+	if child.setEnv("app", map[string]string{"A": "1", indexEnvVar: "8"}) {
+		t.Error("expected a new index alone not to restart the child")
+	}
+	if !child.setEnv("app", map[string]string{"A": "2", indexEnvVar: "9"}) {
+		t.Error("expected a changed variable to restart the child")
+	}
+}
@@ -0,0 +1,79 @@
+package fsconsul
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Transformations of key names into file (and variable) names.
+const (
+	keyCaseLower = "lower"
+	keyCaseUpper = "upper"
+	keyCaseSnake = "snake" // camelCase to snake_case
+)
+
+// Determine the name of a key's file relative to the mapping's path, once any evaluation
+// suffix is stripped and the mapping's KeyCase is applied.
+func fileKey(mappingConfig *MappingConfig, key string) string {
+	return casedKey(mappingConfig.KeyCase, evaluatedKey(mappingConfig, key))
+}
+
+func casedKey(keyCase, key string) string {
+	switch keyCase {
+	case keyCaseLower:
+		return strings.ToLower(key)
+	case keyCaseUpper:
+		return strings.ToUpper(key)
+	case keyCaseSnake:
+		return snakeCase(key)
+	default:
+		return key
+	}
+}
+
+// Convert camelCase to snake_case, keeping acronyms together, so that "myHTTPServer"
+// becomes "my_http_server".
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// Drop the keys of a snapshot whose file names collide once cased, keeping the first of
+// each in lexical order, so which key a file holds doesn't depend on map order.  Returns
+// the dropped keys, in order.
+func dropCaseCollisions(mappingConfig *MappingConfig, env map[string]string) []string {
+	if mappingConfig.KeyCase == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[string]bool, len(keys))
+	var dropped []string
+	for _, k := range keys {
+		name := fileKey(mappingConfig, k)
+		if seen[name] {
+			delete(env, k)
+			dropped = append(dropped, k)
+			continue
+		}
+		seen[name] = true
+	}
+	return dropped
+}
@@ -0,0 +1,41 @@
+package fsconsul
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCasedKey(t *testing.T) {
+	for _, test := range []struct {
+		keyCase, key, want string
+	}{
+		{"", "myApp/Config.yaml", "myApp/Config.yaml"},
+		{keyCaseLower, "myApp/Config.yaml", "myapp/config.yaml"},
+		{keyCaseUpper, "db/poolSize", "DB/POOLSIZE"},
+		{keyCaseSnake, "myApp/serverConfig.yaml", "my_app/server_config.yaml"},
+		{keyCaseSnake, "myHTTPServer", "my_http_server"},
+		{keyCaseSnake, "Version2Name", "version2_name"},
+		{keyCaseSnake, "already_snake", "already_snake"},
+	} {
+		if got := casedKey(test.keyCase, test.key); got != test.want {
+			t.Errorf("%q of %s: expected %s, got %s", test.keyCase, test.key, test.want, got)
+		}
+	}
+}
+
+func TestDropCaseCollisions(t *testing.T) {
+	env := map[string]string{"App": "1", "app": "2", "other": "3"}
+	dropped := dropCaseCollisions(&MappingConfig{KeyCase: keyCaseLower}, env)
+	if !reflect.DeepEqual(dropped, []string{"app"}) {
+		t.Errorf("expected app to be dropped, got %v", dropped)
+	}
+	if !reflect.DeepEqual(env, map[string]string{"App": "1", "other": "3"}) {
+		t.Errorf("expected App and other to be kept, got %v", env)
+	}
+
+	mappingConfig := &MappingConfig{KeyCase: keyCaseSnake}
+	exploded := string(explodeEnv(mappingConfig, []string{"db/poolSize"}, map[string]string{"db/poolSize": "5"}))
+	if exploded != "DB_POOL_SIZE=5\n" {
+		t.Errorf("expected a snake-cased variable, got %q", exploded)
+	}
+}
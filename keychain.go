@@ -0,0 +1,125 @@
+package fsconsul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Keystores given as keychain:<service> are read from the macOS Keychain: each key is a
+// generic password of the service, with the key's name as its account.
+const keychainPrefix = "keychain:"
+
+// keychainStore holds the keys fetched from the Keychain, in a private directory for
+// gosecret to read them from, for the life of the process.
+type keychainStore struct {
+	service string
+	dir     string
+
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+var (
+	keychainsLock sync.Mutex
+	keychains     = make(map[string]*keychainStore)
+)
+
+// Matches gosecret tags, [gosecret|caption|ciphertext|iv|keyname]
+var gosecretTag = regexp.MustCompile(`\[gosecret\|[^\]]*\]`)
+
+func isKeychain(keystore string) bool {
+	return strings.HasPrefix(keystore, keychainPrefix)
+}
+
+// List the names of the keys the gosecret tags in a value are encrypted with.
+func gosecretKeyNames(value []byte) []string {
+	var names []string
+	for _, tag := range gosecretTag.FindAll(value, -1) {
+		parts := strings.Split(string(tag[1:len(tag)-1]), "|")
+		if len(parts) == 5 {
+			names = append(names, parts[4])
+		}
+	}
+	return names
+}
+
+// Get the directory of a keystore holding the named keys.  A Keychain keystore fetches the
+// keys it hasn't yet.
+func resolveKeystore(keystore string, keyNames ...string) (string, error) {
+	if !isKeychain(keystore) {
+		return keystore, nil
+	}
+
+	store, err := keychainFor(strings.TrimPrefix(keystore, keychainPrefix))
+	if err != nil {
+		return "", err
+	}
+	for _, name := range keyNames {
+		if err := store.fetch(name); err != nil {
+			return "", err
+		}
+	}
+	return store.dir, nil
+}
+
+func keychainFor(service string) (*keychainStore, error) {
+	if runtime.GOOS != "darwin" {
+		return nil, fmt.Errorf("keychain keystores are only available on macOS")
+	}
+
+	keychainsLock.Lock()
+	defer keychainsLock.Unlock()
+
+	if store, ok := keychains[service]; ok {
+		return store, nil
+	}
+
+	dir, err := ioutil.TempDir("", "fsconsul-keychain-")
+	if err != nil {
+		return nil, err
+	}
+	store := &keychainStore{service: service, dir: dir, fetched: make(map[string]bool)}
+	keychains[service] = store
+	return store, nil
+}
+
+func (store *keychainStore) fetch(name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.fetched[name] {
+		return nil
+	}
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid key name %q", name)
+	}
+
+	out, err := exec.Command("security", "find-generic-password", "-s", store.service, "-a", name, "-w").Output()
+	if err != nil {
+		return fmt.Errorf("failed to read key %s of %s from the keychain: %v", name, store.service, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(store.dir, name), []byte(strings.TrimSpace(string(out))), 0600); err != nil {
+		return err
+	}
+	store.fetched[name] = true
+	return nil
+}
+
+// Remove the keys fetched from the Keychain from disk.
+func removeKeychains() {
+	keychainsLock.Lock()
+	defer keychainsLock.Unlock()
+
+	for service, store := range keychains {
+		os.RemoveAll(store.dir)
+		delete(keychains, service)
+	}
+}
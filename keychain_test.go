@@ -0,0 +1,20 @@
+package fsconsul
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGosecretKeyNames(t *testing.T) {
+	value := []byte("user=[gosecret|db user|Y2lwaGVy|aXY=|dbkey]\npass=[gosecret|db pass|Y2lwaGVy|aXY=|otherkey]\n[gosecret|not a tag]")
+
+	names := gosecretKeyNames(value)
+	if !reflect.DeepEqual(names, []string{"dbkey", "otherkey"}) {
+		t.Errorf("unexpected key names %v", names)
+	}
+
+	// Directories are passed through as they are
+	if dir, err := resolveKeystore("/var/lib/keys", names...); err != nil || dir != "/var/lib/keys" {
+		t.Errorf("unexpected keystore %q: %v", dir, err)
+	}
+}
@@ -0,0 +1,53 @@
+package fsconsul
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Check that a key's file is inside the mapping's path: none of its segments may be . or
+// .., and it mustn't hold anything the platform would read as a separator, drive or
+// stream.  Keys are relative to the prefix, and a trailing slash marks a folder.
+func checkKeyPath(mappingConfig *MappingConfig, key string) error {
+	name := fileKey(mappingConfig, key)
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("key %q has a NUL byte", key)
+	}
+	if runtime.GOOS == "windows" && strings.ContainsAny(name, `\:`) {
+		return fmt.Errorf("key %q has a backslash or colon, which Windows reads as a path", key)
+	}
+
+	for _, segment := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("key %q would be written outside %s", key, mappingConfig.Path)
+		}
+	}
+	return nil
+}
+
+// Drop the keys of a snapshot whose files wouldn't be inside the mapping's path, so that
+// whoever can write to the prefix can't write anywhere else.  Returns why each was dropped,
+// in order.  Keys that don't name files (for exploding, registry, socket and environment
+// mappings) are left alone.
+func dropUnsafeKeys(mappingConfig *MappingConfig, env map[string]string) []error {
+	if mappingConfig.Format != "" || mappingConfig.Registry != "" || mappingConfig.Socket != "" || mappingConfig.envOnly() {
+		return nil
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		if err := checkKeyPath(mappingConfig, k); err != nil {
+			delete(env, k)
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,39 @@
+package fsconsul
+
+import (
+	"testing"
+)
+
+func TestDropUnsafeKeys(t *testing.T) {
+	mappingConfig := &MappingConfig{Path: "/etc/app/", Evaluate: true}
+	env := map[string]string{
+		"app.conf":          "",
+		"conf.d/":           "",
+		"..hidden":          "",
+		"../../etc/passwd":  "",
+		"a/../../b":         "",
+		"./a":               "",
+		"...jsonnet":        "",
+		"conf.d/site.conf":  "",
+		"conf.d/../../shad": "",
+	}
+
+	errs := dropUnsafeKeys(mappingConfig, env)
+	if len(errs) != 5 {
+		t.Errorf("expected 5 keys to be dropped, got %v", errs)
+	}
+	for _, k := range []string{"app.conf", "conf.d/", "..hidden", "conf.d/site.conf"} {
+		if _, ok := env[k]; !ok {
+			t.Errorf("expected %s to be kept", k)
+		}
+	}
+	if len(env) != 4 {
+		t.Errorf("expected only the safe keys to be kept, got %v", env)
+	}
+
+	// Exploded keys don't name files
+	exploded := map[string]string{"../x": ""}
+	if errs := dropUnsafeKeys(&MappingConfig{Format: "json"}, exploded); len(errs) != 0 || len(exploded) != 1 {
+		t.Errorf("expected exploded keys to be left alone, got %v", errs)
+	}
+}
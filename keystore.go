@@ -0,0 +1,151 @@
+package fsconsul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often keystore directories are checked for added, removed and replaced keys.
+var keystorePollInterval = 10 * time.Second
+
+// The keystores a mapping decrypts values with, in the order they're tried.
+func (mappingConfig *MappingConfig) keystores() []string {
+	if mappingConfig.Keystore == "" {
+		return nil
+	}
+	return append([]string{mappingConfig.Keystore}, mappingConfig.Keystores...)
+}
+
+// Decrypt the gosecret tags in a value.  With several keystores, each tag is decrypted
+// with its key from the first keystore that has it, so that values encrypted with a key
+// being rotated out still decrypt.
+func decryptGosecret(keystores []string, value []byte) ([]byte, error) {
+	if len(keystores) == 1 {
+		keystore, err := resolveKeystore(keystores[0], gosecretKeyNames(value)...)
+		if err != nil {
+			return nil, &decryptionError{fmt.Errorf("failed to read keystore: %v", err)}
+		}
+		decrypted, err := gosecret.DecryptTags(value, keystore)
+		if err != nil {
+			return nil, &decryptionError{fmt.Errorf("failed to decrypt value: %v", err)}
+		}
+		return decrypted, nil
+	}
+
+	var firstErr error
+	decrypted := gosecretTag.ReplaceAllFunc(value, func(tag []byte) []byte {
+		if firstErr != nil {
+			return tag
+		}
+		keystore, err := keystoreWith(keystores, gosecretKeyNames(tag))
+		if err != nil {
+			firstErr = &decryptionError{fmt.Errorf("failed to read keystore: %v", err)}
+			return tag
+		}
+		plaintext, err := gosecret.DecryptTags(tag, keystore)
+		if err != nil {
+			firstErr = &decryptionError{fmt.Errorf("failed to decrypt value: %v", err)}
+			return tag
+		}
+		return plaintext
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return decrypted, nil
+}
+
+// Get the directory of the first keystore holding the named keys.
+func keystoreWith(keystores []string, keyNames []string) (string, error) {
+	if len(keystores) == 1 {
+		return resolveKeystore(keystores[0], keyNames...)
+	}
+
+	for _, keystore := range keystores {
+		if isKeychain(keystore) {
+			if dir, err := resolveKeystore(keystore, keyNames...); err == nil {
+				return dir, nil
+			}
+			continue
+		}
+
+		found := true
+		for _, name := range keyNames {
+			if _, err := os.Stat(filepath.Join(keystore, name)); err != nil {
+				found = false
+				break
+			}
+		}
+		if found {
+			return keystore, nil
+		}
+	}
+	return "", fmt.Errorf("no keystore has key %s", strings.Join(keyNames, ", "))
+}
+
+// Poll a mapping's keystore directories, receiving on the channel returned whenever keys
+// are added, removed or replaced, until quitCh is closed.  Keys are read as values are
+// decrypted, so a rotated key is used from the next snapshot on; this lets the snapshot
+// already applied be rendered again with it.  Keychain keystores aren't watched.
+func watchKeystores(run *mappingRun, quitCh <-chan struct{}) <-chan struct{} {
+	var dirs []string
+	for _, keystore := range run.config.keystores() {
+		if !isKeychain(keystore) {
+			dirs = append(dirs, keystore)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	changed := make(chan struct{}, 1)
+	last := keystoreSignature(dirs)
+	go func() {
+		ticker := time.NewTicker(keystorePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-quitCh:
+				return
+			}
+
+			if current := keystoreSignature(dirs); current != last {
+				run.logger.WithFields(log.Fields{
+					"keystores": dirs,
+				}).Info("Keystore changed")
+				last = current
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
+
+// Sum up the keys in keystore directories, by name, size and modification time.
+func keystoreSignature(dirs []string) string {
+	var b strings.Builder
+	for _, dir := range dirs {
+		fmt.Fprintf(&b, "%s:", dir)
+		keys, err := ioutil.ReadDir(dir)
+		if err != nil {
+			fmt.Fprintf(&b, "%v;", err)
+			continue
+		}
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s,%d,%d;", key.Name(), key.Size(), key.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
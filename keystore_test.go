@@ -0,0 +1,43 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeystores(t *testing.T) {
+	current, previous := t.TempDir(), t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(previous, "old"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keystores := (&MappingConfig{Keystore: current, Keystores: []string{previous}}).keystores()
+
+	// Keys are taken from the first keystore that has them
+	if dir, err := keystoreWith(keystores, []string{"old"}); err != nil || dir != previous {
+		t.Fatalf("expected the old key from the previous keystore, got %s (%v)", dir, err)
+	}
+	if _, err := keystoreWith(keystores, []string{"missing"}); err == nil {
+		t.Fatal("expected an error for a key no keystore has")
+	}
+
+	defer func(interval time.Duration) { keystorePollInterval = interval }(keystorePollInterval)
+	keystorePollInterval = 10 * time.Millisecond
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+	changed := watchKeystores(newMappingRun(&MappingConfig{Keystore: current, Keystores: []string{previous}}, nil), quitCh)
+
+	// Adding a key to the current keystore is noticed
+	if err := ioutil.WriteFile(filepath.Join(current, "old"), []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the new key to be noticed")
+	}
+	if dir, err := keystoreWith(keystores, []string{"old"}); err != nil || dir != current {
+		t.Fatalf("expected the rotated key from the current keystore, got %s (%v)", dir, err)
+	}
+}
@@ -0,0 +1,192 @@
+package fsconsul
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// kvExportEntry is a key in the format written by `consul kv export` and read by
+// `consul kv import`, so that snapshots can be restored with either tool.  fsconsul
+// snapshots also record each key's modify index, for check-and-set imports; consul
+// ignores it.
+type kvExportEntry struct {
+	Key         string `json:"key"`
+	Flags       uint64 `json:"flags"`
+	Value       string `json:"value"`
+	ModifyIndex uint64 `json:"modifyIndex,omitempty"`
+}
+
+func encodeKVExport(pairs consulapi.KVPairs) ([]byte, error) {
+	entries := make([]kvExportEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		entries = append(entries, kvExportEntry{
+			Key:         pair.Key,
+			Flags:       pair.Flags,
+			Value:       base64.StdEncoding.EncodeToString(pair.Value),
+			ModifyIndex: pair.ModifyIndex,
+		})
+	}
+
+	// Indented with tabs like the consul CLI
+	encoded, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(encoded, '\n'), nil
+}
+
+func decodeKVExport(data []byte) (consulapi.KVPairs, error) {
+	var entries []kvExportEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("not in consul kv export format: %v", err)
+	}
+
+	pairs := make(consulapi.KVPairs, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Key == "" {
+			return nil, fmt.Errorf("entry without a key")
+		}
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s isn't valid base64: %v", entry.Key, err)
+		}
+		pairs = append(pairs, &consulapi.KVPair{Key: entry.Key, Flags: entry.Flags, Value: value, ModifyIndex: entry.ModifyIndex})
+	}
+	return pairs, nil
+}
+
+func snapshotCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul snapshot", snapshotHelpText, &opts)
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.loadConfig(log)
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 1
+	}
+
+	pairs, _, err := client.KV().List(flags.Arg(0), &consulapi.QueryOptions{Token: config.Consul.Token})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to read keys")
+		return 1
+	}
+
+	encoded, err := encodeKVExport(pairs)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to encode keys")
+		return 1
+	}
+
+	os.Stdout.Write(encoded)
+	return 0
+}
+
+func importCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul import", importHelpText, &opts)
+	cas := flags.Bool("cas", false, "only write keys that haven't changed since the snapshot was taken")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.loadConfig(log)
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	var data []byte
+	var err error
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		data, err = ioutil.ReadFile(flags.Arg(0))
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to read snapshot")
+		return 1
+	}
+
+	pairs, err := decodeKVExport(data)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to parse snapshot")
+		return 1
+	}
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 1
+	}
+
+	// A conflicting key doesn't stop the others being imported, but any other failure does
+	conflicts := 0
+	for _, pair := range pairs {
+		if *cas {
+			err = casPut(client.KV(), pair, &consulapi.WriteOptions{Token: config.Consul.Token})
+		} else {
+			_, err = client.KV().Put(pair, &consulapi.WriteOptions{Token: config.Consul.Token})
+		}
+		if conflict, ok := err.(*casConflict); ok {
+			log.WithFields(logrus.Fields{
+				"key":          pair.Key,
+				"modifyIndex":  conflict.Expected,
+				"currentIndex": conflict.Current,
+				"error":        err,
+			}).Error("Key changed since the snapshot, leaving it alone")
+			conflicts++
+			continue
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"key":   pair.Key,
+				"error": err,
+			}).Error("Failed to write key")
+			return 1
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"keys":      len(pairs) - conflicts,
+		"conflicts": conflicts,
+	}).Info("Imported snapshot")
+	if conflicts > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package fsconsul
+
+import (
+	"bytes"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestKVExport(t *testing.T) {
+	// As written by consul kv export
+	exported := []byte(`[
+	{
+		"key": "app/db",
+		"flags": 42,
+		"value": "aG9zdD1kYgo="
+	},
+	{
+		"key": "app/empty",
+		"flags": 0,
+		"value": ""
+	}
+]
+`)
+
+	pairs, err := decodeKVExport(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || pairs[0].Key != "app/db" || pairs[0].Flags != 42 || string(pairs[0].Value) != "host=db\n" {
+		t.Fatalf("Unexpected pairs %+v", pairs)
+	}
+
+	encoded, err := encodeKVExport(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, exported) {
+		t.Fatalf("Expected\n%s\nbut got\n%s", exported, encoded)
+	}
+
+	if encoded, _ := encodeKVExport(consulapi.KVPairs{}); string(encoded) != "[]\n" {
+		t.Fatalf("Expected an empty list but got %s", encoded)
+	}
+
+	if _, err := decodeKVExport([]byte(`[{"key": "app/db", "value": "not base64!"}]`)); err == nil {
+		t.Fatal("Expected an error for a value that isn't base64")
+	}
+}
+
+func TestKVExportModifyIndex(t *testing.T) {
+	encoded, err := encodeKVExport(consulapi.KVPairs{{Key: "app/db", Value: []byte("db"), ModifyIndex: 17}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := decodeKVExport(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 1 || pairs[0].ModifyIndex != 17 {
+		t.Fatalf("Expected the modify index to survive a round trip, got %+v", pairs)
+	}
+
+	conflicts := map[string]*casConflict{
+		"app/db already exists, at modify index 9":               {Key: "app/db", Current: 9},
+		"app/db was deleted since modify index 17":               {Key: "app/db", Expected: 17},
+		"app/db changed since modify index 17, and is now at 21": {Key: "app/db", Expected: 17, Current: 21},
+	}
+	for want, conflict := range conflicts {
+		if conflict.Error() != want {
+			t.Errorf("Expected %q, got %q", want, conflict.Error())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package fsconsul
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// launchdJob is what goes into a launchd property list for fsconsul watch.
+type launchdJob struct {
+	Label     string
+	Program   string
+	Arguments []string
+	LogPath   string
+}
+
+// Write the job as a launchd property list.  launchd restarts fsconsul if it fails, but not
+// once it exits cleanly after being unloaded.
+func (job *launchdJob) writePlist(out io.Writer) error {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+
+	plistString(&b, "Label", job.Label)
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{job.Program, "watch"}, job.Arguments...) {
+		b.WriteString("\t\t<string>")
+		xml.EscapeText(&b, []byte(arg))
+		b.WriteString("</string>\n")
+	}
+	b.WriteString("\t</array>\n")
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	plistString(&b, "ProcessType", "Background")
+	if job.LogPath != "" {
+		plistString(&b, "StandardOutPath", job.LogPath)
+		plistString(&b, "StandardErrorPath", job.LogPath)
+	}
+
+	b.WriteString("</dict>\n</plist>\n")
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func plistString(b *strings.Builder, key, value string) {
+	b.WriteString("\t<key>" + key + "</key>\n\t<string>")
+	xml.EscapeText(b, []byte(value))
+	b.WriteString("</string>\n")
+}
+
+func launchdCommand(args []string) int {
+	flags := newFlagSet("fsconsul launchd", launchdHelpText, nil)
+	label := flags.String("label", "io.fsconsul", "the job's label")
+	logPath := flags.String("log", "/Library/Logs/fsconsul.log", "the file fsconsul's output is written to")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	program, err := os.Executable()
+	if err == nil {
+		program, err = filepath.Abs(program)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find the fsconsul executable: %v\n", err)
+		return 1
+	}
+
+	job := &launchdJob{Label: *label, Program: program, Arguments: flags.Args(), LogPath: *logPath}
+	if err := job.writePlist(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package fsconsul
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLaunchdPlist(t *testing.T) {
+	job := &launchdJob{
+		Label:     "io.fsconsul",
+		Program:   "/usr/local/bin/fsconsul",
+		Arguments: []string{"-configFile", "/etc/fsconsul & co.json"},
+	}
+
+	var out bytes.Buffer
+	if err := job.writePlist(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, want := range []string{
+		"<string>/usr/local/bin/fsconsul</string>\n\t\t<string>watch</string>\n\t\t<string>-configFile</string>",
+		"<string>/etc/fsconsul &amp; co.json</string>",
+		"<key>SuccessfulExit</key>\n\t\t<false/>",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected the plist to contain %q, got:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "StandardOutPath") {
+		t.Error("expected no log path")
+	}
+}
@@ -0,0 +1,109 @@
+package fsconsul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Hooks are called as an embedded fsconsul applies snapshots, from the goroutine of the
+// mapping concerned, so they may be called concurrently for different mappings.  Files are
+// named as in the summary: by path, registry value, or key for socket mappings.  Any hook
+// may be nil.
+type Hooks struct {
+	// Called after a file is written
+	OnWrite func(mapping, file string)
+
+	// Called after a file is deleted because its key was removed
+	OnDelete func(mapping, file string)
+
+	// Called when a file can't be rendered, written or deleted, or a mapping fails, in
+	// which case the file is empty
+	OnError func(mapping, file string, err error)
+
+	// Told about operational failures as they start and end, alongside any configured notifiers
+	Notifier Notifier
+
+	// Called once a snapshot's onchange command (or change mode) is done, for fsconsul bench
+	changed func(mapping string, files []string)
+}
+
+func (h *Hooks) wrote(mapping, file string) {
+	if h != nil && h.OnWrite != nil {
+		h.OnWrite(mapping, file)
+	}
+}
+
+func (h *Hooks) deleted(mapping, file string) {
+	if h != nil && h.OnDelete != nil {
+		h.OnDelete(mapping, file)
+	}
+}
+
+func (h *Hooks) ranOnChange(mapping string, files []string) {
+	if h != nil && h.changed != nil {
+		h.changed(mapping, files)
+	}
+}
+
+func (h *Hooks) failed(mapping, file string, err error) {
+	if h != nil && h.OnError != nil {
+		h.OnError(mapping, file, err)
+	}
+}
+
+// Watcher runs a configuration's mappings in-process, as fsconsul watch does, for programs
+// embedding fsconsul rather than running it.  Mappings can be registered and deregistered
+// while it runs.
+type Watcher struct {
+	config  WatchConfig
+	hooks   Hooks
+	changes chan mappingChange
+	stopped chan struct{}
+}
+
+// NewWatcher prepares to watch the configuration's mappings, calling the hooks as their
+// files change.  The configuration may have no mappings, if they're all to be registered.
+func NewWatcher(config WatchConfig, hooks Hooks) *Watcher {
+	return &Watcher{
+		config:  config,
+		hooks:   hooks,
+		changes: make(chan mappingChange),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Run watches until the context is done, then waits for the mappings to finish the writes
+// and onchange commands they're in the middle of, as on SIGINT.  With RunOnce, it returns
+// once every mapping has been applied instead.  Returns an error if the configuration is
+// invalid or a mapping failed.  A Watcher can only be run once.
+func (w *Watcher) Run(ctx context.Context) error {
+	defer close(w.stopped)
+
+	config := w.config
+	config.Mappings = append([]MappingConfig(nil), w.config.Mappings...)
+
+	// These apply to the whole process, which isn't fsconsul's to manage
+	if config.Exec.Command != "" || config.ConfDir != "" || config.Harden.Enabled {
+		return errors.New("exec, confdir and harden aren't available when embedded")
+	}
+	config.done = ctx.Done()
+	config.hooks = &w.hooks
+	config.changes = w.changes
+
+	applyDefaults(&config)
+	if errs := validateConfig(&config); len(errs) > 0 {
+		return errs[0]
+	}
+
+	if code := watchAndExec(&config); code != 0 {
+		return fmt.Errorf("watching failed with exit code %d", code)
+	}
+	return nil
+}
+
+// Run watches the configuration's mappings until the context is done, calling the hooks as
+// their files change.  See Watcher.Run.
+func Run(ctx context.Context, config WatchConfig, hooks Hooks) error {
+	return NewWatcher(config, hooks).Run(ctx)
+}
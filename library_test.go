@@ -0,0 +1,73 @@
+package fsconsul
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fixture := filepath.Join(tempDir, "kv.json")
+	if err := ioutil.WriteFile(fixture, []byte(`[{"key": "app/a", "value": "MQ=="}, {"key": "other/b", "value": "Mg=="}]`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	writes := make(chan string, 10)
+	watcher := NewWatcher(WatchConfig{
+		SourceFile: fixture,
+		Mappings:   []MappingConfig{{Prefix: "app/", Path: filepath.Join(tempDir, "app")}},
+	}, Hooks{
+		OnWrite: func(mapping, file string) { writes <- filepath.Base(file) },
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- watcher.Run(ctx) }()
+
+	wrote := func(want string) {
+		select {
+		case file := <-writes:
+			if file != want {
+				t.Fatalf("expected %s to be written, got %s", want, file)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s was never written", want)
+		}
+	}
+	wrote("a")
+
+	if err := watcher.RegisterMapping(ctx, MappingConfig{Prefix: "other/", Path: filepath.Join(tempDir, "other")}); err != nil {
+		t.Fatalf("failed to register mapping: %v", err)
+	}
+	wrote("b")
+	if err := watcher.RegisterMapping(ctx, MappingConfig{Prefix: "other/", Path: filepath.Join(tempDir, "other")}); err == nil {
+		t.Fatal("expected a second mapping with the same name to be refused")
+	}
+	if err := watcher.DeregisterMapping(ctx, "other/"); err != nil {
+		t.Fatalf("failed to deregister mapping: %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("expected a clean stop, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("watcher didn't stop")
+	}
+
+	if err := watcher.DeregisterMapping(context.Background(), "app/"); err != errStopping {
+		t.Fatalf("expected a stopped watcher to refuse changes, got %v", err)
+	}
+}
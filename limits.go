@@ -0,0 +1,71 @@
+package fsconsul
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// How often the approval key of a paused snapshot is checked.
+const approvalPollInterval = 5 * time.Second
+
+// DeltaLimitsConfig holds limits on how much a single snapshot may change.  A snapshot
+// exceeding them is paused until it's approved by setting ApprovalKey to its index.
+type DeltaLimitsConfig struct {
+	// The most files a snapshot may add, change or delete (0 for no limit)
+	MaxFiles int
+
+	// The most bytes a snapshot may add to or remove from the files (0 for no limit)
+	MaxBytes int64
+
+	// Absolute Consul key holding the index of the snapshot to apply despite the limits
+	ApprovalKey string
+}
+
+// delta is how much a snapshot changes.
+type delta struct {
+	files int
+	bytes int64
+}
+
+func snapshotDelta(env, newEnv map[string]string) delta {
+	var d delta
+	for k, v := range newEnv {
+		old, ok := env[k]
+		if ok && old == v {
+			continue
+		}
+		d.files++
+		d.bytes += abs(int64(len(v)) - int64(len(old)))
+	}
+	for k, old := range env {
+		if _, ok := newEnv[k]; !ok {
+			d.files++
+			d.bytes += int64(len(old))
+		}
+	}
+	return d
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Determine whether a delta exceeds the limits.
+func (limits DeltaLimitsConfig) exceeded(d delta) bool {
+	return (limits.MaxFiles > 0 && d.files > limits.MaxFiles) || (limits.MaxBytes > 0 && d.bytes > limits.MaxBytes)
+}
+
+// Check whether the approval key names the snapshot at index.
+func snapshotApproved(client *consulapi.Client, token, key string, index uint64) (bool, error) {
+	pair, _, err := client.KV().Get(strings.TrimPrefix(key, "/"), &consulapi.QueryOptions{Token: token})
+	if err != nil || pair == nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(pair.Value)) == strconv.FormatUint(index, 10), nil
+}
@@ -0,0 +1,95 @@
+package fsconsul
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestSnapshotDelta(t *testing.T) {
+	env := map[string]string{
+		"same":    "unchanged",
+		"changed": "12345",
+		"deleted": "123",
+	}
+	newEnv := map[string]string{
+		"same":    "unchanged",
+		"changed": "12",
+		"added":   "1234567",
+	}
+
+	d := snapshotDelta(env, newEnv)
+	if d.files != 3 || d.bytes != 3+3+7 {
+		t.Fatalf("Expected 3 files and 13 bytes changed but got %+v", d)
+	}
+
+	if (DeltaLimitsConfig{}).exceeded(d) {
+		t.Errorf("Expected no limits to allow anything")
+	}
+	if !(DeltaLimitsConfig{MaxFiles: 2}).exceeded(d) {
+		t.Errorf("Expected too many files to exceed the limit")
+	}
+	if !(DeltaLimitsConfig{MaxFiles: 3, MaxBytes: 12}).exceeded(d) {
+		t.Errorf("Expected too many bytes to exceed the limit")
+	}
+	if (DeltaLimitsConfig{MaxFiles: 3, MaxBytes: 13}).exceeded(d) {
+		t.Errorf("Expected a delta within the limits to be allowed")
+	}
+}
+
+func TestDeltaLimitsUnindexed(t *testing.T) {
+	// Source files and their recordings have no index
+	replay := t.TempDir()
+	for _, pairs := range []consulapi.KVPairs{
+		{{Key: "app/a", Value: []byte("1")}, {Key: "app/b", Value: []byte("1")}},
+		{{Key: "app/a", Value: []byte("2")}, {Key: "app/b", Value: []byte("2")}},
+		{{Key: "app/a", Value: []byte("1")}, {Key: "app/b", Value: []byte("1")}, {Key: "app/c", Value: []byte("1")}},
+	} {
+		if err := recordSnapshot(replay, "app", kvSnapshot{pairs, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writes := make(chan string, 10)
+	watcher := NewWatcher(WatchConfig{
+		Replay: replay,
+		Mappings: []MappingConfig{{
+			Name:        "app",
+			Prefix:      "app/",
+			Path:        t.TempDir(),
+			DeltaLimits: DeltaLimitsConfig{MaxFiles: 1},
+		}},
+	}, Hooks{
+		OnWrite: func(mapping, file string) { writes <- filepath.Base(file) },
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- watcher.Run(ctx) }()
+
+	// The second snapshot changes both files, so it's paused until the third supersedes it
+	var written []string
+	for len(written) == 0 || written[len(written)-1] != "c" {
+		select {
+		case file := <-writes:
+			written = append(written, file)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("c was never written, only %v", written)
+		}
+	}
+	sort.Strings(written)
+	if !reflect.DeepEqual(written, []string{"a", "b", "c"}) {
+		t.Fatalf("expected the snapshot exceeding the limits to be skipped, got writes %v", written)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("expected a clean stop, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package fsconsul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The lock file held in each target path while an fsconsul instance manages it.
+const lockFileName = ".fsconsul.lock"
+
+// How long to wait for a taken over instance to release its lock.
+const takeoverTimeout = 30 * time.Second
+
+// pathLock is an exclusive lock on a target path, held for the life of the process.
+type pathLock struct {
+	file *os.File
+}
+
+// Lock the target path of every mapping, so that no two fsconsul instances manage the same
+// path.  If takeover is set, instances already holding a lock are asked to terminate.
+func lockPaths(config *WatchConfig) ([]*pathLock, error) {
+	var locks []*pathLock
+
+	seen := make(map[string]bool)
+	for i, mappingConfig := range config.Mappings {
+		// Registry mappings have no path
+		if mappingConfig.Path == "" || seen[mappingConfig.Path] {
+			continue
+		}
+		seen[mappingConfig.Path] = true
+
+		lock, err := lockPath(&config.Mappings[i], config.Takeover)
+		if err != nil {
+			unlockPaths(locks)
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+
+	return locks, nil
+}
+
+func unlockPaths(locks []*pathLock) {
+	for _, lock := range locks {
+		lock.unlock()
+	}
+}
+
+// Lock a mapping's path, creating it with the mapping's directory mode and owner if need be.
+// The lock file gets the mapping's file mode.
+func lockPath(mappingConfig *MappingConfig, takeover bool) (*pathLock, error) {
+	path := mappingConfig.Path
+	if err := makeDirs(mappingConfig, path); err != nil {
+		return nil, err
+	}
+
+	attrs, err := mappingConfig.fileAttrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFile(filepath.Join(path, lockFileName), attrs.mode, takeover)
+	if err != nil {
+		return nil, fmt.Errorf("cannot manage %s: %v", path, err)
+	}
+
+	return lock, nil
+}
+
+// Take an exclusive lock on the given file, which records the pid of the holder.  The file
+// is given the mode, whether or not it already existed.
+func lockFile(lockFile string, mode os.FileMode, takeover bool) (*pathLock, error) {
+	f, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	locked, err := tryLockFile(f)
+	if err == nil && !locked && takeover {
+		locked, err = takeoverLock(f, lockFile)
+	}
+	if err == nil && !locked {
+		err = fmt.Errorf("another fsconsul instance (pid %s) holds %s, use -takeover to replace it", lockHolder(lockFile), lockFile)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Record who holds the lock, for the benefit of humans and -takeover
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	return &pathLock{file: f}, nil
+}
+
+// Terminate the instance holding the lock and wait for it to let go.
+func takeoverLock(f *os.File, lockFile string) (bool, error) {
+	pid, err := strconv.Atoi(lockHolder(lockFile))
+	if err != nil {
+		return false, fmt.Errorf("cannot take over %s, it does not name the holding process", lockFile)
+	}
+
+	log.WithFields(log.Fields{
+		"pid":  pid,
+		"lock": lockFile,
+	}).Warn("Taking over from another fsconsul instance")
+
+	if err := terminateProcess(pid); err != nil {
+		return false, err
+	}
+
+	for deadline := time.Now().Add(takeoverTimeout); time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		if locked, err := tryLockFile(f); err != nil || locked {
+			return locked, err
+		}
+	}
+
+	return false, fmt.Errorf("fsconsul instance %d did not exit within %s", pid, takeoverTimeout)
+}
+
+func lockHolder(lockFile string) string {
+	data, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (lock *pathLock) unlock() {
+	unlockFile(lock.file)
+	lock.file.Close()
+}
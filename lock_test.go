@@ -0,0 +1,112 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLockPath(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{Path: tempDir}
+
+	lock, err := lockPath(mappingConfig, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := lockPath(mappingConfig, false); err == nil {
+		t.Fatal("Expected a second lock on the same path to fail")
+	}
+
+	lock.unlock()
+
+	lock, err = lockPath(mappingConfig, false)
+	if err != nil {
+		t.Fatalf("Expected the path to be lockable once released, got %v", err)
+	}
+	lock.unlock()
+}
+
+func TestLockPathCreatesPrivateRoot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no file modes")
+	}
+
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name     string
+		dirMode  string
+		fileMode string
+		wantDir  os.FileMode
+		wantLock os.FileMode
+	}{
+		{"defaults", "", "", defaultDirMode, defaultFileMode},
+		{"configured", "0700", "0600", 0700, 0600},
+	}
+
+	for _, tt := range tests {
+		root := filepath.Join(tempDir, tt.name, "root")
+		lock, err := lockPath(&MappingConfig{Path: root, DirMode: tt.dirMode, FileMode: tt.fileMode}, false)
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		lock.unlock()
+
+		info, err := os.Stat(root)
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if info.Mode().Perm() != tt.wantDir {
+			t.Errorf("%s: expected the root to have mode %04o, got %04o", tt.name, tt.wantDir, info.Mode().Perm())
+		}
+
+		info, err = os.Stat(filepath.Join(root, lockFileName))
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if info.Mode().Perm() != tt.wantLock {
+			t.Errorf("%s: expected the lock file to have mode %04o, got %04o", tt.name, tt.wantLock, info.Mode().Perm())
+		}
+
+		// Watching Consul leaves creating the root to the mapping too
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Consul-Index", "5")
+			w.Write([]byte(`[{"Key": "app/a.conf", "Value": "YQ==", "ModifyIndex": 5}]`))
+		}))
+		root = filepath.Join(tempDir, tt.name, "consul")
+		config := &WatchConfig{
+			RunOnce:  true,
+			Consul:   ConsulConfig{Addr: strings.TrimPrefix(server.URL, "http://")},
+			Mappings: []MappingConfig{{Prefix: "app/", Path: root + "/", DirMode: tt.dirMode, FileMode: tt.fileMode}},
+		}
+		code := watchAndExec(config)
+		server.Close()
+		if code != 0 {
+			t.Fatalf("%s: expected the Consul mapping to render, got %d", tt.name, code)
+		}
+
+		info, err = os.Stat(root)
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if info.Mode().Perm() != tt.wantDir {
+			t.Errorf("%s: expected the Consul mapping's root to have mode %04o, got %04o", tt.name, tt.wantDir, info.Mode().Perm())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//go:build windows
+// +build windows
+
+package fsconsul
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// Windows locks are mandatory, so the byte locked is well past the end of the file to
+// leave its content (the holder's pid) readable.
+const lockOffsetHigh = 1
+
+// Try to take an exclusive lock on the file without blocking.
+func tryLockFile(f *os.File) (bool, error) {
+	overlapped := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	ret, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ret != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
+
+func unlockFile(f *os.File) error {
+	overlapped := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	ret, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// Windows has no SIGTERM, so the holding process is killed outright.
+func terminateProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// Finding a process on Windows opens a handle to it, which fails if it doesn't exist.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,194 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// LogConfig holds the configuration for fsconsul's own logging
+type LogConfig struct {
+	Journald bool
+
+	// Least severe level logged: debug, info (the default), warn or error
+	Level string
+
+	// json, or text for logfmt (by default, the console format at a terminal and logfmt
+	// otherwise)
+	Format string
+}
+
+// journaldHook sends log entries to systemd-journald, preserving entry fields as
+// journal fields so they can be queried with journalctl (e.g. journalctl KEY=foo).
+type journaldHook struct{}
+
+func (hook *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *journaldHook) Fire(entry *logrus.Entry) error {
+	vars := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		vars[journalFieldName(k)] = fmt.Sprint(v)
+	}
+
+	return journal.Send(entry.Message, journalPriority(entry.Level), vars)
+}
+
+func journalPriority(level logrus.Level) journal.Priority {
+	switch level {
+	case logrus.PanicLevel:
+		return journal.PriEmerg
+	case logrus.FatalLevel:
+		return journal.PriCrit
+	case logrus.ErrorLevel:
+		return journal.PriErr
+	case logrus.WarnLevel:
+		return journal.PriWarning
+	case logrus.InfoLevel:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
+}
+
+// Journal field names may only contain upper case letters, digits and underscores,
+// and must not start with an underscore (those are reserved for trusted fields).
+func journalFieldName(name string) string {
+	field := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, name)
+
+	return strings.TrimLeft(field, "_")
+}
+
+// consoleFormatter renders terse, single line entries for humans watching a terminal.
+type consoleFormatter struct {
+	Colors bool
+}
+
+func (f *consoleFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	b := &bytes.Buffer{}
+
+	level := strings.ToUpper(entry.Level.String())
+	if len(level) > 4 {
+		level = level[:4]
+	}
+
+	if f.Colors {
+		fmt.Fprintf(b, "\x1b[%dm%-4s\x1b[0m", levelColor(entry.Level), level)
+	} else {
+		fmt.Fprintf(b, "%-4s", level)
+	}
+
+	fmt.Fprintf(b, " %s %s", entry.Time.Format("15:04:05"), entry.Message)
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if f.Colors {
+			fmt.Fprintf(b, " \x1b[%dm%s\x1b[0m=%v", levelColor(entry.Level), k, entry.Data[k])
+		} else {
+			fmt.Fprintf(b, " %s=%v", k, entry.Data[k])
+		}
+	}
+
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+func levelColor(level logrus.Level) int {
+	switch level {
+	case logrus.DebugLevel:
+		return 37 // gray
+	case logrus.InfoLevel:
+		return 36 // cyan
+	case logrus.WarnLevel:
+		return 33 // yellow
+	default:
+		return 31 // red
+	}
+}
+
+// Determine whether the given output is attached to a terminal.
+func isTerminal(out interface{}) bool {
+	f, ok := out.(*os.File)
+	return ok && terminal.IsTerminal(int(f.Fd()))
+}
+
+// Whether the journal can be logged to, replaced by tests.
+var journalEnabled = journal.Enabled
+
+// Apply the logging configuration to the given logger.  It's applied again on each reload,
+// so a journald hook from an earlier configuration is replaced rather than added to.
+func configureLogging(logger *logrus.Logger, config LogConfig) error {
+	hooks := make(logrus.LevelHooks)
+	for level, levelHooks := range logger.Hooks {
+		for _, hook := range levelHooks {
+			// Other hooks, like the Windows event log's, are kept
+			if _, ok := hook.(*journaldHook); !ok {
+				hooks[level] = append(hooks[level], hook)
+			}
+		}
+	}
+	logger.ReplaceHooks(hooks)
+
+	logger.Level = logrus.InfoLevel
+	if config.Level != "" {
+		level, err := logrus.ParseLevel(config.Level)
+		if err != nil {
+			return err
+		}
+		logger.Level = level
+	}
+
+	if config.Journald {
+		if !journalEnabled() {
+			return fmt.Errorf("journald logging requested but the journal socket is not available")
+		}
+
+		logger.Hooks.Add(&journaldHook{})
+		logger.Out = ioutil.Discard
+		return nil
+	}
+
+	switch config.Format {
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+		return nil
+	case "text":
+		logger.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("unknown log format %s, expected json or text", config.Format)
+	}
+
+	// Humans at a terminal get the console format (colored unless NO_COLOR is set and not
+	// empty, see https://no-color.org), everything else gets logfmt so that it can be parsed.
+	if isTerminal(logger.Out) {
+		logger.Formatter = &consoleFormatter{Colors: os.Getenv("NO_COLOR") == ""}
+	} else {
+		logger.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package fsconsul
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJournalFieldName(t *testing.T) {
+	for _, test := range []struct {
+		name, expected string
+	}{
+		{"key", "KEY"},
+		{"error", "ERROR"},
+		{"lastIndex", "LASTINDEX"},
+		{"_private", "PRIVATE"},
+		{"with-dash", "WITH_DASH"},
+	} {
+		if actual := journalFieldName(test.name); actual != test.expected {
+			t.Fatalf("Expected %s to map to %s but got %s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestConsoleFormatter(t *testing.T) {
+	entry := &logrus.Entry{
+		Data:    logrus.Fields{"key": "app/db", "error": "boom"},
+		Time:    time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC),
+		Level:   logrus.WarnLevel,
+		Message: "Failed to write to file",
+	}
+
+	out, err := (&consoleFormatter{}).Format(entry)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := "WARN 15:04:05 Failed to write to file error=boom key=app/db\n"
+	if string(out) != expected {
+		t.Fatalf("Expected %q but got %q", expected, string(out))
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	logger := logrus.New()
+	if err := configureLogging(logger, LogConfig{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if logger.Level != logrus.InfoLevel {
+		t.Errorf("expected info level by default, got %s", logger.Level)
+	}
+
+	if err := configureLogging(logger, LogConfig{Level: "warn", Format: "json"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if logger.Level != logrus.WarnLevel {
+		t.Errorf("expected warn level, got %s", logger.Level)
+	}
+	if _, ok := logger.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Errorf("expected a JSON formatter, got %T", logger.Formatter)
+	}
+
+	if err := configureLogging(logger, LogConfig{Level: "loud"}); err == nil {
+		t.Errorf("expected an unknown level to be refused")
+	}
+	if err := configureLogging(logger, LogConfig{Format: "xml"}); err == nil {
+		t.Errorf("expected an unknown format to be refused")
+	}
+}
+
+func TestReloadKeepsOneJournaldHook(t *testing.T) {
+	defer func(enabled func() bool) { journalEnabled = enabled }(journalEnabled)
+	journalEnabled = func() bool { return true }
+
+	std := logrus.StandardLogger()
+	defer func(hooks logrus.LevelHooks, out io.Writer, level logrus.Level) {
+		std.ReplaceHooks(hooks)
+		std.Out, std.Level = out, level
+	}(std.ReplaceHooks(make(logrus.LevelHooks)), std.Out, std.Level)
+
+	configFile := filepath.Join(t.TempDir(), "fsconsul.json")
+	if err := ioutil.WriteFile(configFile, []byte(`{"log": {"journald": true}, "mappings": [{"prefix": "app", "path": "/tmp/app"}]}`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Starting loads the configuration, and each reload loads it again
+	opts := &options{configFile: configFile}
+	logger := logrus.New()
+	for i := 0; i < 3; i++ {
+		if config, code := opts.buildConfig(logger, nil); config == nil {
+			t.Fatalf("failed to load configuration, code %d", code)
+		}
+	}
+
+	for _, l := range []*logrus.Logger{logger, std} {
+		count := 0
+		for _, hook := range l.Hooks[logrus.InfoLevel] {
+			if _, ok := hook.(*journaldHook); ok {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("expected one journald hook after reloading, got %d", count)
+		}
+	}
+}
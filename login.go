@@ -0,0 +1,332 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// LoginConfig holds the configuration for acquiring an ACL token by logging in to a Consul
+// auth method, rather than being given a static token.
+type LoginConfig struct {
+	AuthMethod string
+
+	// Where the bearer token presented to the auth method comes from: kubernetes (the
+	// default), jwt, aws-iam, gcp or azure
+	Type string
+
+	// The file holding the bearer token, for kubernetes and jwt
+	TokenFile string
+
+	// The audience to request an identity token for, for gcp and azure
+	Audience string
+
+	// The value of the X-Consul-IAM-ServerID header the auth method requires, for aws-iam
+	ServerIDHeader string
+
+	Meta map[string]string
+}
+
+const (
+	kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	gcpIdentityURL      = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+	azureIdentityURL    = "http://169.254.169.254/metadata/identity/oauth2/token"
+	iamServerIDHeader   = "X-Consul-IAM-ServerID"
+)
+
+var metadataClient = &http.Client{Timeout: 10 * time.Second}
+
+// consulLogin holds the token acquired from an auth method, logging in again as it nears
+// expiry.  Logins are shared by every client built from the same configuration.
+type consulLogin struct {
+	consulConfig ConsulConfig
+
+	mu        sync.Mutex
+	secret    string
+	refreshAt time.Time
+	expires   time.Time
+}
+
+var (
+	loginsLock sync.Mutex
+	logins     = make(map[string]*consulLogin)
+)
+
+func loginFor(consulConfig ConsulConfig) *consulLogin {
+	key := strings.Join([]string{consulConfig.Addr, consulConfig.DC, consulConfig.Login.AuthMethod}, "\x00")
+
+	loginsLock.Lock()
+	defer loginsLock.Unlock()
+
+	login, ok := logins[key]
+	if !ok {
+		login = &consulLogin{consulConfig: consulConfig}
+		logins[key] = login
+	}
+	return login
+}
+
+// Get the current token, logging in first if there is none or it's due to be refreshed.
+// While the current token is still valid, a failure to refresh it is only logged.
+func (l *consulLogin) token() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.secret != "" && (l.refreshAt.IsZero() || time.Now().Before(l.refreshAt)) {
+		return l.secret, nil
+	}
+
+	err := l.login()
+	if err != nil && l.secret != "" && time.Now().Before(l.expires) {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"expires": l.expires,
+		}).Warn("Failed to refresh Consul token, using the current one")
+		return l.secret, nil
+	}
+
+	return l.secret, err
+}
+
+// Forget the given token, e.g. because Consul no longer recognises it.
+func (l *consulLogin) invalidate(secret string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.secret == secret {
+		l.secret = ""
+	}
+}
+
+func (l *consulLogin) login() error {
+	loginConfig := l.consulConfig.Login
+
+	bearer, err := bearerToken(loginConfig)
+	if err != nil {
+		return fmt.Errorf("failed to get bearer token for %s: %v", loginConfig.AuthMethod, err)
+	}
+
+	// Logging in mustn't itself need a token
+	consulConfig := l.consulConfig
+	consulConfig.Login = LoginConfig{}
+	client, err := buildConsulClient(consulConfig)
+	if err != nil {
+		return err
+	}
+
+	token, _, err := client.ACL().Login(&consulapi.ACLLoginParams{
+		AuthMethod:  loginConfig.AuthMethod,
+		BearerToken: bearer,
+		Meta:        loginConfig.Meta,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to log in to %s: %v", loginConfig.AuthMethod, err)
+	}
+
+	l.secret = token.SecretID
+	l.refreshAt, l.expires = time.Time{}, time.Time{}
+	if token.ExpirationTime != nil {
+		// Refresh with a quarter of the token's lifetime to spare
+		l.expires = *token.ExpirationTime
+		l.refreshAt = time.Now().Add(time.Until(l.expires) * 3 / 4)
+	}
+
+	log.WithFields(log.Fields{
+		"authMethod": loginConfig.AuthMethod,
+		"accessor":   token.AccessorID,
+		"expires":    l.expires,
+	}).Info("Logged in to Consul")
+
+	return nil
+}
+
+func bearerToken(loginConfig LoginConfig) (string, error) {
+	switch loginConfig.Type {
+	case "", "kubernetes":
+		tokenFile := loginConfig.TokenFile
+		if tokenFile == "" {
+			tokenFile = kubernetesTokenFile
+		}
+		return readBearerToken(tokenFile)
+	case "jwt":
+		if loginConfig.TokenFile == "" {
+			return "", fmt.Errorf("jwt login needs a TokenFile")
+		}
+		return readBearerToken(loginConfig.TokenFile)
+	case "aws-iam":
+		return awsIAMBearerToken(loginConfig.ServerIDHeader)
+	case "gcp":
+		return gcpIdentityToken(loginConfig.Audience)
+	case "azure":
+		return azureIdentityToken(loginConfig.Audience)
+	default:
+		return "", fmt.Errorf("unknown login type %q", loginConfig.Type)
+	}
+}
+
+func readBearerToken(tokenFile string) (string, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// Build the signed sts:GetCallerIdentity request that Consul's aws-iam auth method expects
+// as a bearer token, using the instance's (or environment's) AWS credentials.
+func awsIAMBearerToken(serverID string) (string, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return "", err
+	}
+
+	request, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	if serverID != "" {
+		request.HTTPRequest.Header.Add(iamServerIDHeader, serverID)
+	}
+	if err := request.Sign(); err != nil {
+		return "", err
+	}
+
+	headers, err := json.Marshal(request.HTTPRequest.Header)
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(request.HTTPRequest.Body)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := json.Marshal(map[string]string{
+		"iam_http_request_method": request.HTTPRequest.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(request.HTTPRequest.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+	})
+	return string(token), err
+}
+
+// Get a JWT identifying the instance's service account from the GCE metadata server, for a
+// jwt auth method.
+func gcpIdentityToken(audience string) (string, error) {
+	if audience == "" {
+		return "", fmt.Errorf("gcp login needs an Audience")
+	}
+
+	query := url.Values{"audience": {audience}, "format": {"full"}}
+	token, err := getMetadata(gcpIdentityURL+"?"+query.Encode(), "Metadata-Flavor", "Google")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// Get a JWT for the instance's managed identity from the Azure instance metadata service,
+// for a jwt auth method.
+func azureIdentityToken(resource string) (string, error) {
+	if resource == "" {
+		return "", fmt.Errorf("azure login needs an Audience")
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+	body, err := getMetadata(azureIdentityURL+"?"+query.Encode(), "Metadata", "true")
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	return response.AccessToken, nil
+}
+
+func getMetadata(url, header, value string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(header, value)
+
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata request failed with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// loginTransport adds the token from an auth method login to requests that don't carry
+// their own, logging in again if Consul no longer recognises it.
+type loginTransport struct {
+	login *consulLogin
+	base  http.RoundTripper
+}
+
+func (t *loginTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Consul-Token") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	token, err := t.login.token()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(withToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusForbidden || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+
+	// Only retry if the token itself was rejected, e.g. after being deleted
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !bytes.Contains(body, []byte("ACL not found")) {
+		return resp, nil
+	}
+
+	t.login.invalidate(token)
+	if token, err = t.login.token(); err != nil {
+		return nil, err
+	}
+
+	retry := withToken(req, token)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(retry)
+}
+
+func withToken(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Consul-Token", token)
+	return req
+}
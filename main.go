@@ -1,4 +1,4 @@
-package main
+package fsconsul
 
 import (
 	"encoding/json"
@@ -8,67 +8,195 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-func main() {
-	logrus.SetLevel(logrus.DebugLevel)
-	os.Exit(realMain())
+// Set at build time with -ldflags "-X github.com/adam-zacharski/fsconsul.version=..."
+var version = "dev"
+
+// Main runs the fsconsul command line with the given arguments (without the program name),
+// returning the exit code.
+func Main(args []string) int {
+	if os.Getenv(workerEnv) != "" {
+		return workerMain()
+	}
+
+	if len(args) > 0 {
+		if cmd := findCommand(args[0]); cmd != nil {
+			return cmd.Run(args[1:])
+		}
+	}
+
+	// No subcommand, so this is the original invocation style
+	return watchMain(args)
 }
 
-func realMain() int {
-	var consulAddr string
-	var consulDC string
-	var keystore string
-	var token string
-	var configFile string
-	var once bool
+// options holds the command-line switches shared by all commands.
+type options struct {
+	consulAddr  string
+	consulDC    string
+	keystore    string
+	token       string
+	authMethod  string
+	authType    string
+	proxy       string
+	confDir     string
+	stateFile   string
+	sourceFile  string
+	record      string
+	replay      string
+	exec        string
+	execSignal  string
+	configFile  string
+	once        bool
+	dryRun      bool
+	journald    bool
+	logLevel    string
+	logFormat   string
+	jsonSummary bool
+	format      string
+	takeover    bool
+	harden      bool
+	dangerous   bool
 
-	// This will hold the configuration, whether it's resolved from command-line or JSON.
-	var config WatchConfig
+	pidFile        string
+	singleInstance bool
+
+	user  string
+	group string
+
+	onceOnChange        bool
+	onceOnChangeTimeout time.Duration
+	shutdownTimeout     time.Duration
+	waitFor             string
+	healthAddr          string
+
+	// The configuration as loaded, before the run options were applied, to tell which
+	// settings came from the switches
+	loaded map[string]interface{}
+}
 
-	flag.Usage = usage
-	flag.StringVar(
-		&consulAddr, "addr", "",
+func (opts *options) register(flags *flag.FlagSet) {
+	flags.StringVar(
+		&opts.consulAddr, "addr", "",
 		"consul HTTP API address with port")
-	flag.StringVar(
-		&consulDC, "dc", "",
+	flags.StringVar(
+		&opts.consulDC, "dc", "",
 		"consul datacenter, uses local if blank")
-	flag.StringVar(
-		&keystore, "keystore", "",
-		"directory of keys used for decryption")
-	flag.StringVar(
-		&token, "token", "",
+	flags.StringVar(
+		&opts.keystore, "keystore", "",
+		"directory of keys used for decryption, or keychain:<service> on macOS")
+	flags.StringVar(
+		&opts.token, "token", "",
 		"token to use for ACL access")
-	flag.BoolVar(
-		&once, "once", false,
+	flags.StringVar(
+		&opts.proxy, "proxy", "",
+		"proxy URL to reach consul through (http, https or socks5), instead of HTTP_PROXY/HTTPS_PROXY")
+	flags.StringVar(
+		&opts.authMethod, "auth-method", "",
+		"consul auth method to log in to for a token, instead of -token")
+	flags.StringVar(
+		&opts.authType, "auth-type", "",
+		"where the auth method's bearer token comes from: kubernetes (default), aws-iam, gcp or azure")
+	flags.BoolVar(
+		&opts.once, "once", false,
 		"run once and exit")
-	flag.StringVar(
-		&configFile, "configFile", "",
+	flags.BoolVar(
+		&opts.dryRun, "dry-run", false,
+		"log the files that would be written and deleted, with diffs, without changing anything or running onchange")
+	flags.BoolVar(
+		&opts.onceOnChange, "once-on-change", false,
+		"exit after the first change following startup has been applied")
+	flags.DurationVar(
+		&opts.onceOnChangeTimeout, "once-on-change-timeout", 0,
+		"with -once-on-change, fail if no change happens within this long")
+	flags.DurationVar(
+		&opts.shutdownTimeout, "shutdown-timeout", 0,
+		"how long writes and onchange commands in progress have to finish on SIGINT or SIGTERM (default 30s)")
+	flags.StringVar(
+		&opts.healthAddr, "health-addr", "",
+		"address to serve /healthz on, reporting whether every mapping is in sync")
+	flags.BoolVar(
+		&opts.takeover, "takeover", false,
+		"terminate other fsconsul instances managing the same paths instead of refusing to run")
+	flags.StringVar(
+		&opts.pidFile, "pid-file", "",
+		"write the process id to this file, refusing to start if it names a running process")
+	flags.BoolVar(
+		&opts.singleInstance, "single-instance", false,
+		"refuse to start if another instance is running the same config file")
+	flags.StringVar(
+		&opts.user, "user", "",
+		"user to switch to once started")
+	flags.StringVar(
+		&opts.group, "group", "",
+		"group to switch to once started (defaults to the user's group)")
+	flags.StringVar(
+		&opts.exec, "exec", "",
+		"command to run once everything has rendered, signalled whenever files change")
+	flags.StringVar(
+		&opts.execSignal, "exec-reload-signal", "",
+		"signal sent to the -exec command when files change (HUP by default), or restart")
+	flags.BoolVar(
+		&opts.harden, "harden", false,
+		"restrict filesystem access and syscalls once started (Linux only)")
+	flags.BoolVar(
+		&opts.dangerous, "i-know-what-im-doing", false,
+		"allow mappings to delete files in protected system paths such as /etc")
+	flags.StringVar(
+		&opts.stateFile, "state-file", "",
+		"file recording the consul index applied to each mapping, so restarts skip unchanged mappings")
+	flags.StringVar(
+		&opts.sourceFile, "source-file", "",
+		"render from this file in consul kv export format instead of consul, for testing mappings offline")
+	flags.StringVar(
+		&opts.record, "record", "",
+		"save every snapshot received from consul to this directory, for replaying with -replay")
+	flags.StringVar(
+		&opts.replay, "replay", "",
+		"render the snapshots saved by -record in this directory instead of watching consul")
+	flags.StringVar(
+		&opts.waitFor, "wait-for", "",
+		"key[=value][,timeout] that must exist (and match) before anything is rendered")
+	flags.BoolVar(
+		&opts.journald, "journald", false,
+		"send logs to systemd-journald instead of stderr")
+	flags.StringVar(
+		&opts.logLevel, "log-level", "",
+		"least severe level to log: debug, info (default), warn or error")
+	flags.StringVar(
+		&opts.logFormat, "log-format", "",
+		"log as json or text (logfmt) rather than choosing by whether stderr is a terminal")
+	flags.BoolVar(
+		&opts.jsonSummary, "json-summary", false,
+		"print a JSON summary of the run to stdout (once, diff and validate)")
+	flags.StringVar(
+		&opts.format, "summary-format", "",
+		"print the summary as json, or as an ansible or salt result (implies -json-summary)")
+	flags.StringVar(
+		&opts.confDir, "conf-dir", "",
+		"directory of mapping fragments, each rendered as the user owning it")
+	flags.StringVar(
+		&opts.configFile, "configFile", "",
 		"json file containing all configuration (if this is provided, all other config is ignored)")
-	flag.Parse()
-	if configFile == "" && flag.NArg() < 2 {
-		flag.Usage()
-		return 1
-	}
-
-	// Setup the logging
-	var log = logrus.New()
-	log.Out = os.Stderr
-
-	log.Info("fsconsul initializing...")
+}
 
-	args := flag.Args()
+// Resolve the configuration from the config file if one was given, otherwise from the
+// command-line switches, leaving the mappings to the caller.  On failure, the returned
+// code is the exit code to use.
+func (opts *options) loadConfig(log *logrus.Logger) (*WatchConfig, int) {
+	var config WatchConfig
 
-	if configFile != "" {
+	if opts.configFile != "" {
 		// Load the configuration from JSON.
-		configBody, err := ioutil.ReadFile(configFile)
+		configBody, err := ioutil.ReadFile(opts.configFile)
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("Failed to read config file")
-			return 2
+			return nil, 2
 		}
 
 		err = json.Unmarshal(configBody, &config)
@@ -76,60 +204,417 @@ func realMain() int {
 			log.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("Failed to parse JSON")
-			return 3
+			return nil, 3
 		}
 	} else {
-		// Build the configuraiton from the command-line
-		var onChange []string
-		if len(args) > 2 {
-			onChange = args[2:]
+		config = WatchConfig{
+			RunOnce:             opts.once,
+			OnceOnChange:        opts.onceOnChange,
+			OnceOnChangeTimeout: Duration(opts.onceOnChangeTimeout),
+			Consul: ConsulConfig{
+				Addr:  opts.consulAddr,
+				DC:    opts.consulDC,
+				Token: opts.token,
+				Proxy: opts.proxy,
+				Login: LoginConfig{
+					AuthMethod: opts.authMethod,
+					Type:       opts.authType,
+				},
+			},
+			Log: LogConfig{
+				Journald: opts.journald,
+			},
 		}
 
-		// Check whether multiple paths / prefixes are specified
-		var prefixes = strings.Split(args[0], "|")
-		var paths = strings.Split(args[1], "|")
+		if opts.waitFor != "" {
+			wait, err := parseWaitFor(opts.waitFor)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err,
+				}).Error("Invalid -wait-for")
+				return nil, 1
+			}
+			config.WaitFor = wait
+		}
+	}
 
-		if len(prefixes) != len(paths) {
-			log.Error("There must be an identical number of prefixes and paths.")
-			return 1
+	opts.loaded = flattenConfig(&config)
+
+	// These are run options rather than configuration, so they apply to config files too
+	if opts.jsonSummary {
+		config.JSONSummary = true
+	}
+	if opts.format != "" {
+		config.JSONSummary = true
+		config.SummaryFormat = opts.format
+	}
+	if !validSummaryFormat(config.SummaryFormat) {
+		log.WithFields(logrus.Fields{
+			"format":   config.SummaryFormat,
+			"expected": strings.Join(summaryFormats, ", "),
+		}).Error("Unknown summary format")
+		return nil, 1
+	}
+	if opts.takeover {
+		config.Takeover = true
+	}
+	if opts.harden {
+		config.Harden.Enabled = true
+	}
+	if opts.dangerous {
+		config.IKnowWhatImDoing = true
+	}
+	if opts.confDir != "" {
+		config.ConfDir = opts.confDir
+	}
+	if opts.stateFile != "" {
+		config.StateFile = opts.stateFile
+	}
+	if opts.sourceFile != "" {
+		config.SourceFile = opts.sourceFile
+	}
+	if opts.exec != "" {
+		config.Exec.Command = opts.exec
+	}
+	if opts.execSignal != "" {
+		config.Exec.ReloadSignal = opts.execSignal
+	}
+	if opts.record != "" {
+		config.Record = opts.record
+	}
+	if opts.dryRun {
+		config.DryRun = true
+	}
+	if opts.replay != "" {
+		config.Replay = opts.replay
+	}
+	if opts.shutdownTimeout > 0 {
+		config.ShutdownTimeout = Duration(opts.shutdownTimeout)
+	}
+	if opts.healthAddr != "" {
+		config.Health.Addr = opts.healthAddr
+	}
+	if opts.logLevel != "" {
+		config.Log.Level = opts.logLevel
+	}
+	if opts.logFormat != "" {
+		config.Log.Format = opts.logFormat
+	}
+	if config.Harden.Enabled && opts.pidFile != "" {
+		// The pid file is removed on exit
+		config.Harden.WritePaths = append(config.Harden.WritePaths, filepath.Dir(opts.pidFile))
+	}
+
+	for _, logger := range []*logrus.Logger{log, logrus.StandardLogger()} {
+		if err := configureLogging(logger, config.Log); err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to configure logging")
+			return nil, 1
 		}
+	}
 
-		config = WatchConfig{
-			RunOnce: once,
-			Consul: ConsulConfig{
-				Addr:  consulAddr,
-				DC:    consulDC,
-				Token: token,
-			},
-			Mappings: make([]MappingConfig, len(prefixes)),
+	return &config, 0
+}
+
+// Resolve the configuration, whether it's from the command-line (a single prefix, path and
+// onchange command) or JSON.  On failure, the returned code is the exit code to use.
+func (opts *options) buildConfig(log *logrus.Logger, args []string) (*WatchConfig, int) {
+	config, code := opts.loadConfig(log)
+	if config == nil || opts.configFile != "" || len(args) == 0 {
+		return config, code
+	}
+
+	if strings.Contains(args[0], "|") || strings.Contains(args[1], "|") {
+		log.Error("Pipe-delimited prefixes and paths are only supported without a command, use a config file for multiple mappings.")
+		return nil, 1
+	}
+
+	config.Mappings = []MappingConfig{opts.mapping(args[0], args[1], args[2:])}
+	return config, 0
+}
+
+// Resolve the configuration for the original invocation style, where multiple prefixes and
+// paths may be given pipe-delimited.  On failure, the returned code is the exit code to use.
+func (opts *options) buildLegacyConfig(log *logrus.Logger, args []string) (*WatchConfig, int) {
+	config, code := opts.loadConfig(log)
+	if config == nil || opts.configFile != "" {
+		return config, code
+	}
+
+	// Check whether multiple paths / prefixes are specified
+	var prefixes = strings.Split(args[0], "|")
+	var paths = strings.Split(args[1], "|")
+
+	if len(prefixes) != len(paths) {
+		log.Error("There must be an identical number of prefixes and paths.")
+		return nil, 1
+	}
+
+	config.Mappings = make([]MappingConfig, len(prefixes))
+	for i := 0; i < len(prefixes); i++ {
+		config.Mappings[i] = opts.mapping(prefixes[i], paths[i], args[2:])
+	}
+
+	return config, 0
+}
+
+func (opts *options) mapping(prefix, path string, onChange []string) MappingConfig {
+	if len(onChange) == 0 {
+		onChange = nil
+	}
+
+	return MappingConfig{
+		Prefix:   prefix,
+		Path:     path,
+		Keystore: opts.keystore,
+		OnChange: onChange,
+	}
+}
+
+func newLogger() *logrus.Logger {
+	var log = logrus.New()
+	log.Out = os.Stderr
+	return log
+}
+
+// Run the original, command-less invocation style.  Pipe-delimited prefixes and paths are
+// still accepted here so that existing init scripts and units keep working, but are
+// deprecated in favour of config files.
+func watchMain(args []string) int {
+	var opts options
+	var emit bool
+
+	flags := newFlagSet("fsconsul", strings.Replace(helpText, "{{commands}}\n", commandList(), 1), &opts)
+	flags.BoolVar(
+		&emit, "emit-config", false,
+		"print the equivalent JSON config file and exit")
+	flags.Parse(args)
+	if opts.configFile == "" && flags.NArg() < 2 {
+		flags.Usage()
+		return 1
+	}
+
+	// Setup the logging
+	log := newLogger()
+
+	config, code := opts.buildLegacyConfig(log, flags.Args())
+	if config == nil {
+		return code
+	}
+
+	if emit {
+		configBody, err := emitConfig(config)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to build JSON")
+			return 1
 		}
 
-		for i := 0; i < len(prefixes); i++ {
-			config.Mappings[i] = MappingConfig{
-				Prefix:   prefixes[i],
-				Path:     paths[i],
-				Keystore: keystore,
-				OnChange: onChange,
+		os.Stdout.Write(configBody)
+		return 0
+	}
+
+	if opts.configFile == "" {
+		log.Warn("Passing prefixes and paths without a command is deprecated, run with -emit-config to translate them to a config file.")
+	}
+
+	log.Info("fsconsul initializing...")
+	logEffectiveConfig(log, opts.effective(config))
+
+	release, err := acquireInstance(&opts, flags.Args())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Refusing to start")
+		return 1
+	}
+	defer release()
+
+	if !checkConfig(log, config) {
+		return 1
+	}
+	return watchAndExec(config)
+}
+
+func runWatch(name, help string, args []string, once bool) int {
+	var opts options
+
+	flags := newFlagSet(name, help, &opts)
+	flags.Parse(args)
+	// Mappings come from a config file, a conf.d directory and/or the arguments
+	if opts.configFile == "" && flags.NArg() < 2 && (opts.confDir == "" || flags.NArg() != 0) {
+		flags.Usage()
+		return 1
+	}
+
+	// Setup the logging
+	log := newLogger()
+
+	log.Info("fsconsul initializing...")
+
+	config, code := opts.buildConfig(log, flags.Args())
+	if config == nil {
+		return code
+	}
+	logEffectiveConfig(log, opts.effective(config))
+
+	if once {
+		config.RunOnce = true
+	} else {
+		config.reload = func() (*WatchConfig, error) {
+			reloaded, _ := opts.buildConfig(log, flags.Args())
+			if reloaded == nil {
+				return nil, fmt.Errorf("failed to load configuration")
 			}
+			return reloaded, nil
+		}
+	}
+
+	release, err := acquireInstance(&opts, flags.Args())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Refusing to start")
+		return 1
+	}
+	defer release()
+
+	if !checkConfig(log, config) {
+		return 1
+	}
+	return watchAndExec(config)
+}
+
+// Refuse to start with a configuration that would only fail once running, logging why, as
+// a reload or registering a mapping would.
+func checkConfig(log *logrus.Logger, config *WatchConfig) bool {
+	applyDefaults(config)
+	errs := validateConfig(config)
+	for _, err := range errs {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Invalid configuration")
+	}
+	return len(errs) == 0
+}
+
+// Translate a configuration built from the command-line into the equivalent config file.
+func emitConfig(config *WatchConfig) ([]byte, error) {
+	type loginJSON struct {
+		AuthMethod string `json:"authmethod"`
+		Type       string `json:"type,omitempty"`
+	}
+	type consulJSON struct {
+		Addr  string     `json:"addr,omitempty"`
+		DC    string     `json:"dc,omitempty"`
+		Token string     `json:"token,omitempty"`
+		Proxy string     `json:"proxy,omitempty"`
+		Login *loginJSON `json:"login,omitempty"`
+	}
+	type logJSON struct {
+		Journald bool   `json:"journald,omitempty"`
+		Level    string `json:"level,omitempty"`
+		Format   string `json:"format,omitempty"`
+	}
+	type waitForJSON struct {
+		Key     string    `json:"key"`
+		Value   string    `json:"value,omitempty"`
+		Timeout *Duration `json:"timeout,omitempty"`
+	}
+	type mappingJSON struct {
+		OnChange string `json:"onchange,omitempty"`
+		Prefix   string `json:"prefix"`
+		Path     string `json:"path"`
+		Keystore string `json:"keystore,omitempty"`
+	}
+
+	out := struct {
+		RunOnce             bool          `json:"runonce,omitempty"`
+		OnceOnChange        bool          `json:"onceonchange,omitempty"`
+		OnceOnChangeTimeout *Duration     `json:"onceonchangetimeout,omitempty"`
+		Consul              consulJSON    `json:"consul"`
+		Log                 *logJSON      `json:"log,omitempty"`
+		WaitFor             *waitForJSON  `json:"waitfor,omitempty"`
+		Mappings            []mappingJSON `json:"mappings"`
+	}{
+		RunOnce:      config.RunOnce,
+		OnceOnChange: config.OnceOnChange,
+		Consul: consulJSON{
+			Addr:  config.Consul.Addr,
+			DC:    config.Consul.DC,
+			Token: config.Consul.Token,
+			Proxy: config.Consul.Proxy,
+		},
+	}
+
+	if config.Consul.Login.AuthMethod != "" {
+		out.Consul.Login = &loginJSON{AuthMethod: config.Consul.Login.AuthMethod, Type: config.Consul.Login.Type}
+	}
+
+	if config.OnceOnChangeTimeout > 0 {
+		out.OnceOnChangeTimeout = &config.OnceOnChangeTimeout
+	}
+
+	if config.Log != (LogConfig{}) {
+		out.Log = &logJSON{Journald: config.Log.Journald, Level: config.Log.Level, Format: config.Log.Format}
+	}
+
+	if config.WaitFor.Key != "" {
+		out.WaitFor = &waitForJSON{Key: config.WaitFor.Key, Value: config.WaitFor.Value}
+		if config.WaitFor.Timeout > 0 {
+			out.WaitFor.Timeout = &config.WaitFor.Timeout
 		}
 	}
 
-	return watchAndExec(&config)
+	for _, mappingConfig := range config.Mappings {
+		out.Mappings = append(out.Mappings, mappingJSON{
+			OnChange: strings.Join(mappingConfig.OnChange, " "),
+			Prefix:   mappingConfig.Prefix,
+			Path:     mappingConfig.Path,
+			Keystore: mappingConfig.Keystore,
+		})
+	}
+
+	configBody, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(configBody, '\n'), nil
 }
 
-func usage() {
+// Create the flag set for a command, with the shared options registered.
+func newFlagSet(name, help string, opts *options) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() { usage(flags, help) }
+	if opts != nil {
+		opts.register(flags)
+	}
+	return flags
+}
+
+func usage(flags *flag.FlagSet, text string) {
 	cmd := filepath.Base(os.Args[0])
-	fmt.Fprintf(os.Stderr, strings.TrimSpace(helpText)+"\n\n", cmd)
-	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, strings.TrimSpace(text)+"\n\n", cmd)
+	flags.PrintDefaults()
 }
 
 const helpText = `
 Usage: %s [options] prefix path onchange
+       %[1]s <command> [options] [args]
 
   Write files to the specified locations on the local system by reading K/Vs
   from Consul's K/V store with the given prefixes and executing a program on
   any change.  Prefixes and paths must be pipe-delimited if provided as
-  command-line switches.
+  command-line switches; this is deprecated, use a config file instead.
+
+Commands:
+
+{{commands}}
+
+  Run "%[1]s <command> -h" for help on a command.
 
 Options:
 `
@@ -0,0 +1,198 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ManagedByConfig holds the marker written at the top of rendered files, telling people and
+// configuration management tools that fsconsul owns them.
+type ManagedByConfig struct {
+	// The text of the marker, e.g. "Managed by fsconsul, local changes will be overwritten"
+	Header string
+
+	// Comment syntax by file extension, on top of the defaults, e.g. {".conf": "#"}.  Block
+	// comments are given as the opening and closing delimiters separated by a space, e.g.
+	// "<!-- -->".  Files whose extension has no comment syntax (or "") aren't marked.
+	Comments map[string]string
+}
+
+// Comment syntax for common file types.  JSON has no comments, so JSON files aren't marked.
+var defaultCommentSyntax = map[string]string{
+	".cfg":        "#",
+	".conf":       "#",
+	".env":        "#",
+	".hcl":        "#",
+	".ini":        ";",
+	".properties": "#",
+	".py":         "#",
+	".rb":         "#",
+	".sh":         "#",
+	".toml":       "#",
+	".yaml":       "#",
+	".yml":        "#",
+	".c":          "/* */",
+	".css":        "/* */",
+	".go":         "//",
+	".java":       "//",
+	".js":         "//",
+	".lua":        "--",
+	".sql":        "--",
+	".html":       "<!-- -->",
+	".xml":        "<!-- -->",
+}
+
+// Find the comment syntax for a file, returning false if it can't be marked.
+func (managedBy ManagedByConfig) commentSyntax(keyfile string) (start, end string, ok bool) {
+	ext := strings.ToLower(filepath.Ext(keyfile))
+
+	syntax, found := managedBy.Comments[ext]
+	if !found {
+		syntax = defaultCommentSyntax[ext]
+	}
+	if syntax == "" {
+		return "", "", false
+	}
+
+	delimiters := strings.SplitN(syntax, " ", 2)
+	if len(delimiters) == 2 {
+		return delimiters[0], delimiters[1], true
+	}
+	return delimiters[0], "", true
+}
+
+// Insert the managed-by marker into rendered content, after any shebang or XML declaration,
+// which must stay on the first line.  Patched files aren't fsconsul's alone, so they're
+// never marked.
+func markManaged(mappingConfig *MappingConfig, keyfile string, content []byte) []byte {
+	if mappingConfig.ManagedBy.Header == "" || mappingConfig.Patch {
+		return content
+	}
+
+	start, end, ok := mappingConfig.ManagedBy.commentSyntax(keyfile)
+	if !ok {
+		return content
+	}
+
+	var marker bytes.Buffer
+	for _, line := range strings.Split(mappingConfig.ManagedBy.Header, "\n") {
+		marker.WriteString(start + " " + line)
+		if end != "" {
+			marker.WriteString(" " + end)
+		}
+		marker.WriteString("\n")
+	}
+
+	var first []byte
+	if bytes.HasPrefix(content, []byte("#!")) || bytes.HasPrefix(content, []byte("<?xml")) {
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			first, content = content[:i+1], content[i+1:]
+		} else {
+			first, content = append(content, '\n'), nil
+		}
+	}
+
+	marked := make([]byte, 0, len(first)+marker.Len()+len(content))
+	marked = append(marked, first...)
+	marked = append(marked, marker.Bytes()...)
+	return append(marked, content...)
+}
+
+// ownedFile is a file rendered by fsconsul, and the mapping it's rendered by.
+type ownedFile struct {
+	file    string
+	mapping string
+}
+
+// List the files a configuration renders from what's currently under its prefixes.
+func ownedFiles(config *WatchConfig) ([]ownedFile, error) {
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var owned []ownedFile
+	for i := range config.Mappings {
+		mapping := reportOn(client, config, &config.Mappings[i])
+		if mapping.Error != "" {
+			return nil, fmt.Errorf("mapping %s: %s", mapping.Mapping, mapping.Error)
+		}
+
+		for _, file := range mapping.Files {
+			// Exploded mappings render every key to the same file
+			if !seen[file.File] {
+				seen[file.File] = true
+				owned = append(owned, ownedFile{file.File, mapping.Mapping})
+			}
+		}
+	}
+
+	sort.Slice(owned, func(i, j int) bool { return owned[i].file < owned[j].file })
+	return owned, nil
+}
+
+// Print the files fsconsul owns, or with files given, which of them it owns.  Exits 0 if it
+// owns every file given, 1 if it doesn't and 2 on error, so that configuration management
+// tools can skip the files fsconsul manages.
+func ownsCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul owns", ownsHelpText, &opts)
+	flags.Parse(args)
+	if opts.configFile == "" {
+		flags.Usage()
+		return 2
+	}
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, nil)
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	owned, err := ownedFiles(config)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to list owned files")
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		for _, o := range owned {
+			fmt.Printf("%s\t%s\n", o.file, o.mapping)
+		}
+		return 0
+	}
+
+	byFile := make(map[string]string, len(owned))
+	for _, o := range owned {
+		byFile[absPath(o.file)] = o.mapping
+	}
+
+	code = 0
+	for _, file := range flags.Args() {
+		if mapping, ok := byFile[absPath(file)]; ok {
+			fmt.Printf("%s\t%s\n", file, mapping)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s is not managed by fsconsul\n", file)
+			code = 1
+		}
+	}
+	return code
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
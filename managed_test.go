@@ -0,0 +1,38 @@
+package fsconsul
+
+import (
+	"testing"
+)
+
+func TestMarkManaged(t *testing.T) {
+	mappingConfig := &MappingConfig{
+		ManagedBy: ManagedByConfig{
+			Header:   "Managed by fsconsul",
+			Comments: map[string]string{".vcl": "#", ".sh": ""},
+		},
+	}
+
+	cases := []struct {
+		file     string
+		content  string
+		expected string
+	}{
+		{"app.conf", "port=80\n", "# Managed by fsconsul\nport=80\n"},
+		{"app.xml", "<?xml version=\"1.0\"?>\n<app/>\n", "<?xml version=\"1.0\"?>\n<!-- Managed by fsconsul -->\n<app/>\n"},
+		{"app.yml", "#!ignored\n", "#!ignored\n# Managed by fsconsul\n"},
+		{"default.vcl", "vcl 4.0;", "# Managed by fsconsul\nvcl 4.0;"},
+		{"app.json", "{}", "{}"},
+		{"start.sh", "#!/bin/sh\n", "#!/bin/sh\n"},
+		{"README", "hello", "hello"},
+	}
+	for _, c := range cases {
+		if marked := string(markManaged(mappingConfig, c.file, []byte(c.content))); marked != c.expected {
+			t.Errorf("expected %s to be marked as %q, got %q", c.file, c.expected, marked)
+		}
+	}
+
+	mappingConfig.Patch = true
+	if marked := string(markManaged(mappingConfig, "app.conf", []byte("port=80\n"))); marked != "port=80\n" {
+		t.Errorf("expected patched files not to be marked, got %q", marked)
+	}
+}
@@ -0,0 +1,52 @@
+package fsconsul
+
+import (
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// The Consul agent a mapping reads from: the configuration's, with whatever the mapping's
+// own Consul sets overriding it.  Credentials are overridden together, so a mapping with
+// its own token doesn't also log in with the configuration's auth method, and so is TLS
+// material.
+func (config *WatchConfig) consulFor(mappingConfig *MappingConfig) ConsulConfig {
+	consul := config.Consul
+	override := mappingConfig.Consul
+	if override == nil {
+		return consul
+	}
+
+	if override.Addr != "" {
+		consul.Addr = override.Addr
+	}
+	if override.DC != "" {
+		consul.DC = override.DC
+	}
+	if override.Token != "" || override.TokenFile != "" || override.Login.AuthMethod != "" {
+		consul.Token, consul.TokenFile, consul.Login = override.Token, override.TokenFile, override.Login
+	}
+	if override.CAFile != "" || override.CertFile != "" || override.KeyFile != "" {
+		consul.CAFile, consul.CertFile, consul.KeyFile = override.CAFile, override.CertFile, override.KeyFile
+	}
+	if override.UseTLS {
+		consul.UseTLS = true
+	}
+	if override.Proxy != "" {
+		consul.Proxy = override.Proxy
+	}
+	if len(override.PinnedKeys) > 0 {
+		consul.PinnedKeys = override.PinnedKeys
+	}
+	if override.CheckRevocation {
+		consul.CheckRevocation = true
+	}
+	return consul
+}
+
+// The client for a mapping's Consul: the configuration's client, unless the mapping has its
+// own Consul.
+func (config *WatchConfig) consulClientFor(client *consulapi.Client, mappingConfig *MappingConfig) (*consulapi.Client, error) {
+	if mappingConfig.Consul == nil {
+		return client, nil
+	}
+	return buildConsulClient(config.consulFor(mappingConfig))
+}
@@ -0,0 +1,43 @@
+package fsconsul
+
+import (
+	"testing"
+)
+
+func TestConsulFor(t *testing.T) {
+	config := &WatchConfig{Consul: ConsulConfig{
+		Addr:   "consul.east:8500",
+		DC:     "east",
+		Token:  "east-token",
+		CAFile: "/etc/consul/ca.pem",
+		Login:  LoginConfig{AuthMethod: "kubernetes"},
+	}}
+
+	if consul := config.consulFor(&MappingConfig{}); consul.Addr != "consul.east:8500" || consul.Token != "east-token" {
+		t.Errorf("expected a mapping without its own consul to use the top-level one, got %+v", consul)
+	}
+
+	// Another datacenter of the same cluster only changes the datacenter
+	consul := config.consulFor(&MappingConfig{Consul: &ConsulConfig{DC: "west"}})
+	if consul.Addr != "consul.east:8500" || consul.DC != "west" || consul.Token != "east-token" || consul.Login.AuthMethod != "kubernetes" {
+		t.Errorf("expected only the datacenter to be overridden, got %+v", consul)
+	}
+
+	// A separate cluster has its own credentials and TLS material
+	consul = config.consulFor(&MappingConfig{Consul: &ConsulConfig{
+		Addr:     "consul.other:8501",
+		Token:    "other-token",
+		CertFile: "/etc/other/cert.pem",
+		KeyFile:  "/etc/other/key.pem",
+		UseTLS:   true,
+	}})
+	if consul.Addr != "consul.other:8501" || consul.DC != "east" || !consul.UseTLS {
+		t.Errorf("expected the address and TLS to be overridden, got %+v", consul)
+	}
+	if consul.Token != "other-token" || consul.Login.AuthMethod != "" {
+		t.Errorf("expected the token to replace the auth method, got %+v", consul)
+	}
+	if consul.CAFile != "" || consul.CertFile != "/etc/other/cert.pem" {
+		t.Errorf("expected the TLS material to be overridden together, got %+v", consul)
+	}
+}
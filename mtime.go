@@ -0,0 +1,51 @@
+package fsconsul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// modifyTimes remembers when the current ModifyIndex of each key was first observed, so
+// that rendered files can carry the time their key actually changed rather than the time
+// they were last rewritten.  Consul only records a ModifyIndex per key, not a wall clock
+// time, so the time of observation is the best approximation available.
+type modifyTimes struct {
+	indexes map[string]uint64
+	times   map[string]time.Time
+}
+
+func newModifyTimes() *modifyTimes {
+	return &modifyTimes{
+		indexes: make(map[string]uint64),
+		times:   make(map[string]time.Time),
+	}
+}
+
+// Record the ModifyIndex of a key and return the modification time to give its file.  The
+// first time a key is seen, a keyfile already holding the rendered content (e.g. from before
+// a restart) keeps its current mtime.
+func (m *modifyTimes) observe(key string, index uint64, keyfile string, content []byte) time.Time {
+	if known, ok := m.indexes[key]; ok && known == index {
+		return m.times[key]
+	}
+
+	modified := time.Now()
+	if _, ok := m.indexes[key]; !ok {
+		if info, err := os.Stat(keyfile); err == nil {
+			if existing, err := ioutil.ReadFile(keyfile); err == nil && bytes.Equal(existing, content) {
+				modified = info.ModTime()
+			}
+		}
+	}
+
+	m.indexes[key] = index
+	m.times[key] = modified
+	return modified
+}
+
+func (m *modifyTimes) forget(key string) {
+	delete(m.indexes, key)
+	delete(m.times, key)
+}
@@ -0,0 +1,41 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestModifyTimes(t *testing.T) {
+	tempDir := t.TempDir()
+	keyfile := filepath.Join(tempDir, "app.conf")
+	mtimes := newModifyTimes()
+
+	first := mtimes.observe("app.conf", 1, keyfile, []byte("a"))
+
+	// An unchanged key keeps its time across snapshots
+	time.Sleep(10 * time.Millisecond)
+	if again := mtimes.observe("app.conf", 1, keyfile, []byte("a")); !again.Equal(first) {
+		t.Errorf("expected an unchanged key to keep %v, got %v", first, again)
+	}
+
+	// A changed key gets the time it was observed
+	changed := mtimes.observe("app.conf", 2, keyfile, []byte("b"))
+	if !changed.After(first) {
+		t.Errorf("expected a changed key to get a time after %v, got %v", first, changed)
+	}
+
+	// A file already holding a key's content when first observed keeps its mtime
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := ioutil.WriteFile(keyfile, []byte("c"), 0640); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Chtimes(keyfile, past, past); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if kept := newModifyTimes().observe("app.conf", 3, keyfile, []byte("c")); !kept.Equal(past) {
+		t.Errorf("expected the existing file's mtime %v, got %v", past, kept)
+	}
+}
@@ -0,0 +1,67 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// How trailing newlines of rendered files are normalized.
+const (
+	newlineKeep = "keep" // leave files as rendered (the default)
+	newlineOne  = "one"  // end files with exactly one newline
+	newlineNone = "none" // strip trailing newlines
+)
+
+// Resolve the trailing newline policy of a file, given by its path relative to the mapping's
+// path, from the mapping's and the overrides in Files.
+func (mappingConfig *MappingConfig) trailingNewline(rel string) string {
+	policy := mappingConfig.TrailingNewline
+	for _, override := range mappingConfig.fileOverrides(rel) {
+		if override.TrailingNewline != "" {
+			policy = override.TrailingNewline
+		}
+	}
+	return policy
+}
+
+// Normalize the trailing newlines of rendered content.  Empty content is left empty, and
+// a final \r\n counts as a newline, so Windows files keep their line endings.
+func normalizeNewline(policy string, content []byte) []byte {
+	if len(content) == 0 || (policy != newlineOne && policy != newlineNone) {
+		return content
+	}
+
+	newline := []byte("\n")
+	trimmed := content
+	for {
+		if bytes.HasSuffix(trimmed, []byte("\r\n")) {
+			newline = []byte("\r\n")
+			trimmed = trimmed[:len(trimmed)-2]
+		} else if bytes.HasSuffix(trimmed, []byte("\n")) {
+			trimmed = trimmed[:len(trimmed)-1]
+		} else {
+			break
+		}
+	}
+
+	if policy == newlineNone {
+		return trimmed
+	}
+	return append(trimmed[:len(trimmed):len(trimmed)], newline...)
+}
+
+// Check a mapping's trailing newline policies, including those in Files.
+func (mappingConfig *MappingConfig) checkTrailingNewline() error {
+	policies := []string{mappingConfig.TrailingNewline}
+	for _, override := range mappingConfig.Files {
+		policies = append(policies, override.TrailingNewline)
+	}
+	for _, policy := range policies {
+		switch policy {
+		case "", newlineKeep, newlineOne, newlineNone:
+		default:
+			return fmt.Errorf("unknown trailingnewline %s, expected keep, one or none", policy)
+		}
+	}
+	return nil
+}
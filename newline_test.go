@@ -0,0 +1,53 @@
+package fsconsul
+
+import "testing"
+
+func TestNormalizeNewline(t *testing.T) {
+	for _, test := range []struct {
+		policy, content, want string
+	}{
+		{"", "a", "a"},
+		{newlineKeep, "a\n\n", "a\n\n"},
+		{newlineOne, "a", "a\n"},
+		{newlineOne, "a\n\n\n", "a\n"},
+		{newlineOne, "a\r\n\r\n", "a\r\n"},
+		{newlineOne, "", ""},
+		{newlineNone, "a\n", "a"},
+		{newlineNone, "a\r\n", "a"},
+	} {
+		if got := string(normalizeNewline(test.policy, []byte(test.content))); got != test.want {
+			t.Errorf("%q of %q: expected %q, got %q", test.policy, test.content, test.want, got)
+		}
+	}
+}
+
+func TestTrailingNewlineOverrides(t *testing.T) {
+	mappingConfig := &MappingConfig{
+		TrailingNewline: newlineOne,
+		Files: map[string]FilePermissions{
+			"motd":    {TrailingNewline: newlineKeep},
+			"tls/*":   {FileMode: "0600"},
+			"raw/*.b": {TrailingNewline: newlineNone},
+		},
+	}
+	for rel, want := range map[string]string{
+		"sudoers": newlineOne,
+		"motd":    newlineKeep,
+		"tls/key": newlineOne,
+		"raw/x.b": newlineNone,
+	} {
+		if got := mappingConfig.trailingNewline(rel); got != want {
+			t.Errorf("%s: expected %s, got %s", rel, want, got)
+		}
+	}
+
+	rendered, err := renderValue(mappingConfig, "sudoers", []byte("root ALL=(ALL) ALL"), nil)
+	if err != nil || string(rendered) != "root ALL=(ALL) ALL\n" {
+		t.Errorf("expected the rendered value to end in a newline, got %q (%v)", rendered, err)
+	}
+
+	mappingConfig.Files["bad"] = FilePermissions{TrailingNewline: "two"}
+	if err := mappingConfig.checkTrailingNewline(); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
@@ -0,0 +1,316 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of events notifiers are told about.
+const (
+	// A mapping hasn't synced with Consul for longer than its staleness allows, or failed
+	EventUnhealthy = "mapping-unhealthy"
+
+	// A mapping's deletions weren't confirmed
+	EventDeletesBlocked = "deletes-blocked"
+
+	// A value couldn't be decrypted, or its keystore read
+	EventDecryptionFailed = "decryption-failed"
+
+	// Consul has been unreachable for long enough to be degraded
+	EventDegraded = "degraded"
+)
+
+var eventKinds = []string{EventUnhealthy, EventDeletesBlocked, EventDecryptionFailed, EventDegraded}
+
+// Event is an operational failure, or the end of one, that notifiers are told about.
+type Event struct {
+	Kind string `json:"kind"`
+
+	// Empty for events about the whole process, such as being degraded
+	Mapping string `json:"mapping,omitempty"`
+
+	Message  string    `json:"message"`
+	Resolved bool      `json:"resolved"`
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+}
+
+// The key identifying a failure across its event and the event resolving it, so that the
+// services paged can tell they're the same incident.
+func (event Event) dedupKey() string {
+	return strings.Join([]string{"fsconsul", event.Host, event.Mapping, event.Kind}, "/")
+}
+
+// Notifier is told about operational failures as they start and end, to page the team
+// concerned.  It's called from a goroutine of its own, so it may take its time.
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// NotifierConfig configures one of the built-in notifiers.
+type NotifierConfig struct {
+	// webhook, pagerduty or opsgenie
+	Type string
+
+	// Where webhook events are POSTed, or the API to use instead of PagerDuty's or Opsgenie's
+	// (e.g. https://api.eu.opsgenie.com)
+	URL string
+
+	// The PagerDuty Events API v2 integration key, or the Opsgenie API key
+	RoutingKey string
+	APIKey     string
+
+	// Kinds of events to notify about, all by default
+	Events []string
+}
+
+// Check a notifier's configuration, without building it.
+func (notifierConfig NotifierConfig) check() error {
+	switch notifierConfig.Type {
+	case "webhook":
+		if notifierConfig.URL == "" {
+			return fmt.Errorf("webhook notifier needs a url")
+		}
+	case "pagerduty":
+		if notifierConfig.RoutingKey == "" {
+			return fmt.Errorf("pagerduty notifier needs a routingkey")
+		}
+	case "opsgenie":
+		if notifierConfig.APIKey == "" {
+			return fmt.Errorf("opsgenie notifier needs an apikey")
+		}
+	default:
+		return fmt.Errorf("unknown notifier type %s, expected webhook, pagerduty or opsgenie", notifierConfig.Type)
+	}
+
+	for _, kind := range notifierConfig.Events {
+		if !containsString(eventKinds, kind) {
+			return fmt.Errorf("unknown event %s, expected one of %s", kind, strings.Join(eventKinds, ", "))
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// notifiers passes events on to the configured notifiers and the embedding program's,
+// once per failure: an event is only sent when a failure starts, and resolved when it
+// ends, however many times it's seen in between.  Methods are safe to call on a nil
+// notifiers.
+type notifiers struct {
+	host    string
+	targets []notifyTarget
+	logger  *log.Entry
+
+	mu   sync.Mutex
+	open map[string]Event
+}
+
+// notifyTarget is a notifier and the kinds of events it's told about, nil for all.
+type notifyTarget struct {
+	notifier Notifier
+	events   []string
+}
+
+func newNotifiers(configs []NotifierConfig, hooks *Hooks) *notifiers {
+	var targets []notifyTarget
+	for _, notifierConfig := range configs {
+		targets = append(targets, notifyTarget{builtinNotifier(notifierConfig), notifierConfig.Events})
+	}
+	if hooks != nil && hooks.Notifier != nil {
+		targets = append(targets, notifyTarget{hooks.Notifier, nil})
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	host, _ := os.Hostname()
+	return &notifiers{host: host, targets: targets, logger: log.NewEntry(log.StandardLogger()), open: make(map[string]Event)}
+}
+
+// Notify that a failure has started, unless it's already been notified.
+func (n *notifiers) trigger(kind, mapping, message string) {
+	if n == nil {
+		return
+	}
+
+	event := Event{Kind: kind, Mapping: mapping, Message: message, Host: n.host, Time: time.Now()}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.open[event.dedupKey()]; ok {
+		return
+	}
+	n.open[event.dedupKey()] = event
+	n.send(event)
+}
+
+// Notify that a mapping's failures have ended, if they were notified.
+func (n *notifiers) resolve(kind, mapping string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := Event{Kind: kind, Mapping: mapping, Host: n.host}.dedupKey()
+	event, ok := n.open[key]
+	if !ok {
+		return
+	}
+	delete(n.open, key)
+
+	event.Resolved = true
+	event.Time = time.Now()
+	n.send(event)
+}
+
+// Notify that every failure of a mapping has ended, once it's in sync again.
+func (n *notifiers) resolveMapping(mapping string) {
+	for _, kind := range []string{EventUnhealthy, EventDeletesBlocked, EventDecryptionFailed} {
+		n.resolve(kind, mapping)
+	}
+}
+
+func (n *notifiers) send(event Event) {
+	for _, target := range n.targets {
+		if target.events != nil && !containsString(target.events, event.Kind) {
+			continue
+		}
+		go func(notifier Notifier) {
+			if err := notifier.Notify(event); err != nil {
+				n.logger.WithFields(log.Fields{
+					"error": err,
+					"event": event.Kind,
+				}).Error("Failed to notify")
+			}
+		}(target.notifier)
+	}
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func builtinNotifier(notifierConfig NotifierConfig) Notifier {
+	switch notifierConfig.Type {
+	case "pagerduty":
+		return &pagerDutyNotifier{notifierConfig}
+	case "opsgenie":
+		return &opsgenieNotifier{notifierConfig}
+	default:
+		return &webhookNotifier{notifierConfig}
+	}
+}
+
+// POST a JSON body, failing unless the response is 2xx.
+func postJSON(url string, header http.Header, body interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier POSTs events as they are.
+type webhookNotifier struct {
+	config NotifierConfig
+}
+
+func (w *webhookNotifier) Notify(event Event) error {
+	return postJSON(w.config.URL, nil, event)
+}
+
+// pagerDutyNotifier triggers and resolves PagerDuty incidents with the Events API v2.
+type pagerDutyNotifier struct {
+	config NotifierConfig
+}
+
+func (p *pagerDutyNotifier) Notify(event Event) error {
+	body := map[string]interface{}{
+		"routing_key":  p.config.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    event.dedupKey(),
+	}
+	if event.Resolved {
+		body["event_action"] = "resolve"
+	} else {
+		body["payload"] = map[string]interface{}{
+			"summary":   event.Message,
+			"source":    event.Host,
+			"severity":  "error",
+			"component": event.Mapping,
+			"class":     event.Kind,
+			"timestamp": event.Time.Format(time.RFC3339),
+		}
+	}
+
+	api := p.config.URL
+	if api == "" {
+		api = "https://events.pagerduty.com/v2/enqueue"
+	}
+	return postJSON(api, nil, body)
+}
+
+// opsgenieNotifier creates and closes Opsgenie alerts, identified by the event's alias.
+type opsgenieNotifier struct {
+	config NotifierConfig
+}
+
+func (o *opsgenieNotifier) Notify(event Event) error {
+	api := strings.TrimSuffix(o.config.URL, "/")
+	if api == "" {
+		api = "https://api.opsgenie.com"
+	}
+	header := http.Header{"Authorization": {"GenieKey " + o.config.APIKey}}
+
+	if event.Resolved {
+		return postJSON(api+"/v2/alerts/"+url.PathEscape(event.dedupKey())+"/close?identifierType=alias", header,
+			map[string]string{"source": "fsconsul", "note": event.Kind + " resolved"})
+	}
+
+	// Messages are limited to 130 characters, and the whole message goes in the description
+	message := event.Message
+	if len(message) > 130 {
+		message = message[:127] + "..."
+	}
+	return postJSON(api+"/v2/alerts", header, map[string]interface{}{
+		"message":     message,
+		"alias":       event.dedupKey(),
+		"description": event.Message,
+		"source":      "fsconsul",
+		"entity":      event.Host,
+		"tags":        []string{"fsconsul", event.Kind},
+		"details":     map[string]string{"mapping": event.Mapping, "kind": event.Kind},
+	})
+}
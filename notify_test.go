@@ -0,0 +1,66 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifiers(t *testing.T) {
+	received := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer server.Close()
+
+	notify := newNotifiers([]NotifierConfig{{Type: "pagerduty", RoutingKey: "key", URL: server.URL}}, nil)
+	next := func() map[string]interface{} {
+		select {
+		case body := <-received:
+			return body
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected an event")
+			return nil
+		}
+	}
+
+	// A failure is only notified once, however often it's seen
+	notify.trigger(EventDeletesBlocked, "app1", "20 deletions weren't confirmed")
+	notify.trigger(EventDeletesBlocked, "app1", "20 deletions weren't confirmed")
+	triggered := next()
+	if triggered["event_action"] != "trigger" || triggered["routing_key"] != "key" {
+		t.Errorf("expected an incident to be triggered, got %v", triggered)
+	}
+
+	notify.resolveMapping("app1")
+	resolved := next()
+	if resolved["event_action"] != "resolve" || resolved["dedup_key"] != triggered["dedup_key"] {
+		t.Errorf("expected the incident to be resolved, got %v", resolved)
+	}
+
+	// Only open failures are resolved
+	notify.resolveMapping("app1")
+	select {
+	case body := <-received:
+		t.Errorf("expected nothing more, got %v", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Without notifiers, nothing is sent
+	var none *notifiers
+	none.trigger(EventDegraded, "", "unreachable")
+	if newNotifiers(nil, nil) != nil {
+		t.Errorf("expected no notifiers without any configured")
+	}
+
+	if err := (NotifierConfig{Type: "opsgenie"}).check(); err == nil {
+		t.Errorf("expected an opsgenie notifier without an apikey to be refused")
+	}
+	if err := (NotifierConfig{Type: "webhook", URL: server.URL, Events: []string{"stale"}}).check(); err == nil {
+		t.Errorf("expected an unknown event to be refused")
+	}
+}
@@ -0,0 +1,211 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Beyond this many bytes of file names, the changed files are only given on stdin, so that
+// a large snapshot can't make the onchange command's environment too big to start it.
+const maxChangedFilesEnv = 64 << 10
+
+// How long an onchange command that timed out has to exit after SIGTERM before it's killed.
+var onChangeKillGrace = 10 * time.Second
+
+// How much of a timed out onchange command's output is logged.
+const onChangeOutputTail = 4 << 10
+
+// keyFailure is a key whose file couldn't be rendered, written or deleted while applying a
+// snapshot.
+type keyFailure struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// fileChanges are the files a snapshot created, updated or deleted.
+type fileChanges struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+	Deleted []string `json:"deleted"`
+}
+
+func (c *fileChanges) empty() bool {
+	return len(c.Created) == 0 && len(c.Updated) == 0 && len(c.Deleted) == 0
+}
+
+// Every file changed, in order.
+func (c *fileChanges) files() []string {
+	files := make([]string, 0, len(c.Created)+len(c.Updated)+len(c.Deleted))
+	files = append(files, c.Created...)
+	files = append(files, c.Updated...)
+	files = append(files, c.Deleted...)
+	sort.Strings(files)
+	return files
+}
+
+// Describe the snapshot just applied to the onchange command, so that it can decide not to
+// reload a service on top of an incomplete tree: FSCONSUL_FAILED_KEYS is set to the number
+// of files that failed, and the details are given as JSON on stdin along with the files
+// created, updated or deleted.  The changed files are also listed one per line in
+// FSCONSUL_CHANGED_FILES, FSCONSUL_CREATED_FILES, FSCONSUL_UPDATED_FILES and
+// FSCONSUL_DELETED_FILES, unless there are too many of them.
+func onChangeInput(mappingConfig *MappingConfig, index uint64, changes fileChanges, failed []keyFailure) ([]string, []byte, error) {
+	// A file can fail more than once, e.g. when its directory can't be created, it can't
+	// be written either
+	seen := make(map[string]bool, len(failed))
+	failures := make([]keyFailure, 0, len(failed))
+	for _, failure := range failed {
+		if !seen[failure.File] {
+			seen[failure.File] = true
+			failures = append(failures, failure)
+		}
+	}
+
+	// Lists are empty rather than null
+	for _, list := range []*[]string{&changes.Created, &changes.Updated, &changes.Deleted} {
+		if *list == nil {
+			*list = []string{}
+		}
+		sort.Strings(*list)
+	}
+	changed := changes.files()
+
+	input, err := json.Marshal(struct {
+		Mapping string   `json:"mapping"`
+		Index   uint64   `json:"index"`
+		Changed []string `json:"changed"`
+		fileChanges
+		Failed []keyFailure `json:"failed"`
+	}{mappingConfig.Name, index, changed, changes, failures})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env := []string{
+		"FSCONSUL_MAPPING=" + mappingConfig.Name,
+		"FSCONSUL_FAILED_KEYS=" + strconv.Itoa(len(failures)),
+	}
+	if size := len(strings.Join(changed, "\n")); size <= maxChangedFilesEnv {
+		env = append(env,
+			"FSCONSUL_CHANGED_FILES="+strings.Join(changed, "\n"),
+			"FSCONSUL_CREATED_FILES="+strings.Join(changes.Created, "\n"),
+			"FSCONSUL_UPDATED_FILES="+strings.Join(changes.Updated, "\n"),
+			"FSCONSUL_DELETED_FILES="+strings.Join(changes.Deleted, "\n"))
+	}
+	return env, append(input, '\n'), nil
+}
+
+// Run the mapping's onchange command, if it has one, and wait for it to exit.  A failure
+// stops the mapping with exit code 111.  A command that times out is stopped and logged, and
+// only stops the mapping if OnChangeTimeoutFatal is set, so that one hung reload doesn't
+// stop the files from being kept up to date.
+func runOnChange(config *WatchConfig, run *mappingRun, index uint64, changes fileChanges, failed []keyFailure) (int, error) {
+	mappingConfig := run.config
+	if mappingConfig.OnChange == nil {
+		return 0, nil
+	}
+
+	onChangeEnv, input, err := onChangeInput(mappingConfig, index, changes, failed)
+	if err != nil {
+		return 111, err
+	}
+
+	var cmd = exec.Command(mappingConfig.OnChange[0], mappingConfig.OnChange[1:]...)
+	cmd.Env = append(os.Environ(), onChangeEnv...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Keep stdout clean for the summary
+	if config.JSONSummary {
+		cmd.Stdout = os.Stderr
+	}
+	// Always wait for the forked process to exit.  We may wish to revisit this, but I think
+	// it's the safest approach since it avoids a case where rapid key updates DOS a system
+	// by slurping all proc handles.
+	timeout := time.Duration(mappingConfig.OnChangeTimeout)
+	if timeout <= 0 {
+		if err := cmd.Run(); err != nil {
+			return 111, err
+		}
+		return 0, nil
+	}
+
+	// Unless it takes too long, in which case it's stopped with whatever it started
+	output := &tailBuffer{max: onChangeOutputTail}
+	cmd.Stdout = io.MultiWriter(cmd.Stdout, output)
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, output)
+	cmd.SysProcAttr = onChangeSysProcAttr()
+	if err := cmd.Start(); err != nil {
+		return 111, err
+	}
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- cmd.Wait() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-waitCh:
+		if err != nil {
+			return 111, err
+		}
+		return 0, nil
+	case <-timer.C:
+	}
+
+	signalOnChange(cmd, syscall.SIGTERM)
+	select {
+	case <-waitCh:
+	case <-time.After(onChangeKillGrace):
+		signalOnChange(cmd, syscall.SIGKILL)
+		select {
+		case <-waitCh:
+		case <-time.After(onChangeKillGrace):
+			// Something outside the process group is holding its output open
+		}
+	}
+
+	run.logger.WithFields(log.Fields{
+		"timeout": timeout,
+		"output":  output.String(),
+	}).Error("Onchange command timed out and was stopped")
+	if mappingConfig.OnChangeTimeoutFatal {
+		return 111, fmt.Errorf("onchange command timed out after %s", timeout)
+	}
+	return 0, nil
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
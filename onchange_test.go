@@ -0,0 +1,138 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestOnChangeInput(t *testing.T) {
+	failed := []keyFailure{
+		{"/etc/app/conf.d/a.conf", "mkdir: permission denied"},
+		{"/etc/app/conf.d/a.conf", "open: no such file or directory"},
+		{"/etc/app/b.conf", "could not execute template"},
+	}
+
+	changes := fileChanges{Created: []string{"/etc/app/d.conf"}, Updated: []string{"/etc/app/c.conf"}}
+	env, input, err := onChangeInput(&MappingConfig{Name: "app"}, 42, changes, failed)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(env) != 6 || env[1] != "FSCONSUL_FAILED_KEYS=2" {
+		t.Fatalf("expected two failed keys in the environment, got %v", env)
+	}
+	if env[2] != "FSCONSUL_CHANGED_FILES=/etc/app/c.conf\n/etc/app/d.conf" || env[3] != "FSCONSUL_CREATED_FILES=/etc/app/d.conf" || env[5] != "FSCONSUL_DELETED_FILES=" {
+		t.Fatalf("unexpected changed files in the environment %q", env[2:])
+	}
+
+	var decoded struct {
+		Mapping string
+		Index   uint64
+		Changed []string
+		Created []string
+		Failed  []keyFailure
+	}
+	if err := json.Unmarshal(input, &decoded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if decoded.Mapping != "app" || decoded.Index != 42 || len(decoded.Changed) != 2 || len(decoded.Created) != 1 || len(decoded.Failed) != 2 || decoded.Failed[0].Error != "mkdir: permission denied" {
+		t.Fatalf("unexpected input %s", input)
+	}
+
+	// A clean snapshot has empty lists rather than null
+	_, input, _ = onChangeInput(&MappingConfig{Name: "app"}, 43, fileChanges{}, nil)
+	if string(input) != `{"mapping":"app","index":43,"changed":[],"created":[],"updated":[],"deleted":[],"failed":[]}`+"\n" {
+		t.Fatalf("unexpected input for a clean snapshot %s", input)
+	}
+
+	// Too many changed files are only given on stdin
+	many := fileChanges{Updated: make([]string, maxChangedFilesEnv)}
+	for i := range many.Updated {
+		many.Updated[i] = "/etc/app/x.conf"
+	}
+	if env, _, _ = onChangeInput(&MappingConfig{Name: "app"}, 44, many, nil); len(env) != 2 {
+		t.Fatalf("expected changed files to be left out of the environment, got %d variables", len(env))
+	}
+}
+
+func TestOnChangeTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("onchange commands are shell scripts here")
+	}
+
+	defer func(grace time.Duration) { onChangeKillGrace = grace }(onChangeKillGrace)
+	onChangeKillGrace = 200 * time.Millisecond
+
+	// The command ignores SIGTERM, so it has to be killed
+	mappingConfig := &MappingConfig{
+		Name:            "app",
+		OnChange:        []string{"/bin/sh", "-c", "trap '' TERM; echo reloading; sleep 60"},
+		OnChangeTimeout: Duration(100 * time.Millisecond),
+	}
+
+	started := time.Now()
+	code, err := runOnChange(&WatchConfig{JSONSummary: true}, newMappingRun(mappingConfig, nil), 1, fileChanges{}, nil)
+	if code != 0 || err != nil {
+		t.Fatalf("expected the mapping to keep watching after a timeout, got %d (%v)", code, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("expected the command to be killed after the grace period, took %s", elapsed)
+	}
+
+	// Unless a timeout is asked to stop the mapping
+	mappingConfig.OnChangeTimeoutFatal = true
+	code, err = runOnChange(&WatchConfig{JSONSummary: true}, newMappingRun(mappingConfig, nil), 1, fileChanges{}, nil)
+	if code != 111 || err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the command to time out, got %d (%v)", code, err)
+	}
+
+	output := &tailBuffer{max: 4}
+	output.Write([]byte("reloading"))
+	if output.String() != "ding" {
+		t.Errorf("expected the end of the output to be kept, got %q", output.String())
+	}
+}
+
+func TestSkipInitialOnChange(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("onchange commands are shell scripts here")
+	}
+
+	replay := t.TempDir()
+	snapshot := kvSnapshot{consulapi.KVPairs{{Key: "app/a.conf", Value: []byte("a"), ModifyIndex: 5}}, 5}
+	if err := recordSnapshot(replay, "app", snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "..", filepath.Base(dir)+".reloaded")
+	defer os.Remove(marker)
+	config := &WatchConfig{
+		RunOnce: true,
+		Replay:  replay,
+		Mappings: []MappingConfig{{
+			Name:                "app",
+			Prefix:              "app/",
+			Path:                dir,
+			OnChange:            []string{"/bin/sh", "-c", "touch " + marker},
+			SkipInitialOnChange: true,
+		}},
+	}
+
+	if code := watchAndExec(config); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "a.conf")); err != nil || string(content) != "a" {
+		t.Fatalf("expected a.conf to be written, got %q (%v)", content, err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("expected onchange not to run for the first snapshot")
+	}
+}
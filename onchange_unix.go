@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package fsconsul
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start onchange commands in a process group of their own, so that everything a hung
+// command started is stopped with it.
+func onChangeSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Send a signal to an onchange command's process group.
+func signalOnChange(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
@@ -0,0 +1,15 @@
+package fsconsul
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func onChangeSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// Windows processes can only be killed.
+func signalOnChange(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,59 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+)
+
+// The key of the path used on operating systems a mapping doesn't list.
+const defaultPathOS = "default"
+
+// mappingConfigFields has MappingConfig's fields without its methods, so it can be decoded
+// without recursing into UnmarshalJSON.
+type mappingConfigFields MappingConfig
+
+// UnmarshalJSON implements json.Unmarshaler.  A mapping's path may be given as an object
+// of paths keyed by operating system (as in runtime.GOOS, or "default"), so that one
+// config file serves a mixed fleet.
+func (mappingConfig *MappingConfig) UnmarshalJSON(data []byte) error {
+	fields := struct {
+		*mappingConfigFields
+		Path json.RawMessage
+	}{mappingConfigFields: (*mappingConfigFields)(mappingConfig)}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	path, err := pathForOS(fields.Path, runtime.GOOS)
+	if err != nil {
+		return err
+	}
+	mappingConfig.Path = path
+	return nil
+}
+
+// Pick the path for an operating system from a mapping's path, which is either a string
+// or an object of paths keyed by operating system.
+func pathForOS(data json.RawMessage, goos string) (string, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return "", nil
+	}
+
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		return path, nil
+	}
+
+	var paths map[string]string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return "", fmt.Errorf("path must be a string or an object of paths keyed by operating system: %v", err)
+	}
+	if path, ok := paths[goos]; ok {
+		return path, nil
+	}
+	if path, ok := paths[defaultPathOS]; ok {
+		return path, nil
+	}
+	return "", fmt.Errorf("no path for %s, or default path, in %s", goos, data)
+}
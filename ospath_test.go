@@ -0,0 +1,35 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+)
+
+func TestPathForOS(t *testing.T) {
+	paths := json.RawMessage(`{"linux": "/etc/app/", "windows": "C:\\app\\conf\\", "default": "/usr/local/etc/app/"}`)
+
+	for goos, want := range map[string]string{
+		"linux":   "/etc/app/",
+		"windows": `C:\app\conf\`,
+		"darwin":  "/usr/local/etc/app/",
+	} {
+		if path, err := pathForOS(paths, goos); err != nil || path != want {
+			t.Errorf("expected %s for %s, got %s (%v)", want, goos, path, err)
+		}
+	}
+
+	if _, err := pathForOS(json.RawMessage(`{"windows": "C:\\app"}`), "linux"); err == nil {
+		t.Error("expected an error without a path for the OS")
+	}
+
+	// Decoding a mapping keeps its other fields
+	var mappingConfig MappingConfig
+	err := json.Unmarshal([]byte(`{"prefix": "app/", "path": {"`+runtime.GOOS+`": "/srv/app/"}, "onchange": "reload"}`), &mappingConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mappingConfig.Path != "/srv/app/" || mappingConfig.Prefix != "app/" || mappingConfig.OnChangeRaw != "reload" {
+		t.Errorf("unexpected mapping %+v", mappingConfig)
+	}
+}
@@ -0,0 +1,188 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Apply a rendered value to the existing file as a patch, for mappings whose files are also
+// managed by other tooling.  JSON files are patched with a JSON merge patch (RFC 7386); INI
+// files have the keys given in the value set, or removed if given as "-key".
+func patchFile(mappingConfig *MappingConfig, keyfile string, patch []byte) ([]byte, error) {
+	if !mappingConfig.Patch {
+		return patch, nil
+	}
+
+	existing, err := ioutil.ReadFile(keyfile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(keyfile)) {
+	case ".json":
+		return mergePatch(existing, patch)
+	case ".ini", ".cfg", ".conf":
+		return iniPatch(existing, patch), nil
+	default:
+		return nil, fmt.Errorf("don't know how to patch %s, expected a .json, .ini, .cfg or .conf file", keyfile)
+	}
+}
+
+func mergePatch(doc, patch []byte) ([]byte, error) {
+	var target, changes interface{}
+	if len(bytes.TrimSpace(doc)) > 0 {
+		if err := json.Unmarshal(doc, &target); err != nil {
+			return nil, fmt.Errorf("existing file isn't valid JSON: %v", err)
+		}
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, fmt.Errorf("patch isn't valid JSON: %v", err)
+	}
+
+	patched, err := json.MarshalIndent(applyMergePatch(target, changes), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(patched, '\n'), nil
+}
+
+// Apply the merge patch algorithm: objects are merged recursively, nulls remove members and
+// anything else replaces the target.
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = applyMergePatch(targetObject[name], value)
+		}
+	}
+
+	return targetObject
+}
+
+// iniSetting is a key to set (or remove) in a section of an INI file.
+type iniSetting struct {
+	section string
+	key     string
+	value   string
+	remove  bool
+}
+
+func parseINISettings(patch []byte) []iniSetting {
+	var settings []iniSetting
+
+	section := ""
+	for _, line := range strings.Split(string(patch), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case strings.HasPrefix(line, "-"):
+			settings = append(settings, iniSetting{section: section, key: strings.TrimSpace(line[1:]), remove: true})
+		default:
+			key, value := splitINILine(line)
+			settings = append(settings, iniSetting{section: section, key: key, value: value})
+		}
+	}
+
+	return settings
+}
+
+func splitINILine(line string) (key, value string) {
+	i := strings.IndexAny(line, "=:")
+	if i < 0 {
+		return strings.TrimSpace(line), ""
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// Apply the settings in patch to the INI document, keeping its comments, ordering and the
+// rest of its keys.  New keys are added at the end of their section, and new sections at the
+// end of the document.
+func iniPatch(doc, patch []byte) []byte {
+	var lines []string
+	if len(doc) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(doc), "\n"), "\n")
+	}
+
+	for _, setting := range parseINISettings(patch) {
+		lines = applyINISetting(lines, setting)
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func applyINISetting(lines []string, setting iniSetting) []string {
+	section := ""
+	found := setting.section == ""
+	insertAt := -1
+	if found {
+		insertAt = 0
+	}
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			if section == setting.section {
+				found = true
+				insertAt = i + 1
+			}
+			continue
+		}
+		if section != setting.section || trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";") {
+			continue
+		}
+
+		key, _ := splitINILine(trimmed)
+		if key == setting.key {
+			if setting.remove {
+				return append(lines[:i:i], lines[i+1:]...)
+			}
+			lines[i] = formatINILine(line, setting)
+			return lines
+		}
+		insertAt = i + 1
+	}
+
+	if setting.remove {
+		return lines
+	}
+
+	newLine := formatINILine("", setting)
+	if !found {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		return append(lines, "["+setting.section+"]", newLine)
+	}
+
+	lines = append(lines, "")
+	copy(lines[insertAt+1:], lines[insertAt:])
+	lines[insertAt] = newLine
+	return lines
+}
+
+// Format a setting like the line it replaces, with or without spaces around the "=".
+func formatINILine(original string, setting iniSetting) string {
+	if original != "" && !strings.Contains(original, " = ") {
+		return setting.key + "=" + setting.value
+	}
+	return setting.key + " = " + setting.value
+}
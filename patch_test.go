@@ -0,0 +1,77 @@
+package fsconsul
+
+import "testing"
+
+func TestMergePatch(t *testing.T) {
+	doc := []byte(`{"name": "app", "db": {"host": "old", "port": 5432}, "debug": true}`)
+	patch := []byte(`{"db": {"host": "new"}, "debug": null, "replicas": 3}`)
+
+	patched, err := mergePatch(doc, patch)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := `{
+  "db": {
+    "host": "new",
+    "port": 5432
+  },
+  "name": "app",
+  "replicas": 3
+}
+`
+	if string(patched) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, patched)
+	}
+
+	// A missing file is patched as if empty
+	patched, err = mergePatch(nil, []byte(`{"a": 1}`))
+	if err != nil || string(patched) != "{\n  \"a\": 1\n}\n" {
+		t.Errorf("unexpected patch of an empty file: %q, %v", patched, err)
+	}
+}
+
+func TestINIPatch(t *testing.T) {
+	doc := []byte(`# managed by hand
+global=1
+
+[db]
+host = old
+; the port
+port = 5432
+debug = true
+
+[log]
+level=info
+`)
+	patch := []byte(`[db]
+host = new
+-debug
+pool = 10
+
+[log]
+level = warn
+
+[cache]
+size = 64
+`)
+
+	expected := `# managed by hand
+global=1
+
+[db]
+host = new
+; the port
+port = 5432
+pool = 10
+
+[log]
+level=warn
+
+[cache]
+size = 64
+`
+	if patched := string(iniPatch(doc, patch)); patched != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, patched)
+	}
+}
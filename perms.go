@@ -0,0 +1,233 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Files and directories fsconsul creates aren't world-readable unless configured to be.
+const (
+	defaultFileMode os.FileMode = 0640
+	defaultDirMode  os.FileMode = 0750
+)
+
+// FilePermissions overrides the mode and ownership of the files written for some keys, and
+// how their trailing newlines are normalized.
+type FilePermissions struct {
+	// Octal, e.g. "0600"
+	FileMode string
+
+	// User and group names or ids
+	Owner string
+	Group string
+
+	// As for the mapping
+	TrailingNewline string
+}
+
+// fileAttrs are the resolved mode and ownership of a file or directory.  Ids are -1 to leave
+// them unchanged.
+type fileAttrs struct {
+	mode     os.FileMode
+	uid, gid int
+}
+
+// Resolve the mode and ownership of the file written for a key.
+func (mappingConfig *MappingConfig) fileAttrs(keyfile string) (fileAttrs, error) {
+	rel := filepath.ToSlash(strings.TrimPrefix(keyfile, mappingConfig.Path))
+
+	perms := FilePermissions{FileMode: mappingConfig.FileMode, Owner: mappingConfig.Owner, Group: mappingConfig.Group}
+	for _, override := range mappingConfig.fileOverrides(rel) {
+		if override.FileMode != "" {
+			perms.FileMode = override.FileMode
+		}
+		if override.Owner != "" {
+			perms.Owner = override.Owner
+		}
+		if override.Group != "" {
+			perms.Group = override.Group
+		}
+	}
+
+	return resolveAttrs(perms.FileMode, defaultFileMode, perms.Owner, perms.Group)
+}
+
+// List the overrides in Files for a file, given by its path relative to the mapping's path
+// (i.e. its key).  They apply in order of their patterns, with an exact match last.
+func (mappingConfig *MappingConfig) fileOverrides(rel string) []FilePermissions {
+	patterns := make([]string, 0, len(mappingConfig.Files))
+	for pattern := range mappingConfig.Files {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	var overrides []FilePermissions
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, rel); matched && pattern != rel {
+			overrides = append(overrides, mappingConfig.Files[pattern])
+		}
+	}
+	if override, ok := mappingConfig.Files[rel]; ok {
+		overrides = append(overrides, override)
+	}
+	return overrides
+}
+
+// Resolve the mode and ownership of directories created for a mapping's files.
+func (mappingConfig *MappingConfig) dirAttrs() (fileAttrs, error) {
+	return resolveAttrs(mappingConfig.DirMode, defaultDirMode, mappingConfig.Owner, mappingConfig.Group)
+}
+
+// Check that a mapping's modes are valid and its owners exist.
+func (mappingConfig *MappingConfig) checkPermissions() error {
+	if _, err := mappingConfig.dirAttrs(); err != nil {
+		return err
+	}
+	if _, err := mappingConfig.fileAttrs(mappingConfig.Path); err != nil {
+		return err
+	}
+	for pattern, override := range mappingConfig.Files {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid files pattern %s: %v", pattern, err)
+		}
+		if _, err := resolveAttrs(override.FileMode, defaultFileMode, override.Owner, override.Group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveAttrs(mode string, defaultMode os.FileMode, owner, group string) (fileAttrs, error) {
+	attrs := fileAttrs{mode: defaultMode, uid: -1, gid: -1}
+
+	if mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || parsed > 0777 {
+			return attrs, fmt.Errorf("invalid file mode %s, expected octal permissions such as 0640", mode)
+		}
+		attrs.mode = os.FileMode(parsed)
+	}
+
+	if (owner != "" || group != "") && runtime.GOOS == "windows" {
+		return attrs, fmt.Errorf("file owners and groups aren't supported on Windows")
+	}
+
+	var err error
+	if owner != "" {
+		if attrs.uid, err = lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return attrs, err
+		}
+	}
+	if group != "" {
+		if attrs.gid, err = lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return attrs, err
+		}
+	}
+
+	return attrs, nil
+}
+
+// Resolve a user or group given by name or numeric id.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	parsed, err := strconv.Atoi(id)
+	if err != nil {
+		return -1, fmt.Errorf("%s has non-numeric id %s", name, id)
+	}
+	return parsed, nil
+}
+
+// Set the mode and ownership of an open file, before anything is written to it.  The mode
+// is set explicitly since the file may already exist, and the umask applies on creation.
+func (attrs fileAttrs) apply(f *os.File) error {
+	if err := f.Chmod(attrs.mode); err != nil {
+		return err
+	}
+	if attrs.uid >= 0 || attrs.gid >= 0 {
+		return f.Chown(attrs.uid, attrs.gid)
+	}
+	return nil
+}
+
+// Describe how a file's mode and ownership differ from the attributes it should have.
+// Windows has no modes or numeric owners to compare.
+func (attrs fileAttrs) differences(info os.FileInfo) []string {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	var differences []string
+	if info.Mode().Perm() != attrs.mode {
+		differences = append(differences, fmt.Sprintf("mode is %04o, expected %04o", info.Mode().Perm(), attrs.mode))
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		if attrs.uid >= 0 && uid != attrs.uid {
+			differences = append(differences, fmt.Sprintf("owner is %d, expected %d", uid, attrs.uid))
+		}
+		if attrs.gid >= 0 && gid != attrs.gid {
+			differences = append(differences, fmt.Sprintf("group is %d, expected %d", gid, attrs.gid))
+		}
+	}
+	return differences
+}
+
+// Create a directory and any missing parents with the mapping's directory mode and owner.
+func makeDirs(mappingConfig *MappingConfig, dir string) error {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s exists and isn't a directory", dir)
+		}
+		return nil
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := makeDirs(mappingConfig, parent); err != nil {
+			return err
+		}
+	}
+
+	attrs, err := mappingConfig.dirAttrs()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, attrs.mode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Chmod(dir, attrs.mode); err != nil {
+		return err
+	}
+	if attrs.uid >= 0 || attrs.gid >= 0 {
+		return os.Chown(dir, attrs.uid, attrs.gid)
+	}
+	return nil
+}
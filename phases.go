@@ -0,0 +1,85 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The orders in which a snapshot's deletes, writes and onchange command happen.
+const (
+	phasesDeleteFirst   = "delete-write-onchange" // the default
+	phasesWriteFirst    = "write-delete-onchange"
+	phasesOnChangeFirst = "write-onchange-delete" // reload with the new files, then delete the old
+)
+
+func (mappingConfig *MappingConfig) checkPhaseOrder() error {
+	switch mappingConfig.PhaseOrder {
+	case "", phasesDeleteFirst, phasesWriteFirst, phasesOnChangeFirst:
+		return nil
+	}
+	return fmt.Errorf("unknown phaseorder %s, expected %s, %s or %s",
+		mappingConfig.PhaseOrder, phasesDeleteFirst, phasesWriteFirst, phasesOnChangeFirst)
+}
+
+// Delete the files of keys removed from Consul and the files to prune, returning the files
+// deleted and those that couldn't be.
+func deleteFiles(mappingConfig *MappingConfig, logger *log.Entry, summary *mappingSummary, removed, pruned []string) ([]string, []keyFailure) {
+	var deleted []string
+	var failed []keyFailure
+
+	for _, keyfile := range pruned {
+		if err := os.Remove(keyfile); err != nil {
+			logger.WithFields(log.Fields{
+				"error": err,
+				"file":  keyfile,
+			}).Error("Failed to prune file")
+			summary.addError(keyfile, err)
+			failed = append(failed, keyFailure{keyfile, err.Error()})
+			continue
+		}
+		logger.WithFields(log.Fields{
+			"file": keyfile,
+		}).Info("Pruned file no key renders")
+		summary.deleted(keyfile)
+		deleted = append(deleted, keyfile)
+
+		if mappingConfig.RemoveEmptyDirs {
+			if err := removeEmptyDirs(mappingConfig, keyfile); err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"file":  keyfile,
+				}).Warn("Failed to remove empty directory")
+			}
+		}
+	}
+
+	for _, k := range removed {
+		keyfile := keyfilePath(mappingConfig, k)
+
+		err := os.Remove(keyfile)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"error": err,
+				"key":   k,
+			}).Error("Failed to remove key")
+			summary.addError(keyfile, err)
+			failed = append(failed, keyFailure{keyfile, err.Error()})
+			continue
+		}
+		summary.deleted(keyfile)
+		deleted = append(deleted, keyfile)
+
+		if mappingConfig.RemoveEmptyDirs {
+			if err := removeEmptyDirs(mappingConfig, keyfile); err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"key":   k,
+				}).Warn("Failed to remove empty directory")
+			}
+		}
+	}
+
+	return deleted, failed
+}
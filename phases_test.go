@@ -0,0 +1,52 @@
+package fsconsul
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestOnChangeBeforeDeletes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("onchange commands are shell scripts here")
+	}
+
+	replay := t.TempDir()
+	for _, snapshot := range []kvSnapshot{
+		{consulapi.KVPairs{{Key: "app/old.conf", Value: []byte("old"), ModifyIndex: 5}}, 5},
+		{consulapi.KVPairs{{Key: "app/new.conf", Value: []byte("new"), ModifyIndex: 9}}, 9},
+	} {
+		if err := recordSnapshot(replay, "app", snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "..", filepath.Base(dir)+".reloaded")
+	defer os.Remove(marker)
+	config := &WatchConfig{
+		OnceOnChange: true,
+		Replay:       replay,
+		Mappings: []MappingConfig{{
+			Name:       "app",
+			Prefix:     "app/",
+			Path:       dir,
+			PhaseOrder: phasesOnChangeFirst,
+			// The service reloads with both the new file and the old one there
+			OnChange: []string{"/bin/sh", "-c", "test -f " + filepath.Join(dir, "new.conf") + " && test -f " + filepath.Join(dir, "old.conf") + " && touch " + marker},
+		}},
+	}
+
+	if code := watchAndExec(config); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("expected onchange to run before old.conf was deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.conf")); !os.IsNotExist(err) {
+		t.Error("expected old.conf to be deleted after onchange")
+	}
+}
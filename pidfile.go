@@ -0,0 +1,86 @@
+package fsconsul
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Write our pid to the pid file, refusing if it names another live process.  A pid file
+// left behind by a process that is no longer running is replaced.
+func writePidFile(pidFile string) error {
+	if data, err := ioutil.ReadFile(pidFile); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("%s names running process %d", pidFile, pid)
+		}
+
+		log.WithFields(log.Fields{
+			"pidFile": pidFile,
+		}).Warn("Replacing stale pid file")
+	}
+
+	return ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// Lock keyed on the config file (or, without one, the command-line arguments), so that
+// only one instance can run a given configuration at a time.
+func lockInstance(opts *options, args []string, takeover bool) (*pathLock, error) {
+	key := strings.Join(args, "\x00")
+	if opts.configFile != "" {
+		configFile, err := filepath.Abs(opts.configFile)
+		if err != nil {
+			return nil, err
+		}
+		key = configFile
+	}
+
+	name := fmt.Sprintf("fsconsul-%x.lock", sha256.Sum256([]byte(key)))
+	return lockFile(filepath.Join(os.TempDir(), name), 0644, takeover)
+}
+
+// Take the process-wide pid file and instance lock asked for on the command-line and then
+// drop privileges if asked to, returning a function that releases them.
+func acquireInstance(opts *options, args []string) (func(), error) {
+	var instance *pathLock
+	if opts.singleInstance {
+		var err error
+		instance, err = lockInstance(opts, args, opts.takeover)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.pidFile != "" {
+		if err := writePidFile(opts.pidFile); err != nil {
+			if instance != nil {
+				instance.unlock()
+			}
+			return nil, err
+		}
+	}
+
+	release := func() {
+		if opts.pidFile != "" {
+			os.Remove(opts.pidFile)
+		}
+		if instance != nil {
+			instance.unlock()
+		}
+	}
+
+	if opts.user != "" || opts.group != "" {
+		if err := dropPrivileges(opts.user, opts.group); err != nil {
+			release()
+			return nil, fmt.Errorf("failed to drop privileges: %v", err)
+		}
+	}
+
+	return release, nil
+}
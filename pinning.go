@@ -0,0 +1,201 @@
+package fsconsul
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// How long to trust a revocation check whose response doesn't say when to check again.
+const revocationCacheTime = time.Hour
+
+var revocationClient = &http.Client{Timeout: 10 * time.Second}
+
+// Build the check applied to the Consul server's certificate chain once it has been
+// verified against the CAs, enforcing the configured pins and revocation checking.
+func verifyConsulServer(consulConfig ConsulConfig) (func(tls.ConnectionState) error, error) {
+	pins := make(map[string]bool)
+	for _, pin := range consulConfig.PinnedKeys {
+		// Accept pins as given to curl (sha256//...) or HPKP (sha256/...)
+		pin = strings.TrimLeft(strings.TrimPrefix(pin, "sha256"), "/")
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned key %q, expected a base64 SHA-256 hash", pin)
+		}
+		pins[string(hash)] = true
+	}
+
+	return func(state tls.ConnectionState) error {
+		if len(pins) > 0 && !pinned(state.PeerCertificates, pins) {
+			return fmt.Errorf("consul server certificate doesn't match any pinned key")
+		}
+
+		if consulConfig.CheckRevocation {
+			if len(state.VerifiedChains) == 0 {
+				return fmt.Errorf("consul server certificate chain wasn't verified")
+			}
+
+			chain := state.VerifiedChains[0]
+			for i := 0; i < len(chain)-1; i++ {
+				var stapled []byte
+				if i == 0 {
+					stapled = state.OCSPResponse
+				}
+				if err := checkRevocation(chain[i], chain[i+1], stapled); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// Determine whether any certificate in the chain has a pinned public key.
+func pinned(certs []*x509.Certificate, pins map[string]bool) bool {
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[string(hash[:])] {
+			return true
+		}
+	}
+	return false
+}
+
+type revocationResult struct {
+	err     error
+	expires time.Time
+}
+
+var (
+	revocationLock  sync.Mutex
+	revocationCache = make(map[string]revocationResult)
+)
+
+// Check that cert hasn't been revoked by issuer, using a stapled OCSP response if there is
+// one, otherwise asking the OCSP responder, otherwise the CRL distribution points.  If none
+// of these can say, the certificate isn't trusted.
+func checkRevocation(cert, issuer *x509.Certificate, stapled []byte) error {
+	key := string(issuer.SubjectKeyId) + cert.SerialNumber.String()
+
+	revocationLock.Lock()
+	cached, ok := revocationCache[key]
+	revocationLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.err
+	}
+
+	var result revocationResult
+	var err error
+	if len(stapled) > 0 {
+		result, err = ocspResult(cert, issuer, stapled)
+	} else if len(cert.OCSPServer) > 0 {
+		result, err = queryOCSP(cert, issuer)
+	} else if len(cert.CRLDistributionPoints) > 0 {
+		result, err = queryCRL(cert, issuer)
+	} else {
+		err = fmt.Errorf("certificate %s has no OCSP responder or CRL", cert.Subject)
+	}
+	if err != nil {
+		// Failing to check isn't cached, so that it's retried on the next connection
+		return fmt.Errorf("failed to check revocation of %s: %v", cert.Subject, err)
+	}
+
+	revocationLock.Lock()
+	revocationCache[key] = result
+	revocationLock.Unlock()
+
+	return result.err
+}
+
+func queryOCSP(cert, issuer *x509.Certificate) (revocationResult, error) {
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return revocationResult{}, err
+	}
+
+	resp, err := revocationClient.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return revocationResult{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return revocationResult{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return revocationResult{}, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+
+	return ocspResult(cert, issuer, body)
+}
+
+func ocspResult(cert, issuer *x509.Certificate, response []byte) (revocationResult, error) {
+	parsed, err := ocsp.ParseResponseForCert(response, cert, issuer)
+	if err != nil {
+		return revocationResult{}, err
+	}
+
+	result := revocationResult{expires: cacheUntil(parsed.NextUpdate)}
+	switch parsed.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		result.err = fmt.Errorf("certificate %s was revoked at %s", cert.Subject, parsed.RevokedAt)
+	default:
+		return revocationResult{}, fmt.Errorf("OCSP responder doesn't know the certificate")
+	}
+
+	return result, nil
+}
+
+func queryCRL(cert, issuer *x509.Certificate) (revocationResult, error) {
+	resp, err := revocationClient.Get(cert.CRLDistributionPoints[0])
+	if err != nil {
+		return revocationResult{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return revocationResult{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return revocationResult{}, fmt.Errorf("CRL distribution point returned %s", resp.Status)
+	}
+
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return revocationResult{}, err
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return revocationResult{}, err
+	}
+
+	result := revocationResult{expires: cacheUntil(crl.NextUpdate)}
+	for _, revoked := range crl.RevokedCertificateEntries {
+		if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			result.err = fmt.Errorf("certificate %s was revoked at %s", cert.Subject, revoked.RevocationTime)
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func cacheUntil(nextUpdate time.Time) time.Time {
+	if nextUpdate.IsZero() {
+		return time.Now().Add(revocationCacheTime)
+	}
+	return nextUpdate
+}
@@ -0,0 +1,45 @@
+package fsconsul
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyPinnedKeys(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	cert := server.Certificate()
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	for _, test := range []struct {
+		pins  []string
+		valid bool
+	}{
+		{[]string{pin}, true},
+		{[]string{"sha256//" + pin}, true},
+		{[]string{other, "sha256/" + pin}, true},
+		{[]string{other}, false},
+	} {
+		verify, err := verifyConsulServer(ConsulConfig{PinnedKeys: test.pins})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := verify(state); (err == nil) != test.valid {
+			t.Errorf("pins %v: expected valid=%v, got %v", test.pins, test.valid, err)
+		}
+	}
+
+	if _, err := verifyConsulServer(ConsulConfig{PinnedKeys: []string{"not a hash"}}); err == nil {
+		t.Errorf("expected an invalid pin to be rejected")
+	}
+}
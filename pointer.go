@@ -0,0 +1,145 @@
+package fsconsul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The prefix a pointer key's value names, e.g. app/config/v42/.
+func pointerTarget(value []byte) string {
+	return strings.TrimLeft(strings.TrimSpace(string(value)), "/")
+}
+
+// Rename the pairs listed under a pointer's target as if they had been listed under the
+// mapping's prefix, so that switching targets renders the same files from other keys.
+func aliasPairs(mappingConfig *MappingConfig, target string, pairs consulapi.KVPairs) consulapi.KVPairs {
+	aliased := make(consulapi.KVPairs, len(pairs))
+	for i, pair := range pairs {
+		copied := *pair
+		copied.Key = mappingConfig.Prefix + strings.TrimPrefix(pair.Key, target)
+		aliased[i] = &copied
+	}
+	return aliased
+}
+
+// Read the prefix a mapping's pointer key names.
+func readPointer(client *consulapi.Client, mappingConfig *MappingConfig, opts *consulapi.QueryOptions) (string, *consulapi.QueryMeta, error) {
+	pair, meta, err := client.KV().Get(mappingConfig.PointerKey, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	if pair == nil || pointerTarget(pair.Value) == "" {
+		return "", meta, fmt.Errorf("pointer key %s doesn't name a prefix", mappingConfig.PointerKey)
+	}
+	return pointerTarget(pair.Value), meta, nil
+}
+
+// Watch the prefix a mapping's pointer key names, switching to the new prefix whenever the
+// pointer changes.  Each switch is a snapshot of the new prefix like any other, so the files
+// it doesn't have are deleted.  Snapshots are indexed by the later of the prefix's and the
+// pointer's index, so that a switch is never mistaken for an unchanged prefix on restart.
+func watchPointer(
+	client *consulapi.Client,
+	mappingConfig *MappingConfig,
+	token string,
+	conn *connectivity,
+	logger *log.Entry,
+	pairCh chan<- kvSnapshot,
+	errCh chan<- error,
+	quitCh <-chan struct{}) {
+
+	logger = logger.WithFields(log.Fields{
+		"pointer": mappingConfig.PointerKey,
+	})
+
+	// Fail fast if the pointer can't be read, as with a prefix
+	target, meta, err := readPointer(client, mappingConfig, &consulapi.QueryOptions{Token: token})
+	if err != nil {
+		errCh <- err
+		return
+	}
+	pointerIndex := meta.LastIndex
+
+	type pointed struct {
+		target string
+		index  uint64
+	}
+	targetCh := make(chan pointed)
+	go func() {
+		delays := newBackoff(mappingConfig.Retry)
+		curIndex := pointerIndex
+		for {
+			next, meta, err := readPointer(client, mappingConfig, &consulapi.QueryOptions{WaitIndex: curIndex, Token: token})
+			if meta != nil && meta.LastIndex > curIndex {
+				curIndex = meta.LastIndex
+			}
+			if err != nil {
+				// A pointer that's gone keeps the prefix it last named
+				logger.WithFields(log.Fields{
+					"error": err,
+				}).Warn("Failed to read pointer key, rendering the prefix it last named")
+				if meta == nil {
+					conn.failed()
+				}
+				select {
+				case <-quitCh:
+					return
+				case <-time.After(delays.next()):
+				}
+				continue
+			}
+			delays.reset()
+
+			select {
+			case targetCh <- pointed{next, curIndex}:
+			case <-quitCh:
+				return
+			}
+		}
+	}()
+
+	for {
+		logger.WithFields(log.Fields{
+			"prefix": target,
+		}).Info("Rendering the prefix the pointer names")
+
+		prefixCh := make(chan kvSnapshot)
+		prefixQuit := make(chan struct{})
+		go watch(client, target, token, mappingConfig.Retry, mappingConfig.KeysOnly, conn, logger, prefixCh, errCh, prefixQuit)
+
+	forward:
+		for {
+			select {
+			case <-quitCh:
+				close(prefixQuit)
+				return
+			case snapshot := <-prefixCh:
+				if pointerIndex > snapshot.index {
+					snapshot.index = pointerIndex
+				}
+				select {
+				case pairCh <- kvSnapshot{aliasPairs(mappingConfig, target, snapshot.pairs), snapshot.index}:
+				case <-quitCh:
+					close(prefixQuit)
+					return
+				}
+			case next := <-targetCh:
+				pointerIndex = next.index
+				if next.target == target {
+					continue
+				}
+				logger.WithFields(log.Fields{
+					"from": target,
+					"to":   next.target,
+				}).Info("Pointer moved, switching prefixes")
+				target = next.target
+				close(prefixQuit)
+				break forward
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package fsconsul
+
+import (
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestAliasPairs(t *testing.T) {
+	if target := pointerTarget([]byte(" /app/config/v42/\n")); target != "app/config/v42/" {
+		t.Errorf("expected the pointer to name app/config/v42/, got %q", target)
+	}
+
+	mappingConfig := &MappingConfig{PointerKey: "app/config/current", Path: "/etc/app/"}
+	pairs := consulapi.KVPairs{
+		{Key: "app/config/v42/db.conf", Value: []byte("db"), ModifyIndex: 7},
+		{Key: "app/config/v42/nested/cache.conf", Value: []byte("cache"), ModifyIndex: 8},
+	}
+
+	aliased := aliasPairs(mappingConfig, "app/config/v42/", pairs)
+	env, _ := snapshotEnv(mappingConfig, aliased)
+	if len(env) != 2 || env["db.conf"] != "db" || env["nested/cache.conf"] != "cache" {
+		t.Errorf("expected keys relative to the pointer's target, got %v", env)
+	}
+	if pairs[0].Key != "app/config/v42/db.conf" {
+		t.Errorf("expected the listed pairs to be left alone, got %s", pairs[0].Key)
+	}
+}
@@ -0,0 +1,38 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// Switch the process to the given user and/or group.  Without a group, the user's primary
+// group is used.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid := -1, -1
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("user %s has non-numeric uid %s", userName, u.Uid)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("user %s has non-numeric gid %s", userName, u.Gid)
+		}
+	}
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("group %s has non-numeric gid %s", groupName, g.Gid)
+		}
+	}
+
+	return setIDs(uid, gid)
+}
@@ -0,0 +1,88 @@
+package fsconsul
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"kernel.org/pub/linux/libs/security/libcap/psx"
+)
+
+const (
+	linuxCapabilityVersion3 = 0x20080522
+	capChown                = 0
+	capFowner               = 3
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// Switch to the given ids (-1 to leave one unchanged), retaining only CAP_CHOWN and
+// CAP_FOWNER so that file ownership and modes can still be managed.
+func setIDs(uid, gid int) error {
+	// Keeping capabilities across setuid is a per-thread setting, while setuid changes
+	// every thread, so it's set on every thread, and the sequence stays on this one
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if errno := keepCaps(1); errno != 0 {
+		return errno
+	}
+	defer keepCaps(0)
+
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+
+	// Without them, every chown for Owner or Group would fail later, far from the cause
+	header := capHeader{version: linuxCapabilityVersion3}
+	data := retainedCaps()
+	if errno := capset(&header, &data); errno != 0 {
+		return fmt.Errorf("failed to retain CAP_CHOWN and CAP_FOWNER: %v", errno)
+	}
+
+	return nil
+}
+
+// The capabilities kept after switching ids: CAP_CHOWN and CAP_FOWNER, permitted and
+// effective.
+func retainedCaps() [2]capData {
+	return [2]capData{{
+		effective: 1<<capChown | 1<<capFowner,
+		permitted: 1<<capChown | 1<<capFowner,
+	}}
+}
+
+// Set the capabilities of every thread of the process, since they're per thread.  psx runs
+// the syscall on every thread, including those started by cgo, where the runtime's
+// AllThreadsSyscall fails with ENOTSUP.
+var capset = func(header *capHeader, data *[2]capData) syscall.Errno {
+	_, _, errno := psx.Syscall3(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	return errno
+}
+
+// Set PR_SET_KEEPCAPS on every thread.
+func keepCaps(keep uintptr) syscall.Errno {
+	_, _, errno := psx.Syscall3(syscall.SYS_PRCTL, syscall.PR_SET_KEEPCAPS, keep, 0)
+	return errno
+}
@@ -0,0 +1,103 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetainedCaps(t *testing.T) {
+	data := retainedCaps()
+
+	const want = 1<<0 | 1<<3 // CAP_CHOWN and CAP_FOWNER
+	if data[0].effective != want || data[0].permitted != want {
+		t.Errorf("expected only CAP_CHOWN and CAP_FOWNER, got effective %#x and permitted %#x", data[0].effective, data[0].permitted)
+	}
+	if data[0].inheritable != 0 || data[1] != (capData{}) {
+		t.Errorf("expected no other capabilities, got %+v", data)
+	}
+}
+
+func TestSetIDsFailsWithoutCaps(t *testing.T) {
+	defer func(original func(*capHeader, *[2]capData) syscall.Errno) { capset = original }(capset)
+	capset = func(*capHeader, *[2]capData) syscall.Errno { return syscall.ENOTSUP }
+
+	// Ids are left unchanged, so this only sets the capabilities
+	err := setIDs(-1, -1)
+	if err == nil || !strings.Contains(err.Error(), "CAP_CHOWN") {
+		t.Fatalf("expected failing to keep capabilities to fail, got %v", err)
+	}
+
+	capset = func(*capHeader, *[2]capData) syscall.Errno { return 0 }
+	if err := setIDs(-1, -1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// Run as a child of TestSetIDsKeepsCaps, since switching ids can't be undone.
+func TestSetIDsChild(t *testing.T) {
+	if os.Getenv("FSCONSUL_TEST_SETIDS") == "" {
+		t.Skip("only run by TestSetIDsKeepsCaps")
+	}
+
+	// Threads started before switching need the capabilities too
+	for i := 0; i < 8; i++ {
+		go func() {
+			runtime.LockOSThread()
+			time.Sleep(time.Minute)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := setIDs(65534, 65534); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tasks, err := filepath.Glob("/proc/self/task/*/status")
+	if err != nil || len(tasks) < 2 {
+		t.Fatalf("expected several threads, got %v (%v)", tasks, err)
+	}
+	for _, task := range tasks {
+		status, err := ioutil.ReadFile(task)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "Uid:":
+				if fields[1] != "65534" {
+					t.Errorf("%s: expected uid 65534, got %s", task, fields[1])
+				}
+			case "CapEff:":
+				if caps, _ := strconv.ParseUint(fields[1], 16, 64); caps != 1<<capChown|1<<capFowner {
+					t.Errorf("%s: expected only CAP_CHOWN and CAP_FOWNER, got %s", task, fields[1])
+				}
+			}
+		}
+	}
+}
+
+func TestSetIDsKeepsCaps(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching ids needs root")
+	}
+
+	// Every thread is checked, however the test binary was built, with cgo or without
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestSetIDsChild$", "-test.v")
+	cmd.Env = append(os.Environ(), "FSCONSUL_TEST_SETIDS=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "--- PASS: TestSetIDsChild") {
+		t.Fatalf("expected every thread to keep its capabilities once switched, got %v:\n%s", err, output)
+	}
+}
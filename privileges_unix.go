@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package fsconsul
+
+import "syscall"
+
+// Switch to the given ids (-1 to leave one unchanged).
+func setIDs(uid, gid int) error {
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+
+	if uid >= 0 {
+		return syscall.Setuid(uid)
+	}
+
+	return nil
+}
@@ -0,0 +1,7 @@
+package fsconsul
+
+import "fmt"
+
+func setIDs(uid, gid int) error {
+	return fmt.Errorf("dropping privileges is not supported on Windows")
+}
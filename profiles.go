@@ -0,0 +1,262 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProfileConfig is a named group of mappings run as if by a separate fsconsul in the same
+// process: with its own Consul connection, degraded mode, log level, locks and state.
+type ProfileConfig struct {
+	Name string
+
+	// Consul agent and degraded mode for the profile's mappings, instead of the top-level
+	// ones
+	Consul   *ConsulConfig
+	Degraded *DegradedConfig
+
+	// Level of the profile's mapping logs (debug, info, warn or error), instead of the
+	// process's
+	LogLevel string
+
+	Mappings []MappingConfig
+}
+
+var (
+	profileLoggersLock sync.Mutex
+	profileLoggers     = make(map[string]*log.Logger)
+)
+
+// The logger a profile's mappings log to, which shares the standard logger's output and
+// hooks but may have its own level.  Loggers are made once per profile and level.
+func profileLogger(level string) (*log.Logger, error) {
+	if level == "" {
+		return nil, nil
+	}
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	profileLoggersLock.Lock()
+	defer profileLoggersLock.Unlock()
+
+	if logger, ok := profileLoggers[level]; ok {
+		return logger, nil
+	}
+
+	std := log.StandardLogger()
+	logger := &log.Logger{
+		Out:       std.Out,
+		Formatter: std.Formatter,
+		Hooks:     std.Hooks,
+		Level:     parsed,
+		ExitFunc:  os.Exit,
+	}
+	profileLoggers[level] = logger
+	return logger, nil
+}
+
+// The logger for a configuration's mappings, naming its profile if it has one.
+func (config *WatchConfig) mappingLogger() *log.Entry {
+	logger := config.logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	if config.profile == "" {
+		return log.NewEntry(logger)
+	}
+	return logger.WithField("profile", config.profile)
+}
+
+// Derive the configuration a profile runs with from the whole configuration: the
+// top-level settings, with the profile's own overriding them.  The empty name is the
+// top-level mappings, which keep conf.d fragments, exec and mappings registered while
+// watching.  Profiles get state files and recording directories of their own, and are
+// hardened once for the whole process.
+func profileConfig(config *WatchConfig, name string) (*WatchConfig, error) {
+	derived := *config
+	derived.Profiles = nil
+	derived.profile = name
+	if config.Harden.Enabled {
+		derived.Harden = HardenConfig{}
+	}
+	if config.reload != nil {
+		derived.reload = func() (*WatchConfig, error) {
+			reloaded, err := config.reload()
+			if err != nil {
+				return nil, err
+			}
+			return profileConfig(reloaded, name)
+		}
+	}
+
+	if name == "" {
+		return &derived, nil
+	}
+
+	var profile *ProfileConfig
+	for i := range config.Profiles {
+		if config.Profiles[i].Name == name {
+			profile = &config.Profiles[i]
+			break
+		}
+	}
+	if profile == nil {
+		return nil, fmt.Errorf("no profile named %s", name)
+	}
+
+	derived.Mappings = profile.Mappings
+	derived.ConfDir = ""
+	derived.Exec = ExecConfig{}
+	derived.changes = nil
+	if profile.Consul != nil {
+		derived.Consul = *profile.Consul
+	}
+	if profile.Degraded != nil {
+		derived.Degraded = *profile.Degraded
+	}
+	if derived.StateFile != "" {
+		derived.StateFile += "." + name
+	}
+	if derived.Record != "" {
+		derived.Record = filepath.Join(derived.Record, name)
+	}
+	if derived.Replay != "" {
+		derived.Replay = filepath.Join(derived.Replay, name)
+	}
+
+	logger, err := profileLogger(profile.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %v", name, err)
+	}
+	derived.logger = logger
+
+	return &derived, nil
+}
+
+// Run each profile, and the top-level mappings if there are any, until all of them have
+// exited.  A profile failing doesn't stop the others, but makes fsconsul exit non-zero.
+func watchProfiles(config *WatchConfig) int {
+	names := make([]string, 0, len(config.Profiles)+1)
+	if len(config.Mappings) > 0 || config.ConfDir != "" || config.changes != nil {
+		names = append(names, "")
+	}
+	for _, profile := range config.Profiles {
+		names = append(names, profile.Name)
+	}
+
+	configs := make([]*WatchConfig, len(names))
+	for i, name := range names {
+		derived, err := profileConfig(config, name)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Invalid profile")
+			return -1
+		}
+		configs[i] = derived
+	}
+
+	// Restrictions apply to the whole process, so they're applied once for every profile
+	if config.Harden.Enabled {
+		merged := *config
+		merged.Mappings = nil
+		for _, derived := range configs {
+			merged.Mappings = append(merged.Mappings, derived.Mappings...)
+			if derived.Record != "" {
+				if err := os.MkdirAll(derived.Record, 0700); err != nil {
+					log.WithFields(log.Fields{
+						"error": err,
+					}).Error("Failed to create recording directory")
+					return -1
+				}
+			}
+		}
+		applyDefaults(&merged)
+		if err := harden(&merged); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to harden process")
+			return -1
+		}
+	}
+
+	// Mappings are protected from pruning by those of every profile
+	live := newLivePaths()
+	for _, derived := range configs {
+		derived.live = live
+	}
+
+	// Every profile reports to the same health check endpoint
+	if !config.RunOnce {
+		health, err := startHealthServer(config.Health)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"addr":  config.Health.Addr,
+			}).Error("Failed to serve health checks")
+			return -1
+		}
+		defer health.close()
+		for _, derived := range configs {
+			derived.health = health
+		}
+	}
+
+	codes := make(chan int, len(configs))
+	for _, derived := range configs {
+		go func(derived *WatchConfig) {
+			code := watchAndExec(derived)
+			if code != 0 {
+				log.WithFields(log.Fields{
+					"profile": derived.profile,
+					"code":    code,
+				}).Error("Profile exited")
+			}
+			codes <- code
+		}(derived)
+	}
+
+	exitCode := 0
+	for range configs {
+		if code := <-codes; code != 0 && exitCode == 0 {
+			exitCode = code
+		}
+	}
+	return exitCode
+}
+
+// Check the profiles of a configuration, including each profile's own mappings.
+func validateProfiles(config *WatchConfig) []error {
+	var errs []error
+
+	names := make(map[string]bool, len(config.Profiles))
+	for i, profile := range config.Profiles {
+		if profile.Name == "" {
+			errs = append(errs, fmt.Errorf("profile %d has no name", i))
+			continue
+		}
+		if names[profile.Name] {
+			errs = append(errs, fmt.Errorf("profiles are named %s more than once", profile.Name))
+			continue
+		}
+		names[profile.Name] = true
+
+		derived, err := profileConfig(config, profile.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		applyDefaults(derived)
+		for _, err := range validateConfig(derived) {
+			errs = append(errs, fmt.Errorf("profile %s: %v", profile.Name, err))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,97 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestProfileConfig(t *testing.T) {
+	config := &WatchConfig{
+		Consul:    ConsulConfig{Addr: "127.0.0.1:8500", Token: "top"},
+		StateFile: "/var/lib/fsconsul/state.json",
+		Harden:    HardenConfig{Enabled: true},
+		Exec:      ExecConfig{Command: "nginx"},
+		Mappings:  []MappingConfig{{Prefix: "app", Path: "/etc/app/"}},
+		Profiles: []ProfileConfig{{
+			Name:     "tenant",
+			Consul:   &ConsulConfig{Addr: "10.0.0.1:8500", Token: "tenant"},
+			LogLevel: "warn",
+			Mappings: []MappingConfig{{Prefix: "tenant", Path: "/srv/tenant/"}},
+		}},
+	}
+
+	derived, err := profileConfig(config, "tenant")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if derived.Consul.Token != "tenant" || derived.Mappings[0].Prefix != "tenant" || derived.Exec.Command != "" {
+		t.Errorf("expected the profile's own settings, got %+v", derived)
+	}
+	if derived.StateFile != "/var/lib/fsconsul/state.json.tenant" || derived.Harden.Enabled || len(derived.Profiles) != 0 {
+		t.Errorf("expected an isolated profile, got %+v", derived)
+	}
+	if derived.logger == nil || derived.logger.Level.String() != "warning" {
+		t.Errorf("expected the profile's log level")
+	}
+
+	top, err := profileConfig(config, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if top.Consul.Token != "top" || top.Exec.Command != "nginx" || top.StateFile != config.StateFile {
+		t.Errorf("expected the top-level settings, got %+v", top)
+	}
+
+	config.Profiles = append(config.Profiles, ProfileConfig{Name: "tenant", LogLevel: "loud"})
+	if errs := validateProfiles(config); len(errs) != 1 {
+		t.Errorf("expected a duplicate profile to be rejected, got %v", errs)
+	}
+	config.Profiles[1].Name = "other"
+	if errs := validateProfiles(config); len(errs) != 1 {
+		t.Errorf("expected an invalid log level to be rejected, got %v", errs)
+	}
+}
+
+func TestProfileLogging(t *testing.T) {
+	replay := t.TempDir()
+	if err := recordSnapshot(replay, "app", kvSnapshot{consulapi.KVPairs{{Key: "app/a.conf", Value: []byte("a"), ModifyIndex: 3}}, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	config := &WatchConfig{
+		RunOnce:  true,
+		Replay:   replay,
+		Mappings: []MappingConfig{{Name: "app", Prefix: "app/", Path: t.TempDir()}},
+		profile:  "search",
+		logger:   &log.Logger{Out: &output, Formatter: &log.JSONFormatter{}, Hooks: make(log.LevelHooks), Level: log.InfoLevel},
+	}
+	if code := watchAndExec(config); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	// The mapping's own logs, down to the source replaying its snapshot, go to the profile's
+	// logger, naming the profile and the mapping, and only at its level
+	var replayed bool
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if entry["profile"] != "search" || entry["mapping"] != "app" {
+			t.Errorf("expected the profile and mapping to be named, got %s", line)
+		}
+		if entry["level"] == "debug" {
+			t.Errorf("expected debug logs to be filtered, got %s", line)
+		}
+		replayed = replayed || entry["msg"] == "Replaying snapshot"
+	}
+	if !replayed {
+		t.Errorf("expected the source to log to the profile's logger, got %s", output.String())
+	}
+}
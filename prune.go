@@ -0,0 +1,115 @@
+package fsconsul
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// livePaths are the paths of the running mappings of every profile, including those added
+// by reloading or registering, so that a pruning mapping leaves alone mappings nested in its
+// path however they were started.  Methods are safe to call on a nil livePaths.
+type livePaths struct {
+	mu       sync.Mutex
+	profiles map[string][]string
+}
+
+func newLivePaths() *livePaths {
+	return &livePaths{profiles: make(map[string][]string)}
+}
+
+// Set the running mappings of a profile, whenever they change.
+func (l *livePaths) setRuns(profile string, runs []*mappingRun) {
+	if l == nil {
+		return
+	}
+
+	paths := make([]string, len(runs))
+	for i, run := range runs {
+		paths[i] = run.config.Path
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.profiles[profile] = paths
+}
+
+// The paths of every running mapping.
+func (l *livePaths) all() []string {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var paths []string
+	for _, profilePaths := range l.profiles {
+		paths = append(paths, profilePaths...)
+	}
+	return paths
+}
+
+// List the files pruning deletes when a mapping applies a new env.  Files of keys removed
+// since the last snapshot are left to be deleted as removed keys, and those of empty values
+// the mapping skips are kept as they were.
+func prunedFiles(config *WatchConfig, mappingConfig *MappingConfig, newEnv map[string]string, removed, emptyKeys []string) ([]string, error) {
+	keys := make([]string, 0, len(newEnv)+len(removed)+len(emptyKeys))
+	for k := range newEnv {
+		keys = append(keys, k)
+	}
+	keys = append(keys, removed...)
+	if mappingConfig.EmptyValues == emptySkip {
+		keys = append(keys, emptyKeys...)
+	}
+	return prunableFiles(config, mappingConfig, keys)
+}
+
+// List the files under a mapping's path that none of the keys renders: files left by
+// earlier runs, or put there by hand.  fsconsul's own lock and staging files are kept, as
+// are the paths of other mappings nested in this one's, configured or running.
+func prunableFiles(config *WatchConfig, mappingConfig *MappingConfig, keys []string) ([]string, error) {
+	expected := make(map[string]bool, len(keys))
+	for _, keyfile := range keyfilePaths(mappingConfig, keys) {
+		expected[keyfile] = true
+	}
+
+	nested := make(map[string]bool)
+	others := config.live.all()
+	for i := range config.Mappings {
+		others = append(others, config.Mappings[i].Path)
+	}
+	for _, other := range others {
+		if other != "" && filepath.Clean(other) != filepath.Clean(mappingConfig.Path) {
+			nested[filepath.Clean(other)] = true
+		}
+	}
+	if mappingConfig.StagingDir != "" {
+		nested[filepath.Clean(mappingConfig.StagingDir)] = true
+	}
+
+	var prunable []string
+	err := filepath.Walk(mappingConfig.Path, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if nested[filepath.Clean(path)] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == lockFileName || strings.HasPrefix(info.Name(), ".fsconsul-") {
+			return nil
+		}
+		if !expected[path] {
+			prunable = append(prunable, path)
+		}
+		return nil
+	})
+	sort.Strings(prunable)
+	return prunable, err
+}
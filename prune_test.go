@@ -0,0 +1,143 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestPrunableFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := tempDir + string(filepath.Separator)
+	for _, name := range []string{"app.conf", "stale.conf", "nested/old.conf", lockFileName, ".fsconsul-123", "other/kept.conf"} {
+		file := filepath.Join(tempDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0755)
+		if err := ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	config := &WatchConfig{Mappings: []MappingConfig{
+		{Name: "app", Path: path, Prune: true},
+		{Name: "other", Path: filepath.Join(tempDir, "other") + string(filepath.Separator)},
+	}}
+	prunable, err := prunableFiles(config, &config.Mappings[0], []string{"app.conf", "nested/"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []string{filepath.Join(tempDir, "nested", "old.conf"), filepath.Join(tempDir, "stale.conf")}
+	if !reflect.DeepEqual(prunable, expected) {
+		t.Errorf("expected %v to be prunable, got %v", expected, prunable)
+	}
+}
+
+func TestPrunedFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"app.conf", "removed.conf", "empty.conf", "stale.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	tests := []struct {
+		emptyValues string
+		expected    []string
+	}{
+		{emptySkip, []string{"stale.conf"}},
+		{emptyDelete, []string{"empty.conf", "stale.conf"}},
+	}
+
+	for _, tt := range tests {
+		config := &WatchConfig{Mappings: []MappingConfig{{Name: "app", Path: tempDir + string(filepath.Separator), Prune: true, EmptyValues: tt.emptyValues}}}
+		newEnv := map[string]string{"app.conf": "x"}
+
+		// Removed keys are deleted as such, skipped empty values keep their files
+		pruned, err := prunedFiles(config, &config.Mappings[0], newEnv, []string{"removed.conf"}, []string{"empty.conf"})
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.emptyValues, err)
+		}
+
+		var expected []string
+		for _, name := range tt.expected {
+			expected = append(expected, filepath.Join(tempDir, name))
+		}
+		if !reflect.DeepEqual(pruned, expected) {
+			t.Errorf("%s: expected %v to be pruned, got %v", tt.emptyValues, expected, pruned)
+		}
+	}
+}
+
+func TestPruneLiveMappings(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"stale.conf", "registered/kept.conf", "profile/kept.conf"} {
+		file := filepath.Join(tempDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0755)
+		if err := ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Mappings registered, reloaded or run by another profile aren't in the configuration
+	config := &WatchConfig{
+		Mappings: []MappingConfig{{Name: "app", Path: tempDir + string(filepath.Separator), Prune: true}},
+		live:     newLivePaths(),
+	}
+	config.live.setRuns("", []*mappingRun{
+		newMappingRun(&config.Mappings[0], nil),
+		newMappingRun(&MappingConfig{Name: "registered", Path: filepath.Join(tempDir, "registered") + string(filepath.Separator)}, nil),
+	})
+	config.live.setRuns("other", []*mappingRun{
+		newMappingRun(&MappingConfig{Name: "nested", Path: filepath.Join(tempDir, "profile") + string(filepath.Separator)}, nil),
+	})
+
+	prunable, err := prunableFiles(config, &config.Mappings[0], nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := []string{filepath.Join(tempDir, "stale.conf")}; !reflect.DeepEqual(prunable, expected) {
+		t.Errorf("expected %v to be prunable, got %v", expected, prunable)
+	}
+}
+
+func TestDiffPrune(t *testing.T) {
+	tempDir := t.TempDir()
+	for name, content := range map[string]string{"app.conf": "x", "stale.conf": "old"} {
+		if err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	config := &WatchConfig{Mappings: []MappingConfig{{Prefix: "app/", Path: tempDir, Prune: true}}}
+	applyDefaults(config)
+	pairs := consulapi.KVPairs{{Key: "app/app.conf", Value: []byte("x")}}
+
+	// A run would only delete the stray file
+	added, updated, deleted, err := diffMapping(config, &config.Mappings[0], pairs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(added)+len(updated) != 0 || !reflect.DeepEqual(deleted, []string{filepath.Join(tempDir, "stale.conf")}) {
+		t.Errorf("expected only stale.conf to be deleted, got %v %v %v", added, updated, deleted)
+	}
+
+	// Nor would it delete the file of a skipped empty value
+	config.Mappings[0].EmptyValues = emptySkip
+	pairs = append(pairs, &consulapi.KVPair{Key: "app/stale.conf", Value: []byte{}})
+	_, _, deleted, err = diffMapping(config, &config.Mappings[0], pairs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("expected the skipped empty value's file to be kept, got %v", deleted)
+	}
+}
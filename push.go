@@ -0,0 +1,187 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// pushPlan is what pushing a directory would change under a prefix.  Pairs carry the
+// ModifyIndex they were listed at (0 for new keys), for check-and-set.
+type pushPlan struct {
+	puts    consulapi.KVPairs
+	deletes consulapi.KVPairs
+}
+
+// Work out the writes that make the keys under prefix mirror the files in dir, given the
+// keys currently there.  Unchanged keys aren't written, and keys without a file are only
+// deleted if asked to.  fsconsul's own lock and staging files are skipped.
+func planPush(dir, prefix string, existing consulapi.KVPairs, mirrorDeletes bool) (*pushPlan, error) {
+	prefix = strings.TrimSuffix(strings.TrimPrefix(prefix, "/"), "/")
+
+	current := make(map[string]*consulapi.KVPair, len(existing))
+	for _, pair := range existing {
+		current[pair.Key] = pair
+	}
+
+	plan := &pushPlan{}
+	seen := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Name() == lockFileName || strings.HasPrefix(info.Name(), ".fsconsul-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if prefix != "" {
+			key = prefix + "/" + key
+		}
+		seen[key] = true
+
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		pair := &consulapi.KVPair{Key: key, Value: value}
+		if old, ok := current[key]; ok {
+			if bytes.Equal(old.Value, value) {
+				return nil
+			}
+			pair.ModifyIndex = old.ModifyIndex
+			pair.Flags = old.Flags
+		}
+		plan.puts = append(plan.puts, pair)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if mirrorDeletes {
+		for _, pair := range existing {
+			// Folders have no file of their own
+			if !seen[pair.Key] && !strings.HasSuffix(pair.Key, "/") {
+				plan.deletes = append(plan.deletes, pair)
+			}
+		}
+	}
+
+	sort.Slice(plan.puts, func(i, j int) bool { return plan.puts[i].Key < plan.puts[j].Key })
+	sort.Slice(plan.deletes, func(i, j int) bool { return plan.deletes[i].Key < plan.deletes[j].Key })
+	return plan, nil
+}
+
+// Push the files in dir to the keys under prefix.  With cas, each write only succeeds if
+// the key hasn't changed since it was listed, and keys that have are returned as errors.
+func pushDir(client *consulapi.Client, token, dir, prefix string, mirrorDeletes, cas bool) (*pushPlan, []error, error) {
+	listPrefix := strings.TrimPrefix(prefix, "/")
+	if listPrefix != "" && !strings.HasSuffix(listPrefix, "/") {
+		listPrefix += "/"
+	}
+
+	existing, _, err := client.KV().List(listPrefix, &consulapi.QueryOptions{Token: token})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plan, err := planPush(dir, prefix, existing, mirrorDeletes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kv := client.KV()
+	writeOpts := &consulapi.WriteOptions{Token: token}
+
+	var errs []error
+	for _, pair := range plan.puts {
+		if cas {
+			if err := casPut(kv, pair, writeOpts); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if _, err := kv.Put(pair, writeOpts); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", pair.Key, err))
+		}
+	}
+
+	for _, pair := range plan.deletes {
+		if cas {
+			if err := casDelete(kv, pair, writeOpts); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if _, err := kv.Delete(pair.Key, writeOpts); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", pair.Key, err))
+		}
+	}
+
+	return plan, errs, nil
+}
+
+func pushCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul push", pushHelpText, &opts)
+	mirrorDeletes := flags.Bool("delete", false, "delete keys under the prefix that have no file in the path")
+	cas := flags.Bool("cas", false, "only write keys that haven't changed since they were listed")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.loadConfig(log)
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 1
+	}
+
+	plan, errs, err := pushDir(client, config.Consul.Token, flags.Arg(0), flags.Arg(1), *mirrorDeletes, *cas)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to push path")
+		return 1
+	}
+	for _, err := range errs {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to write key")
+	}
+
+	log.WithFields(logrus.Fields{
+		"written": len(plan.puts),
+		"deleted": len(plan.deletes),
+		"failed":  len(errs),
+	}).Info("Pushed path")
+
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestPlanPush(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.MkdirAll(filepath.Join(tempDir, "nested"), 0755)
+	for file, value := range map[string]string{
+		"same.conf":        "same",
+		"changed.conf":     "new",
+		"nested/new.conf":  "added",
+		lockFileName:       "123",
+		".fsconsul-staged": "partial",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tempDir, file), []byte(value), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	existing := consulapi.KVPairs{
+		{Key: "app/same.conf", Value: []byte("same"), ModifyIndex: 3},
+		{Key: "app/changed.conf", Value: []byte("old"), ModifyIndex: 5, Flags: 42},
+		{Key: "app/removed.conf", Value: []byte("gone"), ModifyIndex: 7},
+		{Key: "app/folder/", ModifyIndex: 2},
+	}
+
+	plan, err := planPush(tempDir, "/app/", existing, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(plan.puts) != 2 || len(plan.deletes) != 0 {
+		t.Fatalf("expected two writes and no deletes, got %+v", plan)
+	}
+	changed, added := plan.puts[0], plan.puts[1]
+	if changed.Key != "app/changed.conf" || string(changed.Value) != "new" || changed.ModifyIndex != 5 || changed.Flags != 42 {
+		t.Errorf("unexpected write %+v", changed)
+	}
+	if added.Key != "app/nested/new.conf" || added.ModifyIndex != 0 {
+		t.Errorf("expected a new key to be created only if absent, got %+v", added)
+	}
+
+	plan, err = planPush(tempDir, "app", existing, true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(plan.deletes) != 1 || plan.deletes[0].Key != "app/removed.conf" || plan.deletes[0].ModifyIndex != 7 {
+		t.Errorf("expected only the key without a file to be deleted, got %+v", plan.deletes)
+	}
+}
@@ -0,0 +1,110 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordedSnapshot is a snapshot as saved with -record, keeping every field of the pairs
+// (including their indexes) so that replaying it renders exactly what was rendered.
+type recordedSnapshot struct {
+	Index uint64
+	Pairs consulapi.KVPairs
+}
+
+// Counts recorded snapshots, to keep their names apart on platforms with a coarse clock.
+var recordedCount uint64
+
+// The directory a mapping's snapshots are recorded in.  Mapping names are usually prefixes,
+// so they're escaped to a single path element.
+func recordDir(dir, mapping string) string {
+	return filepath.Join(dir, url.PathEscape(mapping))
+}
+
+// Save a snapshot received for a mapping.  Files are named by the time they were received,
+// so they sort in the order they're to be replayed.  Snapshots hold secrets as they are in
+// Consul, so only the owner can read them.
+func recordSnapshot(dir, mapping string, snapshot kvSnapshot) error {
+	mappingDir := recordDir(dir, mapping)
+	if err := os.MkdirAll(mappingDir, 0700); err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(recordedSnapshot{Index: snapshot.index, Pairs: snapshot.pairs}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d-%010d-%d.json", time.Now().UnixNano(), atomic.AddUint64(&recordedCount, 1), snapshot.index)
+	return ioutil.WriteFile(filepath.Join(mappingDir, name), append(encoded, '\n'), 0600)
+}
+
+func loadRecording(dir, mapping string) ([]kvSnapshot, error) {
+	mappingDir := recordDir(dir, mapping)
+	names, err := filepath.Glob(filepath.Join(mappingDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no snapshots recorded in %s", mappingDir)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]kvSnapshot, 0, len(names))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var recorded recordedSnapshot
+		if err := json.Unmarshal(data, &recorded); err != nil {
+			return nil, fmt.Errorf("failed to parse recorded snapshot %s: %v", name, err)
+		}
+		snapshots = append(snapshots, kvSnapshot{recorded.Pairs, recorded.Index})
+	}
+	return snapshots, nil
+}
+
+// Feed a mapping the snapshots recorded for it, in the order they were received, then wait
+// as if Consul had gone quiet.
+func watchReplay(
+	dir string,
+	mapping string,
+	logger *log.Entry,
+	pairCh chan<- kvSnapshot,
+	errCh chan<- error,
+	quitCh <-chan struct{}) {
+
+	snapshots, err := loadRecording(dir, mapping)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	for i, snapshot := range snapshots {
+		logger.WithFields(log.Fields{
+			"snapshot": i + 1,
+			"of":       len(snapshots),
+			"index":    snapshot.index,
+		}).Info("Replaying snapshot")
+
+		select {
+		case pairCh <- snapshot:
+		case <-quitCh:
+			return
+		}
+	}
+
+	logger.Info("Replay finished")
+	<-quitCh
+}
@@ -0,0 +1,47 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestRecordReplay(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	recorded := []kvSnapshot{
+		{consulapi.KVPairs{{Key: "app/db", Value: []byte("one"), ModifyIndex: 5}}, 5},
+		{consulapi.KVPairs{{Key: "app/db", Value: []byte("two"), ModifyIndex: 9, Flags: 3}}, 9},
+	}
+	for _, snapshot := range recorded {
+		if err := recordSnapshot(tempDir, "app/", snapshot); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	replayed, err := loadRecording(tempDir, "app/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(replayed) != 2 {
+		t.Fatalf("expected 2 snapshots, got %d", len(replayed))
+	}
+	for i, snapshot := range replayed {
+		pair := snapshot.pairs[0]
+		want := recorded[i].pairs[0]
+		if snapshot.index != recorded[i].index || pair.Key != want.Key || string(pair.Value) != string(want.Value) ||
+			pair.ModifyIndex != want.ModifyIndex || pair.Flags != want.Flags {
+			t.Errorf("snapshot %d: expected %+v at %d, got %+v at %d", i, want, recorded[i].index, pair, snapshot.index)
+		}
+	}
+
+	if _, err := loadRecording(tempDir, "other/"); err == nil {
+		t.Errorf("expected an error for a mapping without recorded snapshots")
+	}
+}
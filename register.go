@@ -0,0 +1,116 @@
+package fsconsul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Returned when a mapping is registered or deregistered with a watching fsconsul that's
+// stopping.
+var errStopping = errors.New("fsconsul is stopping")
+
+// mappingChange asks a watching fsconsul to start or stop a single mapping, without
+// reloading its configuration.  The outcome is sent on result.
+type mappingChange struct {
+	register   *MappingConfig // mapping to start alongside the running ones
+	deregister string         // name of the running mapping to stop
+	result     chan error
+}
+
+// RegisterMapping starts a mapping alongside the running ones, once Run has started.  It's
+// checked as if it were in the configuration, so it can't share a name or path with a
+// running mapping.
+func (w *Watcher) RegisterMapping(ctx context.Context, mappingConfig MappingConfig) error {
+	return w.change(ctx, mappingChange{register: &mappingConfig})
+}
+
+// DeregisterMapping stops the named mapping, leaving its files in place.  Mappings that
+// depend on it have to be deregistered first.
+func (w *Watcher) DeregisterMapping(ctx context.Context, name string) error {
+	return w.change(ctx, mappingChange{deregister: name})
+}
+
+func (w *Watcher) change(ctx context.Context, change mappingChange) error {
+	change.result = make(chan error, 1)
+	select {
+	case w.changes <- change:
+	case <-w.stopped:
+		return errStopping
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-change.result
+}
+
+// Make the change asked for, returning how many mappings were started.
+func (m *mappingRuns) change(config *WatchConfig, change mappingChange) int {
+	var started int
+	var err error
+	if change.register != nil {
+		started, err = m.register(config, *change.register)
+	} else {
+		err = m.deregister(change.deregister)
+	}
+	change.result <- err
+	return started
+}
+
+// The configurations of the running mappings.
+func (m *mappingRuns) configs() []MappingConfig {
+	mappings := make([]MappingConfig, len(m.runs))
+	for i, run := range m.runs {
+		mappings[i] = *run.config
+	}
+	return mappings
+}
+
+// Start a mapping alongside the running ones.  It's checked as if it had been added to the
+// configuration, so it can't share a name or path with a running mapping.
+func (m *mappingRuns) register(config *WatchConfig, mappingConfig MappingConfig) (int, error) {
+	candidate := *config
+	candidate.Mappings = append(m.configs(), mappingConfig)
+	applyDefaults(&candidate)
+
+	errs := validateConfig(&candidate)
+	if len(errs) > 0 {
+		return 0, errs[0]
+	}
+
+	run := m.newRun(&candidate.Mappings[len(candidate.Mappings)-1])
+	if err := m.add(config, run); err != nil {
+		return 0, err
+	}
+	return m.startFrom(len(m.runs)-1, nil), nil
+}
+
+// Stop a running mapping, leaving its files in place.  Mappings that depend on it have to be
+// deregistered first.
+func (m *mappingRuns) deregister(name string) error {
+	index := -1
+	for i, run := range m.runs {
+		if run.config.Name == name {
+			index = i
+		} else {
+			for _, dep := range run.config.DependsOn {
+				if dep == name {
+					return fmt.Errorf("mapping %s depends on %s", run.config.Name, name)
+				}
+			}
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("no mapping named %s is running", name)
+	}
+
+	run := m.runs[index]
+	log.WithFields(log.Fields{
+		"mapping": name,
+	}).Info("Stopping mapping")
+	close(run.stop)
+
+	m.runs = append(m.runs[:index:index], m.runs[index+1:]...)
+	return nil
+}
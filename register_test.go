@@ -0,0 +1,84 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegisterMappings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := &WatchConfig{}
+	applyDefaults(config)
+
+	startedCh := make(chan string, 2)
+	running := &mappingRuns{
+		newRun: func(mappingConfig *MappingConfig) *mappingRun { return newMappingRun(mappingConfig, nil) },
+		start:  func(run *mappingRun) { startedCh <- run.config.Name },
+	}
+	defer func() { unlockPaths(running.locks) }()
+
+	register := func(mappingConfig MappingConfig) error {
+		result := make(chan error, 1)
+		running.change(config, mappingChange{register: &mappingConfig, result: result})
+		return <-result
+	}
+	deregister := func(name string) error {
+		result := make(chan error, 1)
+		running.change(config, mappingChange{deregister: name, result: result})
+		return <-result
+	}
+
+	if err := register(MappingConfig{Prefix: "a", Path: filepath.Join(tempDir, "a")}); err != nil {
+		t.Fatalf("failed to register a: %v", err)
+	}
+	if name := <-startedCh; name != "a" {
+		t.Fatalf("expected a to start, got %s", name)
+	}
+	a := running.runs[0]
+
+	// Registered mappings are checked like configured ones
+	if err := register(MappingConfig{Name: "other", Prefix: "b", Path: filepath.Join(tempDir, "a")}); err == nil {
+		t.Fatal("expected a mapping writing to a running mapping's path to be refused")
+	}
+	if err := register(MappingConfig{Prefix: "b", Path: filepath.Join(tempDir, "b"), DependsOn: []string{"a"}}); err != nil {
+		t.Fatalf("failed to register b: %v", err)
+	}
+	<-startedCh
+	if len(running.runs) != 2 || running.runs[1].deps[0] != a {
+		t.Fatal("expected b to wait for a")
+	}
+
+	if err := deregister("a"); err == nil {
+		t.Fatal("expected a mapping others depend on to stay running")
+	}
+	if err := deregister("c"); err == nil {
+		t.Fatal("expected deregistering an unknown mapping to fail")
+	}
+	if err := deregister("b"); err != nil {
+		t.Fatalf("failed to deregister b: %v", err)
+	}
+	if len(running.runs) != 1 || running.runs[0] != a {
+		t.Fatalf("expected only a to be running, got %d runs", len(running.runs))
+	}
+	select {
+	case <-a.stop:
+		t.Fatal("expected a to keep running")
+	default:
+	}
+
+	// Mappings without a path have nothing to lock
+	config.Exec.Command = "true"
+	if err := register(MappingConfig{Prefix: "env", ExecEnv: true}); err != nil {
+		t.Fatalf("failed to register a mapping without a path: %v", err)
+	}
+	if name := <-startedCh; name != "env" {
+		t.Fatalf("expected env to start, got %s", name)
+	}
+}
@@ -0,0 +1,130 @@
+package fsconsul
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Registry hives a mapping's registry key may be under, by their short and long names.
+var registryHives = map[string]string{
+	"HKLM":                "HKLM",
+	"HKEY_LOCAL_MACHINE":  "HKLM",
+	"HKCU":                "HKCU",
+	"HKEY_CURRENT_USER":   "HKCU",
+	"HKU":                 "HKU",
+	"HKEY_USERS":          "HKU",
+	"HKCR":                "HKCR",
+	"HKEY_CLASSES_ROOT":   "HKCR",
+	"HKCC":                "HKCC",
+	"HKEY_CURRENT_CONFIG": "HKCC",
+}
+
+// Split a registry key such as HKLM\SOFTWARE\Vendor into its hive and the path beneath it.
+func splitRegistryKey(key string) (hive, path string, err error) {
+	parts := strings.SplitN(strings.Trim(key, `\`), `\`, 2)
+	hive, ok := registryHives[strings.ToUpper(parts[0])]
+	if !ok {
+		return "", "", fmt.Errorf("registry key %s isn't under a known hive (HKLM, HKCU, HKU, HKCR or HKCC)", key)
+	}
+	if len(parts) == 2 {
+		path = parts[1]
+	}
+	return hive, path, nil
+}
+
+// Determine the registry key and value a Consul key is written to: the last segment of
+// the key names the value, and the segments before it the subkeys it's in.
+func registryValuePath(mappingConfig *MappingConfig, key string) (regKey, name string) {
+	regKey = strings.TrimRight(mappingConfig.Registry, `\`)
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		regKey += `\` + strings.Replace(key[:i], "/", `\`, -1)
+		key = key[i+1:]
+	}
+	return regKey, key
+}
+
+// Apply a snapshot to the registry, writing the values that changed and deleting those
+// whose keys were removed.  Values are written as REG_SZ strings.  Returns the values
+// written or deleted, and those that failed.
+func writeRegistry(mappingConfig *MappingConfig, logger *log.Entry, env, newEnv map[string]string, summary *mappingSummary) (fileChanges, []keyFailure) {
+	var changes fileChanges
+	var failed []keyFailure
+	fail := func(target string, err error) {
+		summary.addError(target, err)
+		failed = append(failed, keyFailure{target, err.Error()})
+	}
+
+	if mappingConfig.managesDeletes() {
+		for k := range env {
+			if _, ok := newEnv[k]; ok {
+				continue
+			}
+
+			regKey, name := registryValuePath(mappingConfig, k)
+			target := regKey + `\` + name
+			if err := deleteRegistryValue(regKey, name); err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"value": target,
+				}).Error("Failed to delete registry value")
+				fail(target, err)
+				continue
+			}
+			summary.deleted(target)
+			changes.Deleted = append(changes.Deleted, target)
+		}
+	}
+
+	for k, v := range newEnv {
+		// Folders have no value of their own
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+
+		regKey, name := registryValuePath(mappingConfig, k)
+		target := regKey + `\` + name
+		valueLogger := logger.WithFields(log.Fields{
+			"key":   k,
+			"value": target,
+		})
+
+		rendered, err := renderValue(mappingConfig, k, []byte(v), newEnv)
+		if err != nil {
+			valueLogger.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to render value")
+			fail(target, err)
+			continue
+		}
+
+		current, existed, err := readRegistryValue(regKey, name)
+		if err != nil {
+			valueLogger.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to read registry value")
+			fail(target, err)
+			continue
+		}
+		if existed && current == string(rendered) {
+			continue
+		}
+
+		if err := writeRegistryValue(regKey, name, string(rendered)); err != nil {
+			valueLogger.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to write registry value")
+			fail(target, err)
+			continue
+		}
+		summary.wrote(target, existed, len(rendered))
+		if existed {
+			changes.Updated = append(changes.Updated, target)
+		} else {
+			changes.Created = append(changes.Created, target)
+		}
+	}
+
+	return changes, failed
+}
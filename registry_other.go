@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package fsconsul
+
+import "fmt"
+
+var errNoRegistry = fmt.Errorf("the registry is only available on Windows")
+
+func readRegistryValue(regKey, name string) (string, bool, error) {
+	return "", false, errNoRegistry
+}
+
+func writeRegistryValue(regKey, name, value string) error {
+	return errNoRegistry
+}
+
+func deleteRegistryValue(regKey, name string) error {
+	return errNoRegistry
+}
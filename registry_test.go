@@ -0,0 +1,27 @@
+package fsconsul
+
+import (
+	"testing"
+)
+
+func TestRegistryValuePath(t *testing.T) {
+	mappingConfig := &MappingConfig{Registry: `HKLM\SOFTWARE\Vendor\App\`}
+
+	regKey, name := registryValuePath(mappingConfig, "db/primary/host")
+	if regKey != `HKLM\SOFTWARE\Vendor\App\db\primary` || name != "host" {
+		t.Errorf("unexpected value %s\\%s", regKey, name)
+	}
+
+	regKey, name = registryValuePath(mappingConfig, "port")
+	if regKey != `HKLM\SOFTWARE\Vendor\App` || name != "port" {
+		t.Errorf("unexpected value %s\\%s", regKey, name)
+	}
+
+	hive, path, err := splitRegistryKey(`hkey_current_user\Software\App`)
+	if err != nil || hive != "HKCU" || path != `Software\App` {
+		t.Errorf("unexpected split %s %s (%v)", hive, path, err)
+	}
+	if _, _, err := splitRegistryKey(`HKXX\Software`); err == nil {
+		t.Error("expected an unknown hive to be rejected")
+	}
+}
@@ -0,0 +1,76 @@
+//go:build windows
+// +build windows
+
+package fsconsul
+
+import (
+	"golang.org/x/sys/windows/registry"
+)
+
+var registryRoots = map[string]registry.Key{
+	"HKLM": registry.LOCAL_MACHINE,
+	"HKCU": registry.CURRENT_USER,
+	"HKU":  registry.USERS,
+	"HKCR": registry.CLASSES_ROOT,
+	"HKCC": registry.CURRENT_CONFIG,
+}
+
+func openRegistryKey(regKey string, access uint32, create bool) (registry.Key, error) {
+	hive, path, err := splitRegistryKey(regKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if create {
+		key, _, err := registry.CreateKey(registryRoots[hive], path, access)
+		return key, err
+	}
+	return registry.OpenKey(registryRoots[hive], path, access)
+}
+
+// Read a string value, reporting whether it exists.
+func readRegistryValue(regKey, name string) (string, bool, error) {
+	key, err := openRegistryKey(regKey, registry.QUERY_VALUE, false)
+	if err == registry.ErrNotExist {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	defer key.Close()
+
+	value, _, err := key.GetStringValue(name)
+	if err == registry.ErrNotExist {
+		return "", false, nil
+	} else if err != nil {
+		// A value of another type is replaced
+		return "", true, nil
+	}
+	return value, true, nil
+}
+
+// Write a string value, creating its key if necessary.
+func writeRegistryValue(regKey, name, value string) error {
+	key, err := openRegistryKey(regKey, registry.SET_VALUE, true)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	return key.SetStringValue(name, value)
+}
+
+// Delete a value, if it exists.  Its key is left in place.
+func deleteRegistryValue(regKey, name string) error {
+	key, err := openRegistryKey(regKey, registry.SET_VALUE, false)
+	if err == registry.ErrNotExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	if err := key.DeleteValue(name); err != nil && err != registry.ErrNotExist {
+		return err
+	}
+	return nil
+}
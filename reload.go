@@ -0,0 +1,178 @@
+package fsconsul
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Returned by a mapping's watcher when it's stopped because a reload removed or changed it.
+var errStopped = errors.New("mapping stopped")
+
+// The channel receiving SIGHUP, asking a watching fsconsul to reload its mappings, or nil
+// if the configuration can't be reloaded.
+func reloadSignal(config *WatchConfig) (<-chan os.Signal, func()) {
+	if config.reload == nil || config.RunOnce {
+		return nil, func() {}
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	return hupCh, func() { signal.Stop(hupCh) }
+}
+
+// mappingRuns are the running mappings, and what's needed to start more.
+type mappingRuns struct {
+	runs  []*mappingRun
+	locks []*pathLock
+
+	newRun func(*MappingConfig) *mappingRun
+	start  func(*mappingRun)
+}
+
+// Reload the configuration and bring the running mappings in line with it: mappings that
+// were removed or changed are stopped, and new or changed ones are started, leaving the
+// others running undisturbed.  Returns how many mappings were started.  An invalid
+// configuration is logged and leaves every mapping running.
+func (m *mappingRuns) reload(config *WatchConfig) int {
+	log.Info("Reloading configuration")
+
+	newConfig, err := config.reload()
+	if err == nil {
+		// Fragments owned by other users are rendered by workers, which aren't restarted
+		_, err = loadConfDir(newConfig)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to reload configuration, keeping the current mappings")
+		return 0
+	}
+	applyDefaults(newConfig)
+
+	if errs := validateConfig(newConfig); len(errs) > 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Invalid configuration, keeping the current mappings")
+		}
+		return 0
+	}
+
+	if !sameSettings(config, newConfig) {
+		log.Warn("Only mappings are reloaded, restart fsconsul to apply other changes")
+	}
+
+	current := make(map[string]*mappingRun, len(m.runs))
+	for _, run := range m.runs {
+		current[run.config.Name] = run
+	}
+
+	var kept, added []*mappingRun
+	for i := range newConfig.Mappings {
+		mappingConfig := &newConfig.Mappings[i]
+		if run, ok := current[mappingConfig.Name]; ok && reflect.DeepEqual(*run.config, *mappingConfig) {
+			kept = append(kept, run)
+			delete(current, mappingConfig.Name)
+			continue
+		}
+		added = append(added, m.newRun(mappingConfig))
+	}
+
+	// Whatever is left was removed or changed.  Their files are left in place.
+	stopping := make(map[string][]*mappingRun)
+	for _, run := range current {
+		run.logger.Info("Stopping mapping")
+		close(run.stop)
+		// Mappings without a path, like registry ones, have nothing to wait for
+		if run.config.Path != "" {
+			path := filepath.Clean(run.config.Path)
+			stopping[path] = append(stopping[path], run)
+		}
+	}
+
+	m.runs = kept
+	for _, run := range added {
+		if err := m.add(config, run); err != nil {
+			run.logger.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to lock target path, not starting mapping")
+		}
+	}
+	started := m.startFrom(len(kept), stopping)
+
+	log.WithFields(log.Fields{
+		"kept":    len(kept),
+		"stopped": len(current),
+		"started": started,
+	}).Info("Reloaded configuration")
+	return started
+}
+
+// Lock a new mapping's path, unless a running mapping already holds it, and add it to the
+// running mappings.  It isn't started until startFrom is called.
+func (m *mappingRuns) add(config *WatchConfig, run *mappingRun) error {
+	// Registry mappings have no path
+	if run.config.Path == "" {
+		m.runs = append(m.runs, run)
+		return nil
+	}
+
+	// Paths stay locked until fsconsul exits, so only new paths need locking
+	path := filepath.Clean(run.config.Path)
+	for _, lock := range m.locks {
+		if filepath.Dir(lock.file.Name()) == path {
+			m.runs = append(m.runs, run)
+			return nil
+		}
+	}
+
+	lock, err := lockPath(run.config, config.Takeover)
+	if err != nil {
+		return err
+	}
+	m.locks = append(m.locks, lock)
+	m.runs = append(m.runs, run)
+	return nil
+}
+
+// Start the mappings added from the given index on.  A mapping replacing ones on the same
+// path waits for them to stop writing.  Returns how many mappings were started.
+func (m *mappingRuns) startFrom(from int, stopping map[string][]*mappingRun) int {
+	linkDependencies(m.runs)
+
+	for _, run := range m.runs[from:] {
+		run.logger.Info("Starting mapping")
+
+		var previous []*mappingRun
+		if run.config.Path != "" {
+			previous = stopping[filepath.Clean(run.config.Path)]
+		}
+		go func(run *mappingRun, previous []*mappingRun) {
+			for _, p := range previous {
+				<-p.done
+			}
+			m.start(run)
+		}(run, previous)
+	}
+	return len(m.runs) - from
+}
+
+// Determine whether two configurations differ only in their mappings.
+func sameSettings(a, b *WatchConfig) bool {
+	aSettings, bSettings := *a, *b
+	aSettings.Mappings, bSettings.Mappings = nil, nil
+	aSettings.reload, bSettings.reload = nil, nil
+	aSettings.logger, bSettings.logger = nil, nil
+	aSettings.changes, bSettings.changes = nil, nil
+	aSettings.health, bSettings.health = nil, nil
+	aSettings.live, bSettings.live = nil, nil
+	aSettings.done, bSettings.done = nil, nil
+	aSettings.hooks, bSettings.hooks = nil, nil
+	return reflect.DeepEqual(aSettings, bSettings)
+}
@@ -0,0 +1,129 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadMappings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappings := func(names ...string) []MappingConfig {
+		var mappingConfigs []MappingConfig
+		for _, name := range names {
+			mappingConfigs = append(mappingConfigs, MappingConfig{Name: name, Prefix: name, Path: filepath.Join(tempDir, name)})
+		}
+		return mappingConfigs
+	}
+
+	config := &WatchConfig{Mappings: mappings("a", "b")}
+	applyDefaults(config)
+
+	reloaded := &WatchConfig{Mappings: mappings("a", "b", "c")}
+	reloaded.Mappings[1].Template = true
+	config.reload = func() (*WatchConfig, error) { return reloaded, nil }
+
+	startedCh := make(chan string, 2)
+	running := &mappingRuns{
+		newRun: func(mappingConfig *MappingConfig) *mappingRun { return newMappingRun(mappingConfig, nil) },
+		start:  func(run *mappingRun) { startedCh <- run.config.Name },
+	}
+	for i := range config.Mappings {
+		running.runs = append(running.runs, running.newRun(&config.Mappings[i]))
+	}
+	a, b := running.runs[0], running.runs[1]
+	defer func() { unlockPaths(running.locks) }()
+
+	if started := running.reload(config); started != 2 {
+		t.Fatalf("expected the changed and added mappings to start, got %d", started)
+	}
+
+	select {
+	case <-b.stop:
+	default:
+		t.Fatal("expected the changed mapping to be stopped")
+	}
+	select {
+	case <-a.stop:
+		t.Fatal("expected the unchanged mapping to keep running")
+	default:
+	}
+	if len(running.runs) != 3 || running.runs[0] != a {
+		t.Fatalf("expected the unchanged mapping to be kept, got %d runs", len(running.runs))
+	}
+
+	// The added mapping starts straight away, the changed one once its predecessor stops
+	if name := <-startedCh; name != "c" {
+		t.Fatalf("expected c to start first, got %s", name)
+	}
+	select {
+	case name := <-startedCh:
+		t.Fatalf("expected %s to wait for its predecessor to stop", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(b.done)
+	if name := <-startedCh; name != "b" {
+		t.Fatalf("expected b to start, got %s", name)
+	}
+
+	// An invalid configuration changes nothing
+	reloaded = &WatchConfig{}
+	if started := running.reload(config); started != 0 || len(running.runs) != 3 {
+		t.Fatalf("expected an invalid configuration to be ignored, started %d", started)
+	}
+}
+
+func TestReloadPathlessMappings(t *testing.T) {
+	envOnly := func(names ...string) []MappingConfig {
+		var mappingConfigs []MappingConfig
+		for _, name := range names {
+			mappingConfigs = append(mappingConfigs, MappingConfig{Name: name, Prefix: name, ExecEnv: true})
+		}
+		return mappingConfigs
+	}
+
+	config := &WatchConfig{Mappings: envOnly("a", "b"), Exec: ExecConfig{Command: "true"}}
+	applyDefaults(config)
+
+	reloaded := &WatchConfig{Mappings: envOnly("a", "b", "c"), Exec: ExecConfig{Command: "true"}}
+	reloaded.Mappings[0].Template = true
+	config.reload = func() (*WatchConfig, error) { return reloaded, nil }
+
+	startedCh := make(chan string, 2)
+	running := &mappingRuns{
+		newRun: func(mappingConfig *MappingConfig) *mappingRun { return newMappingRun(mappingConfig, nil) },
+		start:  func(run *mappingRun) { startedCh <- run.config.Name },
+	}
+	for i := range config.Mappings {
+		running.runs = append(running.runs, running.newRun(&config.Mappings[i]))
+	}
+	defer func() { unlockPaths(running.locks) }()
+
+	if started := running.reload(config); started != 2 {
+		t.Fatalf("expected the changed and added mappings to start, got %d", started)
+	}
+	if len(running.locks) != 0 {
+		t.Fatalf("expected no path to be locked, got %d locks", len(running.locks))
+	}
+
+	// Neither waits on the stopped mapping, which has no path to share
+	started := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-startedCh:
+			started[name] = true
+		case <-time.After(time.Second):
+			t.Fatalf("expected the changed and added mappings to start, got %v", started)
+		}
+	}
+	if !started["a"] || !started["c"] {
+		t.Fatalf("expected a and c to start, got %v", started)
+	}
+}
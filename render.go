@@ -0,0 +1,87 @@
+package fsconsul
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Render the raw value of a key (relative to the mapping's prefix) from Consul into the
+// content to write to disk.  If the mapping has a keystore, encrypted tags in the value are
+// decrypted.  If it has a keystore or asks for templates, the value is then run as a
+// template, with the other keys of the snapshot the value came from available to it.
+// Jsonnet and CUE values are then evaluated if the mapping asks for it.  Finally, unless
+// the value is to be exploded into a single file, its trailing newlines are normalized.
+func renderValue(mappingConfig *MappingConfig, key string, value []byte, env map[string]string) ([]byte, error) {
+	value, err := renderTemplate(mappingConfig, value, env, []string{key})
+	if err != nil {
+		return nil, err
+	}
+
+	value, err = evaluateValue(mappingConfig, key, value)
+	if err != nil || mappingConfig.Format != "" {
+		return value, err
+	}
+	return normalizeNewline(mappingConfig.trailingNewline(fileKey(mappingConfig, key)), value), nil
+}
+
+// decryptionError is a value that couldn't be decrypted, or whose keystore couldn't be read.
+type decryptionError struct {
+	err error
+}
+
+func (e *decryptionError) Error() string {
+	return e.err.Error()
+}
+
+func isDecryptionError(err error) bool {
+	var decryptErr *decryptionError
+	return errors.As(err, &decryptErr)
+}
+
+// The chain is the keys being rendered, each including the next, ending with the key whose
+// value this is.
+func renderTemplate(mappingConfig *MappingConfig, value []byte, env map[string]string, chain []string) ([]byte, error) {
+	if mappingConfig.Transit.Key != "" {
+		decrypted, err := decryptTransit(mappingConfig.Transit, value)
+		if err != nil {
+			return nil, &decryptionError{fmt.Errorf("failed to decrypt value with vault transit: %v", err)}
+		}
+		value = decrypted
+	}
+
+	if len(mappingConfig.Keystore) == 0 && !mappingConfig.Template {
+		return value, nil
+	}
+
+	data := value
+	if len(mappingConfig.Keystore) > 0 {
+		decryptedValue, err := decryptGosecret(mappingConfig.keystores(), value)
+		if err != nil {
+			return nil, err
+		}
+
+		log.WithFields(log.Fields{
+			"length": len(decryptedValue),
+		}).Debug("Output value length")
+
+		data = decryptedValue
+	}
+
+	tmpl, err := template.New("decryption").Funcs(templateFuncs(mappingConfig, env, chain)).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse template: %v", err)
+	}
+
+	// Run the template to verify the output.
+	buff := new(bytes.Buffer)
+	err = tmpl.Execute(buff, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute template: %v", err)
+	}
+
+	return buff.Bytes(), nil
+}
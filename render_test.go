@@ -0,0 +1,85 @@
+package fsconsul
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRenderValueInterpolation(t *testing.T) {
+	mappingConfig := &MappingConfig{Prefix: "app/config", Template: true}
+	env := map[string]string{
+		"shared/db_host": "db.internal",
+		"app.conf":       `host={{kv "shared/db_host"}}`,
+	}
+
+	rendered, err := renderValue(mappingConfig, "app.conf", []byte(env["app.conf"]), env)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(rendered) != "host=db.internal" {
+		t.Fatalf("Expected interpolated value but got %q", string(rendered))
+	}
+
+	if _, err := renderValue(mappingConfig, "app.conf", []byte(`{{kv "missing"}}`), env); err == nil {
+		t.Fatal("Expected an error for a missing key")
+	}
+
+	// Without templates enabled, values are written verbatim
+	mappingConfig.Template = false
+	rendered, err = renderValue(mappingConfig, "app.conf", []byte(env["app.conf"]), env)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(rendered) != env["app.conf"] {
+		t.Fatalf("Expected verbatim value but got %q", string(rendered))
+	}
+}
+
+func TestRenderValueSprig(t *testing.T) {
+	mappingConfig := &MappingConfig{Template: true}
+
+	rendered, err := renderValue(mappingConfig, "app.conf", []byte(`name={{"app" | upper}} port={{"" | default "8080"}}`), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(rendered) != "name=APP port=8080" {
+		t.Fatalf("Expected sprig functions to be applied but got %q", string(rendered))
+	}
+
+	// Templates can't read fsconsul's environment
+	if _, err := renderValue(mappingConfig, "app.conf", []byte(`{{env "CONSUL_HTTP_TOKEN"}}`), nil); err == nil {
+		t.Fatal("Expected env to be unavailable to templates")
+	}
+}
+
+func TestRenderValueInclude(t *testing.T) {
+	mappingConfig := &MappingConfig{Prefix: "app/", Template: true}
+	env := map[string]string{
+		"partials/header": `# {{include "partials/owner"}}`,
+		"partials/owner":  `owned by {{kv "team"}}`,
+		"team":            "platform",
+		"a.conf":          `{{include "b.conf"}}`,
+		"b.conf":          `{{include "a.conf"}}`,
+	}
+
+	rendered, err := renderValue(mappingConfig, "app.conf", []byte(`{{include "app/partials/header"}}`+"\nport=80"), env)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(rendered) != "# owned by platform\nport=80" {
+		t.Fatalf("Expected nested includes to be rendered but got %q", string(rendered))
+	}
+
+	if _, err := renderValue(mappingConfig, "a.conf", []byte(env["a.conf"]), env); err == nil {
+		t.Fatal("Expected an error for an include cycle")
+	}
+
+	// A chain of includes deeper than the limit
+	for i := 0; i <= maxIncludeDepth; i++ {
+		env[fmt.Sprintf("deep/%d", i)] = fmt.Sprintf(`{{include "deep/%d"}}`, i+1)
+	}
+	env[fmt.Sprintf("deep/%d", maxIncludeDepth+1)] = "bottom"
+	if _, err := renderValue(mappingConfig, "top", []byte(`{{include "deep/0"}}`), env); err == nil {
+		t.Fatal("Expected an error for includes nested too deep")
+	}
+}
@@ -0,0 +1,277 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// complianceReport maps every file fsconsul renders to the Consul key it comes from, the
+// identity it's read with, how it's decrypted and the file's permissions, for auditors.
+type complianceReport struct {
+	Generated time.Time       `json:"generated"`
+	Consul    reportConsul    `json:"consul"`
+	Mappings  []reportMapping `json:"mappings"`
+}
+
+type reportConsul struct {
+	Addr  string      `json:"addr"`
+	DC    string      `json:"dc,omitempty"`
+	Token reportToken `json:"token"`
+}
+
+// reportToken identifies the ACL token keys are read with, without revealing its secret.
+type reportToken struct {
+	Source      string `json:"source"` // static, auth-method or anonymous
+	AccessorID  string `json:"accessorID,omitempty"`
+	Description string `json:"description,omitempty"`
+	AuthMethod  string `json:"authMethod,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type reportMapping struct {
+	Mapping    string       `json:"mapping"`
+	Backend    string       `json:"backend"`
+	Prefix     string       `json:"prefix"`
+	Fallback   string       `json:"fallback,omitempty"`
+	Path       string       `json:"path"`
+	Decryption string       `json:"decryption"` // gosecret, vault-transit, both or none
+	Keystore   string       `json:"keystore,omitempty"`
+	TransitKey string       `json:"transitkey,omitempty"`
+	Files      []reportFile `json:"files"`
+	Error      string       `json:"error,omitempty"`
+}
+
+type reportFile struct {
+	File        string `json:"file"`
+	Key         string `json:"key"`
+	ModifyIndex uint64 `json:"modifyIndex"`
+	Fallback    bool   `json:"fallback,omitempty"`
+	Exists      bool   `json:"exists"`
+	Mode        string `json:"mode,omitempty"`
+	UID         *int   `json:"uid,omitempty"`
+	GID         *int   `json:"gid,omitempty"`
+}
+
+func reportCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul report", reportHelpText, &opts)
+	flags.Parse(args)
+	if opts.configFile == "" && flags.NArg() < 2 {
+		flags.Usage()
+		return 1
+	}
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, flags.Args())
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 1
+	}
+
+	report := buildReport(client, config)
+	if err := writeReport(os.Stdout, report); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to write report")
+		return 1
+	}
+
+	for _, mapping := range report.Mappings {
+		if mapping.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+func buildReport(client *consulapi.Client, config *WatchConfig) *complianceReport {
+	report := &complianceReport{
+		Generated: time.Now().UTC(),
+		Consul: reportConsul{
+			Addr:  config.Consul.Addr,
+			DC:    config.Consul.DC,
+			Token: tokenIdentity(client, config.Consul),
+		},
+	}
+
+	for i := range config.Mappings {
+		report.Mappings = append(report.Mappings, reportOn(client, config, &config.Mappings[i]))
+	}
+
+	return report
+}
+
+func tokenIdentity(client *consulapi.Client, consulConfig ConsulConfig) reportToken {
+	var identity reportToken
+	switch {
+	case consulConfig.Login.AuthMethod != "":
+		identity.Source = "auth-method"
+		identity.AuthMethod = consulConfig.Login.AuthMethod
+	case consulConfig.Token != "":
+		identity.Source = "static"
+	default:
+		identity.Source = "anonymous"
+	}
+
+	// Any token can read itself
+	token, _, err := client.ACL().TokenReadSelf(&consulapi.QueryOptions{Token: consulConfig.Token})
+	if err != nil {
+		identity.Error = err.Error()
+		return identity
+	}
+	identity.AccessorID = token.AccessorID
+	identity.Description = token.Description
+	if token.AuthMethod != "" {
+		identity.AuthMethod = token.AuthMethod
+	}
+	return identity
+}
+
+func reportOn(client *consulapi.Client, config *WatchConfig, mappingConfig *MappingConfig) reportMapping {
+	mapping := reportMapping{
+		Mapping:    mappingConfig.Name,
+		Backend:    "consul",
+		Prefix:     mappingConfig.Prefix,
+		Fallback:   mappingConfig.FallbackPrefix,
+		Path:       mappingConfig.Path,
+		Decryption: "none",
+		Keystore:   mappingConfig.Keystore,
+		TransitKey: mappingConfig.Transit.Key,
+		Files:      []reportFile{},
+	}
+	switch {
+	case mappingConfig.Keystore != "" && mappingConfig.Transit.Key != "":
+		mapping.Decryption = "both"
+	case mappingConfig.Keystore != "":
+		mapping.Decryption = "gosecret"
+	case mappingConfig.Transit.Key != "":
+		mapping.Decryption = "vault-transit"
+	}
+	if mappingConfig.Backend != "" {
+		mapping.Backend = mappingConfig.Backend
+	}
+
+	pairs, err := listMapping(client, config, mappingConfig)
+	if err != nil {
+		mapping.Error = err.Error()
+		return mapping
+	}
+
+	mapping.Files = reportFiles(mappingConfig, pairs)
+	return mapping
+}
+
+// List the pairs under a mapping's prefix, from Consul, Vault or etcd.
+func listMapping(client *consulapi.Client, config *WatchConfig, mappingConfig *MappingConfig) (consulapi.KVPairs, error) {
+	if mappingConfig.Backend == "vault" {
+		vault, err := vaultFor(config.Vault)
+		if err != nil {
+			return nil, err
+		}
+		return vault.list(mappingConfig.Prefix)
+	}
+	if mappingConfig.Backend == "etcd" {
+		etcd, err := etcdFor(config.Etcd)
+		if err != nil {
+			return nil, err
+		}
+		pairs, _, err := etcd.list(mappingConfig.Prefix)
+		return pairs, err
+	}
+
+	client, err := config.consulClientFor(client, mappingConfig)
+	if err != nil {
+		return nil, err
+	}
+	token := config.consulFor(mappingConfig).Token
+	if mappingConfig.PointerKey != "" {
+		target, _, err := readPointer(client, mappingConfig, &consulapi.QueryOptions{Token: token})
+		if err != nil {
+			return nil, err
+		}
+		pairs, _, err := client.KV().List(target, &consulapi.QueryOptions{Token: token})
+		return aliasPairs(mappingConfig, target, pairs), err
+	}
+
+	pairs, _, err := client.KV().List(mappingConfig.Prefix, &consulapi.QueryOptions{Token: token})
+	if err != nil || mappingConfig.FallbackPrefix == "" {
+		return pairs, err
+	}
+	fallback, _, err := client.KV().List(mappingConfig.FallbackPrefix, &consulapi.QueryOptions{Token: token})
+	return append(pairs, fallback...), err
+}
+
+// Describe the file each key of a listing is rendered to.
+func reportFiles(mappingConfig *MappingConfig, pairs consulapi.KVPairs) []reportFile {
+	// Work out which Consul key each file comes from (overlays included) by snapshotting
+	// the keys' names rather than their values
+	named := make(consulapi.KVPairs, len(pairs))
+	for i, pair := range pairs {
+		named[i] = &consulapi.KVPair{Key: pair.Key, Value: []byte(pair.Key), ModifyIndex: pair.ModifyIndex}
+	}
+	sources, modifyIndexes := snapshotEnv(mappingConfig, named)
+	// Keys outside the path are never written
+	dropUnsafeKeys(mappingConfig, sources)
+
+	keys := make([]string, 0, len(sources))
+	for k := range sources {
+		// Folders have no file of their own
+		if !strings.HasSuffix(k, "/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	files := []reportFile{}
+	for _, k := range keys {
+		file := keyfilePath(mappingConfig, k)
+		if mappingConfig.Format != "" {
+			file = explodedPath(mappingConfig)
+		}
+		described := describeFile(file, sources[k], modifyIndexes[k])
+		described.Fallback = mappingConfig.FallbackPrefix != "" && strings.HasPrefix(sources[k], mappingConfig.FallbackPrefix)
+		files = append(files, described)
+	}
+	return files
+}
+
+func describeFile(file, key string, modifyIndex uint64) reportFile {
+	described := reportFile{File: file, Key: key, ModifyIndex: modifyIndex}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return described
+	}
+	described.Exists = true
+	described.Mode = fmt.Sprintf("%04o", info.Mode().Perm())
+	if uid, gid, ok := fileOwner(info); ok {
+		described.UID, described.GID = &uid, &gid
+	}
+	return described
+}
+
+func writeReport(w io.Writer, report *complianceReport) error {
+	encoded, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(encoded, '\n'))
+	return err
+}
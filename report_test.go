@@ -0,0 +1,46 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestReportFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "db.conf"), []byte("host=db"), 0640); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	mappingConfig := &MappingConfig{Prefix: "app/", Path: tempDir, Environment: "prod"}
+	mappingConfig.Path += string(os.PathSeparator)
+
+	files := reportFiles(mappingConfig, consulapi.KVPairs{
+		{Key: "app/base/db.conf", ModifyIndex: 3},
+		{Key: "app/overlays/prod/db.conf", ModifyIndex: 7},
+		{Key: "app/base/cache.conf", ModifyIndex: 5},
+	})
+	if len(files) != 2 {
+		t.Fatalf("expected a file per rendered key, got %+v", files)
+	}
+
+	cache, db := files[0], files[1]
+	if cache.Key != "app/base/cache.conf" || cache.Exists {
+		t.Errorf("unexpected report for cache.conf: %+v", cache)
+	}
+	if db.Key != "app/overlays/prod/db.conf" || db.ModifyIndex != 7 || !db.Exists {
+		t.Errorf("expected db.conf to come from the overlay, got %+v", db)
+	}
+	if runtime.GOOS != "windows" && (db.Mode != "0640" || db.UID == nil) {
+		t.Errorf("expected db.conf's mode and owner, got %+v", db)
+	}
+}
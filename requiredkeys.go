@@ -0,0 +1,29 @@
+package fsconsul
+
+import "strings"
+
+// List the required keys missing from a snapshot.
+func (mappingConfig *MappingConfig) missingKeys(env map[string]string) []string {
+	var missing []string
+	for _, k := range mappingConfig.RequiredKeys {
+		if _, ok := env[strings.TrimLeft(k, "/")]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
+
+// Mark the mapping unhealthy, because its snapshot was refused for missing required keys.
+func (run *mappingRun) refused(missing []string, err error) {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	run.lastError = err
+	run.missing = missing
+}
+
+// Get the required keys missing from the mapping's refused snapshot, for health checks.
+func (run *mappingRun) missingKeys() []string {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	return run.missing
+}
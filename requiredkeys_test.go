@@ -0,0 +1,83 @@
+package fsconsul
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var requiredKeysBlobs = []struct {
+	json    string
+	missing []string
+}{
+	{
+		`{
+			"mappings" : [{
+				"prefix": "app/",
+				"requiredkeys": ["db.conf", "/cache.conf"]
+			}]
+		}`,
+		[]string{"/cache.conf"},
+	}, {
+		`{
+			"mappings" : [{
+				"prefix": "app/",
+				"minkeys": 3
+			}]
+		}`,
+		nil,
+	},
+}
+
+func TestRequiredKeys(t *testing.T) {
+	for _, test := range requiredKeysBlobs {
+		tempDir := t.TempDir()
+		target := filepath.Join(tempDir, "out") + "/"
+
+		// The previous snapshot's files, which a refused snapshot leaves in place
+		if err := makeDirs(&MappingConfig{}, target); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(target, "db.conf"), []byte("old"), 0640); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// A partially published snapshot, updating db.conf and adding app.conf
+		var pairs []string
+		for _, name := range []string{"db.conf", "app.conf"} {
+			pairs = append(pairs, fmt.Sprintf(`{"key": "app/%s", "value": %q}`, name, base64.StdEncoding.EncodeToString([]byte("new"))))
+		}
+		fixture := filepath.Join(tempDir, "kv.json")
+		if err := ioutil.WriteFile(fixture, []byte("["+strings.Join(pairs, ",")+"]"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		var config WatchConfig
+		if err := json.Unmarshal([]byte(test.json), &config); err != nil {
+			t.Fatalf("Failed to parse JSON due to %v", err)
+		}
+		config.RunOnce = true
+		config.SourceFile = fixture
+		config.Mappings[0].Path = target
+
+		env := map[string]string{"db.conf": "new", "app.conf": "new"}
+		if missing := config.Mappings[0].missingKeys(env); !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf("expected %v to be missing, got %v", test.missing, missing)
+		}
+
+		if code := watchAndExec(&config); code == 0 {
+			t.Errorf("expected the snapshot to be refused")
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(target, "db.conf")); err != nil || string(content) != "old" {
+			t.Errorf("expected the previous file to be kept, got %q (%v)", content, err)
+		}
+		if _, err := ioutil.ReadFile(filepath.Join(target, "app.conf")); err == nil {
+			t.Errorf("expected nothing to be written from a refused snapshot")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Closed when the Windows service control manager asks a running service to stop, which
+// stops fsconsul as SIGINT does.  Nil unless running as a service.
+var serviceStop <-chan struct{}
+
+func serviceCommand(args []string) int {
+	flags := newFlagSet("fsconsul service", serviceHelpText, nil)
+	name := flags.String("name", "fsconsul", "the service's name")
+	displayName := flags.String("display-name", "fsconsul", "the service's display name, when installing it")
+	if len(args) == 0 {
+		flags.Usage()
+		return 1
+	}
+	action := args[0]
+	flags.Parse(args[1:])
+
+	var err error
+	switch action {
+	case "install":
+		var program string
+		program, err = os.Executable()
+		if err == nil {
+			program, err = filepath.Abs(program)
+		}
+		if err == nil {
+			err = installService(*name, *displayName, program, flags.Args())
+		}
+	case "uninstall":
+		err = uninstallService(*name)
+	case "start":
+		err = startService(*name)
+	case "stop":
+		err = stopService(*name)
+	case "run":
+		return runService(*name, flags.Args())
+	default:
+		flags.Usage()
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to %s service %s: %v\n", action, *name, err)
+		return 1
+	}
+	return 0
+}
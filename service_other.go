@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package fsconsul
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errNoServices = errors.New("services are only supported on Windows, use systemd or launchd instead")
+
+func installService(name, displayName, program string, args []string) error {
+	return errNoServices
+}
+
+func uninstallService(name string) error {
+	return errNoServices
+}
+
+func startService(name string) error {
+	return errNoServices
+}
+
+func stopService(name string) error {
+	return errNoServices
+}
+
+func runService(name string, args []string) int {
+	fmt.Fprintln(os.Stderr, errNoServices)
+	return 1
+}
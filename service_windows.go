@@ -0,0 +1,211 @@
+//go:build windows
+// +build windows
+
+package fsconsul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// How long fsconsul service stop waits for the service to stop: the shutdown timeout plus
+// a margin.
+const serviceStopTimeout = defaultShutdownTimeout + 10*time.Second
+
+// Install a service running fsconsul watch with the given arguments, started
+// automatically, and register it as an event log source.
+func installService(name, displayName, program string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	s, err := m.CreateService(name, program, mgr.Config{
+		DisplayName: displayName,
+		Description: "Writes Consul keys to files",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run", "-name", name, "--"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register the event log source: %v", err)
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(name)
+}
+
+func startService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// Ask the service to stop and wait until it has, which may take as long as its writes and
+// onchange commands take to finish.
+func stopService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run fsconsul watch with the given arguments as the named service, logging to the event
+// log.  This is what the service control manager starts.
+func runService(name string, args []string) int {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		logrus.Error("fsconsul service run is started by the service control manager, use fsconsul service start")
+		return 1
+	}
+
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return 1
+	}
+	defer elog.Close()
+	logrus.AddHook(&eventLogHook{elog})
+
+	if err := svc.Run(name, &serviceHandler{args: args}); err != nil {
+		elog.Error(1, fmt.Sprintf("Service %s failed: %v", name, err))
+		return 1
+	}
+	return 0
+}
+
+// serviceHandler runs fsconsul watch until it exits or the service control manager stops it.
+type serviceHandler struct {
+	args []string
+}
+
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	serviceStop = stop
+
+	exited := make(chan int, 1)
+	go func() {
+		exited <- Main(append([]string{"watch"}, h.args...))
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case code := <-exited:
+			status <- svc.Status{State: svc.StopPending}
+			// A failed watch is reported as a service-specific exit code
+			return code != 0, uint32(code)
+
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				stopOnce.Do(func() { close(stop) })
+			}
+		}
+	}
+}
+
+// eventLogHook sends log entries to the Windows event log, with their fields appended to
+// the message since the event log has no fields of its own.
+type eventLogHook struct {
+	elog *eventlog.Log
+}
+
+func (hook *eventLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (hook *eventLogHook) Fire(entry *logrus.Entry) error {
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(entry.Message)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, entry.Data[k])
+	}
+	msg := b.String()
+
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return hook.elog.Error(1, msg)
+	case logrus.WarnLevel:
+		return hook.elog.Warning(1, msg)
+	default:
+		return hook.elog.Info(1, msg)
+	}
+}
@@ -0,0 +1,78 @@
+package fsconsul
+
+import (
+	"os"
+	"os/signal"
+	"time"
+)
+
+// How long in-flight writes and onchange commands have to finish on shutdown, unless
+// configured otherwise.
+const defaultShutdownTimeout = 30 * time.Second
+
+// The channel receiving the signals that stop a watching fsconsul, as sent by systemd or
+// launchd.  A process run with exec gets them instead, and fsconsul exits when it does.
+// Embedded, fsconsul is stopped by its caller instead, as if by SIGINT.
+func stopSignal(config *WatchConfig, child *supervisor) (<-chan os.Signal, func()) {
+	if config.done != nil {
+		stopCh := make(chan os.Signal, 1)
+		quitCh := make(chan struct{})
+		go func() {
+			select {
+			case <-config.done:
+				stopCh <- os.Interrupt
+			case <-quitCh:
+			}
+		}()
+		return stopCh, func() { close(quitCh) }
+	}
+
+	if config.RunOnce || child != nil {
+		return nil, func() {}
+	}
+
+	stopCh := make(chan os.Signal, 1)
+	return stopCh, notifyStop(stopCh)
+}
+
+// Deliver the signals that stop fsconsul to the channel, and the service control manager's
+// request to stop when running as a Windows service, until the returned function is called.
+func notifyStop(stopCh chan os.Signal) func() {
+	signal.Notify(stopCh, stopSignals...)
+
+	quitCh := make(chan struct{})
+	if serviceStop != nil {
+		go func() {
+			select {
+			case <-serviceStop:
+				select {
+				case stopCh <- os.Interrupt:
+				default:
+				}
+			case <-quitCh:
+			}
+		}()
+	}
+	return func() {
+		signal.Stop(stopCh)
+		close(quitCh)
+	}
+}
+
+// Ask every mapping and worker to stop once they've finished what they're doing, returning
+// the channel receiving when they've had long enough.
+func shutdown(config *WatchConfig, running *mappingRuns, workers []*os.Process, sig os.Signal) <-chan time.Time {
+	for _, run := range running.runs {
+		close(run.stop)
+	}
+	// Workers shut down the same way
+	for _, worker := range workers {
+		worker.Signal(sig)
+	}
+
+	timeout := time.Duration(config.ShutdownTimeout)
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return time.After(timeout)
+}
@@ -0,0 +1,48 @@
+package fsconsul
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	running := &mappingRuns{}
+	for _, name := range []string{"a", "b"} {
+		running.runs = append(running.runs, newMappingRun(&MappingConfig{Name: name}, nil))
+	}
+
+	timeoutCh := shutdown(&WatchConfig{ShutdownTimeout: Duration(10 * time.Millisecond)}, running, nil, nil)
+	for _, run := range running.runs {
+		select {
+		case <-run.stop:
+		default:
+			t.Errorf("expected %s to be asked to stop", run.config.Name)
+		}
+	}
+
+	select {
+	case <-timeoutCh:
+	case <-time.After(time.Second):
+		t.Fatal("expected the shutdown timeout to expire")
+	}
+}
+
+func TestNotifyServiceStop(t *testing.T) {
+	stop := make(chan struct{})
+	serviceStop = stop
+	defer func() { serviceStop = nil }()
+
+	stopCh := make(chan os.Signal, 1)
+	defer notifyStop(stopCh)()
+
+	close(stop)
+	select {
+	case sig := <-stopCh:
+		if sig != os.Interrupt {
+			t.Errorf("expected a service stop to be delivered as an interrupt, got %v", sig)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a service stop to be delivered")
+	}
+}
@@ -0,0 +1,139 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a source file is checked for changes when watching.
+const sourceFilePollInterval = time.Second
+
+// sourceFile serves listings from a local fixture in consul kv export format, in place of a
+// Consul cluster.  Keys changed since the file was last read are given a new ModifyIndex, so
+// the files they're written to get a new mtime just as they would from Consul.
+type sourceFile struct {
+	path       string
+	generation uint64
+	pairs      map[string]*consulapi.KVPair
+}
+
+func newSourceFile(path string) *sourceFile {
+	return &sourceFile{path: path, pairs: make(map[string]*consulapi.KVPair)}
+}
+
+func (s *sourceFile) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	loaded, err := decodeKVExport(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse source file %s: %v", s.path, err)
+	}
+
+	s.generation++
+	pairs := make(map[string]*consulapi.KVPair, len(loaded))
+	for _, pair := range loaded {
+		pair.ModifyIndex = s.generation
+		if previous, ok := s.pairs[pair.Key]; ok && previous.Flags == pair.Flags && bytes.Equal(previous.Value, pair.Value) {
+			pair.ModifyIndex = previous.ModifyIndex
+		}
+		pairs[pair.Key] = pair
+	}
+	s.pairs = pairs
+
+	return nil
+}
+
+// List the keys under prefix, sorted like a Consul listing.
+func (s *sourceFile) list(prefix string) consulapi.KVPairs {
+	var pairs consulapi.KVPairs
+	for key, pair := range s.pairs {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+// Check the wait-for key against a source file.  The file is only read once, so waiting
+// would never end: the key must be there from the start.
+func waitForSourceFile(path string, wait WaitForConfig) error {
+	source := newSourceFile(path)
+	if err := source.load(); err != nil {
+		return err
+	}
+	if !wait.satisfiedBy(source.pairs[wait.Key]) {
+		return fmt.Errorf("key %s is missing from or doesn't match in source file %s", wait.Key, path)
+	}
+	return nil
+}
+
+// Feed the render pipeline from a source file instead of watching Consul, reading it again
+// whenever it changes.  Snapshots have no index, so they're never resumed from.
+func watchSourceFile(
+	path string,
+	prefix string,
+	logger *log.Entry,
+	pairCh chan<- kvSnapshot,
+	errCh chan<- error,
+	quitCh <-chan struct{}) {
+
+	source := newSourceFile(path)
+	if err := source.load(); err != nil {
+		errCh <- err
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		errCh <- err
+		return
+	}
+	modified := info.ModTime()
+
+	select {
+	case pairCh <- kvSnapshot{source.list(prefix), 0}:
+	case <-quitCh:
+		return
+	}
+
+	ticker := time.NewTicker(sourceFilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quitCh:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+
+		// Keep the last good contents if the file is being rewritten or is broken
+		if err := source.load(); err != nil {
+			logger.WithFields(log.Fields{
+				"error": err,
+				"file":  path,
+			}).Warn("Failed to reload source file")
+			continue
+		}
+
+		select {
+		case pairCh <- kvSnapshot{source.list(prefix), 0}:
+		case <-quitCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceFileOnce(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fixture := filepath.Join(tempDir, "kv.json")
+	err = ioutil.WriteFile(fixture, []byte(`[
+		{"key": "app/db.conf", "flags": 0, "value": "aG9zdD1kYgo="},
+		{"key": "other/secret", "flags": 0, "value": "c2VjcmV0"}
+	]`), 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	target := filepath.Join(tempDir, "out") + "/"
+	config := &WatchConfig{
+		RunOnce:    true,
+		SourceFile: fixture,
+		Mappings:   []MappingConfig{{Prefix: "app/", Path: target}},
+	}
+	if code := watchAndExec(config); code != 0 {
+		t.Fatalf("expected a clean run, got %d", code)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(target, "db.conf"))
+	if err != nil || string(content) != "host=db\n" {
+		t.Fatalf("expected db.conf to be rendered from the fixture, got %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "secret")); !os.IsNotExist(err) {
+		t.Fatalf("expected keys outside the prefix to be ignored")
+	}
+}
+
+func TestSourceFileModifyIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fixture := filepath.Join(tempDir, "kv.json")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(fixture, []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	source := newSourceFile(fixture)
+	write(`[{"key": "a", "value": "MQ=="}, {"key": "b", "value": "MQ=="}]`)
+	if err := source.load(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	write(`[{"key": "a", "value": "MQ=="}, {"key": "b", "value": "Mg=="}]`)
+	if err := source.load(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pairs := source.list("")
+	if len(pairs) != 2 || pairs[0].ModifyIndex != 1 || pairs[1].ModifyIndex != 2 {
+		t.Fatalf("expected only the changed key to get a new index, got %+v %+v", pairs[0], pairs[1])
+	}
+}
@@ -0,0 +1,113 @@
+package fsconsul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StalenessConfig holds what to do when a mapping hasn't synced with Consul for too long,
+// so that consumers can tell they're running on stale configuration.
+type StalenessConfig struct {
+	// How long since the last successful sync before the mapping is stale (0 disables this)
+	Max Duration
+
+	// File created while the mapping is stale, holding the time of the last successful sync
+	Marker string
+
+	// Command run on becoming stale, with FSCONSUL_MAPPING and FSCONSUL_LAST_SYNC set
+	Command string
+}
+
+// Record that the mapping's files are in sync with Consul.
+func (run *mappingRun) synced() {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	run.lastSync = time.Now()
+	run.lastError = nil
+	run.missing = nil
+	run.notify.resolveMapping(run.config.Name)
+}
+
+// Get the time of the mapping's last successful sync, or when it started if it hasn't synced.
+func (run *mappingRun) lastSynced() time.Time {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	return run.lastSync
+}
+
+// Check how long it has been since the mapping last synced until it exits, acting once each
+// time it becomes stale.
+func watchStaleness(run *mappingRun) {
+	staleness := run.config.Staleness
+
+	interval := time.Duration(staleness.Max) / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logger := run.logger
+
+	stale := false
+	for {
+		select {
+		case <-run.done:
+			return
+		case <-ticker.C:
+		}
+
+		lastSync := run.lastSynced()
+		if time.Since(lastSync) < time.Duration(staleness.Max) {
+			if stale {
+				stale = false
+				logger.Info("Mapping is in sync again")
+				if staleness.Marker != "" {
+					os.Remove(staleness.Marker)
+				}
+			}
+			continue
+		}
+
+		if stale {
+			continue
+		}
+		stale = true
+
+		logger.WithFields(log.Fields{
+			"lastSync": lastSync,
+		}).Error("Mapping hasn't synced with Consul for too long, its files may be stale")
+		run.notify.trigger(EventUnhealthy, run.config.Name,
+			fmt.Sprintf("mapping hasn't synced with Consul since %s", lastSync.Format(time.RFC3339)))
+
+		if staleness.Marker != "" {
+			err := ioutil.WriteFile(staleness.Marker, []byte(lastSync.Format(time.RFC3339)+"\n"), 0644)
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to write stale marker")
+			}
+		}
+
+		if staleness.Command != "" {
+			args := strings.Split(staleness.Command, " ")
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Env = append(os.Environ(),
+				"FSCONSUL_MAPPING="+run.config.Name,
+				"FSCONSUL_LAST_SYNC="+lastSync.Format(time.RFC3339))
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to run stale command")
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaleMarker(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	marker := filepath.Join(tempDir, "stale")
+	run := newMappingRun(&MappingConfig{
+		Name:      "app",
+		Staleness: StalenessConfig{Max: Duration(2 * time.Second), Marker: marker},
+	}, nil)
+	defer close(run.done)
+
+	go watchStaleness(run)
+
+	// Not yet stale
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("expected no marker, got %v", err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("expected a marker once stale, got %v", err)
+	}
+
+	run.synced()
+	time.Sleep(time.Second)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("expected the marker to be removed once in sync, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package fsconsul
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mappingState is what's recorded about a mapping across restarts.
+type mappingState struct {
+	// The Consul index of the snapshot last applied, and when it was applied
+	Index   uint64
+	Applied time.Time
+
+	// A hash of the mapping's configuration it was applied with, so that a snapshot is
+	// rendered again when the configuration changes, whatever its index
+	Config string `json:",omitempty"`
+
+	// The keys of that snapshot, by name relative to the prefix
+	Keys map[string]keyState `json:",omitempty"`
+
+	// Files rendered by earlier snapshots that later ones left behind, e.g. because the
+	// mapping's path changed, with their hashes, for fsconsul gc
+	Orphans map[string]string `json:",omitempty"`
+}
+
+// keyState is what's recorded about a key of the snapshot last applied: its modify index,
+// the file rendered from it and its hash, for mappings writing a file per key, and whether
+// it was read from the mapping's fallback prefix.
+type keyState struct {
+	ModifyIndex uint64
+	File        string `json:",omitempty"`
+	Hash        string `json:",omitempty"`
+	Fallback    bool   `json:",omitempty"`
+}
+
+// The files recorded for a mapping, with their hashes: those of its keys and its orphans.
+func (state mappingState) files() map[string]string {
+	files := make(map[string]string, len(state.Keys)+len(state.Orphans))
+	for file, hash := range state.Orphans {
+		files[file] = hash
+	}
+	for _, key := range state.Keys {
+		if key.File != "" {
+			files[key.File] = key.Hash
+		}
+	}
+	return files
+}
+
+// Work out the orphans once a snapshot's keys replace the recorded ones: files recorded
+// before that the snapshot didn't render, and that are still there.
+func (state mappingState) orphansAfter(keys map[string]keyState) map[string]string {
+	rendered := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		rendered[key.File] = true
+	}
+
+	var orphans map[string]string
+	for file, hash := range state.files() {
+		if rendered[file] {
+			continue
+		}
+		if _, err := os.Lstat(file); err != nil {
+			continue
+		}
+		if orphans == nil {
+			orphans = make(map[string]string)
+		}
+		orphans[file] = hash
+	}
+	return orphans
+}
+
+// The hash of a rendered file, as recorded in the state file.
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// The hash of a mapping's configuration, as recorded in the state file.
+func configHash(mappingConfig *MappingConfig) string {
+	encoded, err := json.Marshal(mappingConfig)
+	if err != nil {
+		return ""
+	}
+	return contentHash(encoded)
+}
+
+// List the files of the recorded keys that no longer hold what was rendered to them, or
+// are gone, e.g. because they were edited while fsconsul wasn't running.  Keys recorded
+// without a hash aren't checked.
+func (state mappingState) staleFiles(mappingConfig *MappingConfig) []string {
+	var stale []string
+	for k, key := range state.Keys {
+		if key.Hash == "" {
+			continue
+		}
+		keyfile := keyfilePath(mappingConfig, k)
+		content, err := ioutil.ReadFile(keyfile)
+		if err != nil || contentHash(content) != key.Hash {
+			stale = append(stale, keyfile)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// List the keys added, changed or removed since the recorded snapshot, given the modify
+// indexes of the current one.
+func (state mappingState) changedKeys(modifyIndexes map[string]uint64) []string {
+	var changed []string
+	for k, index := range modifyIndexes {
+		if recorded, ok := state.Keys[k]; !ok || recorded.ModifyIndex != index {
+			changed = append(changed, k)
+		}
+	}
+	for k := range state.Keys {
+		if _, ok := modifyIndexes[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// stateFile persists the state of each mapping, by name, so that a restart can resume where
+// the last run left off.  Methods are safe to call on a nil stateFile.
+type stateFile struct {
+	path string
+
+	mu       sync.Mutex
+	Mappings map[string]mappingState
+}
+
+// Load the state file at path, which is empty if it doesn't exist yet.
+func loadState(path string) (*stateFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	state := &stateFile{path: path, Mappings: make(map[string]mappingState)}
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *stateFile) get(name string) mappingState {
+	if s == nil {
+		return mappingState{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Mappings[name]
+}
+
+// Record that the snapshot at index has been applied to the mapping, with its keys, or
+// keeping the keys recorded if they're nil.
+func (s *stateFile) applied(name, config string, index uint64, keys map[string]keyState) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorded := s.Mappings[name]
+	if recorded.Index == index && recorded.Config == config && (keys == nil || reflect.DeepEqual(recorded.Keys, keys)) {
+		return nil
+	}
+	orphans := recorded.Orphans
+	if keys == nil {
+		keys = recorded.Keys
+	} else {
+		orphans = recorded.orphansAfter(keys)
+	}
+	s.Mappings[name] = mappingState{Index: index, Applied: time.Now(), Config: config, Keys: keys, Orphans: orphans}
+	return s.save()
+}
+
+// Forget files of a mapping that have been removed, and the mapping itself if it has no
+// files left and isn't configured any more.
+func (s *stateFile) forget(name string, files []string, configured bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorded := s.Mappings[name]
+	for _, file := range files {
+		delete(recorded.Orphans, file)
+		for k, key := range recorded.Keys {
+			if key.File == file {
+				delete(recorded.Keys, k)
+			}
+		}
+	}
+	if !configured && len(recorded.files()) == 0 {
+		delete(s.Mappings, name)
+	} else {
+		s.Mappings[name] = recorded
+	}
+	return s.save()
+}
+
+// Write the state file, called with the lock held.
+func (s *stateFile) save() error {
+	body, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file atomically, so that a crash never leaves it truncated
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(body, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Record the index applied to the mapping in the state file, if there is one, with the
+// snapshot's keys unless they're nil.
+func (run *mappingRun) recordApplied(index uint64, keys map[string]keyState) {
+	if err := run.state.applied(run.config.Name, configHash(run.config), index, keys); err != nil {
+		run.logger.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to update state file")
+	}
+}
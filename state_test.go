@@ -0,0 +1,131 @@
+package fsconsul
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestStateFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "state.json")
+
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index := state.get("app1").Index; index != 0 {
+		t.Fatalf("expected no index before anything was applied, got %d", index)
+	}
+
+	if err := state.applied("app1", "", 42, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.applied("app2", "", 7, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A restart sees what was applied
+	reloaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index := reloaded.get("app1").Index; index != 42 {
+		t.Errorf("expected index 42, got %d", index)
+	}
+	if index := reloaded.get("app2").Index; index != 7 {
+		t.Errorf("expected index 7, got %d", index)
+	}
+
+	// Without a state file, nothing is recorded
+	var none *stateFile
+	if err := none.applied("app1", "", 1, nil); err != nil || none.get("app1").Index != 0 {
+		t.Errorf("expected a nil state file to record nothing")
+	}
+}
+
+func TestStaleFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{Path: tempDir + string(filepath.Separator)}
+	for name, content := range map[string]string{"kept": "a", "edited": "edited by hand"} {
+		if err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	state := mappingState{Index: 10, Keys: map[string]keyState{
+		"kept":    {ModifyIndex: 3, Hash: contentHash([]byte("a"))},
+		"edited":  {ModifyIndex: 4, Hash: contentHash([]byte("b"))},
+		"removed": {ModifyIndex: 5, Hash: contentHash([]byte("c"))},
+		"nohash":  {ModifyIndex: 6},
+	}}
+
+	stale := state.staleFiles(mappingConfig)
+	want := []string{filepath.Join(tempDir, "edited"), filepath.Join(tempDir, "removed")}
+	if !reflect.DeepEqual(stale, want) {
+		t.Errorf("expected %v to be stale, got %v", want, stale)
+	}
+
+	changed := state.changedKeys(map[string]uint64{"kept": 3, "edited": 9, "removed": 5, "nohash": 6, "added": 10})
+	if !reflect.DeepEqual(changed, []string{"added", "edited"}) {
+		t.Errorf("expected added and edited to have changed, got %v", changed)
+	}
+}
+
+func TestResumeConfigChanged(t *testing.T) {
+	tempDir := t.TempDir()
+	replay := filepath.Join(tempDir, "replay")
+	snapshot := kvSnapshot{consulapi.KVPairs{{Key: "app/a.conf", Value: []byte(`{{ "rendered" }}`), ModifyIndex: 42}}, 42}
+	if err := recordSnapshot(replay, "app", snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(tempDir, "out")
+	run := func(mappingConfig MappingConfig) {
+		writes := make(chan string, 10)
+		watcher := NewWatcher(WatchConfig{
+			Replay:    replay,
+			StateFile: filepath.Join(tempDir, "state.json"),
+			Mappings:  []MappingConfig{mappingConfig},
+		}, Hooks{
+			OnWrite: func(mapping, file string) { writes <- file },
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() { errCh <- watcher.Run(ctx) }()
+		select {
+		case <-writes:
+		case <-time.After(10 * time.Second):
+			t.Error("expected the snapshot to be rendered")
+		}
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Fatalf("expected a clean stop, got %v", err)
+		}
+	}
+
+	run(MappingConfig{Name: "app", Prefix: "app/", Path: target})
+
+	// The snapshot is the same, but the mapping now renders it differently
+	run(MappingConfig{Name: "app", Prefix: "app/", Path: target, Template: true})
+	if content, err := ioutil.ReadFile(filepath.Join(target, "a.conf")); err != nil || string(content) != "rendered" {
+		t.Fatalf("expected a.conf to be rendered again, got %q (%v)", content, err)
+	}
+}
@@ -0,0 +1,127 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Render (and patch) every key of a snapshot up front, for strict mappings, so that a key
+// failing to render leaves every file as it was.  On failure, the file of the failing key
+// is returned with the error.
+func prerender(mappingConfig *MappingConfig, env map[string]string) (map[string][]byte, string, error) {
+	prerendered := make(map[string][]byte, len(env))
+	for k, v := range env {
+		// Folders have no file of their own
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		keyfile := keyfilePath(mappingConfig, k)
+
+		rendered, err := renderValue(mappingConfig, k, []byte(v), env)
+		if err != nil {
+			return nil, keyfile, err
+		}
+
+		rendered, err = patchFile(mappingConfig, keyfile, rendered)
+		if err != nil {
+			return nil, keyfile, err
+		}
+
+		prerendered[k] = markManaged(mappingConfig, keyfile, rendered)
+	}
+	return prerendered, "", nil
+}
+
+// rollback keeps the files a strict mapping's snapshot writes and deletes as they were
+// before, so that a snapshot failing part way leaves every file as it was rather than half
+// applied.  Methods are safe to call on a nil rollback, kept by mappings that aren't strict.
+type rollback struct {
+	saved []savedFile
+}
+
+// savedFile is a file as it was before a snapshot touched it, without info if it didn't
+// exist.
+type savedFile struct {
+	keyfile string
+	content []byte
+	info    os.FileInfo
+}
+
+// Keep files as they are, before they're written or deleted.
+func (r *rollback) save(keyfiles ...string) error {
+	if r == nil {
+		return nil
+	}
+
+	for _, keyfile := range keyfiles {
+		info, err := os.Stat(keyfile)
+		if os.IsNotExist(err) {
+			r.saved = append(r.saved, savedFile{keyfile: keyfile})
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return err
+		}
+		r.saved = append(r.saved, savedFile{keyfile, content, info})
+	}
+	return nil
+}
+
+// Put every saved file back as it was, the last saved first, returning those that
+// couldn't be.
+func (r *rollback) undo(mappingConfig *MappingConfig) []keyFailure {
+	if r == nil {
+		return nil
+	}
+
+	var failed []keyFailure
+	for i := len(r.saved) - 1; i >= 0; i-- {
+		saved := r.saved[i]
+		if err := saved.restore(mappingConfig); err != nil {
+			failed = append(failed, keyFailure{saved.keyfile, err.Error()})
+		}
+	}
+	r.saved = nil
+	return failed
+}
+
+func (saved savedFile) restore(mappingConfig *MappingConfig) error {
+	if saved.info == nil {
+		if err := os.Remove(saved.keyfile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := makeDirs(mappingConfig, filepath.Dir(saved.keyfile)); err != nil {
+		return err
+	}
+	if err := writeKeyFile(mappingConfig, saved.keyfile, saved.content); err != nil {
+		return err
+	}
+	if err := os.Chmod(saved.keyfile, saved.info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(saved.keyfile, time.Now(), saved.info.ModTime())
+}
+
+// Mark a strict mapping unhealthy, because its snapshot couldn't be applied.
+func (run *mappingRun) failed(err error) {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	run.lastError = err
+}
+
+// Get why a strict mapping is unhealthy, or nil if it isn't.
+func (run *mappingRun) failure() error {
+	run.syncLock.Lock()
+	defer run.syncLock.Unlock()
+	return run.lastError
+}
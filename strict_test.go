@@ -0,0 +1,105 @@
+package fsconsul
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStrictMapping(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// One key renders, the other refers to a key that doesn't exist
+	fixture := filepath.Join(tempDir, "kv.json")
+	err = ioutil.WriteFile(fixture, []byte(fmt.Sprintf(`[
+		{"key": "app/good.conf", "value": %q},
+		{"key": "app/bad.conf", "value": %q}
+	]`, base64.StdEncoding.EncodeToString([]byte("good")),
+		base64.StdEncoding.EncodeToString([]byte(`{{kv "missing"}}`)))), 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	run := func(strict bool) (int, string) {
+		target := filepath.Join(tempDir, fmt.Sprintf("out-%t", strict)) + "/"
+		marker := filepath.Join(tempDir, fmt.Sprintf("changed-%t", strict))
+		config := &WatchConfig{
+			RunOnce:    true,
+			SourceFile: fixture,
+			Mappings: []MappingConfig{{
+				Prefix:      "app/",
+				Path:        target,
+				Template:    true,
+				Strict:      strict,
+				OnChangeRaw: "touch " + marker,
+			}},
+		}
+		return watchAndExec(config), target
+	}
+
+	code, target := run(true)
+	if code == 0 {
+		t.Errorf("expected a strict mapping to fail")
+	}
+	if _, err := os.Stat(filepath.Join(target, "good.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected a strict mapping to write nothing when a key fails to render")
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "changed-true")); !os.IsNotExist(err) {
+		t.Errorf("expected a strict mapping not to run onchange")
+	}
+
+	_, target = run(false)
+	if content, err := ioutil.ReadFile(filepath.Join(target, "good.conf")); err != nil || string(content) != "good" {
+		t.Errorf("expected other mappings to write the keys that render, got %q (%v)", content, err)
+	}
+}
+
+func TestStrictRollback(t *testing.T) {
+	tempDir := t.TempDir()
+	target := filepath.Join(tempDir, "out")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A file where a key needs a directory fails that key's write, after others may have
+	// been written
+	for name, content := range map[string]string{"a.conf": "old", "blocked": "not a directory"} {
+		if err := ioutil.WriteFile(filepath.Join(target, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pairs := []string{`{"key": "app/blocked/x.conf", "value": "eA=="}`}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		pairs = append(pairs, fmt.Sprintf(`{"key": "app/%s.conf", "value": %q}`, name, base64.StdEncoding.EncodeToString([]byte("new"))))
+	}
+	fixture := filepath.Join(tempDir, "kv.json")
+	if err := ioutil.WriteFile(fixture, []byte("["+strings.Join(pairs, ",")+"]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &WatchConfig{
+		RunOnce:    true,
+		SourceFile: fixture,
+		Mappings:   []MappingConfig{{Prefix: "app/", Path: target + "/", Strict: true}},
+	}
+	if code := watchAndExec(config); code == 0 {
+		t.Fatal("expected a strict mapping to fail")
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(target, "a.conf")); err != nil || string(content) != "old" {
+		t.Errorf("expected the file to be rolled back, got %q (%v)", content, err)
+	}
+	for _, name := range []string{"b", "c", "d", "e", "f"} {
+		if _, err := os.Stat(filepath.Join(target, name+".conf")); !os.IsNotExist(err) {
+			t.Errorf("expected %s.conf to be removed again, got %v", name, err)
+		}
+	}
+}
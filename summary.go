@@ -0,0 +1,282 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Formats the summary can be printed in: fsconsul's own, an Ansible module result, or a
+// Salt stateful command result.
+var summaryFormats = []string{"json", "ansible", "salt"}
+
+func validSummaryFormat(format string) bool {
+	if format == "" {
+		return true
+	}
+	for _, f := range summaryFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// runSummary is the machine readable account of a run printed by -json-summary.
+type runSummary struct {
+	Mappings []*mappingSummary `json:"mappings"`
+	Errors   []string          `json:"errors"`
+	Duration float64           `json:"durationSeconds"`
+
+	start time.Time
+}
+
+// mappingSummary records what a run did to the files of a single mapping, and passes it on
+// to the hooks of a program embedding fsconsul.  All methods are safe to call on a nil
+// summary, in which case nothing is recorded.
+type mappingSummary struct {
+	Mapping      string   `json:"mapping"`
+	Added        []string `json:"added"`
+	Updated      []string `json:"updated"`
+	Deleted      []string `json:"deleted"`
+	BytesWritten int      `json:"bytesWritten"`
+	Errors       []string `json:"errors"`
+	MissingKeys  []string `json:"missingKeys,omitempty"`
+	EmptyValues  []string `json:"emptyValues,omitempty"`
+	Index        uint64   `json:"index,omitempty"`
+	Duration     float64  `json:"durationSeconds"`
+
+	start time.Time
+
+	// Hooks to call, and whether to only call them, without a summary to print
+	hooks   *Hooks
+	discard bool
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		Mappings: []*mappingSummary{},
+		Errors:   []string{},
+		start:    time.Now(),
+	}
+}
+
+func (s *runSummary) addMapping(name string) *mappingSummary {
+	summary := &mappingSummary{
+		Mapping: name,
+		Added:   []string{},
+		Updated: []string{},
+		Deleted: []string{},
+		Errors:  []string{},
+		start:   time.Now(),
+	}
+	s.Mappings = append(s.Mappings, summary)
+	return summary
+}
+
+func (s *runSummary) addError(err error) {
+	s.Errors = append(s.Errors, err.Error())
+}
+
+func (s *runSummary) write(out io.Writer) error {
+	s.Duration = time.Since(s.start).Seconds()
+
+	body, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", body)
+	return err
+}
+
+// Print the summary in the given format.
+func (s *runSummary) writeAs(out io.Writer, format string) error {
+	switch format {
+	case "", "json":
+		return s.write(out)
+	case "ansible":
+		return s.writeAnsible(out)
+	case "salt":
+		return s.writeSalt(out)
+	}
+	return fmt.Errorf("unknown summary format %s", format)
+}
+
+// Determine whether the run changed (or, for diff, would change) any file.
+func (s *runSummary) changed() bool {
+	for _, m := range s.Mappings {
+		if len(m.Added)+len(m.Updated)+len(m.Deleted) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// List every error of the run, including those of its mappings.
+func (s *runSummary) allErrors() []string {
+	errs := append([]string{}, s.Errors...)
+	for _, m := range s.Mappings {
+		for _, err := range m.Errors {
+			errs = append(errs, m.Mapping+": "+err)
+		}
+	}
+	return errs
+}
+
+// Describe the changes in one line, e.g. "added 1, updated 2 and deleted 0 files".
+func (s *runSummary) describe() string {
+	var added, updated, deleted int
+	for _, m := range s.Mappings {
+		added += len(m.Added)
+		updated += len(m.Updated)
+		deleted += len(m.Deleted)
+	}
+	msg := fmt.Sprintf("added %d, updated %d and deleted %d files", added, updated, deleted)
+	if errs := s.allErrors(); len(errs) > 0 {
+		msg += "; " + strings.Join(errs, "; ")
+	}
+	return msg
+}
+
+// Print an Ansible module result, with the changes as a prepared diff for --diff.
+func (s *runSummary) writeAnsible(out io.Writer) error {
+	s.Duration = time.Since(s.start).Seconds()
+
+	var diff strings.Builder
+	for _, m := range s.Mappings {
+		for _, file := range m.Added {
+			diff.WriteString("+ " + file + "\n")
+		}
+		for _, file := range m.Updated {
+			diff.WriteString("~ " + file + "\n")
+		}
+		for _, file := range m.Deleted {
+			diff.WriteString("- " + file + "\n")
+		}
+	}
+
+	result := struct {
+		Changed  bool              `json:"changed"`
+		Failed   bool              `json:"failed"`
+		Msg      string            `json:"msg"`
+		Diff     map[string]string `json:"diff,omitempty"`
+		Mappings []*mappingSummary `json:"mappings"`
+		Duration float64           `json:"durationSeconds"`
+	}{
+		Changed:  s.changed(),
+		Failed:   len(s.allErrors()) > 0,
+		Msg:      s.describe(),
+		Mappings: s.Mappings,
+		Duration: s.Duration,
+	}
+	if diff.Len() > 0 {
+		result.Diff = map[string]string{"prepared": diff.String()}
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", body)
+	return err
+}
+
+// Print a Salt stateful command result, which must be the last line of output.
+func (s *runSummary) writeSalt(out io.Writer) error {
+	result := struct {
+		Changed bool     `json:"changed"`
+		Comment string   `json:"comment"`
+		Added   []string `json:"added"`
+		Updated []string `json:"updated"`
+		Deleted []string `json:"deleted"`
+	}{
+		Changed: s.changed(),
+		Comment: s.describe(),
+		Added:   []string{},
+		Updated: []string{},
+		Deleted: []string{},
+	}
+	for _, m := range s.Mappings {
+		result.Added = append(result.Added, m.Added...)
+		result.Updated = append(result.Updated, m.Updated...)
+		result.Deleted = append(result.Deleted, m.Deleted...)
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", body)
+	return err
+}
+
+func (s *mappingSummary) wrote(file string, existed bool, length int) {
+	if s == nil {
+		return
+	}
+	s.hooks.wrote(s.Mapping, file)
+	if s.discard {
+		return
+	}
+
+	if existed {
+		s.Updated = append(s.Updated, file)
+	} else {
+		s.Added = append(s.Added, file)
+	}
+	s.BytesWritten += length
+}
+
+func (s *mappingSummary) deleted(file string) {
+	if s == nil {
+		return
+	}
+	s.hooks.deleted(s.Mapping, file)
+	if !s.discard {
+		s.Deleted = append(s.Deleted, file)
+	}
+}
+
+func (s *mappingSummary) addError(file string, err error) {
+	if s == nil {
+		return
+	}
+	s.hooks.failed(s.Mapping, file, err)
+	if s.discard {
+		return
+	}
+
+	if file == "" {
+		s.Errors = append(s.Errors, err.Error())
+	} else {
+		s.Errors = append(s.Errors, fmt.Sprintf("%s: %v", file, err))
+	}
+}
+
+func (s *mappingSummary) missingKeys(keys []string) {
+	if s != nil {
+		s.MissingKeys = keys
+	}
+}
+
+func (s *mappingSummary) emptyValues(keys []string) {
+	if s != nil {
+		s.EmptyValues = keys
+	}
+}
+
+// Record the Consul index of the snapshot the mapping's files reflect.
+func (s *mappingSummary) applied(index uint64) {
+	if s != nil {
+		s.Index = index
+	}
+}
+
+func (s *mappingSummary) finish() {
+	if s != nil {
+		s.Duration = time.Since(s.start).Seconds()
+	}
+}
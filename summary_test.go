@@ -0,0 +1,57 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSummaryFormats(t *testing.T) {
+	summary := newRunSummary()
+	perMapping := summary.addMapping("app")
+	perMapping.wrote("/etc/app/new.conf", false, 10)
+	perMapping.wrote("/etc/app/db.conf", true, 20)
+
+	var out bytes.Buffer
+	if err := summary.writeAs(&out, "ansible"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var ansible struct {
+		Changed bool
+		Failed  bool
+		Msg     string
+		Diff    struct{ Prepared string }
+	}
+	if err := json.Unmarshal(out.Bytes(), &ansible); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ansible.Changed || ansible.Failed || ansible.Diff.Prepared != "+ /etc/app/new.conf\n~ /etc/app/db.conf\n" {
+		t.Errorf("unexpected ansible result %+v", ansible)
+	}
+
+	// Salt reads the result from the last line of output
+	perMapping.addError("/etc/app/db.conf", fmt.Errorf("denied"))
+	out.Reset()
+	if err := summary.writeAs(&out, "salt"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Fatalf("expected a single line, got %q", out.String())
+	}
+	var salt struct {
+		Changed bool
+		Comment string
+	}
+	if err := json.Unmarshal(out.Bytes(), &salt); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !salt.Changed || salt.Comment != "added 1, updated 1 and deleted 0 files; app: /etc/app/db.conf: denied" {
+		t.Errorf("unexpected salt result %+v", salt)
+	}
+
+	if validSummaryFormat("yaml") {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
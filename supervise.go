@@ -0,0 +1,352 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a child is given to stop before it's killed, unless configured otherwise.
+const defaultKillTimeout = 30 * time.Second
+
+// ExecConfig holds the configuration of a long-lived child process run by fsconsul once
+// every mapping has rendered, and signalled whenever their files change.
+type ExecConfig struct {
+	Command string
+
+	// Signal sent to the child when files change, e.g. HUP (the default) or USR1, or
+	// "restart" to stop it and start it again
+	ReloadSignal string
+
+	// Signal sent to stop the child (TERM by default), and how long it has to exit before
+	// it's killed
+	KillSignal  string
+	KillTimeout Duration
+}
+
+// supervisor runs the child process.  Methods are safe to call on a nil supervisor.
+type supervisor struct {
+	config ExecConfig
+	args   []string
+
+	reload os.Signal // nil to restart
+	kill   os.Signal
+
+	// Changes not yet acted on: signals to send the child, or a restart, which supersedes
+	// them.  changes receives when there are some.
+	pendingLock    sync.Mutex
+	pendingSignals []os.Signal
+	pendingRestart bool
+	changes        chan struct{}
+
+	exited chan int // receives the child's exit code when it exits by itself
+
+	// Variables the mappings with execenv set in the child's environment, by mapping
+	envLock sync.Mutex
+	env     map[string]map[string]string
+}
+
+func newSupervisor(config ExecConfig) (*supervisor, error) {
+	if config.Command == "" {
+		return nil, nil
+	}
+
+	s := &supervisor{
+		config:  config,
+		args:    strings.Split(config.Command, " "),
+		changes: make(chan struct{}, 1),
+		exited:  make(chan int, 1),
+	}
+
+	var err error
+	if s.kill, err = parseSignal(config.KillSignal, "TERM"); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(config.ReloadSignal, "restart") {
+		if s.reload, err = parseSignal(config.ReloadSignal, "HUP"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Tell the supervisor files have changed, so that the child is reloaded as configured.
+// Changes made while a reload is pending are folded into it.
+func (s *supervisor) changed() {
+	if s == nil {
+		return
+	}
+	s.changedWith(s.reload)
+}
+
+// Tell the supervisor files have changed, asking for the child to be sent the signal, or
+// restarted if it's nil.
+func (s *supervisor) changedWith(sig os.Signal) {
+	if s == nil {
+		return
+	}
+
+	s.pendingLock.Lock()
+	if sig == nil {
+		s.pendingRestart = true
+	} else {
+		found := false
+		for _, pending := range s.pendingSignals {
+			if pending == sig {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.pendingSignals = append(s.pendingSignals, sig)
+		}
+	}
+	s.pendingLock.Unlock()
+
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Take the changes not yet acted on.
+func (s *supervisor) pending() ([]os.Signal, bool) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	sigs, restart := s.pendingSignals, s.pendingRestart
+	s.pendingSignals, s.pendingRestart = nil, false
+	return sigs, restart
+}
+
+// Set the variables a mapping puts in the child's environment.  As a running process's
+// environment can't be changed, the child is restarted if they differ from those it has,
+// other than FSCONSUL_INDEX.  Returns whether they did.
+func (s *supervisor) setEnv(mapping string, vars map[string]string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.envLock.Lock()
+	old, ok := s.env[mapping]
+	same := ok && len(old) == len(vars)
+	for name, value := range vars {
+		// The index alone changing doesn't change what the child reads, so the index
+		// it has still describes it
+		if name == indexEnvVar {
+			continue
+		}
+		if current, ok := old[name]; !ok || current != value {
+			same = false
+			break
+		}
+	}
+	if !same {
+		if s.env == nil {
+			s.env = make(map[string]map[string]string)
+		}
+		s.env[mapping] = vars
+	}
+	s.envLock.Unlock()
+
+	if !same {
+		s.changedWith(nil)
+	}
+	return !same
+}
+
+// The child's environment: fsconsul's own, then the mappings' variables, in the order of
+// the mappings' names, so that a later mapping's variable takes the place of an earlier
+// one's.  Nil if no mapping sets any, for fsconsul's environment alone.
+func (s *supervisor) environ() []string {
+	s.envLock.Lock()
+	defer s.envLock.Unlock()
+	if len(s.env) == 0 {
+		return nil
+	}
+
+	mappings := make([]string, 0, len(s.env))
+	for mapping := range s.env {
+		mappings = append(mappings, mapping)
+	}
+	sort.Strings(mappings)
+
+	merged := make(map[string]string)
+	for _, mapping := range mappings {
+		for name, value := range s.env[mapping] {
+			merged[name] = value
+		}
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	environ := os.Environ()
+	for _, name := range names {
+		environ = append(environ, name+"="+merged[name])
+	}
+	return environ
+}
+
+// The channel receiving the child's exit code, or nil without a supervisor.
+func (s *supervisor) exit() <-chan int {
+	if s == nil {
+		return nil
+	}
+	return s.exited
+}
+
+// Start the child once every mapping has rendered, then reload it on changes, passing on
+// the signals that would stop fsconsul.  Returns once the child has exited by itself.
+func (s *supervisor) run(runs []*mappingRun) {
+	for _, run := range runs {
+		select {
+		case <-run.rendered:
+		case <-run.done:
+		}
+	}
+
+	// Changes up to now are already in the files the child starts with
+	select {
+	case <-s.changes:
+	default:
+	}
+	s.pending()
+
+	stopCh := make(chan os.Signal, 1)
+	defer notifyStop(stopCh)()
+
+	cmd, waitCh, err := s.start()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"command": s.config.Command,
+		}).Error("Failed to start child process")
+		s.exited <- 1
+		return
+	}
+
+	for {
+		select {
+		case err := <-waitCh:
+			code := exitCode(err)
+			log.WithFields(log.Fields{
+				"code": code,
+				"pid":  cmd.Process.Pid,
+			}).Info("Child process exited")
+			s.exited <- code
+			return
+
+		case sig := <-stopCh:
+			// Stop the child, then exit with its code
+			log.WithFields(log.Fields{
+				"signal": sig,
+			}).Info("Stopping child process")
+			if err := cmd.Process.Signal(sig); err != nil {
+				cmd.Process.Kill()
+			}
+
+		case <-s.changes:
+			sigs, restart := s.pending()
+			if !restart {
+				for _, sig := range sigs {
+					log.WithFields(log.Fields{
+						"signal": sig,
+						"pid":    cmd.Process.Pid,
+					}).Info("Files changed, signalling child process")
+					if err := cmd.Process.Signal(sig); err != nil {
+						log.WithFields(log.Fields{
+							"error": err,
+						}).Error("Failed to signal child process")
+					}
+				}
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"pid": cmd.Process.Pid,
+			}).Info("Files changed, restarting child process")
+			s.stop(cmd, waitCh)
+			if cmd, waitCh, err = s.start(); err != nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"command": s.config.Command,
+				}).Error("Failed to restart child process")
+				s.exited <- 1
+				return
+			}
+		}
+	}
+}
+
+func (s *supervisor) start() (*exec.Cmd, <-chan error, error) {
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = s.environ()
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"command": s.config.Command,
+		"pid":     cmd.Process.Pid,
+	}).Info("Started child process")
+
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- cmd.Wait() }()
+	return cmd, waitCh, nil
+}
+
+// Send the child the kill signal, killing it if it hasn't exited in time.
+func (s *supervisor) stop(cmd *exec.Cmd, waitCh <-chan error) {
+	timeout := time.Duration(s.config.KillTimeout)
+	if timeout <= 0 {
+		timeout = defaultKillTimeout
+	}
+
+	if err := cmd.Process.Signal(s.kill); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-waitCh:
+	case <-time.After(timeout):
+		log.WithFields(log.Fields{
+			"pid":     cmd.Process.Pid,
+			"timeout": timeout,
+		}).Warn("Child process didn't stop in time, killing it")
+		cmd.Process.Kill()
+		<-waitCh
+	}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+func parseSignal(name, fallback string) (os.Signal, error) {
+	if name == "" {
+		name = fallback
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %s", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuperviseChild(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fixture := filepath.Join(tempDir, "kv.json")
+	if err := ioutil.WriteFile(fixture, []byte(`[{"key": "app/a", "value": "MQ=="}]`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The child records that it started, and exits when reloaded
+	log := filepath.Join(tempDir, "child.log")
+	script := filepath.Join(tempDir, "child.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+trap 'echo reloaded >> `+log+`; exit 3' HUP
+echo started >> `+log+`
+while true; do sleep 0.1; done
+`), 0755)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config := &WatchConfig{
+		SourceFile: fixture,
+		Exec:       ExecConfig{Command: script},
+		Mappings:   []MappingConfig{{Prefix: "app/", Path: filepath.Join(tempDir, "out")}},
+	}
+	codes := make(chan int, 1)
+	go func() { codes <- watchAndExec(config) }()
+
+	waitFor := func(want string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if content, _ := ioutil.ReadFile(log); strings.Contains(string(content), want) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("child never %s", want)
+	}
+	waitFor("started")
+
+	if err := ioutil.WriteFile(fixture, []byte(`[{"key": "app/a", "value": "Mg=="}]`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fixture, later, later)
+	waitFor("reloaded")
+
+	select {
+	case code := <-codes:
+		if code != 3 {
+			t.Fatalf("expected fsconsul to exit with the child's code, got %d", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("fsconsul didn't exit with the child")
+	}
+}
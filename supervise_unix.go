@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package fsconsul
+
+import (
+	"os"
+	"syscall"
+)
+
+var signals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// The signals that stop fsconsul, and are passed on to a child process to stop it.
+var stopSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
@@ -0,0 +1,14 @@
+package fsconsul
+
+import (
+	"os"
+)
+
+// Windows processes can only be killed, so children are restarted rather than signalled.
+var signals = map[string]os.Signal{
+	"KILL": os.Kill,
+	"TERM": os.Kill,
+}
+
+// The signals that stop fsconsul, and are passed on to a child process to stop it.
+var stopSignals = []os.Signal{os.Interrupt}
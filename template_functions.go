@@ -1,11 +1,40 @@
-package main
+package fsconsul
 
 import (
 	"encoding/base64"
 	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
 	gosecret "github.com/cimpress-mcp/gosecret/api"
 )
 
+// How deeply templates may include other keys.
+const maxIncludeDepth = 10
+
+// The functions available to templates rendered for a mapping: sprig's, plus our own.
+func templateFuncs(mappingConfig *MappingConfig, env map[string]string, chain []string) template.FuncMap {
+	funcs := sprigFuncs()
+	funcs["kv"] = kvFunc(mappingConfig, env)
+	funcs["include"] = includeFunc(mappingConfig, env, chain)
+
+	if len(mappingConfig.Keystore) > 0 {
+		funcs["goDecrypt"] = goDecryptFunc(mappingConfig.keystores())
+	}
+
+	return funcs
+}
+
+// The sprig function library, without the functions reading fsconsul's own environment:
+// templates come from Consul, and shouldn't be able to read the token fsconsul was given.
+func sprigFuncs() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	delete(funcs, "env")
+	delete(funcs, "expandenv")
+	return funcs
+}
+
 func goEncryptFunc(keystore string) func(...string) (string, error) {
 	return func(s ...string) (string, error) {
 		dt, err := gosecret.ParseEncrytionTag(keystore, s...)
@@ -22,9 +51,18 @@ func goEncryptFunc(keystore string) func(...string) (string, error) {
 	}
 }
 
-func goDecryptFunc(keystore string) func(...string) (string, error) {
+func goDecryptFunc(keystores []string) func(...string) (string, error) {
 	return func(s ...string) (string, error) {
-		plaintext, err := gosecret.ParseDecryptionTag(keystore, s...)
+		var keyNames []string
+		if len(s) > 0 {
+			keyNames = s[len(s)-1:]
+		}
+		dir, err := keystoreWith(keystores, keyNames)
+		if err != nil {
+			return "", err
+		}
+
+		plaintext, err := gosecret.ParseDecryptionTag(dir, s...)
 		if err != nil {
 			fmt.Println("Unable to parse encryption tag", err)
 			return "", err
@@ -33,3 +71,44 @@ func goDecryptFunc(keystore string) func(...string) (string, error) {
 		return fmt.Sprintf("%s", plaintext), nil
 	}
 }
+
+// Look up the raw value of another key in the snapshot being rendered, relative to the
+// mapping's prefix.  This never calls out to Consul.
+func kvFunc(mappingConfig *MappingConfig, env map[string]string) func(string) (string, error) {
+	return func(key string) (string, error) {
+		value, ok := env[relativeKey(mappingConfig, key)]
+		if !ok {
+			return "", fmt.Errorf("key %s not found under %s", key, mappingConfig.Prefix)
+		}
+
+		return value, nil
+	}
+}
+
+// Render the value of another key in the snapshot (relative to the mapping's prefix) as a
+// template in its own right, e.g. a partial shared by many files.  Keys can't include
+// themselves, directly or indirectly, and includes can only be nested so deep.
+func includeFunc(mappingConfig *MappingConfig, env map[string]string, chain []string) func(string) (string, error) {
+	return func(key string) (string, error) {
+		key = relativeKey(mappingConfig, key)
+		for _, including := range chain {
+			if including == key {
+				return "", fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), key)
+			}
+		}
+		if len(chain) > maxIncludeDepth {
+			return "", fmt.Errorf("includes nested more than %d deep: %s", maxIncludeDepth, strings.Join(chain, " -> "))
+		}
+
+		value, ok := env[key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found under %s", key, mappingConfig.Prefix)
+		}
+
+		rendered, err := renderTemplate(mappingConfig, []byte(value), env, append(chain[:len(chain):len(chain)], key))
+		if err != nil {
+			return "", fmt.Errorf("failed to include %s: %v", key, err)
+		}
+		return string(rendered), nil
+	}
+}
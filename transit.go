@@ -0,0 +1,100 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// The most decrypted values kept per Vault, before the cache is emptied.
+const maxTransitCache = 10000
+
+// A value encrypted with Vault's transit engine, e.g. vault:v1:8SDd3WHDOjf7mq69...
+var transitCiphertext = regexp.MustCompile(`^vault:v\d+:[A-Za-z0-9+/]+=*$`)
+
+// TransitConfig holds how values encrypted with Vault's transit engine are decrypted.
+type TransitConfig struct {
+	// The name of the encryption key
+	Key string
+
+	// The path the transit engine is mounted at (transit by default)
+	Mount string
+
+	// The Vault to decrypt with, the top-level one by default
+	Vault *VaultConfig
+}
+
+var (
+	transitCacheLock sync.Mutex
+	transitCache     = make(map[*vaultClient]map[string][]byte)
+)
+
+// Decrypt a value if it's a transit ciphertext, returning it unchanged otherwise.  Decrypted
+// values are cached, so that unchanged ciphertexts aren't sent to Vault with every snapshot.
+func decryptTransit(transit TransitConfig, value []byte) ([]byte, error) {
+	ciphertext := string(bytes.TrimSpace(value))
+	if !transitCiphertext.MatchString(ciphertext) {
+		return value, nil
+	}
+
+	var vaultConfig VaultConfig
+	if transit.Vault != nil {
+		vaultConfig = *transit.Vault
+	}
+	client, err := vaultFor(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	transitCacheLock.Lock()
+	cached, ok := transitCache[client][transit.Key+"\x00"+ciphertext]
+	transitCacheLock.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	plaintext, err := client.decrypt(transit, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	transitCacheLock.Lock()
+	defer transitCacheLock.Unlock()
+	if len(transitCache[client]) >= maxTransitCache || transitCache[client] == nil {
+		transitCache[client] = make(map[string][]byte)
+	}
+	transitCache[client][transit.Key+"\x00"+ciphertext] = plaintext
+	return plaintext, nil
+}
+
+func (c *vaultClient) decrypt(transit TransitConfig, ciphertext string) ([]byte, error) {
+	token, err := c.currentToken()
+	if err != nil {
+		return nil, err
+	}
+
+	mount := transit.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+	resp, err := c.request("POST", mount+"/decrypt/"+transit.Key, token, map[string]string{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("transit key %s not found", transit.Key)
+	}
+	var decrypted struct {
+		Plaintext string
+	}
+	if err := json.Unmarshal(resp.Data, &decrypted); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(decrypted.Plaintext)
+}
@@ -0,0 +1,54 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransitDecryption(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/token/lookup-self" {
+			w.Write([]byte(`{"data": {"ttl": 0, "renewable": false}}`))
+			return
+		}
+		requests++
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path != "/v1/transit/decrypt/app1" || r.Header.Get("X-Vault-Token") != "s.token" || body["ciphertext"] != "vault:v1:c2VjcmV0" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors": ["invalid ciphertext"]}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"plaintext": "aHVudGVyMg=="}}`))
+	}))
+	defer server.Close()
+
+	mappingConfig := &MappingConfig{Transit: TransitConfig{Key: "app1", Vault: &VaultConfig{Addr: server.URL, Token: "s.token"}}}
+
+	for i := 0; i < 2; i++ {
+		rendered, err := renderValue(mappingConfig, "db/password", []byte("vault:v1:c2VjcmV0\n"), nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(rendered) != "hunter2" {
+			t.Errorf("expected the value to be decrypted, got %q", rendered)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the decrypted value to be cached, got %d requests", requests)
+	}
+
+	// Values that aren't ciphertexts are left alone
+	rendered, err := renderValue(mappingConfig, "db/host", []byte("db.example.com"), nil)
+	if err != nil || string(rendered) != "db.example.com" {
+		t.Errorf("expected a plain value to be left alone, got %q (%v)", rendered, err)
+	}
+
+	_, err = renderValue(mappingConfig, "db/other", []byte("vault:v1:b3RoZXI="), nil)
+	if !isDecryptionError(err) {
+		t.Errorf("expected a decryption error, got %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package fsconsul
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often Vault is polled for changes, unless configured otherwise.  Vault has no
+// blocking queries to watch with.
+const defaultVaultPollInterval = time.Minute
+
+// VaultConfig holds the configuration for reading mappings from a Vault KV v2 secrets engine.
+type VaultConfig struct {
+	// Defaults to VAULT_ADDR
+	Addr      string
+	Namespace string
+	CAFile    string
+
+	// The path the KV v2 engine is mounted at (secret by default)
+	Mount string
+
+	// Defaults to VAULT_TOKEN, unless logging in with AppRole
+	Token string
+
+	// Log in with AppRole instead of using a token
+	AppRole AppRoleConfig
+
+	PollInterval Duration
+}
+
+// AppRoleConfig holds the credentials for logging in to Vault's AppRole auth method.
+type AppRoleConfig struct {
+	RoleID       string
+	SecretID     string
+	SecretIDFile string
+
+	// The path the auth method is mounted at (approle by default)
+	Mount string
+}
+
+// vaultClient reads secrets from Vault, renewing its token (or logging in again) before it
+// expires.  Clients are shared by every mapping reading from the same Vault.
+type vaultClient struct {
+	config VaultConfig
+	http   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	renewable bool
+	renewAt   time.Time
+	expires   time.Time
+
+	// Whether a static token has been looked up, to learn when it expires
+	lookedUp bool
+}
+
+var (
+	vaultsLock sync.Mutex
+	vaults     = make(map[string]*vaultClient)
+)
+
+func vaultFor(vaultConfig VaultConfig) (*vaultClient, error) {
+	if vaultConfig.Addr == "" {
+		vaultConfig.Addr = os.Getenv("VAULT_ADDR")
+	}
+	if vaultConfig.Addr == "" {
+		return nil, fmt.Errorf("vault mappings need a vault addr (or VAULT_ADDR)")
+	}
+	vaultConfig.Addr = strings.TrimSuffix(vaultConfig.Addr, "/")
+	if vaultConfig.Mount == "" {
+		vaultConfig.Mount = "secret"
+	}
+	if vaultConfig.AppRole.Mount == "" {
+		vaultConfig.AppRole.Mount = "approle"
+	}
+	if vaultConfig.Token == "" && vaultConfig.AppRole.RoleID == "" {
+		vaultConfig.Token = os.Getenv("VAULT_TOKEN")
+	}
+
+	vaultsLock.Lock()
+	defer vaultsLock.Unlock()
+
+	key := strings.Join([]string{vaultConfig.Addr, vaultConfig.Namespace, vaultConfig.AppRole.RoleID}, "\x00")
+	if client, ok := vaults[key]; ok {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if vaultConfig.CAFile != "" {
+		certPool := x509.NewCertPool()
+		if data, err := ioutil.ReadFile(vaultConfig.CAFile); err != nil {
+			return nil, err
+		} else if !certPool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("Invalid certificate file: %s", vaultConfig.CAFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	client := &vaultClient{
+		config: vaultConfig,
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+		token: vaultConfig.Token,
+	}
+	vaults[key] = client
+	return client, nil
+}
+
+// vaultResponse is the envelope of Vault API responses.
+type vaultResponse struct {
+	Data json.RawMessage
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool
+	}
+	Errors []string
+}
+
+// Make a request to the Vault API, returning nil data if the path doesn't exist.
+func (c *vaultClient) request(method, path, token string, body interface{}) (*vaultResponse, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.config.Addr+"/v1/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.config.Namespace)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var decoded vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil && resp.StatusCode != http.StatusNoContent {
+		if resp.StatusCode == http.StatusNotFound {
+			return &decoded, nil
+		}
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotFound && len(decoded.Errors) == 0 {
+		return &decoded, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(decoded.Errors, "; "))
+	}
+	return &decoded, nil
+}
+
+// Get a token to read secrets with, renewing it or logging in again as it nears expiry.
+func (c *vaultClient) currentToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A static token's lease is only known by asking Vault about it
+	if c.token != "" && c.config.AppRole.RoleID == "" && !c.lookedUp {
+		c.lookedUp = true
+		if err := c.lookup(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Failed to look up Vault token, it won't be renewed")
+		}
+	}
+
+	if c.token != "" && (c.renewAt.IsZero() || time.Now().Before(c.renewAt)) {
+		return c.token, nil
+	}
+
+	if c.token != "" && c.renewable {
+		err := c.renew()
+		if err == nil {
+			return c.token, nil
+		}
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to renew Vault token")
+	}
+
+	if c.config.AppRole.RoleID == "" {
+		// A static token can't be replaced, so keep using it until Vault refuses it
+		return c.token, nil
+	}
+
+	if err := c.login(); err != nil {
+		if c.token != "" && time.Now().Before(c.expires) {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"expires": c.expires,
+			}).Warn("Failed to log in to Vault, using the current token")
+			return c.token, nil
+		}
+		return "", err
+	}
+	return c.token, nil
+}
+
+func (c *vaultClient) login() error {
+	appRole := c.config.AppRole
+
+	secretID := appRole.SecretID
+	if appRole.SecretIDFile != "" {
+		data, err := ioutil.ReadFile(appRole.SecretIDFile)
+		if err != nil {
+			return err
+		}
+		secretID = strings.TrimSpace(string(data))
+	}
+
+	resp, err := c.request("POST", "auth/"+appRole.Mount+"/login", "", map[string]string{
+		"role_id":   appRole.RoleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log in to vault: %v", err)
+	}
+	if resp.Auth == nil {
+		return fmt.Errorf("failed to log in to vault: no token returned")
+	}
+
+	c.setToken(resp)
+	log.WithFields(log.Fields{
+		"expires": c.expires,
+	}).Info("Logged in to Vault")
+	return nil
+}
+
+func (c *vaultClient) renew() error {
+	resp, err := c.request("POST", "auth/token/renew-self", c.token, map[string]string{})
+	if err != nil {
+		return err
+	}
+	if resp.Auth == nil {
+		return fmt.Errorf("no token returned")
+	}
+
+	c.setToken(resp)
+	log.WithFields(log.Fields{
+		"expires": c.expires,
+	}).Debug("Renewed Vault token")
+	return nil
+}
+
+// Look up a static token, so that it's renewed before it expires like one from logging in.
+func (c *vaultClient) lookup() error {
+	resp, err := c.request("GET", "auth/token/lookup-self", c.token, nil)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		TTL       int
+		Renewable bool
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return fmt.Errorf("failed to decode token: %v", err)
+	}
+
+	c.setLease(data.TTL, data.Renewable)
+	log.WithFields(log.Fields{
+		"expires":   c.expires,
+		"renewable": c.renewable,
+	}).Debug("Looked up Vault token")
+	return nil
+}
+
+func (c *vaultClient) setToken(resp *vaultResponse) {
+	c.token = resp.Auth.ClientToken
+	c.setLease(resp.Auth.LeaseDuration, resp.Auth.Renewable)
+}
+
+// Set when the token expires, from its lease in seconds (0 if it never expires).
+func (c *vaultClient) setLease(seconds int, renewable bool) {
+	c.renewable = renewable
+	c.renewAt, c.expires = time.Time{}, time.Time{}
+	if seconds > 0 {
+		// Renew with a third of the lease to spare
+		lease := time.Duration(seconds) * time.Second
+		c.expires = time.Now().Add(lease)
+		c.renewAt = time.Now().Add(lease * 2 / 3)
+	}
+}
+
+// List every secret under path, returning each field of each secret as a pair keyed by the
+// secret's path and the field's name, and versioned by the secret's version.
+func (c *vaultClient) list(path string) (consulapi.KVPairs, error) {
+	token, err := c.currentToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs consulapi.KVPairs
+	if err := c.walk(token, strings.Trim(path, "/"), &pairs); err != nil {
+		return nil, err
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
+
+func (c *vaultClient) walk(token, path string, pairs *consulapi.KVPairs) error {
+	resp, err := c.request("LIST", c.config.Mount+"/metadata/"+path, token, nil)
+	if err != nil {
+		return err
+	}
+
+	var listing struct {
+		Keys []string
+	}
+	if len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, &listing); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range listing.Keys {
+		child := strings.TrimPrefix(path+"/"+name, "/")
+		if strings.HasSuffix(name, "/") {
+			if err := c.walk(token, strings.TrimSuffix(child, "/"), pairs); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.read(token, child, pairs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *vaultClient) read(token, path string, pairs *consulapi.KVPairs) error {
+	resp, err := c.request("GET", c.config.Mount+"/data/"+path, token, nil)
+	if err != nil {
+		return err
+	}
+	if len(resp.Data) == 0 {
+		// Deleted since it was listed
+		return nil
+	}
+
+	var secret struct {
+		Data     map[string]interface{}
+		Metadata struct {
+			Version uint64
+		}
+	}
+	if err := json.Unmarshal(resp.Data, &secret); err != nil {
+		return err
+	}
+
+	for field, value := range secret.Data {
+		var data []byte
+		if s, ok := value.(string); ok {
+			data = []byte(s)
+		} else if data, err = json.Marshal(value); err != nil {
+			return err
+		}
+		*pairs = append(*pairs, &consulapi.KVPair{
+			Key:         path + "/" + field,
+			Value:       data,
+			ModifyIndex: secret.Metadata.Version,
+		})
+	}
+	return nil
+}
+
+// Feed the render pipeline from a Vault KV v2 path, polling it for changes.  Snapshots have
+// no index, so they're never resumed from.
+func watchVault(
+	client *vaultClient,
+	path string,
+	conn *connectivity,
+	logger *log.Entry,
+	pairCh chan<- kvSnapshot,
+	errCh chan<- error,
+	quitCh <-chan struct{}) {
+
+	interval := time.Duration(client.config.PollInterval)
+	if interval <= 0 {
+		interval = defaultVaultPollInterval
+	}
+
+	// Fail fast if the initial listing fails, as with Consul
+	pairs, err := client.list(path)
+	if err != nil {
+		errCh <- err
+		return
+	}
+	conn.succeeded()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case pairCh <- kvSnapshot{pairs, 0}:
+		case <-quitCh:
+			return
+		}
+
+		for {
+			select {
+			case <-quitCh:
+				return
+			case <-ticker.C:
+			}
+
+			if pairs, err = client.list(path); err == nil {
+				conn.succeeded()
+				break
+			}
+			entry := logger.WithFields(log.Fields{
+				"error": err,
+				"path":  path,
+			})
+			if conn.failed() {
+				entry.Debug("Failed to read from Vault")
+			} else {
+				entry.Warn("Failed to read from Vault")
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package fsconsul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Serve a KV v2 engine holding app/db and app/nested/cache, behind AppRole auth.  The token
+// has a minute's lease, renewed for an hour.
+func newVaultServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := func(body string) { w.Write([]byte(body)) }
+
+		if r.URL.Path == "/v1/auth/approle/login" {
+			var login map[string]string
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["role_id"] != "role" || login["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				reply(`{"errors": ["invalid role or secret ID"]}`)
+				return
+			}
+			reply(`{"auth": {"client_token": "s.token", "lease_duration": 3600, "renewable": true}}`)
+			return
+		}
+
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			reply(`{"errors": ["permission denied"]}`)
+			return
+		}
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/auth/token/lookup-self":
+			reply(`{"data": {"ttl": 60, "renewable": true}}`)
+		case "POST /v1/auth/token/renew-self":
+			reply(`{"auth": {"client_token": "s.token", "lease_duration": 3600, "renewable": true}}`)
+		case "LIST /v1/secret/metadata/app":
+			reply(`{"data": {"keys": ["db", "nested/"]}}`)
+		case "LIST /v1/secret/metadata/app/nested":
+			reply(`{"data": {"keys": ["cache"]}}`)
+		case "GET /v1/secret/data/app/db":
+			reply(`{"data": {"data": {"password": "hunter2", "port": 5432}, "metadata": {"version": 3}}}`)
+		case "GET /v1/secret/data/app/nested/cache":
+			reply(`{"data": {"data": {"url": "redis://cache"}, "metadata": {"version": 1}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			reply(`{"errors": []}`)
+		}
+	}))
+}
+
+func TestVaultList(t *testing.T) {
+	server := newVaultServer(t)
+	defer server.Close()
+
+	client, err := vaultFor(VaultConfig{Addr: server.URL, AppRole: AppRoleConfig{RoleID: "role", SecretID: "secret"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pairs, err := client.list("app/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := map[string]struct {
+		value   string
+		version uint64
+	}{
+		"app/db/password":      {"hunter2", 3},
+		"app/db/port":          {"5432", 3},
+		"app/nested/cache/url": {"redis://cache", 1},
+	}
+	if len(pairs) != len(expected) {
+		t.Fatalf("expected %d pairs, got %d", len(expected), len(pairs))
+	}
+	for _, pair := range pairs {
+		if e := expected[pair.Key]; string(pair.Value) != e.value || pair.ModifyIndex != e.version {
+			t.Fatalf("unexpected pair %s=%q at version %d", pair.Key, pair.Value, pair.ModifyIndex)
+		}
+	}
+
+	// A missing path is empty rather than an error
+	if pairs, err = client.list("missing"); err != nil || len(pairs) != 0 {
+		t.Fatalf("expected no pairs for a missing path, got %v (%v)", pairs, err)
+	}
+}
+
+func TestVaultBadLogin(t *testing.T) {
+	server := newVaultServer(t)
+	defer server.Close()
+
+	client, err := vaultFor(VaultConfig{Addr: server.URL, AppRole: AppRoleConfig{RoleID: "role", SecretID: "wrong"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.list("app"); err == nil {
+		t.Fatal("expected a failed login to fail the listing")
+	}
+}
+
+func TestVaultStaticTokenRenewal(t *testing.T) {
+	server := newVaultServer(t)
+	defer server.Close()
+
+	client, err := vaultFor(VaultConfig{Addr: server.URL, Token: "s.token"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.list("app/"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !client.renewable || time.Until(client.expires) > time.Minute {
+		t.Fatalf("expected the token's lease to be looked up, got renewable %v expiring %s", client.renewable, client.expires)
+	}
+
+	// Nearing expiry, the token is renewed rather than used until Vault refuses it
+	client.renewAt = time.Now().Add(-time.Second)
+	if _, err := client.list("app/"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Until(client.expires) < 59*time.Minute {
+		t.Fatalf("expected the token to be renewed, expiring %s", client.expires)
+	}
+}
+
+func TestVaultOnce(t *testing.T) {
+	server := newVaultServer(t)
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	secretIDFile := filepath.Join(tempDir, "secret-id")
+	if err := ioutil.WriteFile(secretIDFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	target := filepath.Join(tempDir, "out") + "/"
+	config := &WatchConfig{
+		RunOnce: true,
+		Vault: VaultConfig{
+			Addr:    server.URL,
+			AppRole: AppRoleConfig{RoleID: "role", SecretIDFile: secretIDFile},
+		},
+		Mappings: []MappingConfig{{Prefix: "app", Path: target, Backend: "vault"}},
+	}
+	if code := watchAndExec(config); code != 0 {
+		t.Fatalf("expected a clean run, got %d", code)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(target, "db", "password"))
+	if err != nil || string(content) != "hunter2" {
+		t.Fatalf("expected db/password to be rendered from vault, got %q (%v)", content, err)
+	}
+}
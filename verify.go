@@ -0,0 +1,171 @@
+package fsconsul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// mismatch is a way a file on disk differs from what its mapping would render.
+type mismatch struct {
+	File    string
+	Problem string
+}
+
+// Check a mapping's files against the pairs, without changing anything: each file must
+// exist with the rendered content and the mapping's mode and ownership.  Returns the
+// files rendered, for finding files that shouldn't be there.
+func verifyMapping(mappingConfig *MappingConfig, pairs consulapi.KVPairs) ([]mismatch, map[string][]byte, error) {
+	files, err := renderMapping(mappingConfig, pairs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mismatches []mismatch
+	for keyfile, rendered := range files {
+		info, err := os.Stat(keyfile)
+		if os.IsNotExist(err) {
+			mismatches = append(mismatches, mismatch{keyfile, "missing"})
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		existing, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(existing, rendered) {
+			mismatches = append(mismatches, mismatch{keyfile, "content differs"})
+		}
+
+		attrs, err := mappingConfig.fileAttrs(keyfile)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, difference := range attrs.differences(info) {
+			mismatches = append(mismatches, mismatch{keyfile, difference})
+		}
+	}
+
+	return mismatches, files, nil
+}
+
+// List the files under a mapping's path that no mapping renders, which fsconsul would have
+// deleted.  fsconsul's own lock and staging files are skipped.
+func unexpectedFiles(mappingConfig *MappingConfig, expected map[string]bool) ([]mismatch, error) {
+	var mismatches []mismatch
+	err := filepath.Walk(mappingConfig.Path, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == mappingConfig.Path {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == lockFileName || strings.HasPrefix(info.Name(), ".fsconsul-") {
+			return nil
+		}
+		if !expected[path] {
+			mismatches = append(mismatches, mismatch{path, "not in consul"})
+		}
+		return nil
+	})
+	return mismatches, err
+}
+
+func verifyCommand(args []string) int {
+	var opts options
+
+	flags := newFlagSet("fsconsul verify", verifyHelpText, &opts)
+	flags.Parse(args)
+	if opts.configFile == "" && flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	log := newLogger()
+	config, code := opts.buildConfig(log, flags.Args())
+	if config == nil {
+		return code
+	}
+	applyDefaults(config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create consul client")
+		return 2
+	}
+
+	var mismatches []mismatch
+	expected := make(map[string]bool)
+	for i := range config.Mappings {
+		mappingConfig := &config.Mappings[i]
+
+		if mappingConfig.Registry != "" || mappingConfig.Socket != "" || mappingConfig.envOnly() {
+			log.WithFields(logrus.Fields{
+				"mapping": mappingConfig.Name,
+			}).Warn("Registry, socket and environment mappings aren't verified")
+			continue
+		}
+
+		pairs, err := listMapping(client, config, mappingConfig)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"mapping": mappingConfig.Name,
+				"error":   err,
+			}).Error("Failed to list prefix")
+			return 2
+		}
+
+		found, files, err := verifyMapping(mappingConfig, pairs)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"mapping": mappingConfig.Name,
+				"error":   err,
+			}).Error("Failed to verify mapping")
+			return 2
+		}
+		mismatches = append(mismatches, found...)
+		for keyfile := range files {
+			expected[keyfile] = true
+		}
+	}
+
+	// Mappings may share a path, so files are only unexpected if no mapping renders them
+	walked := make(map[string]bool)
+	for i := range config.Mappings {
+		mappingConfig := &config.Mappings[i]
+		if mappingConfig.Registry != "" || mappingConfig.Socket != "" || mappingConfig.envOnly() || mappingConfig.Format != "" || !mappingConfig.managesDeletes() || walked[mappingConfig.Path] {
+			continue
+		}
+		walked[mappingConfig.Path] = true
+
+		found, err := unexpectedFiles(mappingConfig, expected)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"mapping": mappingConfig.Name,
+				"error":   err,
+			}).Error("Failed to verify mapping")
+			return 2
+		}
+		mismatches = append(mismatches, found...)
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].File < mismatches[j].File })
+	for _, m := range mismatches {
+		fmt.Printf("%s: %s\n", m.File, m.Problem)
+	}
+
+	if len(mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
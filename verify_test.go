@@ -0,0 +1,70 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestVerifyMapping(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{Prefix: "app", Path: tempDir + string(os.PathSeparator), FileMode: "0600"}
+	pairs := consulapi.KVPairs{
+		{Key: "app/ok.conf", Value: []byte("ok")},
+		{Key: "app/changed.conf", Value: []byte("new")},
+		{Key: "app/missing.conf", Value: []byte("missing")},
+	}
+	ioutil.WriteFile(filepath.Join(tempDir, "ok.conf"), []byte("ok"), 0600)
+	ioutil.WriteFile(filepath.Join(tempDir, "changed.conf"), []byte("old"), 0600)
+	ioutil.WriteFile(filepath.Join(tempDir, "stale.conf"), []byte("stale"), 0600)
+	ioutil.WriteFile(filepath.Join(tempDir, lockFileName), nil, 0600)
+
+	mismatches, files, err := verifyMapping(mappingConfig, pairs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := make(map[string]bool)
+	for keyfile := range files {
+		expected[keyfile] = true
+	}
+	unexpected, err := unexpectedFiles(mappingConfig, expected)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	problems := make(map[string]string)
+	for _, m := range append(mismatches, unexpected...) {
+		problems[filepath.Base(m.File)] = m.Problem
+	}
+	want := map[string]string{
+		"changed.conf": "content differs",
+		"missing.conf": "missing",
+		"stale.conf":   "not in consul",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %v, got %v", want, problems)
+	}
+	for file, problem := range want {
+		if problems[file] != problem {
+			t.Errorf("expected %s to be %q, got %q", file, problem, problems[file])
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	os.Chmod(filepath.Join(tempDir, "ok.conf"), 0644)
+	mismatches, _, _ = verifyMapping(mappingConfig, pairs[:1])
+	if len(mismatches) != 1 || mismatches[0].Problem != "mode is 0644, expected 0600" {
+		t.Errorf("expected a mode mismatch, got %v", mismatches)
+	}
+}
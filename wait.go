@@ -0,0 +1,103 @@
+package fsconsul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// WaitForConfig names a key that must exist (and, if Value is set, hold that value) before
+// anything is rendered.
+type WaitForConfig struct {
+	Key     string
+	Value   string
+	Timeout Duration
+}
+
+// Parse a wait-for specification of the form key[=value][,timeout].
+func parseWaitFor(spec string) (WaitForConfig, error) {
+	var wait WaitForConfig
+
+	if i := strings.LastIndex(spec, ","); i >= 0 {
+		timeout, err := time.ParseDuration(spec[i+1:])
+		if err != nil {
+			return wait, fmt.Errorf("invalid wait-for timeout %q: %v", spec[i+1:], err)
+		}
+		wait.Timeout = Duration(timeout)
+		spec = spec[:i]
+	}
+
+	parts := strings.SplitN(spec, "=", 2)
+	wait.Key = strings.TrimPrefix(parts[0], "/")
+	if len(parts) == 2 {
+		wait.Value = parts[1]
+	}
+
+	if wait.Key == "" {
+		return wait, fmt.Errorf("wait-for requires a key")
+	}
+
+	return wait, nil
+}
+
+func (wait WaitForConfig) satisfiedBy(pair *consulapi.KVPair) bool {
+	return pair != nil && (wait.Value == "" || string(pair.Value) == wait.Value)
+}
+
+// Block until the wait-for key is present and matches, the timeout passes or quitCh is
+// closed.  Failed queries are retried with backoff, as watches retry them.
+func waitForKey(client *consulapi.Client, token string, wait WaitForConfig, quitCh <-chan struct{}) error {
+	var deadline time.Time
+	if wait.Timeout > 0 {
+		deadline = time.Now().Add(time.Duration(wait.Timeout))
+	}
+
+	log.WithFields(log.Fields{
+		"key":   wait.Key,
+		"value": wait.Value,
+	}).Info("Waiting for key before rendering")
+
+	delays := newBackoff(RetryConfig{})
+	var index uint64
+	for {
+		opts := &consulapi.QueryOptions{Token: token, WaitIndex: index, WaitTime: 5 * time.Minute}
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				return fmt.Errorf("timed out waiting for key %s", wait.Key)
+			}
+			if remaining < opts.WaitTime {
+				opts.WaitTime = remaining
+			}
+		}
+
+		pair, meta, err := client.KV().Get(wait.Key, opts)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   wait.Key,
+			}).Warn("Error communicating with consul agent while waiting for key.")
+
+			delay := delays.next()
+			if !deadline.IsZero() && time.Until(deadline) < delay {
+				delay = time.Until(deadline)
+			}
+			select {
+			case <-time.After(delay):
+			case <-quitCh:
+				return fmt.Errorf("stopped waiting for key %s", wait.Key)
+			}
+			continue
+		}
+		delays.reset()
+
+		if wait.satisfiedBy(pair) {
+			return nil
+		}
+
+		index = meta.LastIndex
+	}
+}
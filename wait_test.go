@@ -0,0 +1,60 @@
+package fsconsul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWaitFor(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		expected WaitForConfig
+	}{
+		{"app/ready", WaitForConfig{Key: "app/ready"}},
+		{"/app/version=42", WaitForConfig{Key: "app/version", Value: "42"}},
+		{"app/version=a=b,5m", WaitForConfig{Key: "app/version", Value: "a=b", Timeout: Duration(5 * time.Minute)}},
+	} {
+		wait, err := parseWaitFor(test.spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %s due to %v", test.spec, err)
+		}
+		if wait != test.expected {
+			t.Fatalf("Expected %s to parse as %+v but got %+v", test.spec, test.expected, wait)
+		}
+	}
+
+	for _, spec := range []string{"", "=42", "app/ready,soon"} {
+		if _, err := parseWaitFor(spec); err == nil {
+			t.Fatalf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestWaitForKeyFailing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client, err := buildConsulClient(ConsulConfig{Addr: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retries stop at the timeout rather than after it
+	start := time.Now()
+	err = waitForKey(client, "", WaitForConfig{Key: "ready", Timeout: Duration(200 * time.Millisecond)}, nil)
+	if err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expected to time out promptly, got %v after %s", err, time.Since(start))
+	}
+
+	// Waiting can be stopped while backing off
+	quitCh := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(quitCh) })
+	start = time.Now()
+	if err := waitForKey(client, "", WaitForConfig{Key: "ready"}, quitCh); err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expected to stop promptly, got %v after %s", err, time.Since(start))
+	}
+}
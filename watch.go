@@ -1,116 +1,754 @@
-package main
+package fsconsul
 
 import (
-	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/armed/mkdirp"
 	consulapi "github.com/hashicorp/consul/api"
-
-	gosecret "github.com/cimpress-mcp/gosecret/api"
 )
 
-func init() {
-	log.SetLevel(log.DebugLevel)
-}
-
 // ConsulConfig holds the configuration for Consul
 type ConsulConfig struct {
 	Addr  string
 	DC    string
 	Token string
 
+	// Read the token from this file instead
+	TokenFile string
+
+	// Acquire the token from an auth method instead
+	Login LoginConfig
+
 	KeyFile  string
 	CertFile string
 	CAFile   string
 	UseTLS   bool
+
+	// Proxy to reach Consul through (http, https or socks5), overriding HTTP_PROXY and friends
+	Proxy string
+
+	// Base64 SHA-256 hashes of public keys, one of which the server's certificate chain must have
+	PinnedKeys []string
+
+	// Reject server certificates that have been revoked, or whose revocation can't be checked
+	CheckRevocation bool
 }
 
 // MappingConfig holds configuration for all mappings from KV to fs managed by this process.
 type MappingConfig struct {
+	Name        string
 	OnChange    []string
 	OnChangeRaw string `json:"onchange"`
 	Prefix      string
-	Path        string
+	Path        string // May be given per operating system, see UnmarshalJSON
 	Keystore    string
+
+	// Further keystores whose keys are used for values Keystore has no key for, e.g. the
+	// previous one while keys are rotated
+	Keystores []string
+
+	// Render the prefix named by this key's value instead of Prefix, switching prefixes
+	// whenever the key changes
+	PointerKey string
+
+	// Render keys the prefix lacks from this prefix instead, e.g. while migrating keys
+	// between prefixes
+	FallbackPrefix string
+
+	// Decrypt values encrypted with Vault's transit engine (vault:v1:...)
+	Transit TransitConfig
+
+	// Where keys are read from: consul (the default), vault, in which case the prefix is a
+	// path in the Vault KV v2 engine, or etcd, in which case it's a key prefix in etcd
+	Backend string
+
+	// Run values as templates even without a keystore
+	Template bool
+
+	// Evaluate .jsonnet and .cue keys into JSON or YAML files
+	Evaluate bool
+
+	// Apply values as patches to the existing files rather than replacing them
+	Patch bool
+
+	// Render all keys into the single file ExplodeFile (relative to the path), in the Format
+	// json, yaml, ini, toml, properties, env, xml or template.  XML and template are rendered
+	// from the Skeleton template.  Explode is the older name for Format.
+	Format      string
+	Explode     string
+	ExplodeFile string
+	Skeleton    string
+
+	// Render the base/ sub-prefix merged with overlays/<Environment>/
+	Environment string
+
+	// Write keys as string values under this Windows registry key (e.g.
+	// HKLM\SOFTWARE\Vendor\App) instead of as files under the path
+	Registry string
+
+	// Hand rendered files to the processes connecting to this Unix socket, as memfds,
+	// instead of writing them under the path (Linux only)
+	Socket string
+
+	// Write files by staging them and renaming them into place
+	AtomicWrites bool
+	StagingDir   string
+
+	// Rewrite only the parts of large files that changed, rather than the whole file
+	DeltaWrites bool
+
+	// Set file mtimes to when fsconsul observed their key's last change rather than when
+	// they were written.  Consul keeps no modification time for keys.
+	PreserveMtime bool
+
+	// Fail the mapping when a key would be written outside the path, rather than ignoring
+	// the key
+	StrictKeys bool
+
+	// Transform key names into file names (and variable names when exploding into env):
+	// lower, upper, or snake for camelCase to snake_case
+	KeyCase string
+
+	// End rendered files with exactly one newline (one) or none (none), rather than as
+	// their values do (keep, the default)
+	TrailingNewline string
+
+	// Delete files whose keys are removed from Consul (defaults to true), and the
+	// directories that leaves empty
+	ManageDeletes   *bool
+	RemoveEmptyDirs bool
+
+	// Also delete files under the path that no key renders, e.g. left by earlier runs, on
+	// startup and with every snapshot
+	Prune bool
+
+	// The order of a snapshot's deletes, writes and onchange command: delete-write-onchange
+	// (the default), write-delete-onchange, or write-onchange-delete for services that
+	// mustn't see old files gone before they've reloaded with the new ones
+	PhaseOrder string
+
+	// A hook that must approve deleting more than a threshold of files at once
+	ConfirmDeletes ConfirmDeletesConfig
+
+	// Snapshots lacking any of these keys (relative to the prefix), or with fewer keys
+	// than the minimum, are not applied
+	RequiredKeys []string
+	MinKeys      int
+
+	// What to do with keys with empty values: write an empty file (the default), skip them,
+	// delete their files, or fail the snapshot
+	EmptyValues string
+
+	// What a snapshot changing files does, as in Nomad's template block: noop renders
+	// the files only, restart restarts the process run with exec, signal sends it
+	// ChangeSignal, and script runs the onchange command.  By default, the process is
+	// reloaded as exec configures and the onchange command is run.
+	ChangeMode   string
+	ChangeSignal string
+
+	// Also set the keys as environment variables of the process run with exec, named as
+	// an env explode file names them, restarting it when they change.  Without a path, the
+	// keys are only put in its environment.
+	ExecEnv bool
+
+	// How long the onchange command may run before it's stopped with SIGTERM, then SIGKILL
+	// (no limit by default), and whether that stops the mapping rather than being logged
+	OnChangeTimeout      Duration
+	OnChangeTimeoutFatal bool
+
+	// What happens to snapshots arriving while the previous one is still being applied:
+	// coalesce keeps only the latest (the default), queue keeps up to QueueSize (10 by
+	// default) in order, and drop discards all but the first
+	Backpressure string
+	QueueSize    int
+
+	// Don't act on the files the first snapshot after starting changes, as the service
+	// was presumably already configured with them, e.g. when fsconsul is upgraded or the
+	// host reboots
+	SkipInitialOnChange bool
+
+	// Record the index of the last snapshot applied, and when, in a .fsconsul-index file
+	// in the path, and as FSCONSUL_INDEX for the process run with exec with ExecEnv
+	IndexFile bool
+
+	// Names of mappings that must have rendered before this one renders
+	DependsOn []string
+
+	// What to do when the mapping hasn't synced with Consul for too long
+	Staleness StalenessConfig
+
+	// The Consul agent to read from, for the fields it sets, instead of the top-level one
+	Consul *ConsulConfig
+
+	// How failed queries to Consul are retried
+	Retry RetryConfig
+
+	// Wait for changes with keys-only queries, listing the values only once the prefix has
+	// changed, for prefixes with large values that rarely change
+	KeysOnly bool
+
+	// How files that fail to write are retried, until the next snapshot
+	RetryWrites RetryConfig
+
+	// Apply changes once the prefix has been quiet for Wait, plus a random delay of up to
+	// Splay, but at least every MaxWait (four times Wait by default)
+	Wait    Duration
+	MaxWait Duration
+	Splay   Duration
+
+	// Alert when the prefix differs from the same prefix in another datacenter
+	Drift DriftConfig
+
+	// Apply a snapshot only if every key renders, and don't run onchange unless every file
+	// was written
+	Strict bool
+
+	// Pause snapshots that change too much at once until they're approved
+	DeltaLimits DeltaLimitsConfig
+
+	// Mode of written files (0640 by default) and of directories created for them (0750 by
+	// default), and the user and group owning them, overridden for keys matching the
+	// patterns in Files
+	FileMode string
+	DirMode  string
+	Owner    string
+	Group    string
+	Files    map[string]FilePermissions
+
+	// Mark rendered files as managed by fsconsul
+	ManagedBy ManagedByConfig
+}
+
+func (mappingConfig *MappingConfig) managesDeletes() bool {
+	// Patched files aren't fsconsul's alone, so they're never deleted
+	if mappingConfig.Patch {
+		return false
+	}
+	return mappingConfig.ManageDeletes == nil || *mappingConfig.ManageDeletes
 }
 
 // WatchConfig holds fsconsul configuration
 type WatchConfig struct {
-	RunOnce  bool
-	Consul   ConsulConfig
-	Mappings []MappingConfig
+	RunOnce     bool
+	JSONSummary bool
+	Takeover    bool
+	Consul      ConsulConfig
+	Vault       VaultConfig
+	Etcd        EtcdConfig
+	Log         LogConfig
+	WaitFor     WaitForConfig
+	Harden      HardenConfig
+	Degraded    DegradedConfig
+	Exec        ExecConfig
+	Mappings    []MappingConfig
+
+	// Groups of mappings run as if by separate instances, with their own Consul connection
+	Profiles []ProfileConfig
+
+	// Format of the summary: json (the default), ansible or salt
+	SummaryFormat string
+
+	// Directory of mapping fragments, which are rendered as the user owning each fragment,
+	// and what the fragments of each user besides fsconsul's own may read
+	ConfDir string
+	Tenants []TenantConfig
+
+	// File recording the Consul index applied to each mapping, to resume from on restart
+	StateFile string
+
+	// Fixture in consul kv export format to render from instead of Consul
+	SourceFile string
+
+	// Paths to refuse to manage deletions in, besides the defaults, and whether to allow it
+	// anyway
+	DangerousPaths   []string
+	IKnowWhatImDoing bool
+
+	// Directory to save every snapshot received to, and to replay snapshots from instead of
+	// watching Consul
+	Record string
+	Replay string
+
+	// Log what would be written and deleted instead of touching the disk or running onchange
+	DryRun bool
+
+	// Exit after the first change following startup has been applied
+	OnceOnChange        bool
+	OnceOnChangeTimeout Duration
+
+	// How long writes and onchange commands in progress have to finish on SIGINT or SIGTERM
+	// (30s by default)
+	ShutdownTimeout Duration
+
+	// HTTP endpoint reporting whether every mapping is in sync, for liveness and readiness
+	// probes
+	Health HealthConfig
+
+	// Services paged when mappings become unhealthy, deletions are blocked, values can't be
+	// decrypted or Consul is unreachable
+	Notifiers []NotifierConfig
+
+	// Load the configuration again, on SIGHUP
+	reload func() (*WatchConfig, error)
+
+	// The profile this configuration runs, and the logger for its mappings if it has its
+	// own level
+	profile string
+	logger  *log.Logger
+
+	// Mappings started and stopped while watching, without reloading the configuration
+	changes chan mappingChange
+
+	// The health check endpoint, when shared by several profiles
+	health *healthServer
+
+	// The paths of the running mappings, shared by every profile
+	live *livePaths
+
+	// When embedded, closed to stop watching instead of SIGINT and SIGTERM, and the hooks
+	// to call as files change
+	done  <-chan struct{}
+	hooks *Hooks
 }
 
 func applyDefaults(config *WatchConfig) {
+	applyConsulEnv(&config.Consul)
+	readConsulTokenFile(&config.Consul)
 	if config.Consul.Addr == "" {
 		config.Consul.Addr = "127.0.0.1:8500"
 	}
+
+	for i := range config.Mappings {
+		mappingConfig := &config.Mappings[i]
+
+		if mappingConfig.OnChangeRaw != "" {
+			mappingConfig.OnChange = strings.Split(mappingConfig.OnChangeRaw, " ")
+		}
+
+		// If prefix starts with /, trim it.  etcd keys often start with /, so etcd prefixes
+		// are kept as they are.
+		if mappingConfig.Backend != "etcd" {
+			mappingConfig.Prefix = strings.TrimPrefix(mappingConfig.Prefix, "/")
+		}
+		mappingConfig.PointerKey = strings.TrimPrefix(mappingConfig.PointerKey, "/")
+		mappingConfig.FallbackPrefix = strings.TrimPrefix(mappingConfig.FallbackPrefix, "/")
+
+		if mappingConfig.Path != "" {
+			// If the config path is lacking a trailing separator, add it.
+			if mappingConfig.Path[len(mappingConfig.Path)-1] != os.PathSeparator {
+				mappingConfig.Path += string(os.PathSeparator)
+			}
+
+			// Remove an unhandled trailing quote, which presented itself on Windows when
+			// the given path contained spaces (requiring quotes) and also had a trailing
+			// backslash.
+			if mappingConfig.Path[len(mappingConfig.Path)-1] == 34 {
+				mappingConfig.Path = mappingConfig.Path[:len(mappingConfig.Path)-1]
+			}
+		}
+
+		if mappingConfig.Format == "" {
+			mappingConfig.Format = mappingConfig.Explode
+		}
+
+		if mappingConfig.Consul != nil {
+			readConsulTokenFile(mappingConfig.Consul)
+		}
+
+		// Values are decrypted with the top-level Vault unless the mapping has its own
+		if mappingConfig.Transit.Key != "" && mappingConfig.Transit.Vault == nil {
+			vault := config.Vault
+			mappingConfig.Transit.Vault = &vault
+		}
+
+		// Mappings are identified in logs by name, falling back to their prefix
+		if mappingConfig.Name == "" {
+			mappingConfig.Name = mappingConfig.Prefix
+		}
+		if mappingConfig.Name == "" {
+			mappingConfig.Name = mappingConfig.PointerKey
+		}
+	}
 }
 
 // Queue watchers
 func watchAndExec(config *WatchConfig) int {
+	if len(config.Profiles) > 0 {
+		return watchProfiles(config)
+	}
+
+	// Mappings from fragments owned by other users are run by workers as those users
+	tenants, err := loadConfDir(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load mapping fragments")
+		return -1
+	}
 
 	applyDefaults(config)
 
-	returnCodes := make(chan int)
+	// Don't render anything until the configuration has been published, if asked to.  A
+	// replay renders what was rendered then, whatever the key says now.
+	if config.WaitFor.Key != "" && config.Replay == "" {
+		if config.SourceFile != "" {
+			err = waitForSourceFile(config.SourceFile, config.WaitFor)
+		} else {
+			var client *consulapi.Client
+			client, err = buildConsulClient(config.Consul)
+			if err == nil {
+				err = waitForKey(client, config.Consul.Token, config.WaitFor, config.done)
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed waiting for key")
+			return -1
+		}
+	}
 
-	// Fork a separate goroutine for each prefix/path pair
-	for i := 0; i < len(config.Mappings); i++ {
-		go func(mappingConfig *MappingConfig) {
+	if err := checkDependencies(config.Mappings); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid mapping dependencies")
+		return -1
+	}
 
-			if mappingConfig.OnChangeRaw != "" {
-				mappingConfig.OnChange = strings.Split(mappingConfig.OnChangeRaw, " ")
+	if errs := checkDangerousPaths(config); len(errs) > 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Refusing to manage a protected path")
+		}
+		return -1
+	}
+
+	if config.DryRun {
+		if len(tenants) > 0 {
+			log.WithFields(log.Fields{
+				"fragments": len(tenants),
+			}).Warn("Mapping fragments owned by other users aren't dry run")
+		}
+		return dryRun(config)
+	}
+
+	// Make sure no other instance manages the same paths
+	locks, err := lockPaths(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to lock target paths")
+		return -1
+	}
+	defer unlockPaths(locks)
+	defer removeKeychains()
+
+	var workers []*exec.Cmd
+	for _, tenant := range tenants {
+		worker, err := startWorker(config, tenant)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to start worker")
+			for _, worker := range workers {
+				worker.Process.Kill()
 			}
+			return -1
+		}
+		workers = append(workers, worker)
+	}
 
+	// Create the recording directory up front, so that hardening allows writing to it
+	if config.Record != "" {
+		if err := os.MkdirAll(config.Record, 0700); err != nil {
 			log.WithFields(log.Fields{
-				"config": mappingConfig,
+				"error": err,
+			}).Error("Failed to create recording directory")
+			return -1
+		}
+	}
+
+	if config.Harden.Enabled {
+		if err := harden(config); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to harden process")
+			return -1
+		}
+	}
+
+	// Profiles share the paths of their running mappings, and one health check endpoint
+	if config.live == nil {
+		config.live = newLivePaths()
+	}
+	health := config.health
+	if health == nil && !config.RunOnce {
+		health, err = startHealthServer(config.Health)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"addr":  config.Health.Addr,
+			}).Error("Failed to serve health checks")
+			return -1
+		}
+		defer health.close()
+	}
+
+	returnCodes := make(chan int)
+
+	var summary *runSummary
+	if config.JSONSummary {
+		summary = newRunSummary()
+	}
+
+	notify := newNotifiers(config.Notifiers, config.hooks)
+	if notify != nil {
+		notify.logger = config.mappingLogger()
+	}
+	conns := newConnectivities(config.Degraded)
+	conns.notifiers = notify
+	conns.logger = config.mappingLogger()
+
+	state, err := loadState(config.StateFile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load state file")
+		return -1
+	}
+
+	child, err := newSupervisor(config.Exec)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid exec configuration")
+		return -1
+	}
+
+	newRun := func(mappingConfig *MappingConfig) *mappingRun {
+		var perMapping *mappingSummary
+		if summary != nil {
+			perMapping = summary.addMapping(mappingConfig.Name)
+			perMapping.hooks = config.hooks
+		} else if config.hooks != nil {
+			perMapping = &mappingSummary{Mapping: mappingConfig.Name, hooks: config.hooks, discard: true}
+		}
+		run := newMappingRun(mappingConfig, perMapping)
+		run.logger = config.mappingLogger().WithField("mapping", mappingConfig.Name)
+		run.conn = conns.forMapping(config, mappingConfig)
+		run.state = state
+		run.child = child
+		run.notify = notify
+		return run
+	}
+
+	// Fork a separate goroutine for each prefix/path pair
+	start := func(run *mappingRun) {
+		if run.config.Staleness.Max > 0 {
+			go watchStaleness(run)
+		}
+		if run.config.Drift.Datacenter != "" && watchesConsul(config, run.config) {
+			if client, err := buildConsulClient(config.consulFor(run.config)); err != nil {
+				run.logger.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to create consul client, not comparing datacenters")
+			} else {
+				go watchDrift(run, client, config.consulFor(run.config).Token)
+			}
+		}
+
+		go func(run *mappingRun) {
+			defer close(run.done)
+
+			run.logger.WithFields(log.Fields{
+				"config": run.config,
 			}).Debug("Got mapping config")
 
-			returnCode, err := watchMappingAndExec(config, mappingConfig)
+			returnCode, err := watchMappingAndExec(config, run)
+			if err == errStopped {
+				err = nil
+			}
 			if err != nil {
-				log.WithFields(log.Fields{
+				run.logger.WithFields(log.Fields{
 					"error": err,
 				}).Debug("Failure from watch function")
+				run.summary.addError("", err)
+				run.notify.trigger(EventUnhealthy, run.config.Name, fmt.Sprintf("mapping failed: %v", err))
 			}
+			run.summary.finish()
 
 			returnCodes <- returnCode
-		}(&config.Mappings[i])
+		}(run)
+	}
+
+	runs := make([]*mappingRun, len(config.Mappings))
+	for i := range config.Mappings {
+		runs[i] = newRun(&config.Mappings[i])
+	}
+	linkDependencies(runs)
+
+	for _, run := range runs {
+		start(run)
 	}
+	health.setRuns(config.profile, runs)
+	config.live.setRuns(config.profile, runs)
 
-	// Wait for completion of all forked go routines
+	if child != nil {
+		go child.run(runs)
+	}
+
+	for _, worker := range workers {
+		go func(worker *exec.Cmd) {
+			if err := worker.Wait(); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"pid":   worker.Process.Pid,
+				}).Error("Worker failed")
+				returnCodes <- 1
+				return
+			}
+			returnCodes <- 0
+		}(worker)
+	}
+
+	// Mappings are added and removed on SIGHUP
+	running := &mappingRuns{runs: runs, locks: locks, newRun: newRun, start: start}
+	defer func() { unlockPaths(running.locks[len(locks):]) }()
+	hupCh, stopReloads := reloadSignal(config)
+	defer stopReloads()
+	stopCh, stopStopping := stopSignal(config, child)
+	defer stopStopping()
+
+	// Wait for completion of all forked go routines and workers.  On SIGINT or SIGTERM, the
+	// mappings stop once they've finished writing and running onchange, and fsconsul exits 0,
+	// or 1 if they take longer than the shutdown timeout or another signal comes.
 	failures := false
-	for i := 0; i < len(config.Mappings); i++ {
-		returnCode := <-returnCodes
+	var shutdownCh <-chan time.Time
+	// Embedded, mappings may be registered later, so watching goes on until it's stopped
+	embedded := config.done != nil && !config.RunOnce
+	for pending := len(runs) + len(workers); pending > 0 || (embedded && shutdownCh == nil); {
+		var returnCode int
+		select {
+		case returnCode = <-returnCodes:
+			pending--
+		case code := <-child.exit():
+			// fsconsul lives as long as the process it runs
+			return code
+		case <-hupCh:
+			pending += running.reload(config)
+			health.setRuns(config.profile, running.runs)
+			config.live.setRuns(config.profile, running.runs)
+			continue
+		case change := <-config.changes:
+			if shutdownCh != nil {
+				change.result <- errStopping
+				continue
+			}
+			pending += running.change(config, change)
+			health.setRuns(config.profile, running.runs)
+			config.live.setRuns(config.profile, running.runs)
+			continue
+		case sig := <-stopCh:
+			if shutdownCh != nil {
+				log.WithFields(log.Fields{
+					"signal": sig,
+				}).Warn("Stopping without waiting for mappings")
+				return 1
+			}
+			log.WithFields(log.Fields{
+				"signal":  sig,
+				"pending": pending,
+			}).Info("Stopping once writes and onchange commands in progress finish")
+
+			processes := make([]*os.Process, len(workers))
+			for i, worker := range workers {
+				processes[i] = worker.Process
+			}
+			shutdownCh = shutdown(config, running, processes, sig)
+			// Mappings aren't reloaded while stopping
+			hupCh = nil
+			continue
+		case <-shutdownCh:
+			log.WithFields(log.Fields{
+				"pending": pending,
+			}).Error("Timed out waiting for mappings to stop")
+			return 1
+		}
 		log.Debug(returnCode)
 		if returnCode != 0 {
 			failures = true
 		}
 	}
 
+	if summary != nil {
+		if err := summary.writeAs(os.Stdout, config.SummaryFormat); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to write summary")
+		}
+	}
+
+	if shutdownCh != nil {
+		log.Info("Stopped")
+		if failures {
+			return 1
+		}
+		return 0
+	}
+
 	if failures {
 		return -1
 	}
 
+	// Having rendered once, keep running the child until it exits
+	if child != nil {
+		return <-child.exit()
+	}
+
 	return 0
 }
 
 func buildClient(consulConfig ConsulConfig) (*http.Client, error) {
 	tlsConfig := &tls.Config{}
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	transport := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
 	client := &http.Client{Transport: transport}
 
+	if consulConfig.Proxy != "" {
+		proxyURL, err := url.Parse(consulConfig.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy: %v", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("Invalid proxy: unsupported scheme %q", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if len(consulConfig.PinnedKeys) > 0 || consulConfig.CheckRevocation {
+		verify, err := verifyConsulServer(consulConfig)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = verify
+	}
+
 	// Check if the user defined a specific CA to use
 	if consulConfig.CAFile != "" {
 		certPool := x509.NewCertPool()
@@ -122,13 +760,19 @@ func buildClient(consulConfig ConsulConfig) (*http.Client, error) {
 		tlsConfig.RootCAs = certPool
 	}
 
-	// Check if TLS was configured for client-side verification
+	// Check if TLS was configured for client-side verification.  The certificate is read on
+	// each handshake, so that rotated certificates are picked up.
 	if consulConfig.CertFile != "" && consulConfig.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(consulConfig.CertFile, consulConfig.KeyFile)
+		reloader, err := newCertReloader(consulConfig.CertFile, consulConfig.KeyFile)
 		if err != nil {
 			return nil, err
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	client.Transport = &statusTransport{base: transport}
+	if consulConfig.Login.AuthMethod != "" {
+		client.Transport = &loginTransport{login: loginFor(consulConfig), base: client.Transport}
 	}
 	return client, nil
 }
@@ -155,250 +799,848 @@ func buildConsulClient(consulConfig ConsulConfig) (client *consulapi.Client, err
 	return client, nil
 }
 
-// Connects to Consul and watches a given K/V prefix and uses that to
-// write to the filesystem.
-func watchMappingAndExec(config *WatchConfig, mappingConfig *MappingConfig) (int, error) {
-	client, err := buildConsulClient(config.Consul)
-	if err != nil {
-		return 0, err
+// Build the snapshot of a mapping's values and modify indexes, keyed relative to its prefix,
+// from the pairs listed under the prefix.  If the mapping has an environment, the snapshot is
+// the keys under base/ merged with (and overridden by) the keys under overlays/<env>/.  If
+// it has a fallback prefix, keys the prefix lacks are taken from the fallback's listing.
+func snapshotEnv(mappingConfig *MappingConfig, pairs consulapi.KVPairs) (map[string]string, map[string]uint64) {
+	if mappingConfig.FallbackPrefix != "" {
+		env, modifyIndexes, _ := snapshotFallback(mappingConfig, pairs)
+		return env, modifyIndexes
+	}
+
+	env := make(map[string]string)
+	modifyIndexes := make(map[string]uint64)
+
+	if mappingConfig.Environment == "" {
+		for _, pair := range pairs {
+			k := relativeKey(mappingConfig, pair.Key)
+			env[k] = string(pair.Value)
+			modifyIndexes[k] = pair.ModifyIndex
+		}
+		return env, modifyIndexes
 	}
 
-	// If prefix starts with /, trim it.
-	if mappingConfig.Prefix[0] == '/' {
-		mappingConfig.Prefix = mappingConfig.Prefix[1:]
+	for _, layer := range []string{"base/", "overlays/" + mappingConfig.Environment + "/"} {
+		for _, pair := range pairs {
+			k := relativeKey(mappingConfig, pair.Key)
+			if !strings.HasPrefix(k, layer) || len(k) == len(layer) {
+				continue
+			}
+
+			k = strings.TrimPrefix(k, layer)
+			env[k] = string(pair.Value)
+			modifyIndexes[k] = pair.ModifyIndex
+		}
 	}
 
-	// If the config path is lacking a trailing separator, add it.
-	if mappingConfig.Path[len(mappingConfig.Path)-1] != os.PathSeparator {
-		mappingConfig.Path += string(os.PathSeparator)
+	return env, modifyIndexes
+}
+
+// Strip the mapping's prefix from a key.
+func relativeKey(mappingConfig *MappingConfig, key string) string {
+	return strings.TrimLeft(strings.TrimPrefix(key, mappingConfig.Prefix), "/")
+}
+
+// Determine the file a key under the mapping's prefix is written to.
+func keyfilePath(mappingConfig *MappingConfig, key string) string {
+	// Keys are always /-delimited, whatever the local path delimiter.
+	return mappingConfig.Path + filepath.FromSlash(fileKey(mappingConfig, key))
+}
+
+func keyfilePaths(mappingConfig *MappingConfig, keys []string) []string {
+	keyfiles := make([]string, len(keys))
+	for i, k := range keys {
+		keyfiles[i] = keyfilePath(mappingConfig, k)
 	}
+	return keyfiles
+}
 
-	isWindows := os.PathSeparator != '/'
+// Connects to Consul and watches a given K/V prefix and uses that to
+// write to the filesystem.
+func watchMappingAndExec(config *WatchConfig, run *mappingRun) (int, error) {
+	mappingConfig := run.config
+	summary := run.summary
 
-	// Remove an unhandled trailing quote, which presented itself on Windows when
-	// the given path contained spaces (requiring quotes) and also had a trailing
-	// backslash.
-	if mappingConfig.Path[len(mappingConfig.Path)-1] == 34 {
-		mappingConfig.Path = mappingConfig.Path[:len(mappingConfig.Path)-1]
+	// Render nothing until the mappings this one depends on have rendered
+	if err := run.waitForDeps(); err == errStopped {
+		return 0, err
+	} else if err != nil {
+		return 1, err
 	}
 
+	logger := run.logger
+
 	// Start the watcher goroutine that watches for changes in the
 	// K/V and notifies us on a channel.
 	errCh := make(chan error, 1)
-	pairCh := make(chan consulapi.KVPairs)
+	pairCh := make(chan kvSnapshot)
 	quitCh := make(chan struct{})
+	defer close(quitCh)
 
-	// Defer close of quitCh if we're running more than once
-	if !config.RunOnce {
-		defer close(quitCh)
+	// When exiting after the first change, give up waiting for it after the timeout
+	var timeoutCh <-chan time.Time
+	if config.OnceOnChange && config.OnceOnChangeTimeout > 0 {
+		timeoutCh = time.After(time.Duration(config.OnceOnChangeTimeout))
 	}
+	initial := true
 
-	go watch(
-		client, mappingConfig.Prefix, mappingConfig.Path, config.Consul.Token, pairCh, errCh, quitCh)
+	// Record the index of each snapshot that brings the files in sync, when it's new
+	var indexRecorded uint64
+	recordIndex := func(index uint64) {
+		if !mappingConfig.IndexFile || mappingConfig.Path == "" || index == indexRecorded {
+			return
+		}
+		if err := writeIndexFile(mappingConfig, index, time.Now()); err != nil {
+			logger.WithFields(log.Fields{
+				"error": err,
+				"index": index,
+			}).Error("Failed to write index file")
+			summary.addError(filepath.Join(mappingConfig.Path, indexFileName), err)
+			return
+		}
+		indexRecorded = index
+	}
+
+	// A snapshot exceeding the delta limits waits here until it's approved
+	var pending *kvSnapshot
+	var approvalCh <-chan time.Time
+	var approvalClient *consulapi.Client
+	if mappingConfig.DeltaLimits.ApprovalKey != "" {
+		var err error
+		if approvalClient, err = buildConsulClient(config.consulFor(mappingConfig)); err != nil {
+			return 0, err
+		}
+		approvalTicker := time.NewTicker(approvalPollInterval)
+		defer approvalTicker.Stop()
+		approvalCh = approvalTicker.C
+	}
+
+	// Create the root for KVs with the mapping's mode and owner, if necessary
+	if mappingConfig.Path != "" {
+		if err := makeDirs(mappingConfig, mappingConfig.Path); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := startSource(config, mappingConfig, run.conn, logger, pairCh, errCh, quitCh); err != nil {
+		return 0, err
+	}
+
+	// Socket mappings serve their files rather than writing them
+	var served *fdServer
+	if mappingConfig.Socket != "" {
+		var err error
+		if served, err = listenFDs(mappingConfig); err != nil {
+			return 0, err
+		}
+		defer served.close()
+	}
+
+	// Bursts of changes are applied once they've settled
+	var snapshots <-chan kvSnapshot = pairCh
+	if mappingConfig.Wait > 0 && !config.RunOnce && config.Replay == "" {
+		settled := make(chan kvSnapshot)
+		go debounce(mappingConfig, pairCh, settled, quitCh)
+		snapshots = settled
+	}
+	if !config.RunOnce && config.Replay == "" {
+		held := make(chan kvSnapshot)
+		go backpressure(run, snapshots, held, quitCh)
+		snapshots = held
+	}
 
 	var env map[string]string
+	inSync := false
+	mtimes := newModifyTimes()
+	writes := newWriteRetries(mappingConfig.RetryWrites)
+	// What the last snapshot applied rendered, for the state file
+	var renderedKeys map[string]keyState
+	var retryCh <-chan time.Time
+	// On restart, a prefix that hasn't changed since it was last applied needn't be again
+	resuming := !config.RunOnce && run.state.get(mappingConfig.Name).Index > 0
+	// The last snapshot is rendered again when keys are added to or rotated in the keystores
+	var keystoreCh <-chan struct{}
+	if !config.RunOnce {
+		keystoreCh = watchKeystores(run, quitCh)
+	}
+	var lastPairs consulapi.KVPairs
+	var lastIndex uint64
 	for {
 		var pairs consulapi.KVPairs
+		var index uint64
+		rerender := false
+		// Only the snapshot just approved is let past the delta limits
+		approved := false
 
 		// Wait for new pairs to come on our channel or an error
 		// to occur.
 		select {
-		case pairs = <-pairCh:
+		case snapshot := <-snapshots:
+			pairs, index = snapshot.pairs, snapshot.index
+			if config.Record != "" {
+				if err := recordSnapshot(config.Record, mappingConfig.Name, snapshot); err != nil {
+					logger.WithFields(log.Fields{
+						"error": err,
+					}).Error("Failed to record snapshot")
+				}
+			}
 		case err := <-errCh:
 			return 0, err
+		case <-run.stop:
+			return 0, errStopped
+		case <-timeoutCh:
+			return 1, fmt.Errorf("no change within %s", time.Duration(config.OnceOnChangeTimeout))
+		case <-retryCh:
+			var changes fileChanges
+			var failed []keyFailure
+			changes, failed, retryCh = writes.write(mappingConfig, summary, logger)
+			if writes.synced() {
+				inSync = true
+				run.markRendered()
+				run.synced()
+				run.recordApplied(writes.index, renderedKeys)
+				recordIndex(writes.index)
+				summary.applied(writes.index)
+				logger.WithFields(log.Fields{
+					"index": writes.index,
+				}).Info("Applied snapshot")
+			}
+			if !changes.empty() {
+				if code, err := onChanged(config, run, writes.index, changes, failed); err != nil {
+					return code, err
+				}
+			}
+			continue
+		case <-approvalCh:
+			if pending == nil {
+				continue
+			}
+			var err error
+			approved, err = snapshotApproved(approvalClient, config.consulFor(mappingConfig).Token, mappingConfig.DeltaLimits.ApprovalKey, pending.index)
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"key":   mappingConfig.DeltaLimits.ApprovalKey,
+				}).Warn("Failed to check approval key")
+			}
+			if !approved {
+				continue
+			}
+			logger.WithFields(log.Fields{
+				"index": pending.index,
+			}).Info("Snapshot approved, applying it")
+			pairs, index = pending.pairs, pending.index
+		case <-keystoreCh:
+			// A snapshot awaiting approval is rendered with the new keys once approved
+			if lastPairs == nil || pending != nil {
+				continue
+			}
+			logger.WithFields(log.Fields{
+				"index": lastIndex,
+			}).Info("Keystore changed, rendering the snapshot again")
+			pairs, index = lastPairs, lastIndex
+			rerender = true
 		}
+		lastPairs, lastIndex = pairs, index
+
+		// Whatever arrived supersedes a paused snapshot
+		pending = nil
 
-		newEnv := make(map[string]string)
 		for _, pair := range pairs {
-			log.WithFields(log.Fields{
+			logger.WithFields(log.Fields{
 				"key": pair.Key,
 			}).Debug("Key present in source")
-			k := strings.TrimPrefix(pair.Key, mappingConfig.Prefix)
-			k = strings.TrimLeft(k, "/")
-			newEnv[k] = string(pair.Value)
+		}
+		newEnv, modifyIndexes := snapshotEnv(mappingConfig, pairs)
+		fromFallback := fallbackKeys(mappingConfig, pairs)
+		if len(fromFallback) > 0 {
+			logger.WithFields(log.Fields{
+				"keys":     len(fromFallback),
+				"fallback": mappingConfig.FallbackPrefix,
+			}).Info("Keys missing from the prefix are rendered from the fallback prefix")
+		}
+		if unsafe := dropUnsafeKeys(mappingConfig, newEnv); len(unsafe) > 0 {
+			if mappingConfig.StrictKeys {
+				logger.WithFields(log.Fields{
+					"error": unsafe[0],
+					"keys":  len(unsafe),
+				}).Error("Snapshot has keys outside the mapping's path, failing the mapping")
+				return 1, unsafe[0]
+			}
+			for _, err := range unsafe {
+				logger.WithFields(log.Fields{
+					"error": err,
+				}).Error("Ignoring key outside the mapping's path")
+				summary.addError("", err)
+			}
+		}
+		if dropped := dropCaseCollisions(mappingConfig, newEnv); len(dropped) > 0 {
+			logger.WithFields(log.Fields{
+				"keys": dropped,
+			}).Warn("Keys collide with others once cased, ignoring them")
+		}
+		emptyKeys := applyEmptyValues(mappingConfig, env, newEnv)
+
+		// Files edited or removed while fsconsul wasn't running are rewritten, as are
+		// those whose keys changed meanwhile
+		if resuming {
+			resuming = false
+			recorded := run.state.get(mappingConfig.Name)
+			if recorded.Index != index {
+				if recorded.Keys != nil {
+					logger.WithFields(log.Fields{
+						"index":   index,
+						"changed": recorded.changedKeys(modifyIndexes),
+					}).Info("Keys changed since the last run")
+				}
+			} else if recorded.Config != configHash(mappingConfig) {
+				logger.WithFields(log.Fields{
+					"index": index,
+				}).Info("Mapping's configuration changed since the last run, rendering it again")
+			} else if stale := recorded.staleFiles(mappingConfig); len(stale) > 0 {
+				logger.WithFields(log.Fields{
+					"files": stale,
+				}).Warn("Files changed on disk since the last run, rewriting them")
+			} else {
+				logger.WithFields(log.Fields{
+					"index": index,
+				}).Info("Nothing changed since the last run, resuming")
+
+				env = newEnv
+				inSync = true
+				initial = false
+				run.markRendered()
+				run.synced()
+				recordIndex(index)
+				summary.applied(index)
+				continue
+			}
 		}
 
 		// If the variables didn't actually change,
 		// then don't do anything.
-		if reflect.DeepEqual(env, newEnv) {
+		if !rerender && reflect.DeepEqual(env, newEnv) {
+			if inSync {
+				run.synced()
+				run.recordApplied(index, nil)
+				recordIndex(index)
+			}
 			continue
 		}
 
-		// Iterate over all objects in the current env.  If they are not in the newEnv, they
-		// were deleted from Consul and should be deleted from disk.
-		for k := range env {
-			if _, ok := newEnv[k]; !ok {
-				log.WithFields(log.Fields{
-					"key": k,
-				}).Debug("Key no longer present locally")
-				// Write file to disk
-				keyfile := fmt.Sprintf("%s%s", mappingConfig.Path, k)
-				if isWindows {
-					keyfile = strings.Replace(keyfile, "/", "\\", -1)
-				}
-
-				err := os.Remove(keyfile)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Failed to remove key")
+		// Empty values are counted once for each snapshot that changes something
+		if len(emptyKeys) > 0 {
+			run.sawEmptyValues(len(emptyKeys))
+			summary.emptyValues(emptyKeys)
+
+			if mappingConfig.EmptyValues == emptyFail {
+				logger.WithFields(log.Fields{
+					"keys": emptyKeys,
+				}).Error("Snapshot has keys with empty values, not applying it")
+				if config.RunOnce {
+					return 1, fmt.Errorf("snapshot has keys with empty values")
 				}
+				continue
 			}
+			logger.WithFields(log.Fields{
+				"keys":   emptyKeys,
+				"policy": mappingConfig.EmptyValues,
+			}).Debug("Snapshot has keys with empty values")
 		}
 
-		// Replace the env so we can detect future changes
-		env = newEnv
-
-		// Write the updated keys to the filesystem at the specified path
-		for k, v := range newEnv {
-			// Write file to disk
-			keyfile := fmt.Sprintf("%s%s", mappingConfig.Path, k)
+		// Refuse to apply a partially published snapshot, keeping the previous files.
+		missing := mappingConfig.missingKeys(newEnv)
+		if len(missing) > 0 || len(newEnv) < mappingConfig.MinKeys {
+			logger.WithFields(log.Fields{
+				"missing": missing,
+				"keys":    len(newEnv),
+				"minKeys": mappingConfig.MinKeys,
+			}).Error("Snapshot is missing required keys, not applying it")
+			summary.missingKeys(missing)
+			err := fmt.Errorf("snapshot is missing required keys")
+			run.refused(missing, err)
+
+			if config.RunOnce {
+				return 1, err
+			}
+			continue
+		}
 
-			// if Windows, replace / with windows path delimiter
-			if isWindows {
-				keyfile = strings.Replace(keyfile, "/", "\\", -1)
-				// mkdirp the file's path
-				err := mkdirp.Mk(keyfile[:strings.LastIndex(keyfile, "\\")], 0777)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Failed to create parent directory for key")
-				}
-			} else {
-				// mkdirp the file's path
-				err := mkdirp.Mk(keyfile[:strings.LastIndex(keyfile, "/")], 0777)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Failed to create parent directory for key")
-				}
+		// Pause a snapshot that changes too much at once, keeping the previous files, until
+		// it's approved or a later snapshot supersedes it.  The first snapshot has nothing
+		// to compare with.
+		if env != nil && !approved {
+			if d := snapshotDelta(env, newEnv); mappingConfig.DeltaLimits.exceeded(d) {
+				logger.WithFields(log.Fields{
+					"files":       d.files,
+					"bytes":       d.bytes,
+					"maxFiles":    mappingConfig.DeltaLimits.MaxFiles,
+					"maxBytes":    mappingConfig.DeltaLimits.MaxBytes,
+					"index":       index,
+					"approvalKey": mappingConfig.DeltaLimits.ApprovalKey,
+				}).Error("Snapshot changes too much at once, waiting for approval")
+				pending = &kvSnapshot{pairs, index}
+				continue
 			}
+		}
 
-			f, err := os.Create(keyfile)
+		// A strict mapping renders every key before touching any file, keeping the previous
+		// files if any fails.  The env isn't updated, so the snapshot is tried again next time.
+		var prerendered map[string][]byte
+		var undo *rollback
+		if mappingConfig.Strict && mappingConfig.Format == "" {
+			undo = &rollback{}
+			var keyfile string
+			var err error
+			prerendered, keyfile, err = prerender(mappingConfig, newEnv)
 			if err != nil {
-				log.WithFields(log.Fields{
+				logger.WithFields(log.Fields{
 					"error": err,
 					"file":  keyfile,
-				}).Error("Failed to create file")
+				}).Error("Failed to render snapshot, keeping the previous files")
+				summary.addError(keyfile, err)
+				run.failed(err)
+				if isDecryptionError(err) {
+					run.notify.trigger(EventDecryptionFailed, mappingConfig.Name, fmt.Sprintf("%s: %v", keyfile, err))
+				}
+
+				if config.RunOnce {
+					return 1, err
+				}
 				continue
 			}
+		}
+		previousEnv := env
+
+		// Only a snapshot applied without errors brings the files in sync
+		inSync = true
+		var failed []keyFailure
+		var changes fileChanges
+		retries := make(map[string]pendingWrite)
+		// Deletes put off until onchange has run
+		var lateRemoved, latePruned []string
+		deleteLate := func() {
+			if len(lateRemoved)+len(latePruned) == 0 {
+				return
+			}
+			if _, deleteFailures := deleteFiles(mappingConfig, logger, summary, lateRemoved, latePruned); len(deleteFailures) > 0 {
+				run.failed(fmt.Errorf("failed to delete %d files", len(deleteFailures)))
+			}
+		}
+		renderedKeys = make(map[string]keyState, len(newEnv))
+		for k := range newEnv {
+			renderedKeys[k] = keyState{ModifyIndex: modifyIndexes[k], Fallback: fromFallback[k]}
+		}
 
-			defer f.Close()
-
-			log.WithFields(log.Fields{
-				"length": len(v),
-			}).Debug("Input value length")
+		if mappingConfig.Format != "" {
+			// All keys are rendered into a single file
+			env = newEnv
+			_, err := os.Stat(explodedPath(mappingConfig))
+			existed := err == nil
+			if wrote, err := writeExploded(mappingConfig, newEnv, summary); wrote && existed {
+				changes.Updated = append(changes.Updated, explodedPath(mappingConfig))
+			} else if wrote {
+				changes.Created = append(changes.Created, explodedPath(mappingConfig))
+			} else if err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"file":  explodedPath(mappingConfig),
+				}).Error("Failed to write exploded file")
+				summary.addError(explodedPath(mappingConfig), err)
+				failed = append(failed, keyFailure{explodedPath(mappingConfig), err.Error()})
+				inSync = false
+			}
+		} else if mappingConfig.Registry != "" {
+			// Keys are written to the registry rather than to files
+			changes, failed = writeRegistry(mappingConfig, logger, env, newEnv, summary)
+			if len(failed) > 0 {
+				inSync = false
+			}
+			env = newEnv
+		} else if served != nil {
+			// Files are handed to the processes connecting to the socket rather than written
+			changes, failed = served.update(mappingConfig, logger, newEnv, summary)
+			if len(failed) > 0 {
+				inSync = false
+			}
+			env = newEnv
+		} else if mappingConfig.envOnly() {
+			// Keys are only put in the environment of the process run with exec, below
+			env = newEnv
+		} else {
+			// Iterate over all objects in the current env.  If they are not in the newEnv, they
+			// were deleted from Consul and should be deleted from disk.
+			var removed []string
+			for k := range env {
+				if _, ok := newEnv[k]; !ok {
+					logger.WithFields(log.Fields{
+						"key": k,
+					}).Debug("Key no longer present locally")
+
+					mtimes.forget(k)
+
+					if mappingConfig.managesDeletes() {
+						removed = append(removed, k)
+					}
+				}
+			}
+			sort.Strings(removed)
+
+			// Files no key renders are pruned, unless a skipped empty value keeps its file
+			var pruned []string
+			if mappingConfig.Prune {
+				var err error
+				if pruned, err = prunedFiles(config, mappingConfig, newEnv, removed, emptyKeys); err != nil {
+					logger.WithFields(log.Fields{
+						"error": err,
+					}).Error("Failed to list files to prune")
+					summary.addError("", err)
+					inSync = false
+				}
+			}
 
-			buff := new(bytes.Buffer)
-			buff.Write([]byte(v))
+			// Mass deletions may need approving first.  Refused deletions are kept in the env,
+			// so that they're asked about again with the next snapshot.
+			var vetoed []string
+			if keyfiles := append(keyfilePaths(mappingConfig, removed), pruned...); mappingConfig.ConfirmDeletes.needed(keyfiles) {
+				if err := confirmDeletes(mappingConfig, keyfiles); err != nil {
+					logger.WithFields(log.Fields{
+						"error":     err,
+						"deletions": len(keyfiles),
+					}).Error("Deletions weren't confirmed, keeping the files")
+					summary.addError("", err)
+					run.notify.trigger(EventDeletesBlocked, mappingConfig.Name,
+						fmt.Sprintf("%d deletions weren't confirmed: %v", len(keyfiles), err))
+					inSync = false
+					vetoed, removed, pruned = removed, nil, nil
+				}
+			}
 
-			if len(mappingConfig.Keystore) > 0 {
-				decryptedValue, err := gosecret.DecryptTags([]byte(v), mappingConfig.Keystore)
-				if err != nil {
-					log.WithFields(log.Fields{
+			// Deletes happen before the writes, after them, or once onchange has run, as the
+			// phase order says.  Files deleted after onchange are listed among its changes.
+			deleteNow := func() {
+				if err := undo.save(append(keyfilePaths(mappingConfig, removed), pruned...)...); err != nil {
+					logger.WithFields(log.Fields{
 						"error": err,
-					}).Error("Failed to decrypt value")
+					}).Error("Failed to keep files before deleting them")
+					summary.addError("", err)
+					failed = append(failed, keyFailure{"", err.Error()})
+					inSync = false
+					return
+				}
+				deleted, deleteFailures := deleteFiles(mappingConfig, logger, summary, removed, pruned)
+				changes.Deleted = append(changes.Deleted, deleted...)
+				failed = append(failed, deleteFailures...)
+				if len(deleteFailures) > 0 {
+					inSync = false
+				}
+			}
+			if mappingConfig.PhaseOrder == "" || mappingConfig.PhaseOrder == phasesDeleteFirst {
+				deleteNow()
+			}
+			// Replace the env so we can detect future changes
+			previous := env
+			env = newEnv
+			if len(vetoed) > 0 {
+				env = make(map[string]string, len(newEnv)+len(vetoed))
+				for k, v := range newEnv {
+					env[k] = v
+				}
+				for _, k := range vetoed {
+					env[k] = previous[k]
+				}
+			}
+
+			// Write the updated keys to the filesystem at the specified path
+			for k, v := range newEnv {
+				// A strict mapping stops at the first failure
+				if mappingConfig.Strict && !inSync {
+					break
+				}
+
+				// Folders have no file of their own
+				if strings.HasSuffix(k, "/") {
 					continue
 				}
 
-				log.WithFields(log.Fields{
-					"length": len(decryptedValue),
-				}).Debug("Output value length")
+				keyLogger := logger.WithFields(log.Fields{
+					"key": k,
+				})
 
-				data := string(decryptedValue)
+				// Write file to disk
+				keyfile := keyfilePath(mappingConfig, k)
+
+				keyLogger.WithFields(log.Fields{
+					"length": len(v),
+				}).Debug("Input value length")
+
+				rendered, ok := prerendered[k]
+				if !ok {
+					var err error
+					rendered, err = renderValue(mappingConfig, k, []byte(v), newEnv)
+					if err != nil {
+						keyLogger.WithFields(log.Fields{
+							"error": err,
+						}).Error("Failed to render value")
+						summary.addError(keyfile, err)
+						if isDecryptionError(err) {
+							run.notify.trigger(EventDecryptionFailed, mappingConfig.Name, fmt.Sprintf("%s: %v", keyfile, err))
+						}
+						failed = append(failed, keyFailure{keyfile, err.Error()})
+						inSync = false
+						continue
+					}
+
+					rendered, err = patchFile(mappingConfig, keyfile, rendered)
+					if err != nil {
+						keyLogger.WithFields(log.Fields{
+							"error": err,
+						}).Error("Failed to patch file")
+						summary.addError(keyfile, err)
+						failed = append(failed, keyFailure{keyfile, err.Error()})
+						inSync = false
+						continue
+					}
+					rendered = markManaged(mappingConfig, keyfile, rendered)
+				}
+
+				renderedKeys[k] = keyState{ModifyIndex: modifyIndexes[k], File: keyfile, Hash: contentHash(rendered), Fallback: fromFallback[k]}
 
-				funcs := template.FuncMap{
-					// Template functions
-					"goDecrypt": goDecryptFunc(mappingConfig.Keystore),
+				var modified time.Time
+				if mappingConfig.PreserveMtime {
+					modified = mtimes.observe(k, modifyIndexes[k], keyfile, rendered)
 				}
 
-				tmpl, err := template.New("decryption").Funcs(funcs).Parse(data)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Could not parse template")
+				// Files already as rendered aren't touched, so their mtimes and anything
+				// watching them are left alone
+				if upToDate(mappingConfig, keyfile, rendered) {
+					keyLogger.Debug("File is up to date")
 					continue
 				}
 
-				// Run the template to verify the output.
-				buff = new(bytes.Buffer)
-				err = tmpl.Execute(buff, nil)
+				// Files that fail to write are retried until the next snapshot
+				err := undo.save(keyfile)
+				if err == nil {
+					err = writeRendered(mappingConfig, keyfile, rendered, modified, summary, &changes)
+				}
 				if err != nil {
-					log.WithFields(log.Fields{
+					keyLogger.WithFields(log.Fields{
 						"error": err,
-					}).Error("Could not execute template")
+						"file":  keyfile,
+					}).Error("Failed to write to file")
+					summary.addError(keyfile, err)
+					failed = append(failed, keyFailure{keyfile, err.Error()})
+					inSync = false
+					retries[k] = pendingWrite{keyfile, rendered, modified}
 					continue
 				}
+
+				keyLogger.WithFields(log.Fields{
+					"length": len(rendered),
+					"file":   keyfile,
+				}).Debug("Successfully wrote value to file")
 			}
 
-			wrote, err := f.Write(buff.Bytes())
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-					"file":  keyfile,
-				}).Error("Failed to write to file")
-				continue
+			switch mappingConfig.PhaseOrder {
+			case phasesWriteFirst:
+				deleteNow()
+			case phasesOnChangeFirst:
+				lateRemoved, latePruned = removed, pruned
+				changes.Deleted = append(append(changes.Deleted, pruned...), keyfilePaths(mappingConfig, removed)...)
 			}
+		}
 
-			log.WithFields(log.Fields{
-				"length": wrote,
-				"file":   keyfile,
-			}).Debug("Successfully wrote value to file")
+		// The process run with exec is restarted if its variables change, unless a strict
+		// mapping has already failed
+		if mappingConfig.ExecEnv && !(mappingConfig.Strict && !inSync) {
+			vars, envFailures := execEnvVars(mappingConfig, newEnv)
+			if mappingConfig.IndexFile {
+				vars[indexEnvVar] = strconv.FormatUint(index, 10)
+			}
+			for _, failure := range envFailures {
+				logger.WithFields(log.Fields{
+					"key":   failure.File,
+					"error": failure.Error,
+				}).Error("Failed to render environment variable")
+				summary.addError(failure.File, errors.New(failure.Error))
+			}
+			if len(envFailures) > 0 {
+				failed = append(failed, envFailures...)
+				inSync = false
+			}
+			if !(mappingConfig.Strict && !inSync) && run.child.setEnv(mappingConfig.Name, vars) {
+				logger.WithFields(log.Fields{
+					"variables": len(vars),
+					"index":     index,
+				}).Info("Environment variables of the child process changed")
+			}
+		}
 
-			err = f.Sync()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-					"file":  keyfile,
-				}).Error("Failed to sync file")
+		// A strict mapping that failed part way puts back the files it had written or deleted,
+		// doesn't run onchange, and tries the snapshot again next time
+		if mappingConfig.Strict && !inSync {
+			err := fmt.Errorf("snapshot wasn't applied cleanly")
+			logger.WithFields(log.Fields{
+				"index": index,
+			}).Error("Snapshot wasn't applied cleanly, rolling back and not running onchange")
+			for _, failure := range undo.undo(mappingConfig) {
+				logger.WithFields(log.Fields{
+					"error": failure.Error,
+					"file":  failure.File,
+				}).Error("Failed to roll back file")
+				summary.addError(failure.File, errors.New(failure.Error))
 			}
+			run.failed(err)
+			env = previousEnv
 
-			err = f.Close()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-					"file":  keyfile,
-				}).Error("Failed to close file")
+			if config.RunOnce {
+				return 1, err
 			}
+			continue
 		}
 
-		// Configuration changed, run our onchange command, if one was specified.
-		if mappingConfig.OnChange != nil {
-			var cmd = exec.Command(mappingConfig.OnChange[0], mappingConfig.OnChange[1:]...)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			// Always wait for the forked process to exit.  We may wish to revisit this, but I think
-			// it's the safest approach since it avoids a case where rapid key updates DOS a system
-			// by slurping all proc handles.
-			err = cmd.Run()
+		if !config.RunOnce {
+			retryCh = writes.replace(retries, index, len(failed))
+		}
 
-			if err != nil {
-				return 111, err
+		// Dependents only start once the mapping has rendered without errors
+		if inSync {
+			run.markRendered()
+			run.synced()
+			run.recordApplied(index, renderedKeys)
+			recordIndex(index)
+			summary.applied(index)
+			logger.WithFields(log.Fields{
+				"index": index,
+			}).Info("Applied snapshot")
+		}
+
+		// When waiting for a change, the initial state at startup doesn't count as one.
+		if config.OnceOnChange && initial {
+			initial = false
+			deleteLate()
+			continue
+		}
+		if mappingConfig.SkipInitialOnChange && initial && !(changes.empty() && len(failed) == 0) {
+			logger.WithFields(log.Fields{
+				"index": index,
+			}).Info("Snapshot is the first since starting, not running onchange")
+			initial = false
+			deleteLate()
+			if config.RunOnce {
+				return 0, nil
+			}
+			continue
+		}
+		initial = false
+
+		// Nothing was written, so there's nothing to act on
+		if changes.empty() && len(failed) == 0 {
+			logger.WithFields(log.Fields{
+				"index": index,
+			}).Debug("Snapshot changed no files, not running onchange")
+			if config.OnceOnChange {
+				continue
+			}
+		} else {
+			// Configuration changed, signal the child process and run our onchange command,
+			// as the change mode says.
+			if code, err := onChanged(config, run, index, changes, failed); err != nil {
+				return code, err
 			}
 		}
+		deleteLate()
 
-		// If we are only running once, close the channel on this watcher.
-		if config.RunOnce {
-			close(quitCh)
+		// If we are only running once, stop this watcher.
+		if config.RunOnce || config.OnceOnChange {
 			return 0, nil
 		}
 	}
 }
 
+// Start the goroutine feeding a mapping's snapshots to pairCh, from wherever its keys are
+// read.
+func startSource(config *WatchConfig, mappingConfig *MappingConfig, conn *connectivity, logger *log.Entry, pairCh chan<- kvSnapshot, errCh chan<- error, quitCh <-chan struct{}) error {
+	if config.Replay != "" {
+		go watchReplay(config.Replay, mappingConfig.Name, logger, pairCh, errCh, quitCh)
+	} else if config.SourceFile != "" {
+		go watchSourceFile(config.SourceFile, mappingConfig.Prefix, logger, pairCh, errCh, quitCh)
+	} else if mappingConfig.Backend == "vault" {
+		client, err := vaultFor(config.Vault)
+		if err != nil {
+			return err
+		}
+		go watchVault(client, mappingConfig.Prefix, conn, logger, pairCh, errCh, quitCh)
+	} else if mappingConfig.Backend == "etcd" {
+		client, err := etcdFor(config.Etcd)
+		if err != nil {
+			return err
+		}
+		go watchEtcd(client, mappingConfig.Prefix, mappingConfig.Retry, conn, logger, pairCh, errCh, quitCh)
+	} else if mappingConfig.PointerKey != "" {
+		client, err := buildConsulClient(config.consulFor(mappingConfig))
+		if err != nil {
+			return err
+		}
+		go watchPointer(client, mappingConfig, config.consulFor(mappingConfig).Token, conn, logger, pairCh, errCh, quitCh)
+	} else if mappingConfig.FallbackPrefix != "" {
+		client, err := buildConsulClient(config.consulFor(mappingConfig))
+		if err != nil {
+			return err
+		}
+		go watchFallback(client, mappingConfig, config.consulFor(mappingConfig).Token, conn, logger, pairCh, errCh, quitCh)
+	} else {
+		client, err := buildConsulClient(config.consulFor(mappingConfig))
+		if err != nil {
+			return err
+		}
+		go watch(
+			client, mappingConfig.Prefix, config.consulFor(mappingConfig).Token, mappingConfig.Retry, mappingConfig.KeysOnly, conn, logger, pairCh, errCh, quitCh)
+	}
+	return nil
+}
+
+// Wait for a prefix to change with a keys-only blocking query, whose response is small
+// however large the values are, then list the prefix in full if its index moved.  Consul
+// can't list the modify indexes of keys without their values, so a change fetches them all;
+// what's saved are the values of the blocking queries that time out without a change.
+func listChanged(client *consulapi.Client, prefix string, opts *consulapi.QueryOptions) (consulapi.KVPairs, *consulapi.QueryMeta, bool, error) {
+	_, meta, err := client.KV().Keys(prefix, "", opts)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if meta.LastIndex == opts.WaitIndex {
+		return nil, meta, false, nil
+	}
+
+	pairs, meta, err := client.KV().List(prefix, &consulapi.QueryOptions{Token: opts.Token})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return pairs, meta, true, nil
+}
+
+// kvSnapshot is a listing of a prefix, and the Consul index it was taken at.
+type kvSnapshot struct {
+	pairs consulapi.KVPairs
+	index uint64
+}
+
 func watch(
 	client *consulapi.Client,
 	prefix string,
-	path string,
 	token string,
-	pairCh chan<- consulapi.KVPairs,
+	retry RetryConfig,
+	keysOnly bool,
+	conn *connectivity,
+	logger *log.Entry,
+	pairCh chan<- kvSnapshot,
 	errCh chan<- error,
 	quitCh <-chan struct{}) {
 
-	// Create the root for KVs, if necessary
-	mkdirp.Mk(path, 0777)
-
-	// Get the initial list of k/v pairs. We don't do a retryableList
-	// here because we want a fast fail if the initial request fails.
+	// Get the initial list of k/v pairs. We don't retry here because we
+	// want a fast fail if the initial request fails.
 	opts := &consulapi.QueryOptions{Token: token}
 	pairs, meta, err := client.KV().List(prefix, opts)
 	if err != nil {
@@ -407,11 +1649,19 @@ func watch(
 	}
 
 	// Send the initial list out right away
-	pairCh <- pairs
+	select {
+	case pairCh <- kvSnapshot{pairs, meta.LastIndex}:
+	case <-quitCh:
+		return
+	}
 
 	// Loop forever (or until quitCh is closed) and watch the keys
 	// for changes.
 	curIndex := meta.LastIndex
+	last := pairs
+	delays := newBackoff(retry)
+	failures := 0
+	var failingSince time.Time
 	for {
 		select {
 		case <-quitCh:
@@ -419,47 +1669,75 @@ func watch(
 		default:
 		}
 
-		pairs, meta, err = retryableList(
-			func() (consulapi.KVPairs, *consulapi.QueryMeta, error) {
-				opts = &consulapi.QueryOptions{WaitIndex: curIndex, Token: token}
-				return client.KV().List(prefix, opts)
+		opts = &consulapi.QueryOptions{WaitIndex: curIndex, Token: token}
+		changed := true
+		if keysOnly {
+			pairs, meta, changed, err = listChanged(client, prefix, opts)
+		} else {
+			pairs, meta, err = client.KV().List(prefix, opts)
+		}
+		if err != nil {
+			// This happens when the connection to the consul agent dies, or it's overloaded.
+			// Back off before retrying, for at least as long as consul asked.
+			failures++
+			if failures == 1 {
+				failingSince = time.Now()
+			}
+			kind, retryAfter := classifyError(err)
+			if failingFor := time.Since(failingSince); retry.exhausted(failures) || retry.expired(failingFor) {
+				logger.WithFields(log.Fields{
+					"error":      err,
+					"failures":   failures,
+					"failingFor": failingFor,
+				}).Error("Giving up on consul")
+				errCh <- fmt.Errorf("giving up after %d failed queries over %s: %v", failures, failingFor.Round(time.Second), err)
+				return
+			}
+
+			delay := delays.next()
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+			entry := logger.WithFields(log.Fields{
+				"error":      err,
+				"kind":       kind,
+				"retryAfter": retryAfter,
+				"retryIn":    delay,
+				"failures":   failures,
 			})
+			if conn.failed() {
+				entry.Debug(consulErrorMessage(kind))
+			} else {
+				entry.Warn(consulErrorMessage(kind))
+			}
 
-		if err != nil {
-			// This happens when the connection to the consul agent dies.  Build in a retry by looping after a delay.
-			log.Warn("Error communicating with consul agent.")
+			select {
+			case <-quitCh:
+				return
+			case <-time.After(delay):
+			}
 			continue
 		}
+		failures = 0
+		delays.reset()
+		conn.succeeded()
+
+		// A keys-only query that timed out has fetched nothing new, so the last listing is
+		// sent again: the prefix is still as it was, and the mapping is in sync with it
+		if !changed {
+			pairs = last
+		}
+		last = pairs
 
-		pairCh <- pairs
-		log.WithFields(log.Fields{
+		select {
+		case pairCh <- kvSnapshot{pairs, meta.LastIndex}:
+		case <-quitCh:
+			return
+		}
+		logger.WithFields(log.Fields{
 			"curIndex":  curIndex,
 			"lastIndex": meta.LastIndex,
 		}).Debug("Potential index update observed")
 		curIndex = meta.LastIndex
 	}
 }
-
-// This function is able to call KV listing functions and retry them.
-// We want to retry if there are errors because it is safe (GET request),
-// and erroring early is MUCH more costly than retrying over time and
-// delaying the configuration propagation.
-func retryableList(f func() (consulapi.KVPairs, *consulapi.QueryMeta, error)) (consulapi.KVPairs, *consulapi.QueryMeta, error) {
-	i := 0
-	for {
-		p, m, e := f()
-		if e != nil {
-			if i >= 3 {
-				return nil, nil, e
-			}
-
-			i++
-
-			// Reasonably arbitrary sleep to just try again... It is
-			// a GET request so this is safe.
-			time.Sleep(time.Duration(i*2) * time.Second)
-		}
-
-		return p, m, e
-	}
-}
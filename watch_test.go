@@ -1,4 +1,4 @@
-package main
+package fsconsul
 
 import (
 	"bytes"
@@ -7,13 +7,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
 )
 
 const delay = 500 * time.Millisecond
@@ -459,4 +465,80 @@ func TestFileDecryption(t *testing.T) {
 	if !bytes.Equal(actualFileWritten, expectedDecyptedFile) {
 		t.Fatal("Unmatched values - Decryption may have failed.")
 	}
-}
\ No newline at end of file
+}
+
+func TestSnapshotEnvOverlays(t *testing.T) {
+	pairs := consulapi.KVPairs{
+		{Key: "app/base/app.conf", Value: []byte("base")},
+		{Key: "app/base/log.conf", Value: []byte("base log")},
+		{Key: "app/overlays/prod/app.conf", Value: []byte("prod")},
+		{Key: "app/overlays/dev/app.conf", Value: []byte("dev")},
+		{Key: "app/unrelated", Value: []byte("ignored")},
+	}
+
+	mappingConfig := &MappingConfig{Prefix: "app/", Environment: "prod"}
+	env, _ := snapshotEnv(mappingConfig, pairs)
+
+	expected := map[string]string{
+		"app.conf": "prod",
+		"log.conf": "base log",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("Expected %v but got %v", expected, env)
+	}
+}
+
+func TestKeysOnlyWatch(t *testing.T) {
+	// The prefix never changes, so every keys-only blocking query times out at index 5
+	var lists int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "5")
+		if _, ok := r.URL.Query()["keys"]; ok {
+			w.Write([]byte(`["app/a.conf"]`))
+			return
+		}
+		atomic.AddInt32(&lists, 1)
+		w.Write([]byte(`[{"Key": "app/a.conf", "Value": "YQ==", "ModifyIndex": 5}]`))
+	}))
+	defer server.Close()
+	client, err := buildConsulClient(ConsulConfig{Addr: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, meta, changed, err := listChanged(client, "app/", &consulapi.QueryOptions{WaitIndex: 5})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if changed || meta.LastIndex != 5 || atomic.LoadInt32(&lists) != 0 {
+		t.Fatalf("expected an unchanged index not to list the prefix, listed it %d times", lists)
+	}
+
+	pairCh := make(chan kvSnapshot)
+	errCh := make(chan error, 1)
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+	go watch(client, "app/", "", RetryConfig{}, true, nil, log.NewEntry(log.StandardLogger()), pairCh, errCh, quitCh)
+
+	var snapshots []kvSnapshot
+	for len(snapshots) < 3 {
+		select {
+		case snapshot := <-pairCh:
+			snapshots = append(snapshots, snapshot)
+		case err := <-errCh:
+			t.Fatalf("err: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the watch to send snapshots")
+		}
+	}
+
+	// Only the initial listing fetches values; later snapshots send it again
+	if n := atomic.LoadInt32(&lists); n != 1 {
+		t.Errorf("expected the prefix to be listed once, got %d", n)
+	}
+	for _, snapshot := range snapshots[1:] {
+		if !reflect.DeepEqual(snapshot, snapshots[0]) {
+			t.Errorf("expected the last listing to be sent again, got %+v", snapshot)
+		}
+	}
+}
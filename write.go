@@ -0,0 +1,141 @@
+package fsconsul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Write content to the given keyfile with the mode and owner configured for it.  If the
+// mapping asks for atomic writes, the content is staged in a temporary file and renamed over
+// the keyfile so that readers never observe a partially written file.
+func writeKeyFile(mappingConfig *MappingConfig, keyfile string, content []byte) error {
+	attrs, err := mappingConfig.fileAttrs(keyfile)
+	if err != nil {
+		return err
+	}
+
+	if mappingConfig.DeltaWrites && len(content) >= deltaWriteMinSize {
+		_, err := writeDelta(keyfile, content, attrs)
+		return err
+	}
+	if !mappingConfig.AtomicWrites {
+		return writeAndSync(keyfile, content, attrs)
+	}
+
+	stagingDir := stagingDirFor(mappingConfig, keyfile)
+
+	f, err := ioutil.TempFile(stagingDir, ".fsconsul-")
+	if err != nil {
+		return err
+	}
+	staged := f.Name()
+
+	err = attrs.apply(f)
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(staged, keyfile)
+	}
+
+	if err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	return nil
+}
+
+// Determine whether a keyfile already has the content, mode and owner writing it would give
+// it, so that it needn't be written again.
+func upToDate(mappingConfig *MappingConfig, keyfile string, content []byte) bool {
+	info, err := os.Stat(keyfile)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != int64(len(content)) {
+		return false
+	}
+
+	attrs, err := mappingConfig.fileAttrs(keyfile)
+	if err != nil || len(attrs.differences(info)) > 0 {
+		return false
+	}
+
+	existing, err := ioutil.ReadFile(keyfile)
+	return err == nil && bytes.Equal(existing, content)
+}
+
+// Remove the directories left empty by deleting a keyfile, up to but not including the
+// mapping's path.  Stops at the first directory that isn't empty.
+func removeEmptyDirs(mappingConfig *MappingConfig, keyfile string) error {
+	root := filepath.Clean(mappingConfig.Path)
+	for dir := filepath.Dir(keyfile); strings.HasPrefix(dir, root+string(os.PathSeparator)); dir = filepath.Dir(dir) {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAndSync(keyfile string, content []byte, attrs fileAttrs) error {
+	f, err := os.OpenFile(keyfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, attrs.mode)
+	if err != nil {
+		return err
+	}
+
+	err = attrs.apply(f)
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Pick the directory in which to stage a keyfile before renaming it into place.  A rename
+// is only atomic (or even possible) within a single filesystem, so a configured staging
+// directory on a different mount than the target is not used; the keyfile's own directory
+// is used instead.
+func stagingDirFor(mappingConfig *MappingConfig, keyfile string) string {
+	targetDir := filepath.Dir(keyfile)
+
+	if mappingConfig.StagingDir == "" {
+		return targetDir
+	}
+
+	same, err := sameFilesystem(mappingConfig.StagingDir, targetDir)
+	if err != nil || !same {
+		log.WithFields(log.Fields{
+			"mapping":    mappingConfig.Name,
+			"stagingDir": mappingConfig.StagingDir,
+			"targetDir":  targetDir,
+			"error":      err,
+		}).Warn("Staging directory is not usable for target, staging next to the file instead")
+		return targetDir
+	}
+
+	return mappingConfig.StagingDir
+}
@@ -0,0 +1,195 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestAtomicWriteKeyFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{AtomicWrites: true, StagingDir: tempDir}
+	keyfile := filepath.Join(tempDir, "atomic")
+
+	for _, value := range []string{"first value", "second"} {
+		if err := writeKeyFile(mappingConfig, keyfile, []byte(value)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		fileValue, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if string(fileValue) != value {
+			t.Fatalf("Expected %q but got %q", value, string(fileValue))
+		}
+	}
+
+	// No staged files should be left behind
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the keyfile in %s but found %d entries", tempDir, len(entries))
+	}
+}
+
+func TestStagingDirFallback(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	keyfile := filepath.Join(tempDir, "key")
+
+	mappingConfig := &MappingConfig{StagingDir: filepath.Join(tempDir, "does-not-exist")}
+	if dir := stagingDirFor(mappingConfig, keyfile); dir != tempDir {
+		t.Fatalf("Expected fallback to %s but got %s", tempDir, dir)
+	}
+
+	mappingConfig.StagingDir = tempDir
+	if dir := stagingDirFor(mappingConfig, keyfile); dir != tempDir {
+		t.Fatalf("Expected staging dir %s but got %s", tempDir, dir)
+	}
+}
+
+func TestFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes and owners aren't supported on Windows")
+	}
+
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{
+		Path:     tempDir + "/",
+		FileMode: "0600",
+		Owner:    strconv.Itoa(os.Getuid()),
+		Files: map[string]FilePermissions{
+			"tls/*.pub":   {FileMode: "0644"},
+			"tls/ca.pub":  {FileMode: "0444"},
+			"tls/*.other": {FileMode: "0666"},
+		},
+	}
+
+	expected := map[string]os.FileMode{
+		"app.conf":   0600,
+		"tls/a.pub":  0644,
+		"tls/ca.pub": 0444,
+	}
+	for key, mode := range expected {
+		keyfile := keyfilePath(mappingConfig, key)
+		if err := makeDirs(mappingConfig, filepath.Dir(keyfile)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := writeKeyFile(mappingConfig, keyfile, []byte("value")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		info, err := os.Stat(keyfile)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("expected %s to have mode %o, got %o", key, mode, info.Mode().Perm())
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(tempDir, "tls"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if info.Mode().Perm() != defaultDirMode {
+		t.Errorf("expected directories to have mode %o, got %o", defaultDirMode, info.Mode().Perm())
+	}
+
+	mappingConfig.FileMode = "rw-r--r--"
+	if err := mappingConfig.checkPermissions(); err == nil {
+		t.Error("expected an invalid mode to be rejected")
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{Path: tempDir + string(os.PathSeparator)}
+	keyfile := keyfilePath(mappingConfig, "app.conf")
+
+	if upToDate(mappingConfig, keyfile, []byte("value")) {
+		t.Fatal("expected a missing file to need writing")
+	}
+	if err := writeKeyFile(mappingConfig, keyfile, []byte("value")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !upToDate(mappingConfig, keyfile, []byte("value")) {
+		t.Error("expected an identical file to be up to date")
+	}
+	if upToDate(mappingConfig, keyfile, []byte("other")) {
+		t.Error("expected different content to need writing")
+	}
+
+	if runtime.GOOS != "windows" {
+		os.Chmod(keyfile, 0644)
+		if upToDate(mappingConfig, keyfile, []byte("value")) {
+			t.Error("expected a file with the wrong mode to need writing")
+		}
+	}
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{Path: tempDir + string(os.PathSeparator)}
+	kept := keyfilePath(mappingConfig, "a/kept.conf")
+	removed := keyfilePath(mappingConfig, "a/b/c/removed.conf")
+	for _, keyfile := range []string{kept, removed} {
+		if err := os.MkdirAll(filepath.Dir(keyfile), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(keyfile, []byte("value"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	os.Remove(removed)
+	if err := removeEmptyDirs(mappingConfig, removed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "a", "b")); !os.IsNotExist(err) {
+		t.Error("expected the emptied directories to be removed")
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Error("expected the directory still holding a file to be kept")
+	}
+
+	// The mapping's path is never removed
+	os.Remove(kept)
+	if err := removeEmptyDirs(mappingConfig, kept); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(tempDir); err != nil {
+		t.Error("expected the mapping's path to be kept")
+	}
+}
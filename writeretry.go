@@ -0,0 +1,123 @@
+package fsconsul
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Write a key's rendered file, creating its directory first and setting its mtime after if
+// the mapping preserves them, and record it in the summary and changes.
+func writeRendered(mappingConfig *MappingConfig, keyfile string, rendered []byte, modified time.Time, summary *mappingSummary, changes *fileChanges) error {
+	if err := makeDirs(mappingConfig, filepath.Dir(keyfile)); err != nil {
+		return fmt.Errorf("failed to create parent directory: %v", err)
+	}
+
+	_, err := os.Stat(keyfile)
+	existed := err == nil
+
+	if err := writeKeyFile(mappingConfig, keyfile, rendered); err != nil {
+		return err
+	}
+	summary.wrote(keyfile, existed, len(rendered))
+	if existed {
+		changes.Updated = append(changes.Updated, keyfile)
+	} else {
+		changes.Created = append(changes.Created, keyfile)
+	}
+
+	if mappingConfig.PreserveMtime {
+		if err := os.Chtimes(keyfile, time.Now(), modified); err != nil {
+			return fmt.Errorf("failed to set file modification time: %v", err)
+		}
+	}
+	return nil
+}
+
+// pendingWrite is a file whose write failed, kept with the content rendered for it.
+type pendingWrite struct {
+	keyfile  string
+	rendered []byte
+	modified time.Time
+}
+
+// writeRetries holds the failed writes of the last snapshot a mapping applied, which are
+// retried with backoff, as the mapping's RetryWrites says, rather than left stale until
+// their keys next change.  The next snapshot applied replaces them.
+type writeRetries struct {
+	retry    RetryConfig
+	delays   *backoff
+	failures int
+
+	pending map[string]pendingWrite
+	index   uint64
+
+	// Whether the writes were the snapshot's only failures, so that it's in sync once
+	// they succeed
+	only bool
+}
+
+func newWriteRetries(retry RetryConfig) *writeRetries {
+	return &writeRetries{retry: retry, delays: newBackoff(retry)}
+}
+
+// Replace the pending writes with those of a newly applied snapshot.  Returns the channel
+// receiving when to retry them, or nil if there are none.
+func (r *writeRetries) replace(pending map[string]pendingWrite, index uint64, failures int) <-chan time.Time {
+	r.pending, r.index = pending, index
+	r.only = len(pending) == failures
+	r.failures = 0
+	r.delays.reset()
+	if len(pending) == 0 {
+		return nil
+	}
+	return time.After(r.delays.next())
+}
+
+// Retry the pending writes, returning the files written and those still failing, and the
+// channel receiving when to retry those, or nil if there are none left or the mapping gave
+// up on them.
+func (r *writeRetries) write(mappingConfig *MappingConfig, summary *mappingSummary, logger *log.Entry) (fileChanges, []keyFailure, <-chan time.Time) {
+	var changes fileChanges
+	var failed []keyFailure
+	for k, write := range r.pending {
+		err := writeRendered(mappingConfig, write.keyfile, write.rendered, write.modified, summary, &changes)
+		if err != nil {
+			failed = append(failed, keyFailure{write.keyfile, err.Error()})
+			continue
+		}
+		logger.WithFields(log.Fields{
+			"key":  k,
+			"file": write.keyfile,
+		}).Info("Retried failed write")
+		delete(r.pending, k)
+	}
+	if len(r.pending) == 0 {
+		return changes, nil, nil
+	}
+
+	r.failures++
+	if r.retry.exhausted(r.failures) {
+		logger.WithFields(log.Fields{
+			"files":    len(r.pending),
+			"failures": r.failures,
+		}).Error("Giving up retrying failed writes until the next change")
+		r.pending, r.only = nil, false
+		return changes, failed, nil
+	}
+
+	delay := r.delays.next()
+	logger.WithFields(log.Fields{
+		"files":   len(r.pending),
+		"retryIn": delay,
+	}).Warn("Failed writes failed again")
+	return changes, failed, time.After(delay)
+}
+
+// Whether every write has succeeded and the snapshot had no other failures.
+func (r *writeRetries) synced() bool {
+	return len(r.pending) == 0 && r.only
+}
@@ -0,0 +1,91 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestWriteRetries(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingConfig := &MappingConfig{Path: tempDir + "/"}
+	keyfile := filepath.Join(tempDir, "busy")
+
+	// A directory in the way makes the write fail until it's gone
+	if err := os.Mkdir(keyfile, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var changes fileChanges
+	if err := writeRendered(mappingConfig, keyfile, []byte("value"), time.Time{}, nil, &changes); err == nil {
+		t.Fatal("expected writing over a directory to fail")
+	}
+
+	writes := newWriteRetries(RetryConfig{Initial: Duration(time.Millisecond)})
+	retryCh := writes.replace(map[string]pendingWrite{"busy": {keyfile, []byte("value"), time.Time{}}}, 7, 1)
+	if retryCh == nil {
+		t.Fatal("expected the failed write to be retried")
+	}
+	<-retryCh
+
+	logger := log.WithFields(log.Fields{})
+	changes, failed, retryCh := writes.write(mappingConfig, nil, logger)
+	if len(failed) != 1 || retryCh == nil || writes.synced() {
+		t.Fatalf("expected the write to fail again and be retried, got %v", failed)
+	}
+
+	os.Remove(keyfile)
+	<-retryCh
+	changes, failed, retryCh = writes.write(mappingConfig, nil, logger)
+	if len(failed) != 0 || retryCh != nil || !writes.synced() {
+		t.Fatalf("expected the write to succeed, got %v", failed)
+	}
+	if len(changes.Created) != 1 || changes.Created[0] != keyfile {
+		t.Errorf("expected %s to be created, got %v", keyfile, changes)
+	}
+	if content, _ := ioutil.ReadFile(keyfile); string(content) != "value" {
+		t.Errorf("expected the retried content, got %q", content)
+	}
+
+	// A snapshot without failed writes clears them
+	if writes.replace(map[string]pendingWrite{}, 8, 0) != nil {
+		t.Error("expected nothing to retry")
+	}
+}
+
+func TestFolderKeysAreNotWritten(t *testing.T) {
+	tempDir := t.TempDir()
+	target := filepath.Join(tempDir, "out") + "/"
+
+	// Consul lists folders created in its UI as keys of their own
+	fixture := filepath.Join(tempDir, "kv.json")
+	if err := ioutil.WriteFile(fixture, []byte(`[
+		{"key": "app/dir/"},
+		{"key": "app/dir/a.conf", "value": "YQ=="}
+	]`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		os.RemoveAll(target)
+		config := &WatchConfig{
+			RunOnce:    true,
+			SourceFile: fixture,
+			Mappings:   []MappingConfig{{Prefix: "app/", Path: target, Strict: strict}},
+		}
+		if code := watchAndExec(config); code != 0 {
+			t.Errorf("strict %t: expected a folder key not to fail the mapping, got %d", strict, code)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(target, "dir", "a.conf")); err != nil || string(content) != "a" {
+			t.Errorf("strict %t: expected the folder's key to be written, got %q (%v)", strict, content, err)
+		}
+	}
+}
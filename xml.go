@@ -0,0 +1,90 @@
+package fsconsul
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Render the values of a snapshot into XML by running the mapping's skeleton template, with
+// the rendered values (by key, relative to the prefix) as its data.  Values must be escaped
+// in the skeleton with xml (for text and attributes) or cdata.  The result must be
+// well-formed XML.
+func explodeXML(mappingConfig *MappingConfig, keys []string, values map[string]string) ([]byte, error) {
+	if mappingConfig.Skeleton == "" {
+		return nil, fmt.Errorf("xml explode needs a skeleton template")
+	}
+
+	skeleton, err := ioutil.ReadFile(mappingConfig.Skeleton)
+	if err != nil {
+		return nil, err
+	}
+
+	funcs := sprigFuncs()
+	funcs["xml"] = xmlEscape
+	funcs["cdata"] = cdata
+	funcs["under"] = underFunc(keys)
+
+	tmpl, err := template.New(filepath.Base(mappingConfig.Skeleton)).Funcs(funcs).Parse(string(skeleton))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse skeleton: %v", err)
+	}
+
+	b := &bytes.Buffer{}
+	if err := tmpl.Execute(b, values); err != nil {
+		return nil, fmt.Errorf("could not execute skeleton: %v", err)
+	}
+
+	if err := checkWellFormed(b.Bytes()); err != nil {
+		return nil, fmt.Errorf("skeleton didn't render well-formed XML: %v", err)
+	}
+
+	return b.Bytes(), nil
+}
+
+// Escape a value for use in XML text or a quoted attribute.
+func xmlEscape(value string) (string, error) {
+	b := &strings.Builder{}
+	if err := xml.EscapeText(b, []byte(value)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Wrap a value in a CDATA section, splitting it where the value itself contains "]]>".
+func cdata(value string) string {
+	return "<![CDATA[" + strings.Replace(value, "]]>", "]]]]><![CDATA[>", -1) + "]]>"
+}
+
+// Make the under function, listing the keys below a sub-path (e.g. "servers/") so that
+// skeletons can range over them.
+func underFunc(keys []string) func(string) []string {
+	return func(prefix string) []string {
+		var below []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				below = append(below, k)
+			}
+		}
+		sort.Strings(below)
+		return below
+	}
+}
+
+func checkWellFormed(doc []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
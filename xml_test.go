@@ -0,0 +1,54 @@
+package fsconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplodeXML(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	skeleton := filepath.Join(tempDir, "app.xml.tmpl")
+	ioutil.WriteFile(skeleton, []byte(`<config name="{{xml (index . "name")}}">
+{{- range under "servers/"}}
+  <server>{{xml (index $ .)}}</server>
+{{- end}}
+  <script>{{cdata (index . "script")}}</script>
+</config>
+`), 0644)
+
+	env := map[string]string{
+		"name":      `a "quoted" & <odd> name`,
+		"servers/b": "b.internal",
+		"servers/a": "a.internal",
+		"script":    "if (a < b && c]]>d) {}",
+	}
+
+	mappingConfig := &MappingConfig{Format: "xml", Skeleton: skeleton}
+	exploded, err := renderExploded(mappingConfig, env)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := `<config name="a &#34;quoted&#34; &amp; &lt;odd&gt; name">
+  <server>a.internal</server>
+  <server>b.internal</server>
+  <script><![CDATA[if (a < b && c]]]]><![CDATA[>d) {}]]></script>
+</config>
+`
+	if string(exploded) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, exploded)
+	}
+
+	// Unescaped values that break the document are caught
+	ioutil.WriteFile(skeleton, []byte(`<config>{{index . "name"}}</config>`), 0644)
+	if _, err := renderExploded(mappingConfig, env); err == nil {
+		t.Errorf("expected malformed XML to be rejected")
+	}
+}